@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The Keystone admin token is reused until shortly before it expires instead
+// of logging in on every call. With Redis and ADMIN_TOKEN_KEY set, it is also
+// shared (AES-GCM encrypted) across replicas and restarts.
+
+const (
+	adminTokenKey = "admin_token"
+
+	// adminTokenSafetyMargin is how long before expires_at a token is
+	// considered expired, so it never runs out mid-collection.
+	adminTokenSafetyMargin = 5 * time.Minute
+
+	// adminTokenDefaultLifetime is assumed when Keystone sends no expires_at.
+	adminTokenDefaultLifetime = time.Hour
+)
+
+// adminTokenEntry is an issued admin token; also its stored form.
+type adminTokenEntry struct {
+	Token     string    `json:"token"`
+	ProjectID string    `json:"project_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// usable reports whether the token is still valid beyond the safety margin.
+func (e *adminTokenEntry) usable() bool {
+	return e != nil && e.Token != "" && time.Until(e.ExpiresAt) > adminTokenSafetyMargin
+}
+
+// adminTokenManager holds the current admin token of one cluster.
+type adminTokenManager struct {
+	mu        sync.Mutex
+	current   *adminTokenEntry
+	revoked   string       // last token rejected upstream, never adopted again
+	projectID string       // admin project of the last token, used by Cinder
+	codec     *secretCodec // nil: not stored in Redis
+	key       string       // Redis key of the shared token
+}
+
+// adminLoginFlight runs one load-or-login per manager (keyed by its Redis
+// key) for all concurrent callers, without holding the manager's mutex.
+var adminLoginFlight = newFlightGroup("admin_login")
+
+// initAdminTokenStore enables the shared token of every cluster when Redis
+// and ADMIN_TOKEN_KEY are set.
+func initAdminTokenStore() {
+	secret := os.Getenv("ADMIN_TOKEN_KEY")
+	if redisClient == nil || secret == "" {
+		slog.Info("Admin token sharing disabled (requires Redis and ADMIN_TOKEN_KEY)")
+		return
+	}
+	codec, err := newSecretCodec(secret)
+	if err != nil {
+		slog.Warn("Admin token cipher init failed, token sharing disabled", "error", err)
+		return
+	}
+	for _, c := range clusters {
+		c.tokens.mu.Lock()
+		c.tokens.codec = codec
+		c.tokens.mu.Unlock()
+	}
+}
+
+// ProjectID returns the admin project of the last token, empty before the first login.
+func (m *adminTokenManager) ProjectID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.projectID
+}
+
+// Get returns a usable admin token: the one in memory, the one in Redis, or
+// a new one from login (which is then stored). Concurrent callers share one
+// load or login, which is not cancelled when ctx ends.
+func (m *adminTokenManager) Get(ctx context.Context, login func(context.Context) (adminTokenEntry, error)) (string, error) {
+	m.mu.Lock()
+	if m.current.usable() {
+		token := m.current.Token
+		m.mu.Unlock()
+		return token, nil
+	}
+	m.mu.Unlock()
+
+	loginCtx := context.WithoutCancel(ctx)
+	v, err, _ := adminLoginFlight.Do(ctx, m.key, func() (interface{}, error) {
+		if stored := m.load(loginCtx); stored.usable() && !m.isRevoked(stored.Token) {
+			m.adopt(stored)
+			return stored.Token, nil
+		}
+		entry, err := login(loginCtx)
+		if err != nil {
+			return "", err
+		}
+		if entry.ExpiresAt.IsZero() {
+			entry.ExpiresAt = time.Now().Add(adminTokenDefaultLifetime)
+		}
+		m.adopt(&entry)
+		m.store(loginCtx, &entry)
+		return entry.Token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// Invalidate drops token after an upstream rejected it (401), in memory and
+// in Redis, so the next Get logs in again. A token that was already replaced
+// is ignored, so concurrent 401s lead to a single re-login.
+func (m *adminTokenManager) Invalidate(ctx context.Context, token string) {
+	m.mu.Lock()
+	if m.current == nil || m.current.Token != token {
+		m.mu.Unlock()
+		return
+	}
+	m.current = nil
+	m.revoked = token
+	m.mu.Unlock()
+
+	if m.codec == nil || !cacheEnabled() {
+		return
+	}
+	if stored := m.load(ctx); stored != nil && stored.Token == token {
+		if err := cacheDeleteSecret(ctx, redisClient, m.key); err != nil {
+			slog.Warn("Shared admin token invalidation failed", "service", "redis", "error", err)
+		}
+	}
+}
+
+func (m *adminTokenManager) isRevoked(token string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return token == m.revoked
+}
+
+// adopt makes entry the current token.
+func (m *adminTokenManager) adopt(entry *adminTokenEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current = entry
+	if entry.ProjectID != "" {
+		m.projectID = entry.ProjectID
+	}
+}
+
+// adminReauth is the Reauth hook of Gnocchi and Nova clients using the admin
+// token of ctx's cluster: it drops the rejected token and returns a new one.
+func adminReauth(ctx context.Context) func(stale string) (string, error) {
+	return func(stale string) (string, error) {
+		clusterOf(ctx).tokens.Invalidate(ctx, stale)
+		return GetAdminToken(ctx)
+	}
+}
+
+// reauthTransport retries a request answered with 401 once, with the token
+// from reauth (e.g. the admin token was revoked before its expiry). The new
+// token replaces the configured one for the client's later requests.
+type reauthTransport struct {
+	base   http.RoundTripper
+	reauth func(stale string) (string, error)
+
+	mu    sync.Mutex
+	token string // replacement token; empty: the request's own
+}
+
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	token := t.token
+	t.mu.Unlock()
+	if token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Auth-Token", token)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+	fresh, reauthErr := t.reauth(req.Header.Get("X-Auth-Token"))
+	if reauthErr != nil {
+		slog.Warn("Re-login after 401 failed", "service", "keystone", "url", req.URL.Path, "error", reauthErr)
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.mu.Lock()
+	t.token = fresh
+	t.mu.Unlock()
+	retry := req.Clone(req.Context())
+	retry.Header.Set("X-Auth-Token", fresh)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// load reads the shared token; nil when sharing is off or there is none.
+func (m *adminTokenManager) load(ctx context.Context) *adminTokenEntry {
+	if m.codec == nil || !cacheEnabled() {
+		return nil
+	}
+	plain, err := cacheGetSecret(ctx, redisClient, m.codec, m.key)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Warn("Shared admin token read failed", "service", "redis", "error", err)
+		}
+		return nil
+	}
+	var entry adminTokenEntry
+	if err := json.Unmarshal(plain, &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// store shares the token until its expiry minus the safety margin.
+func (m *adminTokenManager) store(ctx context.Context, entry *adminTokenEntry) {
+	if m.codec == nil || !cacheEnabled() {
+		return
+	}
+	ttl := time.Until(entry.ExpiresAt) - adminTokenSafetyMargin
+	if ttl <= 0 {
+		return
+	}
+	plain, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := cacheSetSecret(ctx, redisClient, m.codec, m.key, plain, ttl); err != nil {
+		slog.Warn("Shared admin token write failed", "service", "redis", "error", err)
+	}
+}
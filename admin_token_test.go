@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLogin is a Keystone login issuing token-1, token-2, … valid for lifetime.
+type countingLogin struct {
+	calls    int
+	lifetime time.Duration
+}
+
+func (l *countingLogin) login(context.Context) (adminTokenEntry, error) {
+	l.calls++
+	return adminTokenEntry{
+		Token:     fmt.Sprintf("token-%d", l.calls),
+		ProjectID: "admin-project",
+		ExpiresAt: time.Now().Add(l.lifetime),
+	}, nil
+}
+
+// newSharedTokenManager returns a manager storing its token in Redis, like
+// one replica's after initAdminTokenStore.
+func newSharedTokenManager(t *testing.T) *adminTokenManager {
+	t.Helper()
+	codec, err := newSecretCodec("test-admin-token-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &adminTokenManager{codec: codec, key: adminTokenKey}
+}
+
+func TestAdminTokenSharedAcrossReplicas(t *testing.T) {
+	mr := useMiniredis(t)
+	login := &countingLogin{lifetime: time.Hour}
+	ctx := context.Background()
+
+	first, second := newSharedTokenManager(t), newSharedTokenManager(t)
+	token, err := first.Get(ctx, login.login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := second.Get(ctx, login.login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token-1" || shared != token || login.calls != 1 {
+		t.Errorf("tokens %s and %s after %d logins, want one shared token", token, shared, login.calls)
+	}
+	if second.ProjectID() != "admin-project" {
+		t.Errorf("project of the shared token = %q", second.ProjectID())
+	}
+
+	// Stored encrypted, expiring with the safety margin
+	stored, err := mr.Get(redisKey(adminTokenKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "token-1") || strings.Contains(stored, "admin-project") {
+		t.Errorf("token stored in plain text: %s", stored)
+	}
+	if ttl := mr.TTL(redisKey(adminTokenKey)); ttl <= 50*time.Minute || ttl > 55*time.Minute {
+		t.Errorf("stored TTL = %s, want just under 55m", ttl)
+	}
+
+	// Another key cannot read it and logs in instead
+	other, _ := newSecretCodec("rotated-key")
+	third := &adminTokenManager{codec: other, key: adminTokenKey}
+	if token, _ := third.Get(ctx, login.login); token != "token-2" {
+		t.Errorf("token with a rotated key = %s, want a new login", token)
+	}
+}
+
+func TestAdminTokenExpiryMargin(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+
+	// Valid for 10 minutes: reused
+	fresh := &countingLogin{lifetime: 10 * time.Minute}
+	m := newSharedTokenManager(t)
+	m.Get(ctx, fresh.login)
+	m.Get(ctx, fresh.login)
+	if fresh.calls != 1 {
+		t.Errorf("logins for a 10m token = %d, want 1", fresh.calls)
+	}
+
+	// Expiring within the 5 minute margin: never reused, never shared
+	expiring := &countingLogin{lifetime: 4 * time.Minute}
+	m = &adminTokenManager{codec: m.codec, key: "admin_token_expiring"}
+	first, _ := m.Get(ctx, expiring.login)
+	second, _ := m.Get(ctx, expiring.login)
+	if first == second || expiring.calls != 2 {
+		t.Errorf("tokens %s, %s after %d logins, want a new login each time", first, second, expiring.calls)
+	}
+	if n, _ := redisClient.Exists(ctx, redisKey("admin_token_expiring")).Result(); n != 0 {
+		t.Error("a token inside the safety margin was shared")
+	}
+}
+
+func TestAdminTokenRedisDown(t *testing.T) {
+	mr := useMiniredis(t)
+	login := &countingLogin{lifetime: time.Hour}
+	ctx := context.Background()
+	m := newSharedTokenManager(t)
+
+	// Redis dies before the probe notices: login still works, the write fails quietly
+	mr.Close()
+	token, err := m.Get(ctx, login.login)
+	if err != nil || token != "token-1" {
+		t.Fatalf("Get with Redis down = %s, %v", token, err)
+	}
+
+	// Once the probe marked it down Redis is skipped; the in-memory token is used
+	pingRedis(ctx)
+	if cacheEnabled() {
+		t.Fatal("Redis still marked up")
+	}
+	m.current = nil
+	if token, err := m.Get(ctx, login.login); err != nil || token != "token-2" {
+		t.Errorf("Get after the probe = %s, %v, want a new login", token, err)
+	}
+	if token, _ := m.Get(ctx, login.login); token != "token-2" || login.calls != 2 {
+		t.Errorf("in-memory token not reused: %s after %d logins", token, login.calls)
+	}
+}
+
+func TestAdminTokenConcurrentLoginOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	login := func(context.Context) (adminTokenEntry, error) {
+		calls.Add(1)
+		<-release
+		return adminTokenEntry{Token: "token-1", ProjectID: "admin-project", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+	m := &adminTokenManager{key: "admin_token_concurrent"}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = m.Get(context.Background(), login)
+		}(i)
+	}
+	// The login in progress doesn't block readers of the manager
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	go func() { m.ProjectID(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ProjectID blocked by the running login")
+	}
+	close(release)
+	wg.Wait()
+
+	for _, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("tokens = %v, want token-1 for every caller", tokens)
+			break
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d logins for concurrent callers, want 1", n)
+	}
+}
+
+func TestAdminTokenReloginOn401(t *testing.T) {
+	useMiniredis(t)
+	login := &countingLogin{lifetime: time.Hour}
+	ctx := context.Background()
+	m := newSharedTokenManager(t)
+	m.key = "admin_token_revoked"
+	if token, _ := m.Get(ctx, login.login); token != "token-1" {
+		t.Fatalf("first token = %s", token)
+	}
+
+	// Keystone revoked token-1 before its expiry
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("X-Auth-Token") != "token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	t.Cleanup(srv.Close)
+	reauth := func(stale string) (string, error) {
+		m.Invalidate(ctx, stale)
+		return m.Get(ctx, login.login)
+	}
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL, Token: "token-1", MaxRetries: -1, Reauth: reauth})
+
+	if _, err := client.GetAllInstances(); err != nil {
+		t.Fatalf("request after re-login: %v", err)
+	}
+	if _, err := client.GetAllInstances(); err != nil {
+		t.Fatal(err)
+	}
+	if login.calls != 2 || requests.Load() != 3 {
+		t.Errorf("%d logins, %d requests; want one re-login and the new token reused", login.calls, requests.Load())
+	}
+	shared := newSharedTokenManager(t)
+	shared.key = m.key
+	if entry := shared.load(ctx); entry == nil || entry.Token != "token-2" {
+		t.Errorf("shared token = %+v, want token-2", entry)
+	}
+
+	// A stale 401 after the re-login doesn't log in again
+	m.Invalidate(ctx, "token-1")
+	if token, _ := m.Get(ctx, login.login); token != "token-2" || login.calls != 2 {
+		t.Errorf("token %s after %d logins, want token-2 kept", token, login.calls)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ClusterAlert is the normalized alert returned by GET /api/v1/cluster/alerts.
+type ClusterAlert struct {
+	ID       string `json:"id,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Since    string `json:"since,omitempty"`
+}
+
+// AlertSummary is the compact alert view embedded in deep health and ClusterUsage.
+type AlertSummary struct {
+	Count      int            `json:"count"`
+	BySeverity map[string]int `json:"by_severity"`
+	Highest    string         `json:"highest_severity,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// ClusterAlertsResponse is the response of GET /api/v1/cluster/alerts.
+type ClusterAlertsResponse struct {
+	Timestamp string         `json:"timestamp"`
+	Alerts    []ClusterAlert `json:"alerts"`
+	Summary   AlertSummary   `json:"summary"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// severityRank orders severities so the summary can report the worst one.
+var severityRank = map[string]int{
+	"info":     1,
+	"warning":  2,
+	"error":    3,
+	"critical": 4,
+}
+
+// getActiveAlerts fetches panel alerts and keeps only the active ones.
+// An unreachable or unconfigured (nil) panel yields an empty list plus an error note.
+func getActiveAlerts(panel PanelAPI) ([]ClusterAlert, error) {
+	if panel == nil {
+		return []ClusterAlert{}, errPanelNotInitialized
+	}
+
+	raw, err := panel.GetAlerts()
+	if err != nil {
+		return []ClusterAlert{}, err
+	}
+
+	alerts := make([]ClusterAlert, 0, len(raw))
+	for _, a := range raw {
+		if !a.Active() {
+			continue
+		}
+
+		severity := strings.ToLower(a.Severity)
+		if severity == "" {
+			severity = strings.ToLower(a.Type)
+		}
+		if severity == "" {
+			severity = "unknown"
+		}
+		message := a.Message
+		if message == "" {
+			message = a.Text
+		}
+		since := a.CreatedAt
+		if since == "" {
+			since = a.Timestamp
+		}
+
+		alerts = append(alerts, ClusterAlert{
+			ID:       a.ID,
+			Severity: severity,
+			Message:  message,
+			Since:    since,
+		})
+	}
+	return alerts, nil
+}
+
+// summarizeAlerts counts alerts per severity and picks the highest one.
+func summarizeAlerts(alerts []ClusterAlert, err error) AlertSummary {
+	summary := AlertSummary{
+		Count:      len(alerts),
+		BySeverity: make(map[string]int),
+	}
+	for _, a := range alerts {
+		summary.BySeverity[a.Severity]++
+		if severityRank[a.Severity] > severityRank[summary.Highest] || summary.Highest == "" {
+			summary.Highest = a.Severity
+		}
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// GET /api/v1/cluster/alerts
+func getClusterAlerts(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	alerts, err := getActiveAlerts(panelFor(r.Context()))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to get panel alerts", "service", "panel", "error", err)
+	}
+
+	response := ClusterAlertsResponse{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Alerts:    alerts,
+		Summary:   summarizeAlerts(alerts, err),
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
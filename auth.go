@@ -6,8 +6,9 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,10 +17,6 @@ import (
 	"time"
 )
 
-// adminProjectID stores the admin project ID extracted from the Keystone token response.
-// Used by Cinder API which requires project_id in the URL path.
-var adminProjectID string
-
 // DomainConfig merepresentasikan satu baris konfigurasi domain/project untuk login Keystone.
 // Format file (per baris):
 //
@@ -51,7 +48,8 @@ func LoadDomains(path string) ([]DomainConfig, error) {
 
 		parts := strings.Split(line, ";")
 		if len(parts) < 4 {
-			log.Printf("Warning: invalid domain line (need 4 fields): %q", line)
+			// The line holds a password; only its domain is logged
+			slog.Warn("Invalid domain line (need 4 fields)", "domain", strings.TrimSpace(parts[0]), "fields", len(parts))
 			continue
 		}
 
@@ -71,17 +69,67 @@ func LoadDomains(path string) ([]DomainConfig, error) {
 }
 
 // KeystoneConfig menyimpan konfigurasi dasar untuk Keystone.
+// BaseURL boleh berupa host saja (https://10.21.0.240) atau endpoint lengkap
+// (https://10.21.0.240:5000/v3); keduanya dinormalisasi oleh NewKeystoneClient.
 type KeystoneConfig struct {
 	BaseURL  string
 	Insecure bool
 }
 
+// normalizeKeystoneURL turns KEYSTONE_URL into the identity v3 endpoint, e.g.
+// https://10.21.0.240:5000/v3. Both conventions in use are accepted:
+//   - bare host ("https://10.21.0.240"): port 5000 and /v3 are added
+//   - endpoint ("https://10.21.0.240:5000/v3", "https://keystone.example/identity"):
+//     the port is kept as given and /v3 is appended when missing
+func normalizeKeystoneURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("KEYSTONE_URL is not set")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid KEYSTONE_URL %s", raw)
+	}
+
+	path := strings.TrimRight(u.Path, "/")
+	if path == "" {
+		// Bare host: Keystone's default public port
+		if u.Port() == "" {
+			u.Host += ":5000"
+		}
+		path = "/v3"
+	} else if !strings.HasSuffix(path, "/v3") {
+		path += "/v3"
+	}
+
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// keystoneURLFor returns the normalized KEYSTONE_URL of ctx's cluster.
+func keystoneURLFor(ctx context.Context) (string, error) {
+	return normalizeKeystoneURL(clusterEnv(ctx, "KEYSTONE_URL", ""))
+}
+
 type KeystoneClient struct {
 	config     KeystoneConfig
 	httpClient *http.Client
 }
 
 func NewKeystoneClient(config KeystoneConfig) *KeystoneClient {
+	if normalized, err := normalizeKeystoneURL(config.BaseURL); err == nil {
+		config.BaseURL = normalized
+	} else {
+		slog.Warn("Keystone URL not normalized", "service", "keystone", "error", err)
+	}
+
 	tr := &http.Transport{}
 
 	if config.Insecure {
@@ -89,7 +137,7 @@ func NewKeystoneClient(config KeystoneConfig) *KeystoneClient {
 	}
 
 	httpClient := &http.Client{
-		Transport: tr,
+		Transport: &countingTransport{base: tr, service: "keystone"}, // counted from the request context
 		Timeout:   30 * time.Second,
 	}
 
@@ -133,7 +181,7 @@ func (c *KeystoneClient) GetToken(ctx context.Context, domain DomainConfig) (str
 		return "", fmt.Errorf("failed to marshal keystone auth payload: %w", err)
 	}
 
-	url := strings.TrimRight(c.config.BaseURL, "/") + "/auth/tokens"
+	url := c.endpoint("/auth/tokens")
 
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
@@ -160,6 +208,11 @@ func (c *KeystoneClient) GetToken(ctx context.Context, domain DomainConfig) (str
 	return token, nil
 }
 
+// endpoint returns the full URL of a Keystone v3 API path, e.g. "/auth/tokens".
+func (c *KeystoneClient) endpoint(path string) string {
+	return c.config.BaseURL + path
+}
+
 // AdminCredentials menyimpan kredensial admin OpenStack/Keystone yang digunakan
 // untuk mendapatkan token admin (X-Subject-Token) sesuai PRD autentikasi.
 type AdminCredentials struct {
@@ -173,24 +226,24 @@ type AdminCredentials struct {
 // GetAdminToken membaca kredensial admin dari environment dan melakukan
 // request ke Keystone untuk mendapatkan X-Subject-Token.
 // Env yang digunakan:
-//   - KEYSTONE_URL                (mis: https://10.21.0.240:5000/v3)
+//   - KEYSTONE_URL                (mis: https://10.21.0.240:5000/v3 atau https://10.21.0.240)
 //   - ADMIN_USERNAME
 //   - ADMIN_PASSWORD
 //   - ADMIN_DOMAIN_ID             (domain.id untuk user admin)
 //   - ADMIN_PROJECT_NAME          (nama project scope admin)
 //   - ADMIN_PROJECT_DOMAIN_ID     (domain.id untuk project admin)
 func GetAdminToken(ctx context.Context) (string, error) {
-	baseURL := getEnv("KEYSTONE_URL", "")
-	if baseURL == "" {
-		return "", fmt.Errorf("KEYSTONE_URL is not set")
+	baseURL, err := keystoneURLFor(ctx)
+	if err != nil {
+		return "", err
 	}
 
 	creds := AdminCredentials{
-		Username:         getEnv("ADMIN_USERNAME", ""),
-		Password:         getEnv("ADMIN_PASSWORD", ""),
-		AdminDomainID:    getEnv("ADMIN_DOMAIN_ID", ""),
-		AdminProjectName: getEnv("ADMIN_PROJECT_NAME", ""),
-		AdminDomainName:  getEnv("ADMIN_DOMAIN_NAME", ""),
+		Username:         clusterEnv(ctx, "ADMIN_USERNAME", ""),
+		Password:         clusterEnv(ctx, "ADMIN_PASSWORD", ""),
+		AdminDomainID:    clusterEnv(ctx, "ADMIN_DOMAIN_ID", ""),
+		AdminProjectName: clusterEnv(ctx, "ADMIN_PROJECT_NAME", ""),
+		AdminDomainName:  clusterEnv(ctx, "ADMIN_DOMAIN_NAME", ""),
 	}
 
 	if creds.Username == "" || creds.Password == "" || creds.AdminDomainID == "" ||
@@ -202,7 +255,10 @@ func GetAdminToken(ctx context.Context) (string, error) {
 		BaseURL:  baseURL,
 		Insecure: true,
 	})
-	return client.getAdminToken(ctx, creds)
+	// Token di-cache sampai mendekati expiry (lihat admin_token.go)
+	return clusterOf(ctx).tokens.Get(ctx, func(ctx context.Context) (adminTokenEntry, error) {
+		return client.getAdminToken(ctx, creds)
+	})
 }
 
 // getAdminToken adalah implementasi internal yang membangun payload sesuai PRD:
@@ -227,9 +283,9 @@ func GetAdminToken(ctx context.Context) (string, error) {
 //	    }
 //	  }
 //	}
-func (c *KeystoneClient) getAdminToken(ctx context.Context, creds AdminCredentials) (string, error) {
+func (c *KeystoneClient) getAdminToken(ctx context.Context, creds AdminCredentials) (adminTokenEntry, error) {
 	if c == nil {
-		return "", fmt.Errorf("keystone client is nil")
+		return adminTokenEntry{}, fmt.Errorf("keystone client is nil")
 	}
 
 	authPayload := map[string]interface{}{
@@ -259,77 +315,64 @@ func (c *KeystoneClient) getAdminToken(ctx context.Context, creds AdminCredentia
 
 	body, err := json.Marshal(authPayload)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal keystone admin auth payload: %w", err)
+		return adminTokenEntry{}, fmt.Errorf("failed to marshal keystone admin auth payload: %w", err)
 	}
 
-	urlStr := strings.TrimRight(c.config.BaseURL, "/") + ":5000/v3/auth/tokens"
+	urlStr := c.endpoint("/auth/tokens")
 
 	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("failed to create keystone admin request: %w", err)
+		return adminTokenEntry{}, fmt.Errorf("failed to create keystone admin request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute keystone admin request: %w", err)
+		return adminTokenEntry{}, fmt.Errorf("failed to execute keystone admin request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("keystone admin auth returned non-2xx status: %d", resp.StatusCode)
+		return adminTokenEntry{}, fmt.Errorf("keystone admin auth returned non-2xx status: %d", resp.StatusCode)
 	}
 
 	token := resp.Header.Get("X-Subject-Token")
 	if token == "" {
-		return "", fmt.Errorf("keystone admin response missing X-Subject-Token header")
+		return adminTokenEntry{}, fmt.Errorf("keystone admin response missing X-Subject-Token header")
 	}
 
-	// Parse response body to extract project_id
+	// Parse response body to extract project_id and expiry
+	entry := adminTokenEntry{Token: token}
 	var tokenResp struct {
 		Token struct {
-			Project struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Project   struct {
 				ID   string `json:"id"`
 				Name string `json:"name"`
 			} `json:"project"`
 		} `json:"token"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		log.Printf("Warning: could not parse token response body for project_id: %v", err)
+		slog.Warn("Could not parse token response body for project_id", "service", "keystone", "error", err)
 	} else {
-		adminProjectID = tokenResp.Token.Project.ID
-		log.Printf("Admin project ID: %s (name: %s)", adminProjectID, tokenResp.Token.Project.Name)
+		entry.ProjectID = tokenResp.Token.Project.ID
+		entry.ExpiresAt = tokenResp.Token.ExpiresAt
+		slog.Debug("Admin token issued", "service", "keystone", "project_id", entry.ProjectID,
+			"project_name", tokenResp.Token.Project.Name, "expires_at", entry.ExpiresAt)
 	}
 
-	return token, nil
+	return entry, nil
 }
 
-// LoadDomainNames membaca file domain.txt yang berisi daftar nama domain (satu per baris).
-// Baris kosong atau yang diawali '#' akan di-skip.
-func LoadDomainNames(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var domains []string
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		domains = append(domains, line)
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	return domains, nil
+// DomainEntry is one line of DOMAINS_FILE: a domain name, optionally followed
+// by the recipients of its monthly report:
+//
+//	domain_name
+//	domain_name;billing@example.com,ops@example.com
+type DomainEntry struct {
+	Name   string
+	Emails []string
 }
 
 // Struktur helper untuk response Keystone
@@ -342,6 +385,9 @@ type keystoneDomainsResponse struct {
 	Domains []KeystoneDomain `json:"domains"`
 }
 
+// errDomainNotFound is returned by ListProjectsForDomainName for an unknown domain name.
+var errDomainNotFound = errors.New("no domain found")
+
 type KeystoneProject struct {
 	ID       string `json:"id"`
 	Name     string `json:"name"`
@@ -357,9 +403,9 @@ type keystoneProjectsResponse struct {
 //   - GET /domains?name={domainName}
 //   - GET /projects?domain_id={domainID}
 func ListProjectsForDomainName(ctx context.Context, token, domainName string) ([]KeystoneProject, error) {
-	baseURL := getEnv("KEYSTONE_URL", "")
-	if baseURL == "" {
-		return nil, fmt.Errorf("KEYSTONE_URL is not set")
+	baseURL, err := keystoneURLFor(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	client := NewKeystoneClient(KeystoneConfig{
@@ -367,9 +413,8 @@ func ListProjectsForDomainName(ctx context.Context, token, domainName string) ([
 		Insecure: true,
 	})
 
-	base := strings.TrimRight(client.config.BaseURL, "/")
 	// 1) Resolve domain name -> domain id
-	domainURL := fmt.Sprintf("%s:5000/v3/domains?name=%s", base, url.QueryEscape(domainName))
+	domainURL := client.endpoint("/domains?name=" + url.QueryEscape(domainName))
 	req, err := http.NewRequestWithContext(ctx, "GET", domainURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create domains request: %w", err)
@@ -392,13 +437,13 @@ func ListProjectsForDomainName(ctx context.Context, token, domainName string) ([
 	}
 
 	if len(domResp.Domains) == 0 {
-		return nil, fmt.Errorf("no domain found with name %q", domainName)
+		return nil, fmt.Errorf("%w with name %q", errDomainNotFound, domainName)
 	}
 
 	domainID := domResp.Domains[0].ID
 
 	// 2) List projects by domain_id
-	projectsURL := fmt.Sprintf("%s:5000/v3/projects?domain_id=%s", base, url.QueryEscape(domainID))
+	projectsURL := client.endpoint("/projects?domain_id=" + url.QueryEscape(domainID))
 
 	reqProj, err := http.NewRequestWithContext(ctx, "GET", projectsURL, nil)
 	if err != nil {
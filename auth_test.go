@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestNormalizeKeystoneURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"https://10.21.0.240:5000/v3", "https://10.21.0.240:5000/v3"},
+		{"https://10.21.0.240:5000/v3/", "https://10.21.0.240:5000/v3"},
+		{"https://10.21.0.240:5000", "https://10.21.0.240:5000/v3"},
+		{"https://10.21.0.240:5000/", "https://10.21.0.240:5000/v3"},
+		{"https://10.21.0.240", "https://10.21.0.240:5000/v3"},
+		{"https://10.21.0.240/", "https://10.21.0.240:5000/v3"},
+		{"10.21.0.240", "https://10.21.0.240:5000/v3"},
+		{"http://keystone.example:35357", "http://keystone.example:35357/v3"},
+		{"https://keystone.example/identity", "https://keystone.example/identity/v3"},
+		{"https://keystone.example/identity/v3/", "https://keystone.example/identity/v3"},
+		{" https://10.21.0.240:5000/v3?x=1 ", "https://10.21.0.240:5000/v3"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeKeystoneURL(tt.raw)
+		if err != nil {
+			t.Errorf("%q: %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeKeystoneURLInvalid(t *testing.T) {
+	for _, raw := range []string{"", "   ", "https://"} {
+		if got, err := normalizeKeystoneURL(raw); err == nil {
+			t.Errorf("%q: got %s, want an error", raw, got)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,8 +19,30 @@ type CPUUsageStats struct {
 	Percentile95    float64       `json:"percentile_95"`
 	UsageByHour     []HourlyUsage `json:"usage_by_hour"`
 	UsageByDay      []DailyUsage  `json:"usage_by_day"`
+	Gaps            []DataGap     `json:"gaps"` // periods without monitoring data
+
+	// Requested with ?percentiles= (/billing/cpu), keyed p50, p99.9, ...
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// emptyCPUUsageStats is CPUUsageStats without data. Its lists are empty, not
+// nil, so they encode as [] rather than null.
+func emptyCPUUsageStats() CPUUsageStats {
+	return CPUUsageStats{UsageByHour: []HourlyUsage{}, UsageByDay: []DailyUsage{}, Gaps: []DataGap{}}
 }
 
+// DataGap is a period where consecutive measures are more than
+// gapGranularityFactor × granularity apart, i.e. monitoring data is missing.
+type DataGap struct {
+	Start         string  `json:"start"` // last measure before the gap
+	End           string  `json:"end"`   // first measure after the gap
+	DurationHours float64 `json:"duration_hours"`
+}
+
+// gapGranularityFactor is how many granularities apart two measures may be
+// before the interval between them counts as a gap.
+const gapGranularityFactor = 2.0
+
 type HourlyUsage struct {
 	Timestamp  string  `json:"timestamp"`
 	CPUPercent float64 `json:"cpu_percent"`
@@ -28,6 +54,7 @@ type DailyUsage struct {
 	AverageCPU    float64 `json:"average_cpu_percent"`
 	MaxCPU        float64 `json:"max_cpu_percent"`
 	MinCPU        float64 `json:"min_cpu_percent"`
+	P95CPU        float64 `json:"p95_cpu_percent"`
 	TotalCPUHours float64 `json:"total_cpu_hours"`
 }
 
@@ -49,6 +76,22 @@ type MemoryUsageStats struct {
 	UsageByDay     []DailyMemUsage `json:"usage_by_day"`
 }
 
+// DiskUsageStats is the disk I/O and provisioned storage of an instance.
+type DiskUsageStats struct {
+	ReadBytes      float64 `json:"read_bytes"`
+	WriteBytes     float64 `json:"write_bytes"`
+	ReadGB         float64 `json:"read_gb"`
+	WriteGB        float64 `json:"write_gb"`
+	TotalIOGB      float64 `json:"total_io_gb"`     // read + write, GB of 1024³ bytes
+	ProvisionedGiB float64 `json:"provisioned_gib"` // average volume size over the period
+	CounterResets  int     `json:"counter_resets"`  // negative deltas skipped (VM restart/migration)
+}
+
+// emptyMemoryUsageStats is MemoryUsageStats without data, with an empty (not nil) UsageByDay.
+func emptyMemoryUsageStats() MemoryUsageStats {
+	return MemoryUsageStats{UsageByDay: []DailyMemUsage{}}
+}
+
 type DailyMemUsage struct {
 	Date           string  `json:"date"`
 	AverageUsedMB  float64 `json:"average_used_mb"`
@@ -63,17 +106,22 @@ type CPUBillingResponse struct {
 	VCPUs        int            `json:"vcpus"`
 	Usage        CPUUsageStats  `json:"usage"`
 	Billing      CPUBillingInfo `json:"billing"`
+
+	// Granularity (seconds) each metric was actually read at, after fallback
+	GranularityUsed map[string]int `json:"granularity_used"`
 }
 
 type ResourceUsage struct {
-	InstanceID   string           `json:"instance_id"`
-	InstanceName string           `json:"instance_name"`
-	FlavorName   string           `json:"flavor_name"`
-	StartDate    string           `json:"start_date"`
-	EndDate      string           `json:"end_date"`
-	VCPUs        int              `json:"vcpus"`
-	CPU          CPUUsageStats    `json:"cpu"`
-	Memory       MemoryUsageStats `json:"memory"`
+	InstanceID   string                `json:"instance_id"`
+	InstanceName string                `json:"instance_name"`
+	FlavorName   string                `json:"flavor_name"`
+	StartDate    string                `json:"start_date"`
+	EndDate      string                `json:"end_date"`
+	VCPUs        int                   `json:"vcpus"`
+	CPU          CPUUsageStats         `json:"cpu"`
+	Memory       MemoryUsageStats      `json:"memory"`
+	Network      *InstanceNetworkUsage `json:"network,omitempty"`
+	Disk         *DiskUsageStats       `json:"disk,omitempty"`
 }
 
 type BillingReport struct {
@@ -91,23 +139,310 @@ type BillingReport struct {
 	MemoryPricePerGB float64          `json:"memory_price_per_gb_hour"`
 	CPUCost          float64          `json:"cpu_cost"`
 	MemoryCost       float64          `json:"memory_cost"`
-	TotalCost        float64          `json:"total_cost"`
+
+	// Part of the period the instance existed (Gnocchi started_at / ended_at).
+	// Memory, disk capacity and pricing expression hours are prorated to it.
+	FirstSeen      string  `json:"first_seen"`
+	LastSeen       string  `json:"last_seen"`
+	EffectiveHours float64 `json:"effective_hours"`
+
+	DiskUsage           DiskUsageStats `json:"disk_usage"`
+	DiskPricePerGBMonth float64        `json:"disk_price_per_gb_month"`
+	IOPricePerGB        float64        `json:"io_price_per_gb"`
+	DiskCost            float64        `json:"disk_cost"`
+
+	// Traffic per interface; egress (outgoing) GB is billed. nil without network metrics
+	NetworkUsage      *InstanceNetworkUsage `json:"network_usage,omitempty"`
+	NetworkPricePerGB float64               `json:"network_price_per_gb"`
+	NetworkCost       float64               `json:"network_cost"`
+
+	// UsageCost = CPU + memory + disk + network; FinalCost = UsageCost + AdjustmentsTotal.
+	// TotalCost is kept equal to FinalCost for existing consumers.
+	UsageCost        float64             `json:"usage_cost"`
+	Adjustments      []BillingAdjustment `json:"adjustments"`
+	AdjustmentsTotal float64             `json:"adjustments_total"`
+	FinalCost        float64             `json:"final_cost"`
+	TotalCost        float64             `json:"total_cost"`
+
+	// Set when a pricing expression replaced the built-in cost formula;
+	// UsageCost is then Pricing.Cost
+	Pricing *PricingResult `json:"pricing,omitempty"`
+
+	// CPU + memory cost per hour, with ?include_hourly_cost=true
+	CostByHour []HourlyCost `json:"cost_by_hour,omitempty"`
+
+	// Usage billed per tier when PRICING_TIERS_FILE priced the report
+	TierCharges []TierCharge `json:"tier_charges,omitempty"`
+
+	// CPU metric coverage for the period (valid points / expected points)
+	Coverage *DataCoverage `json:"coverage,omitempty"`
+
+	// Granularity (seconds) each metric was actually read at, after fallback
+	GranularityUsed map[string]int `json:"granularity_used"`
+}
+
+// DataCoverage describes how much of the billing period is backed by valid measures.
+type DataCoverage struct {
+	GranularitySeconds int     `json:"granularity_seconds"`
+	ValidPoints        int     `json:"valid_points"`
+	ExpectedPoints     int     `json:"expected_points"`
+	Percent            float64 `json:"percent"`
+}
+
+// BillingWindow clamps the period startDate–endDate to the instance's lifetime:
+// from started_at (when later) to ended_at (when set and earlier), and to now
+// for a period that has not ended, so hours still to come are not billed. A
+// lifetime that does not overlap the period gives an empty window
+// (last == first). Unparseable timestamps are ignored.
+func BillingWindow(startDate, endDate, startedAt string, endedAt *string) (first, last time.Time) {
+	first, _ = time.Parse("2006-01-02T15:04:05", startDate)
+	last, _ = time.Parse("2006-01-02T15:04:05", endDate)
+	if t, err := time.Parse(time.RFC3339, startedAt); err == nil && t.After(first) {
+		first = t.UTC()
+		if first.After(last) {
+			first = last // started after the period
+		}
+	}
+	if endedAt != nil {
+		if t, err := time.Parse(time.RFC3339, *endedAt); err == nil && t.Before(last) {
+			last = t.UTC()
+		}
+	}
+	if now := time.Now().UTC(); now.Before(last) {
+		last = now
+	}
+	if last.Before(first) {
+		last = first
+	}
+	return first, last
+}
+
+// billedHours returns the hours the report bills capacity for: EffectiveHours,
+// or the whole period for reports cached before proration (no FirstSeen).
+func billedHours(report *BillingReport) float64 {
+	if report.FirstSeen != "" {
+		return report.EffectiveHours
+	}
+	start, _ := time.Parse("2006-01-02T15:04:05", report.StartDate)
+	end, _ := time.Parse("2006-01-02T15:04:05", report.EndDate)
+	return end.Sub(start).Hours()
+}
+
+// CalculateCoverage compares the valid data points with the number of points the
+// period should have at the given granularity. Coverage is capped at 100%.
+func CalculateCoverage(validPoints int, startDate, endDate string, granularity int) DataCoverage {
+	coverage := DataCoverage{GranularitySeconds: granularity, ValidPoints: validPoints}
+
+	start, errStart := time.Parse("2006-01-02T15:04:05", startDate)
+	end, errEnd := time.Parse("2006-01-02T15:04:05", endDate)
+	if errStart != nil || errEnd != nil || granularity <= 0 || !end.After(start) {
+		return coverage
+	}
+
+	coverage.ExpectedPoints = int(end.Sub(start).Seconds()) / granularity
+	if coverage.ExpectedPoints > 0 {
+		coverage.Percent = math.Min(float64(validPoints)/float64(coverage.ExpectedPoints)*100, 100)
+	}
+	return coverage
+}
+
+// BillingAdjustment is a manual line item (e.g. an SLA credit) applied to a report.
+// Negative amounts are credits, positive amounts are charges.
+type BillingAdjustment struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency,omitempty"`
+}
+
+// maxAdjustmentAmount guards against typos like a missing decimal point.
+const maxAdjustmentAmount = 1e9
+
+// ValidateAdjustments checks every adjustment and fills in the report currency
+// where it is omitted. Adjustments in a different currency are rejected since
+// the report does not convert currencies.
+func ValidateAdjustments(adjustments []BillingAdjustment, currency string) error {
+	for i := range adjustments {
+		a := &adjustments[i]
+		if strings.TrimSpace(a.Description) == "" {
+			return fmt.Errorf("adjustment %d: description is required", i)
+		}
+		if math.IsNaN(a.Amount) || math.IsInf(a.Amount, 0) {
+			return fmt.Errorf("adjustment %d: amount must be a finite number", i)
+		}
+		if a.Amount == 0 {
+			return fmt.Errorf("adjustment %d: amount must not be zero", i)
+		}
+		if math.Abs(a.Amount) > maxAdjustmentAmount {
+			return fmt.Errorf("adjustment %d: amount %.2f exceeds the allowed maximum", i, a.Amount)
+		}
+		if a.Currency == "" {
+			a.Currency = currency
+		}
+		if !strings.EqualFold(a.Currency, currency) {
+			return fmt.Errorf("adjustment %d: currency %s does not match report currency %s", i, a.Currency, currency)
+		}
+		a.Currency = currency
+	}
+	return nil
 }
 
-func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
+// hoursPerBillingMonth converts per GB-month prices to the period (365 × 24 / 12).
+const hoursPerBillingMonth = 730.0
+
+// ApplyDiskPricing prices the report's disk usage: the provisioned GiB per
+// month, prorated to the billed hours, plus the read and written GB. It runs
+// before ApplyPricingExpr and ApplyAdjustments; the cached report has no disk
+// prices.
+func ApplyDiskPricing(report *BillingReport, diskPricePerGBMonth, ioPricePerGB float64) {
+	months := billedHours(report) / hoursPerBillingMonth
+
+	report.DiskPricePerGBMonth = diskPricePerGBMonth
+	report.IOPricePerGB = ioPricePerGB
+	report.DiskCost = report.DiskUsage.ProvisionedGiB*months*diskPricePerGBMonth +
+		report.DiskUsage.TotalIOGB*ioPricePerGB
+}
+
+// ApplyNetworkPricing prices the report's egress (outgoing) traffic per GB. Like
+// ApplyDiskPricing it runs before ApplyPricingExpr and ApplyAdjustments.
+func ApplyNetworkPricing(report *BillingReport, pricePerGB float64) {
+	report.NetworkPricePerGB = pricePerGB
+	report.NetworkCost = 0
+	if report.NetworkUsage != nil {
+		report.NetworkCost = report.NetworkUsage.Total.OutgoingGB * pricePerGB
+	}
+}
+
+// ApplyTieredPricing replaces the flat CPU, memory and disk capacity costs with
+// the tiers of cfg (see pricing_tiers.go); resources without tiers keep their
+// cost. It runs after ApplyDiskPricing (I/O stays priced per GB) and before
+// ApplyPricingExpr and ApplyAdjustments. The flat price fields of a tiered
+// resource are set to 0, and CostByHour, priced flat, is dropped.
+func ApplyTieredPricing(report *BillingReport, cfg *PricingConfig) {
+	hours := billedHours(report)
+
+	report.TierCharges = nil
+	if len(cfg.CPU) > 0 {
+		cpuHours := 0.0
+		for _, daily := range report.CPUUsage.UsageByDay {
+			cpuHours += daily.TotalCPUHours
+		}
+		cost, charges := tieredCost("cpu", cpuHours, cfg.CPU)
+		report.CPUCost, report.CPUPricePerHour = cost, 0
+		report.TierCharges = append(report.TierCharges, charges...)
+	}
+	if len(cfg.Memory) > 0 {
+		gbHours := report.MemoryUsage.AverageUsedMB / 1024.0 * hours
+		cost, charges := tieredCost("memory", gbHours, cfg.Memory)
+		report.MemoryCost, report.MemoryPricePerGB = cost, 0
+		report.TierCharges = append(report.TierCharges, charges...)
+	}
+	if len(cfg.Disk) > 0 {
+		gibMonths := report.DiskUsage.ProvisionedGiB * hours / hoursPerBillingMonth
+		cost, charges := tieredCost("disk", gibMonths, cfg.Disk)
+		report.DiskCost = cost + report.DiskUsage.TotalIOGB*report.IOPricePerGB
+		report.DiskPricePerGBMonth = 0
+		report.TierCharges = append(report.TierCharges, charges...)
+	}
+	report.CostByHour = nil
+}
+
+// ApplyAdjustments sums the adjustments into the report totals. The usage cost
+// is CPU + memory + disk + network cost, or the pricing expression's cost when
+// one was applied.
+func ApplyAdjustments(report *BillingReport, adjustments []BillingAdjustment) {
+	report.UsageCost = report.CPUCost + report.MemoryCost + report.DiskCost + report.NetworkCost
+	if report.Pricing != nil {
+		report.UsageCost = report.Pricing.Cost
+	}
+	report.Adjustments = adjustments
+	if report.Adjustments == nil {
+		report.Adjustments = []BillingAdjustment{}
+	}
+
+	report.AdjustmentsTotal = 0
+	for _, a := range adjustments {
+		report.AdjustmentsTotal += a.Amount
+	}
+
+	report.FinalCost = report.UsageCost + report.AdjustmentsTotal
+	report.TotalCost = report.FinalCost
+}
+
+// ReportPricing prices a loaded report beyond its flat CPU and memory costs
+// (all the cached report has): disk, I/O and egress prices, the tiers of
+// PRICING_TIERS_FILE and the contract pricing expression (nil when not used).
+type ReportPricing struct {
+	DiskPricePerGBMonth float64
+	IOPricePerGB        float64
+	NetworkPricePerGB   float64
+	Tiers               *PricingConfig
+	Expr                *PricingExpr
+}
+
+// PriceReport runs the pricing of a loaded report in order: disk, network,
+// tiers, pricing expression and adjustments. Every path that bills reports
+// goes through it, so a report costs the same wherever it is billed. The
+// error is the pricing expression's.
+func PriceReport(report *BillingReport, pricing ReportPricing, adjustments []BillingAdjustment) error {
+	ApplyDiskPricing(report, pricing.DiskPricePerGBMonth, pricing.IOPricePerGB)
+	ApplyNetworkPricing(report, pricing.NetworkPricePerGB)
+	if pricing.Tiers != nil {
+		ApplyTieredPricing(report, pricing.Tiers)
+	}
+	if pricing.Expr != nil {
+		if err := ApplyPricingExpr(report, pricing.Expr); err != nil {
+			return err
+		}
+	}
+	ApplyAdjustments(report, adjustments)
+	return nil
+}
+
+// findDataGaps lists the intervals where consecutive measures are further apart
+// than gapGranularityFactor × their granularity (300s when Gnocchi didn't report one).
+// Gap bounds are formatted in loc (nil: as returned by Gnocchi).
+func findDataGaps(measures []MetricMeasure, loc *time.Location) []DataGap {
+	gaps := []DataGap{}
+	for i := 1; i < len(measures); i++ {
+		timePrev, errPrev := time.Parse(time.RFC3339, measures[i-1].Timestamp)
+		timeCurr, errCurr := time.Parse(time.RFC3339, measures[i].Timestamp)
+		if errPrev != nil || errCurr != nil {
+			continue
+		}
+
+		granularity := measures[i].Granularity
+		if granularity <= 0 {
+			granularity = 300
+		}
+		delta := timeCurr.Sub(timePrev)
+		if delta.Seconds() > gapGranularityFactor*granularity {
+			gaps = append(gaps, DataGap{
+				Start:         formatTimestamp(measures[i-1].Timestamp, loc),
+				End:           formatTimestamp(measures[i].Timestamp, loc),
+				DurationHours: delta.Hours(),
+			})
+		}
+	}
+	return gaps
+}
+
+// CalculateCPUUsage derives CPU percentages from the cumulative cpu counter.
+// Hourly timestamps and day buckets are in loc (nil: as returned by Gnocchi / UTC).
+func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int, loc *time.Location) CPUUsageStats {
 	if len(measures) < 2 {
-		log.Printf("Warning: Not enough measures (%d), need at least 2", len(measures))
-		return CPUUsageStats{}
+		slog.Debug("Not enough CPU measures, need at least 2", "measures", len(measures))
+		return emptyCPUUsageStats()
 	}
 
 	if numVCPUs <= 0 {
-		log.Printf("Warning: Invalid numVCPUs (%d), defaulting to 1", numVCPUs)
+		slog.Warn("Invalid numVCPUs, defaulting to 1", "vcpus", numVCPUs)
 		numVCPUs = 1
 	}
 
-	var hourlyUsages []HourlyUsage
+	hourlyUsages := []HourlyUsage{}
 	var percentages []float64
 	dailyUsageMap := make(map[string]*DailyUsage)
+	dailyPercentages := make(map[string][]float64) // per day, for average and p95
 
 	skippedNegative := 0
 	skippedAbnormal := 0
@@ -123,8 +458,8 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		// CRITICAL: Skip negative delta (VM restart, live migration, or counter reset)
 		if deltaCPU < 0 {
 			skippedNegative++
-			log.Printf("Warning: Negative CPU delta (%.2f ns) at %s - likely VM restart/migration, skipping",
-				deltaCPU, curr.Timestamp)
+			slog.Debug("Negative CPU delta, likely VM restart/migration, skipping",
+				"delta_ns", deltaCPU, "timestamp", curr.Timestamp)
 			continue
 		}
 
@@ -136,7 +471,7 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		// Skip if time delta is invalid
 		if deltaTime <= 0 {
 			skippedAbnormal++
-			log.Printf("Warning: Invalid time delta (%.2f s) at %s, skipping", deltaTime, curr.Timestamp)
+			slog.Debug("Invalid CPU time delta, skipping", "delta_s", deltaTime, "timestamp", curr.Timestamp)
 			continue
 		}
 
@@ -149,8 +484,8 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		maxAllowed := 100.0
 		if cpuPercent < 0 || cpuPercent > maxAllowed*1.1 { // Allow 10% margin for measurement error
 			skippedAbnormal++
-			log.Printf("Warning: Abnormal CPU%% (%.2f%%) at %s (delta: %.2f ns, time: %.2f s), skipping",
-				cpuPercent, curr.Timestamp, deltaCPU, deltaTime)
+			slog.Debug("Abnormal CPU percentage, skipping", "cpu_percent", cpuPercent,
+				"timestamp", curr.Timestamp, "delta_ns", deltaCPU, "delta_s", deltaTime)
 			continue
 		}
 
@@ -161,7 +496,7 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		totalProcessed++
 
 		hourlyUsages = append(hourlyUsages, HourlyUsage{
-			Timestamp:  curr.Timestamp,
+			Timestamp:  formatTimestamp(curr.Timestamp, loc),
 			CPUPercent: cpuPercent,
 			CPUSeconds: cpuSeconds,
 		})
@@ -169,7 +504,7 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		percentages = append(percentages, cpuPercent)
 
 		// Aggregate by day
-		dateKey := timeCurr.Format("2006-01-02")
+		dateKey := inZone(timeCurr, loc).Format("2006-01-02")
 
 		if _, exists := dailyUsageMap[dateKey]; !exists {
 			dailyUsageMap[dateKey] = &DailyUsage{
@@ -180,7 +515,7 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		}
 
 		daily := dailyUsageMap[dateKey]
-		daily.AverageCPU += cpuPercent
+		dailyPercentages[dateKey] = append(dailyPercentages[dateKey], cpuPercent)
 		daily.TotalCPUHours += cpuSeconds / 3600.0
 
 		if cpuPercent > daily.MaxCPU {
@@ -191,55 +526,41 @@ func CalculateCPUUsage(measures []MetricMeasure, numVCPUs int) CPUUsageStats {
 		}
 	}
 
-	// Log summary of data quality
 	totalMeasures := len(measures) - 1
-	log.Printf("CPU Usage Calculation Summary:")
-	log.Printf("  Total intervals: %d", totalMeasures)
-	log.Printf("  Valid data points: %d (%.1f%%)", totalProcessed, float64(totalProcessed)/float64(totalMeasures)*100)
-	log.Printf("  Skipped negative: %d", skippedNegative)
-	log.Printf("  Skipped abnormal: %d", skippedAbnormal)
-
-	// Convert daily map to slice and calculate averages
-	var dailyUsages []DailyUsage
-	for _, daily := range dailyUsageMap {
-		// Calculate average CPU per day by dividing by number of data points for that day
-		dataPointsThisDay := 0
-		for _, usage := range hourlyUsages {
-			t, _ := time.Parse(time.RFC3339, usage.Timestamp)
-			if t.Format("2006-01-02") == daily.Date {
-				dataPointsThisDay++
-			}
-		}
 
-		if dataPointsThisDay > 0 {
-			daily.AverageCPU = daily.AverageCPU / float64(dataPointsThisDay)
-		}
+	// Convert daily map to slice; average and p95 from the day's data points
+	dailyUsages := []DailyUsage{}
+	for dateKey, daily := range dailyUsageMap {
+		dayPercentages := dailyPercentages[dateKey]
+		daily.AverageCPU = average(dayPercentages)
+		daily.P95CPU = percentile(dayPercentages, 95)
 		dailyUsages = append(dailyUsages, *daily)
 	}
 
+	gaps := findDataGaps(measures, loc)
+
 	// Calculate statistics
 	stats := CPUUsageStats{
 		TotalDataPoints: len(percentages),
 		UsageByHour:     hourlyUsages,
 		UsageByDay:      dailyUsages,
+		Gaps:            gaps,
 	}
 
 	if len(percentages) > 0 {
 		stats.AveragePercent = average(percentages)
 		stats.MaxPercent = max(percentages)
 		stats.MinPercent = min(percentages)
-		stats.MedianPercent = median(percentages)
-		stats.Percentile95 = percentile(percentages, 95)
-
-		log.Printf("CPU Statistics:")
-		log.Printf("  Average: %.2f%%", stats.AveragePercent)
-		log.Printf("  Median: %.2f%%", stats.MedianPercent)
-		log.Printf("  95th percentile: %.2f%%", stats.Percentile95)
-		log.Printf("  Min: %.2f%%, Max: %.2f%%", stats.MinPercent, stats.MaxPercent)
-	} else {
-		log.Printf("Warning: No valid CPU data points after filtering")
+		// Sorted once for both
+		sorted := sortedCopy(percentages)
+		stats.MedianPercent = medianSorted(sorted)
+		stats.Percentile95 = percentileSorted(sorted, 95)
 	}
 
+	// Data quality summary
+	slog.Debug("CPU usage calculated", "intervals", totalMeasures, "valid_points", totalProcessed,
+		"skipped_negative", skippedNegative, "skipped_abnormal", skippedAbnormal, "gaps", len(gaps),
+		"avg_percent", stats.AveragePercent, "p95_percent", stats.Percentile95)
 	return stats
 }
 
@@ -265,27 +586,185 @@ func CalculateCPUBilling(usage CPUUsageStats, startDate, endDate string) CPUBill
 	}
 }
 
-func CalculateMemoryUsage(usageMeasures, totalMeasures []MetricMeasure) MemoryUsageStats {
+// CalculateDiskUsage sums the cumulative disk.device.read.bytes and
+// disk.device.write.bytes counters and averages volume.size (GiB). Like
+// CalculateCPUUsage, a negative delta (VM restart, migration or counter reset)
+// is skipped rather than counted.
+func CalculateDiskUsage(readMeasures, writeMeasures, sizeMeasures []MetricMeasure) DiskUsageStats {
+	var stats DiskUsageStats
+	var resets int
+	stats.ReadBytes, resets = counterIncrease(readMeasures)
+	stats.CounterResets += resets
+	stats.WriteBytes, resets = counterIncrease(writeMeasures)
+	stats.CounterResets += resets
+	stats.ReadGB = stats.ReadBytes / bytesPerGB
+	stats.WriteGB = stats.WriteBytes / bytesPerGB
+	stats.TotalIOGB = stats.ReadGB + stats.WriteGB
+
+	sizes := make([]float64, 0, len(sizeMeasures))
+	for _, m := range sizeMeasures {
+		sizes = append(sizes, m.Value)
+	}
+	stats.ProvisionedGiB = average(sizes)
+	return stats
+}
+
+// HourlyCost is the built-in CPU + memory cost of one hour. Disk, network,
+// pricing expressions and adjustments are not spread over hours.
+type HourlyCost struct {
+	Hour          string  `json:"hour"` // start of the hour
+	CPUHours      float64 `json:"cpu_hours"`
+	MemoryGBHours float64 `json:"memory_gb_hours"`
+	CPUCost       float64 `json:"cpu_cost"`
+	MemoryCost    float64 `json:"memory_cost"`
+	Cost          float64 `json:"cost"`
+}
+
+// CalculateHourlyCost prices every hour with CPU measured intervals
+// (cpu_seconds of UsageByHour) and memory.usage measures, each measure
+// counting for its granularity (memGranularity when it has none). Hours are in
+// loc (nil: as the timestamps are) and sorted. The CPU costs add up to CPUCost;
+// the memory costs add up to MemoryCost only when memory data covers the whole
+// period, since MemoryCost bills the average over the period.
+func CalculateHourlyCost(cpuIntervals []HourlyUsage, memMeasures []MetricMeasure, memGranularity int,
+	cpuPricePerHour, memoryPricePerGB float64, loc *time.Location) []HourlyCost {
+	hours := make(map[string]*HourlyCost)
+	hourOf := func(ts string) *HourlyCost {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return nil
+		}
+		t = inZone(t, loc)
+		key := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Format(time.RFC3339)
+		h := hours[key]
+		if h == nil {
+			h = &HourlyCost{Hour: key}
+			hours[key] = h
+		}
+		return h
+	}
+
+	for _, interval := range cpuIntervals {
+		if h := hourOf(interval.Timestamp); h != nil {
+			h.CPUHours += interval.CPUSeconds / 3600.0
+		}
+	}
+	for _, m := range memMeasures {
+		granularity := m.Granularity
+		if granularity <= 0 {
+			granularity = float64(memGranularity)
+		}
+		if h := hourOf(m.Timestamp); h != nil {
+			h.MemoryGBHours += m.Value / 1024.0 * granularity / 3600.0
+		}
+	}
+
+	result := make([]HourlyCost, 0, len(hours))
+	for _, h := range hours {
+		h.CPUCost = h.CPUHours * cpuPricePerHour
+		h.MemoryCost = h.MemoryGBHours * memoryPricePerGB
+		h.Cost = h.CPUCost + h.MemoryCost
+		result = append(result, *h)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Hour < result[j].Hour })
+	return result
+}
+
+// bytesPerGB is the GB used for disk and network traffic (1024³ bytes).
+const bytesPerGB = 1024.0 * 1024.0 * 1024.0
+
+// CalculateNetworkUsage totals the cumulative network.incoming.bytes and
+// network.outgoing.bytes counters ([incoming, outgoing] measures) of every
+// interface, keyed by tap device; the empty name holds the instance's
+// aggregate metrics and only counts in the total. Negative deltas (counter
+// reset on reboot or migration) are skipped, like in CalculateCPUUsage.
+// Interfaces are sorted by name.
+func CalculateNetworkUsage(counters map[string][2][]MetricMeasure) InstanceNetworkUsage {
+	usage := InstanceNetworkUsage{Interfaces: []NetworkUsageStats{}}
+	for tap, measures := range counters {
+		in, _ := counterIncrease(measures[0])
+		out, _ := counterIncrease(measures[1])
+		usage.Total.IncomingBytes += in
+		usage.Total.OutgoingBytes += out
+		if tap != "" {
+			usage.Interfaces = append(usage.Interfaces, NetworkUsageStats{
+				Interface:     tap,
+				IncomingBytes: in,
+				OutgoingBytes: out,
+				IncomingGB:    in / bytesPerGB,
+				OutgoingGB:    out / bytesPerGB,
+			})
+		}
+	}
+	sort.Slice(usage.Interfaces, func(i, j int) bool { return usage.Interfaces[i].Interface < usage.Interfaces[j].Interface })
+	usage.Total.IncomingGB = usage.Total.IncomingBytes / bytesPerGB
+	usage.Total.OutgoingGB = usage.Total.OutgoingBytes / bytesPerGB
+	return usage
+}
+
+// counterIncrease returns how much a cumulative counter grew over the measures,
+// and how many negative deltas (resets) were skipped.
+func counterIncrease(measures []MetricMeasure) (float64, int) {
+	total := 0.0
+	resets := 0
+	for i := 1; i < len(measures); i++ {
+		prev := measures[i-1]
+		curr := measures[i]
+
+		delta := curr.Value - prev.Value
+		if delta < 0 {
+			resets++
+			slog.Debug("Negative counter delta, likely VM restart/migration, skipping",
+				"delta", delta, "timestamp", curr.Timestamp)
+			continue
+		}
+		timePrev, _ := time.Parse(time.RFC3339, prev.Timestamp)
+		timeCurr, _ := time.Parse(time.RFC3339, curr.Timestamp)
+		if !timeCurr.After(timePrev) {
+			continue
+		}
+		total += delta
+	}
+	return total, resets
+}
+
+// CalculateMemoryUsage summarizes memory.usage against the memory size; day
+// buckets are keyed in loc (nil: UTC). Each sample's percentage uses the
+// memory size in effect at its time, so a flavor resize mid-period doesn't
+// skew the days before it; TotalMemoryMB is the latest size. Both measure
+// lists are in time order, as Gnocchi returns them.
+func CalculateMemoryUsage(usageMeasures, totalMeasures []MetricMeasure, loc *time.Location) MemoryUsageStats {
 	if len(usageMeasures) == 0 || len(totalMeasures) == 0 {
-		return MemoryUsageStats{}
+		return emptyMemoryUsageStats()
 	}
 
 	var usedMBs []float64
 	var percentages []float64
 	dailyUsageMap := make(map[string]*DailyMemUsage)
+	dailyCounts := make(map[string]int) // samples per day, for the daily averages
 
-	totalMemoryMB := totalMeasures[0].Value
+	totalMemoryMB := totalMeasures[len(totalMeasures)-1].Value
 
-	for i, usageMeasure := range usageMeasures {
+	next := 0 // first total measure later than the current sample
+	for _, usageMeasure := range usageMeasures {
 		usedMB := usageMeasure.Value
 		usedMBs = append(usedMBs, usedMB)
 
-		percent := (usedMB / totalMemoryMB) * 100
+		t, _ := time.Parse(time.RFC3339, usageMeasure.Timestamp)
+		for next < len(totalMeasures) && !measureAfter(totalMeasures[next], t) {
+			next++
+		}
+		// Samples before the first total measure use the earliest size
+		sizeMB := totalMeasures[0].Value
+		if next > 0 {
+			sizeMB = totalMeasures[next-1].Value
+		}
+
+		percent := (usedMB / sizeMB) * 100
 		percentages = append(percentages, percent)
 
 		// Aggregate by day
-		t, _ := time.Parse(time.RFC3339, usageMeasure.Timestamp)
-		dateKey := t.Format("2006-01-02")
+		dateKey := inZone(t, loc).Format("2006-01-02")
 
 		if _, exists := dailyUsageMap[dateKey]; !exists {
 			dailyUsageMap[dateKey] = &DailyMemUsage{
@@ -296,26 +775,15 @@ func CalculateMemoryUsage(usageMeasures, totalMeasures []MetricMeasure) MemoryUs
 		daily := dailyUsageMap[dateKey]
 		daily.AverageUsedMB += usedMB
 		daily.AveragePercent += percent
-
-		// Simple counter for averaging
-		if i == len(usageMeasures)-1 ||
-			(i+1 < len(usageMeasures) &&
-				usageMeasures[i+1].Timestamp[:10] != dateKey) {
-			// End of day, calculate average
-			// This is simplified - in production you'd track counts properly
-		}
-	}
-
-	// Convert daily map to slice
-	var dailyUsages []DailyMemUsage
-	dataPointsPerDay := len(usageMeasures) / len(dailyUsageMap)
-	if dataPointsPerDay == 0 {
-		dataPointsPerDay = 1
+		dailyCounts[dateKey]++
 	}
 
-	for _, daily := range dailyUsageMap {
-		daily.AverageUsedMB = daily.AverageUsedMB / float64(dataPointsPerDay)
-		daily.AveragePercent = daily.AveragePercent / float64(dataPointsPerDay)
+	// Convert daily map to slice, each day averaged over its own samples
+	dailyUsages := []DailyMemUsage{}
+	for dateKey, daily := range dailyUsageMap {
+		count := float64(dailyCounts[dateKey])
+		daily.AverageUsedMB = daily.AverageUsedMB / count
+		daily.AveragePercent = daily.AveragePercent / count
 		dailyUsages = append(dailyUsages, *daily)
 	}
 
@@ -338,6 +806,12 @@ func CalculateMemoryUsage(usageMeasures, totalMeasures []MetricMeasure) MemoryUs
 	return stats
 }
 
+// measureAfter reports whether measure m was taken after t.
+func measureAfter(m MetricMeasure, t time.Time) bool {
+	mt, err := time.Parse(time.RFC3339, m.Timestamp)
+	return err == nil && mt.After(t)
+}
+
 // Helper functions
 func average(values []float64) float64 {
 	if len(values) == 0 {
@@ -376,24 +850,23 @@ func min(values []float64) float64 {
 	return minVal
 }
 
-func median(values []float64) float64 {
-	if len(values) == 0 {
-		return 0
-	}
-
-	// Simple median calculation (should sort in production)
+// sortedCopy returns an ascending copy of values; values is left untouched.
+func sortedCopy(values []float64) []float64 {
 	sorted := make([]float64, len(values))
 	copy(sorted, values)
+	sort.Float64s(sorted)
+	return sorted
+}
 
-	// Bubble sort (use proper sort in production)
-	for i := 0; i < len(sorted); i++ {
-		for j := i + 1; j < len(sorted); j++ {
-			if sorted[i] > sorted[j] {
-				sorted[i], sorted[j] = sorted[j], sorted[i]
-			}
-		}
-	}
+func median(values []float64) float64 {
+	return medianSorted(sortedCopy(values))
+}
 
+// medianSorted is median of already sorted values.
+func medianSorted(sorted []float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
 	mid := len(sorted) / 2
 	if len(sorted)%2 == 0 {
 		return (sorted[mid-1] + sorted[mid]) / 2
@@ -401,26 +874,63 @@ func median(values []float64) float64 {
 	return sorted[mid]
 }
 
-func percentile(values []float64, p float64) float64 {
-	if len(values) == 0 {
-		return 0
-	}
-
-	sorted := make([]float64, len(values))
-	copy(sorted, values)
+// maxPercentiles bounds the values of one ?percentiles= parameter.
+const maxPercentiles = 20
 
-	// Bubble sort
-	for i := 0; i < len(sorted); i++ {
-		for j := i + 1; j < len(sorted); j++ {
-			if sorted[i] > sorted[j] {
-				sorted[i], sorted[j] = sorted[j], sorted[i]
-			}
+// parsePercentiles parses a comma-separated list of percentiles (0-100), e.g.
+// "50,90,95,99".
+func parsePercentiles(s string) ([]float64, error) {
+	var ps []float64
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(part, 64)
+		if err != nil || math.IsNaN(p) || p < 0 || p > 100 {
+			return nil, fmt.Errorf("%s is not a number between 0 and 100", part)
 		}
+		ps = append(ps, p)
+	}
+	if len(ps) > maxPercentiles {
+		return nil, fmt.Errorf("at most %d percentiles", maxPercentiles)
+	}
+	return ps, nil
+}
+
+// CPUPercentiles returns the requested percentiles of the valid CPU data
+// points (the cpu_percent of UsageByHour), keyed "p" + the percentile.
+func CPUPercentiles(usage CPUUsageStats, ps []float64) map[string]float64 {
+	values := make([]float64, len(usage.UsageByHour))
+	for i, h := range usage.UsageByHour {
+		values[i] = h.CPUPercent
+	}
+	sort.Float64s(values)
+	result := make(map[string]float64, len(ps))
+	for _, p := range ps {
+		result["p"+strconv.FormatFloat(p, 'f', -1, 64)] = percentileSorted(values, p)
 	}
+	return result
+}
+
+// percentile returns the p-th percentile (0-100) with linear interpolation
+// between the closest ranks, numpy's default "linear" method (and Grafana's).
+func percentile(values []float64, p float64) float64 {
+	return percentileSorted(sortedCopy(values), p)
+}
 
-	index := int(float64(len(sorted)) * p / 100.0)
-	if index >= len(sorted) {
-		index = len(sorted) - 1
+// percentileSorted is percentile of already sorted values.
+func percentileSorted(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	if p <= 0 {
+		return sorted[0]
+	}
+	if p >= 100 {
+		return sorted[len(sorted)-1]
 	}
-	return sorted[index]
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
 }
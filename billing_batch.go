@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchInstances bounds the instance_ids of one POST /billing/report/batch call.
+const maxBatchInstances = 500
+
+// billingBatchRequest is the body of POST /api/v1/billing/report/batch.
+// Omitted prices default like the price parameters of the single report
+// (PRICING_TIERS_FILE included), omitted dates to last month.
+type billingBatchRequest struct {
+	InstanceIDs         []string `json:"instance_ids"`
+	StartDate           string   `json:"start_date"`
+	EndDate             string   `json:"end_date"`
+	CPUPricePerHour     *float64 `json:"cpu_price_per_hour"`
+	MemoryPricePerGB    *float64 `json:"memory_price_per_gb"`
+	DiskPricePerGBMonth *float64 `json:"disk_price_per_gb_month"`
+	IOPricePerGB        *float64 `json:"io_price_per_gb"`
+	NetworkPricePerGB   *float64 `json:"network_price_per_gb"`
+}
+
+// pricing returns how the reports of the batch are priced; like
+// reportPricingFromQuery, PRICING_TIERS_FILE applies unless the request gives
+// its own CPU, memory or disk price.
+func (req billingBatchRequest) pricing(expr *PricingExpr) ReportPricing {
+	pricing := ReportPricing{Expr: expr}
+	if req.DiskPricePerGBMonth != nil {
+		pricing.DiskPricePerGBMonth = *req.DiskPricePerGBMonth
+	}
+	if req.IOPricePerGB != nil {
+		pricing.IOPricePerGB = *req.IOPricePerGB
+	}
+	if req.NetworkPricePerGB != nil {
+		pricing.NetworkPricePerGB = *req.NetworkPricePerGB
+	}
+	if req.CPUPricePerHour == nil && req.MemoryPricePerGB == nil && req.DiskPricePerGBMonth == nil {
+		pricing.Tiers = fileConfigs.get().tiers
+	}
+	return pricing
+}
+
+// BillingBatchResponse holds the reports of the instances that could be
+// billed, in request order, and an error per instance that could not.
+type BillingBatchResponse struct {
+	StartDate string          `json:"start_date"`
+	EndDate   string          `json:"end_date"`
+	Reports   []BillingReport `json:"reports"`
+	Errors    []UsageError    `json:"errors"`
+}
+
+// billingBatchConcurrency returns how many instances of a batch are billed in
+// parallel (BILLING_BATCH_CONCURRENCY, default 10).
+func billingBatchConcurrency() int {
+	if v, err := strconv.Atoi(getEnv("BILLING_BATCH_CONCURRENCY", "")); err == nil && v > 0 {
+		return v
+	}
+	return 10
+}
+
+// parseBillingBatchRequest decodes and validates the request body. Instance
+// IDs are trimmed and de-duplicated, keeping their order.
+func parseBillingBatchRequest(r *http.Request) (billingBatchRequest, error) {
+	var req billingBatchRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	if err := dec.Decode(&req); err != nil {
+		return req, fmt.Errorf("invalid JSON body: %v", err)
+	}
+
+	seen := make(map[string]bool, len(req.InstanceIDs))
+	ids := make([]string, 0, len(req.InstanceIDs))
+	for _, id := range req.InstanceIDs {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return req, fmt.Errorf("instance_ids is required")
+	}
+	if len(ids) > maxBatchInstances {
+		return req, fmt.Errorf("at most %d instance_ids per request", maxBatchInstances)
+	}
+	req.InstanceIDs = ids
+
+	if (req.StartDate == "") != (req.EndDate == "") {
+		return req, fmt.Errorf("start_date and end_date must be given together")
+	}
+	if req.StartDate == "" {
+		now := time.Now()
+		req.StartDate = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02T15:04:05")
+		req.EndDate = time.Date(now.Year(), now.Month(), 0, 23, 59, 59, 0, time.UTC).Format("2006-01-02T15:04:05")
+	}
+	start, err := time.Parse("2006-01-02T15:04:05", req.StartDate)
+	if err != nil {
+		return req, fmt.Errorf("invalid start_date (use 2006-01-02T15:04:05)")
+	}
+	end, err := time.Parse("2006-01-02T15:04:05", req.EndDate)
+	if err != nil {
+		return req, fmt.Errorf("invalid end_date (use 2006-01-02T15:04:05)")
+	}
+	if !end.After(start) {
+		return req, fmt.Errorf("end_date must be after start_date")
+	}
+
+	for _, p := range []*float64{req.CPUPricePerHour, req.MemoryPricePerGB, req.DiskPricePerGBMonth, req.IOPricePerGB, req.NetworkPricePerGB} {
+		if p != nil && *p < 0 {
+			return req, fmt.Errorf("prices must not be negative")
+		}
+	}
+	return req, nil
+}
+
+// POST /api/v1/billing/report/batch
+// {"instance_ids": ["..."], "start_date": "", "end_date": "", "cpu_price_per_hour": 0.05, "memory_price_per_gb": 0.01,
+// "disk_price_per_gb_month": 0, "io_price_per_gb": 0, "network_price_per_gb": 0}
+//
+// Bills many instances of the cluster in one call, each like
+// /billing/report/{instance_id} without adjustments (cached, then priced by
+// PriceReport with the body's prices and ?pricing_expr or the default). An instance that cannot be billed is
+// listed in errors instead of failing the batch.
+func postBillingReportBatch(w http.ResponseWriter, r *http.Request) {
+	req, err := parseBillingBatchRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+	cpuPricePerHour, memoryPricePerGB := 0.05, 0.01
+	if req.CPUPricePerHour != nil {
+		cpuPricePerHour = *req.CPUPricePerHour
+	}
+	if req.MemoryPricePerGB != nil {
+		memoryPricePerGB = *req.MemoryPricePerGB
+	}
+
+	expr, err := pricingExprFromRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid pricing_expr: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+	pricing := req.pricing(expr)
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	noCache, ok := parseMeasuresCache(w, r)
+	if !ok {
+		return
+	}
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := r.Context()
+	client := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(ctx, "GNOCCHI_URL", ""),
+		Token:    clusterEnv(ctx, "GNOCCHI_TOKEN", ""),
+		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
+		NoCache:  noCache,
+	})
+	allowed, restricted := tokenProjects(tokenLabel(r))
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, billingBatchConcurrency())
+		reports = make([]*BillingReport, len(req.InstanceIDs))
+		errs    = make([]*UsageError, len(req.InstanceIDs))
+	)
+	for i, instanceID := range req.InstanceIDs {
+		wg.Add(1)
+		go func(i int, instanceID string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			fail := func(err error) {
+				errs[i] = &UsageError{InstanceID: instanceID, Error: err.Error()}
+			}
+			if ctx.Err() != nil {
+				fail(fmt.Errorf("request cancelled: %v", ctx.Err()))
+				return
+			}
+
+			// Restricted tokens only get instances of their own projects
+			if restricted {
+				instance, err := getInstanceResource(ctx, client, instanceID, policy)
+				if err != nil {
+					fail(err)
+					return
+				}
+				if !allowed[instance.ProjectID] {
+					fail(errors.New("instance is not in a project allowed for this token"))
+					return
+				}
+			}
+
+			report, _, err := loadBillingReport(ctx, client, instanceID, req.StartDate, req.EndDate,
+				cpuPricePerHour, memoryPricePerGB, policy, nil, false)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if err := PriceReport(&report, pricing, nil); err != nil {
+				fail(err)
+				return
+			}
+			reports[i] = &report
+		}(i, instanceID)
+	}
+	wg.Wait()
+
+	response := BillingBatchResponse{
+		StartDate: req.StartDate,
+		EndDate:   req.EndDate,
+		Reports:   make([]BillingReport, 0, len(reports)),
+		Errors:    []UsageError{},
+	}
+	for i := range req.InstanceIDs {
+		if reports[i] != nil {
+			response.Reports = append(response.Reports, *reports[i])
+		} else if errs[i] != nil {
+			response.Errors = append(response.Errors, *errs[i])
+		}
+	}
+	if len(response.Errors) > 0 {
+		slog.WarnContext(ctx, "Some instances of the billing batch failed",
+			"instances", len(req.InstanceIDs), "failed", len(response.Errors))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BillingDelta is one component of a period comparison. ChangePercent is
+// relative to period A and null when period A is zero.
+type BillingDelta struct {
+	PeriodA       float64  `json:"period_a"`
+	PeriodB       float64  `json:"period_b"`
+	Change        float64  `json:"change"`
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+func newBillingDelta(a, b float64) BillingDelta {
+	d := BillingDelta{PeriodA: a, PeriodB: b, Change: b - a}
+	if a != 0 {
+		pct := (b - a) / a * 100
+		d.ChangePercent = &pct
+	}
+	return d
+}
+
+// BillingComparison is the response of GET /api/v1/billing/compare/{instance_id}.
+type BillingComparison struct {
+	InstanceID   string                  `json:"instance_id"`
+	InstanceName string                  `json:"instance_name"`
+	Currency     string                  `json:"currency"`
+	PeriodA      BillingPeriod           `json:"period_a"`
+	PeriodB      BillingPeriod           `json:"period_b"`
+	Deltas       map[string]BillingDelta `json:"deltas"` // cpu_cost, memory_cost, usage_cost, cpu_hours, avg_cpu_percent
+	GeneratedAt  string                  `json:"generated_at"`
+}
+
+// BillingPeriod is one side of a comparison (usage cost, before adjustments).
+type BillingPeriod struct {
+	StartDate string        `json:"start_date"`
+	EndDate   string        `json:"end_date"`
+	Coverage  *DataCoverage `json:"coverage,omitempty"`
+}
+
+// compareBillingReports builds the per-component deltas from period A to B.
+func compareBillingReports(a, b BillingReport) BillingComparison {
+	cpuHours := func(r BillingReport) float64 {
+		return CalculateCPUBilling(r.CPUUsage, r.StartDate, r.EndDate).TotalCPUHours
+	}
+	return BillingComparison{
+		InstanceID:   b.InstanceID,
+		InstanceName: b.InstanceName,
+		Currency:     b.Currency,
+		PeriodA:      BillingPeriod{StartDate: a.StartDate, EndDate: a.EndDate, Coverage: a.Coverage},
+		PeriodB:      BillingPeriod{StartDate: b.StartDate, EndDate: b.EndDate, Coverage: b.Coverage},
+		Deltas: map[string]BillingDelta{
+			"cpu_cost":        newBillingDelta(a.CPUCost, b.CPUCost),
+			"memory_cost":     newBillingDelta(a.MemoryCost, b.MemoryCost),
+			"usage_cost":      newBillingDelta(a.CPUCost+a.MemoryCost, b.CPUCost+b.MemoryCost),
+			"cpu_hours":       newBillingDelta(cpuHours(a), cpuHours(b)),
+			"avg_cpu_percent": newBillingDelta(a.CPUUsage.AveragePercent, b.CPUUsage.AveragePercent),
+		},
+		GeneratedAt: time.Now().Format(time.RFC3339),
+	}
+}
+
+// parseBillingPeriod reads <prefix>_start and <prefix>_end (2006-01-02T15:04:05).
+func parseBillingPeriod(r *http.Request, prefix string) (string, string, error) {
+	start := r.URL.Query().Get(prefix + "_start")
+	end := r.URL.Query().Get(prefix + "_end")
+	if start == "" || end == "" {
+		return "", "", fmt.Errorf("%s_start and %s_end are required", prefix, prefix)
+	}
+	startTime, err := time.Parse("2006-01-02T15:04:05", start)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid %s_start (use 2006-01-02T15:04:05)", prefix)
+	}
+	endTime, err := time.Parse("2006-01-02T15:04:05", end)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid %s_end (use 2006-01-02T15:04:05)", prefix)
+	}
+	if !endTime.After(startTime) {
+		return "", "", fmt.Errorf("%s_end must be after %s_start", prefix, prefix)
+	}
+	return start, end, nil
+}
+
+// GET /api/v1/billing/compare/{instance_id}?period_a_start=&period_a_end=&period_b_start=&period_b_end=
+func getBillingComparison(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+
+	startA, endA, err := parseBillingPeriod(r, "period_a")
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+	startB, endB, err := parseBillingPeriod(r, "period_b")
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	cpuPricePerHour := parseFloat(r.URL.Query().Get("cpu_price_per_hour"), 0.05)
+	memoryPricePerGB := parseFloat(r.URL.Query().Get("memory_price_per_gb"), 0.01)
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	noCache, ok := parseMeasuresCache(w, r)
+	if !ok {
+		return
+	}
+
+	client := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    clusterEnv(r.Context(), "GNOCCHI_TOKEN", ""),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+		NoCache:  noCache,
+	})
+	if !allowInstance(w, r, client, instanceID) {
+		return
+	}
+
+	// Kedua periode dihitung bersamaan
+	var (
+		wg               sync.WaitGroup
+		reportA, reportB BillingReport
+		errA, errB       error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		reportA, _, errA = loadBillingReport(r.Context(), client, instanceID, startA, endA, cpuPricePerHour, memoryPricePerGB, policy, nil, false)
+	}()
+	go func() {
+		defer wg.Done()
+		reportB, _, errB = loadBillingReport(r.Context(), client, instanceID, startB, endB, cpuPricePerHour, memoryPricePerGB, policy, nil, false)
+	}()
+	wg.Wait()
+
+	for _, err := range []error{errA, errB} {
+		if errors.Is(err, errInstanceNotFound) {
+			writeInstanceError(w, err)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Billing comparison failed", "instance_id", instanceID, "error", err)
+			http.Error(w, fmt.Sprintf(`{"error":"failed to get instance: %v"}`, err), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, compareBillingReports(reportA, reportB))
+}
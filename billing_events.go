@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Billing events are published best-effort to BILLING_EVENT_SINK for the
+// event-driven billing pipeline. Publishing never fails or slows a request:
+// events are queued and sent by one background worker; failures are logged
+// and counted in vhi_billing_events_total.
+
+// Event types.
+const (
+	billingEventReportGenerated      = "billing.report.generated"       // payload: InvoiceLineItem
+	billingEventPeriodClosed         = "billing.period.closed"          // payload: billingPeriodClosed
+	billingEventReportDeliveryFailed = "billing.report.delivery_failed" // payload: monthlyReportFailure
+)
+
+// BillingEvent is the envelope of every published event.
+type BillingEvent struct {
+	ID            string      `json:"id"`
+	Type          string      `json:"type"`
+	SchemaVersion string      `json:"schema_version"` // invoice schema version of the payload
+	Time          string      `json:"time"`
+	Payload       interface{} `json:"payload"`
+}
+
+// billingPeriodClosed is the payload of billing.period.closed (a finished
+// cluster billing job): the invoice summary plus one line item per instance.
+type billingPeriodClosed struct {
+	JobID     string            `json:"job_id"`
+	Summary   InvoiceSummary    `json:"summary"`
+	LineItems []InvoiceLineItem `json:"line_items"`
+}
+
+// Publisher delivers billing events to a broker.
+type Publisher interface {
+	Publish(ctx context.Context, event BillingEvent) error
+	Close() error
+}
+
+// noopPublisher drops events (BILLING_EVENT_SINK not set).
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(context.Context, BillingEvent) error { return nil }
+func (noopPublisher) Close() error                                { return nil }
+
+// httpPublisher POSTs each event as JSON, e.g. to a Kafka REST proxy topic or
+// an AMQP HTTP bridge. BILLING_EVENT_SINK_TOKEN is sent as a bearer token.
+type httpPublisher struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (p *httpPublisher) Publish(ctx context.Context, event BillingEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // keep the connection reusable
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *httpPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// newPublisher builds the publisher for a BILLING_EVENT_SINK URL: http(s)://,
+// kafka:// or amqp(s):// (billing_events_broker.go).
+func newPublisher(sink string) (Publisher, error) {
+	if sink == "" {
+		return noopPublisher{}, nil
+	}
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BILLING_EVENT_SINK: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpPublisher{
+			url:    sink,
+			token:  getEnv("BILLING_EVENT_SINK_TOKEN", ""),
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "kafka":
+		return newKafkaPublisher(u)
+	case "amqp", "amqps":
+		return newAMQPPublisher(u)
+	}
+	return nil, fmt.Errorf("unsupported BILLING_EVENT_SINK scheme %q", u.Scheme)
+}
+
+// billingEventQueueSize bounds the events waiting for the worker; when the
+// sink is slow or down, newer events are dropped (and counted) instead.
+const billingEventQueueSize = 256
+
+// eventBus queues events for one publishing goroutine.
+type eventBus struct {
+	publisher Publisher
+	queue     chan BillingEvent
+}
+
+// billingEvents is the process-wide bus, created in main after .env is loaded.
+var billingEvents *eventBus
+
+// newEventBusFromEnv reads BILLING_EVENT_SINK. A bad sink is logged and
+// events are dropped, like an unset one.
+func newEventBusFromEnv() *eventBus {
+	sink := getEnv("BILLING_EVENT_SINK", "")
+	publisher, err := newPublisher(sink)
+	if err != nil {
+		slog.Error("Billing events disabled", "error", err)
+		publisher = noopPublisher{}
+	} else if sink != "" {
+		slog.Info("Billing events enabled", "sink", redactURL(sink))
+	}
+
+	bus := &eventBus{publisher: publisher, queue: make(chan BillingEvent, billingEventQueueSize)}
+	if _, noop := publisher.(noopPublisher); !noop {
+		go bus.run()
+	}
+	return bus
+}
+
+func (b *eventBus) run() {
+	for event := range b.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		err := b.publisher.Publish(ctx, event)
+		cancel()
+		if err != nil {
+			slog.Warn("Failed to publish billing event", "service", "event_sink", "event_id", event.ID, "event_type", event.Type, "error", err)
+			countBillingEvent(event.Type, "error")
+			continue
+		}
+		countBillingEvent(event.Type, "published")
+	}
+}
+
+// publish queues an event without blocking. No-op when events are disabled.
+func (b *eventBus) publish(eventType string, payload interface{}) {
+	if b == nil {
+		return
+	}
+	if _, noop := b.publisher.(noopPublisher); noop {
+		return
+	}
+	// Random ID, consumers de-duplicate on it
+	id, err := newBillingJobID()
+	if err != nil {
+		id = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	event := BillingEvent{
+		ID:            id,
+		Type:          eventType,
+		SchemaVersion: invoiceSchemaVersion,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Payload:       payload,
+	}
+	select {
+	case b.queue <- event:
+	default:
+		slog.Warn("Billing event queue full, dropping event", "event_type", eventType)
+		countBillingEvent(eventType, "dropped")
+	}
+}
+
+func countBillingEvent(eventType, result string) {
+	metrics.IncCounter("vhi_billing_events_total",
+		"Billing events by type and result (published, error, dropped).",
+		map[string]string{"type": eventType, "result": result})
+}
+
+// redactURL hides the password of a URL for logging.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
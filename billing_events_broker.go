@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// Native broker sinks, besides the http(s):// bridge:
+//
+//	kafka://[user:pass@]broker1:9092[,broker2:9092]/<topic>[?tls=true]
+//	amqp(s)://user:pass@host:5672/<vhost>[?exchange=amq.topic&routing_key=]
+//
+// Kafka messages are keyed by the event ID, with the event type in the "type"
+// header; user:pass enables SASL/PLAIN. AMQP messages are persistent and
+// published with confirms to exchange (default amq.topic), routed by the
+// event type unless routing_key is set. Both connect on the first event and
+// reconnect after a failure.
+
+// kafkaPublisher writes each event to one Kafka topic.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(u *url.URL) (*kafkaPublisher, error) {
+	var brokers []string
+	for _, b := range strings.Split(u.Host, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	topic := strings.Trim(u.Path, "/")
+	if len(brokers) == 0 || topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("kafka sink must be kafka://broker:9092/<topic>")
+	}
+
+	transport := &kafka.Transport{DialTimeout: 10 * time.Second}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		transport.SASL = plain.Mechanism{Username: u.User.Username(), Password: password}
+	}
+	if u.Query().Get("tls") == "true" {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond, // events are sent one at a time
+		Transport:    transport,
+	}}, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, event BillingEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	return p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(event.ID),
+		Value:   body,
+		Headers: []kafka.Header{{Key: "type", Value: []byte(event.Type)}},
+	})
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// amqpPublisher publishes each event to an AMQP 0-9-1 exchange (RabbitMQ).
+type amqpPublisher struct {
+	url        string // without the exchange/routing_key parameters
+	exchange   string
+	routingKey string // empty: the event type
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+func newAMQPPublisher(u *url.URL) (*amqpPublisher, error) {
+	query := u.Query()
+	exchange := query.Get("exchange")
+	if _, set := query["exchange"]; !set {
+		exchange = "amq.topic"
+	}
+	routingKey := query.Get("routing_key")
+	if exchange == "" && routingKey == "" {
+		return nil, fmt.Errorf("amqp sink on the default exchange needs routing_key (the queue name)")
+	}
+	query.Del("exchange")
+	query.Del("routing_key")
+
+	dial := *u
+	dial.RawQuery = query.Encode()
+	if _, err := amqp.ParseURI(dial.String()); err != nil {
+		return nil, fmt.Errorf("invalid amqp sink: %w", err)
+	}
+	return &amqpPublisher{url: dial.String(), exchange: exchange, routingKey: routingKey}, nil
+}
+
+// channel returns the open confirm-mode channel, dialing when there is none.
+// Called with mu held.
+func (p *amqpPublisher) channel() (*amqp.Channel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+	p.closeLocked()
+
+	conn, err := amqp.DialConfig(p.url, amqp.Config{Dial: amqp.DefaultDial(10 * time.Second)})
+	if err != nil {
+		return nil, fmt.Errorf("amqp dial: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("amqp channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("amqp confirm mode: %w", err)
+	}
+	p.conn, p.ch = conn, ch
+	return ch, nil
+}
+
+func (p *amqpPublisher) Publish(ctx context.Context, event BillingEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	routingKey := p.routingKey
+	if routingKey == "" {
+		routingKey = event.Type
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, err := p.channel()
+	if err != nil {
+		return err
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, p.exchange, routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    event.ID,
+		Type:         event.Type,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		p.closeLocked() // reconnect on the next event
+		return fmt.Errorf("amqp publish: %w", err)
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		p.closeLocked()
+		return fmt.Errorf("amqp confirm: %w", err)
+	}
+	if !acked {
+		return errors.New("amqp broker nacked the event")
+	}
+	return nil
+}
+
+// closeLocked drops the connection. Called with mu held.
+func (p *amqpPublisher) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.ch = nil, nil
+}
+
+func (p *amqpPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked()
+	return nil
+}
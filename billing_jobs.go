@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+// Cluster billing runs one billing report per instance and can take longer than
+// client/proxy timeouts, so it runs as a background job. Job state and result
+// live in Redis (<prefix>billing_job:<id> and <prefix>billing_job:<id>:result),
+// so any replica can answer the status request.
+
+const billingJobKeyPrefix = "billing_job:"
+
+// Billing job states.
+const (
+	billingJobPending = "pending"
+	billingJobRunning = "running"
+	billingJobDone    = "done"
+	billingJobFailed  = "failed"
+)
+
+// BillingJobProgress counts the instances billed so far.
+type BillingJobProgress struct {
+	Processed int `json:"processed"`
+	Total     int `json:"total"`
+}
+
+// BillingJob is the state of a cluster billing job.
+type BillingJob struct {
+	ID                  string             `json:"id"`
+	Cluster             string             `json:"cluster"`
+	Status              string             `json:"status"` // pending, running, done, failed
+	StartDate           string             `json:"start_date"`
+	EndDate             string             `json:"end_date"`
+	CPUPricePerHour     float64            `json:"cpu_price_per_hour"`
+	MemoryPricePerGB    float64            `json:"memory_price_per_gb_hour"`
+	DiskPricePerGBMonth float64            `json:"disk_price_per_gb_month"`
+	IOPricePerGB        float64            `json:"io_price_per_gb"`
+	NetworkPricePerGB   float64            `json:"network_price_per_gb"`
+	PricingTiers        bool               `json:"pricing_tiers"`          // PRICING_TIERS_FILE, as loaded when the job runs
+	PricingExpr         string             `json:"pricing_expr,omitempty"` // replaces the built-in cost formula
+	CreatedAt           string             `json:"created_at"`
+	StartedAt           string             `json:"started_at,omitempty"`
+	FinishedAt          string             `json:"finished_at,omitempty"`
+	Progress            BillingJobProgress `json:"progress"`
+	Error               string             `json:"error,omitempty"`
+	ResultURL           string             `json:"result_url,omitempty"` // set once done
+}
+
+// ClusterBillingResult is the output of a finished job.
+type ClusterBillingResult struct {
+	JobID         string          `json:"job_id"`
+	StartDate     string          `json:"start_date"`
+	EndDate       string          `json:"end_date"`
+	GeneratedAt   string          `json:"generated_at"`
+	Currency      string          `json:"currency"`
+	InstanceCount int             `json:"instance_count"`
+	TotalCost     float64         `json:"total_cost"`
+	Reports       []BillingReport `json:"reports"`
+}
+
+// billingJobTTL returns how long job state and results are kept
+// (BILLING_JOB_TTL_HOURS, default 24).
+func billingJobTTL() time.Duration {
+	if v, err := strconv.Atoi(getEnv("BILLING_JOB_TTL_HOURS", "")); err == nil && v > 0 {
+		return time.Duration(v) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// billingJobConcurrency returns how many instances are billed in parallel
+// (BILLING_JOB_CONCURRENCY, default 4), shared fairly across projects.
+func billingJobConcurrency() int {
+	if v, err := strconv.Atoi(getEnv("BILLING_JOB_CONCURRENCY", "")); err == nil && v > 0 {
+		return v
+	}
+	return 4
+}
+
+func newBillingJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// saveBillingJob writes the job state to Redis.
+func saveBillingJob(job *BillingJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return redisClient.Set(ctx, redisKey(billingJobKeyPrefix+job.ID), data, billingJobTTL()).Err()
+}
+
+// loadBillingJob reads the job state (suffix "") or its result (suffix ":result")
+// from Redis; ok is false when it doesn't exist or expired.
+func loadBillingJob(id string, dest interface{}, suffix string) (ok bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	data, err := redisGet(ctx, billingJobKeyPrefix+id+suffix)
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, dest)
+}
+
+// runBillingJob bills every instance that existed during the period and stores the result.
+func runBillingJob(job *BillingJob) {
+	update := func() {
+		if err := saveBillingJob(job); err != nil {
+			slog.Warn("Failed to save billing job", "job_id", job.ID, "error", err)
+		}
+	}
+	fail := func(err error) {
+		slog.Error("Billing job failed", "job_id", job.ID, "cluster", job.Cluster, "error", err)
+		job.Status = billingJobFailed
+		job.Error = err.Error()
+		job.FinishedAt = time.Now().Format(time.RFC3339)
+		update()
+	}
+	// A panic fails the job rather than the process (and leaving the job
+	// "running" until its state expires).
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("Billing job panicked", "job_id", job.ID, "panic", p, "stack", string(debug.Stack()))
+			fail(fmt.Errorf("internal error: %v", p))
+		}
+	}()
+
+	job.Status = billingJobRunning
+	job.StartedAt = time.Now().Format(time.RFC3339)
+	update()
+
+	pricing := ReportPricing{
+		DiskPricePerGBMonth: job.DiskPricePerGBMonth,
+		IOPricePerGB:        job.IOPricePerGB,
+		NetworkPricePerGB:   job.NetworkPricePerGB,
+	}
+	if job.PricingTiers {
+		pricing.Tiers = fileConfigs.get().tiers
+	}
+	if job.PricingExpr != "" {
+		var err error
+		if pricing.Expr, err = ParsePricingExpr(job.PricingExpr); err != nil {
+			fail(fmt.Errorf("invalid pricing expression: %w", err))
+			return
+		}
+	}
+
+	cluster := findCluster(job.Cluster)
+	if cluster == nil {
+		fail(fmt.Errorf("cluster %q is not configured", job.Cluster))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCluster(context.Background(), cluster), 2*time.Minute)
+	adminToken, err := GetAdminToken(ctx)
+	cancel()
+	if err != nil {
+		fail(fmt.Errorf("failed to authenticate admin: %w", err))
+		return
+	}
+
+	client := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  cluster.env("GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+	})
+	instances, err := client.GetAllInstances()
+	if err != nil {
+		fail(fmt.Errorf("Gnocchi instances failed: %w", err))
+		return
+	}
+	instances = instancesActiveSince(instances, job.StartDate)
+
+	job.Progress.Total = len(instances)
+	update()
+
+	lastUpdate := time.Now()
+	reports, err := billInstances(client, instances, job.StartDate, job.EndDate,
+		job.CPUPricePerHour, job.MemoryPricePerGB, pricing, func(processed int) {
+			job.Progress.Processed = processed
+			// Progress is written at most once a second
+			if time.Since(lastUpdate) >= time.Second {
+				lastUpdate = time.Now()
+				update()
+			}
+		})
+	if err != nil {
+		// Rather no result than one billed partly with the built-in formula
+		fail(err)
+		return
+	}
+
+	result := ClusterBillingResult{
+		JobID:         job.ID,
+		StartDate:     job.StartDate,
+		EndDate:       job.EndDate,
+		GeneratedAt:   time.Now().Format(time.RFC3339),
+		Currency:      "USD",
+		InstanceCount: len(reports),
+		Reports:       reports,
+	}
+	for _, r := range reports {
+		result.TotalCost += r.TotalCost
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		fail(fmt.Errorf("failed to encode result: %w", err))
+		return
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = redisClient.Set(ctx, redisKey(billingJobKeyPrefix+job.ID+":result"), data, billingJobTTL()).Err()
+	cancel()
+	if err != nil {
+		fail(fmt.Errorf("failed to store result: %w", err))
+		return
+	}
+
+	job.Status = billingJobDone
+	job.FinishedAt = time.Now().Format(time.RFC3339)
+	job.ResultURL = "/api/v1/billing/cluster/jobs/" + job.ID + "/result"
+	update()
+	slog.Info("Billing job done", "job_id", job.ID, "cluster", job.Cluster, "instances", len(reports),
+		"total_cost", result.TotalCost, "currency", result.Currency)
+
+	closed := billingPeriodClosed{
+		JobID: job.ID,
+		Summary: InvoiceSummary{
+			SchemaVersion: invoiceSchemaVersion,
+			RecordType:    "summary",
+			PeriodStart:   invoicePeriod(job.StartDate),
+			PeriodEnd:     invoicePeriod(job.EndDate),
+			Currency:      result.Currency,
+			GeneratedAt:   time.Now().UTC().Format(time.RFC3339),
+		},
+		LineItems: make([]InvoiceLineItem, 0, len(reports)),
+	}
+	for _, r := range reports {
+		item := newInvoiceLineItem(r)
+		closed.LineItems = append(closed.LineItems, item)
+		closed.Summary.LineItems++
+		closed.Summary.UsageCost += item.UsageCost
+		closed.Summary.AdjustmentsTotal += item.AdjustmentsTotal
+		closed.Summary.TotalCost += item.TotalCost
+	}
+	billingEvents.publish(billingEventPeriodClosed, closed)
+
+	if exporter != nil {
+		projectOf := make(map[string]string, len(instances))
+		for _, inst := range instances {
+			projectOf[inst.ID] = inst.ProjectID
+		}
+		exporter.exportBillingResult(cluster, result, projectOf, adminToken)
+	}
+}
+
+// billInstances bills every instance in parallel (BILLING_JOB_CONCURRENCY
+// workers, shared fairly across projects) and returns the reports in the order
+// of instances. progress, if set, is called serialized after each instance with
+// the number billed so far. The error is the first failed measures fetch,
+// pricing expression failure or panic of an instance. Reports are priced by
+// PriceReport, without adjustments.
+func billInstances(client *GnocchiClient, instances []GnocchiInstance, startDate, endDate string,
+	cpuPricePerHour, memoryPricePerGB float64, pricing ReportPricing, progress func(processed int)) ([]BillingReport, error) {
+	var (
+		mu        sync.Mutex
+		reports   = make([]BillingReport, len(instances))
+		processed int
+		tasks     = make(map[string][]func())
+		billErr   error
+	)
+	for i, inst := range instances {
+		i, inst := i, inst
+		tasks[inst.ProjectID] = append(tasks[inst.ProjectID], func() {
+			// Workers run outside the caller's goroutine, so its recover doesn't see this
+			defer func() {
+				if p := recover(); p != nil {
+					slog.Error("Billing an instance panicked", "instance_id", inst.ID, "panic", p, "stack", string(debug.Stack()))
+					mu.Lock()
+					defer mu.Unlock()
+					if billErr == nil {
+						billErr = fmt.Errorf("instance %s: internal error: %v", inst.ID, p)
+					}
+				}
+			}()
+			report, err := buildBillingReport(client, inst.ID, inst.DisplayName, inst.FlavorName, inst.Metrics,
+				inst.StartedAt, inst.EndedAt, startDate, endDate, cpuPricePerHour, memoryPricePerGB, nil, false)
+			if err == nil {
+				err = PriceReport(&report, pricing, nil)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && billErr == nil {
+				billErr = fmt.Errorf("instance %s: %w", inst.ID, err)
+			}
+			reports[i] = report
+			processed++
+			if progress != nil {
+				progress(processed)
+			}
+		})
+	}
+	workers := billingJobConcurrency()
+	runFair(workers, projectConcurrency(), tasks)
+	if billErr != nil {
+		return nil, billErr
+	}
+	return reports, nil
+}
+
+// instancesActiveSince drops instances deleted before the period start.
+// Instances with an unparseable ended_at are kept.
+func instancesActiveSince(instances []GnocchiInstance, startDate string) []GnocchiInstance {
+	start, err := time.Parse("2006-01-02T15:04:05", startDate)
+	if err != nil {
+		return instances
+	}
+	active := make([]GnocchiInstance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.EndedAt != nil {
+			if ended, err := time.Parse(time.RFC3339, *inst.EndedAt); err == nil && ended.Before(start) {
+				continue
+			}
+		}
+		active = append(active, inst)
+	}
+	return active
+}
+
+// POST /api/v1/billing/cluster/jobs?start_date=...&end_date=...&cpu_price_per_hour=...&memory_price_per_gb=...
+// Optional ?disk_price_per_gb_month=, ?io_price_per_gb=, ?network_price_per_gb=
+// and ?pricing_expr= (default PRICING_EXPR), priced like /billing/report.
+func createClusterBillingJob(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if !cacheEnabled() {
+		http.Error(w, `{"error":"billing jobs require Redis (REDIS_HOST), which is not configured or unreachable"}`, http.StatusServiceUnavailable)
+		return
+	}
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	startDate := r.URL.Query().Get("start_date")
+	endDate := r.URL.Query().Get("end_date")
+	if startDate == "" || endDate == "" {
+		// Previous calendar month, like /billing/report
+		now := time.Now()
+		startDate = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02T15:04:05")
+		endDate = time.Date(now.Year(), now.Month(), 0, 23, 59, 59, 0, time.UTC).Format("2006-01-02T15:04:05")
+	}
+
+	expr, err := pricingExprFromRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid pricing_expr: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+	pricing := reportPricingFromQuery(r.URL.Query(), expr)
+
+	id, err := newBillingJobID()
+	if err != nil {
+		http.Error(w, `{"error":"failed to create job ID"}`, http.StatusInternalServerError)
+		return
+	}
+	job := &BillingJob{
+		ID:                  id,
+		Cluster:             clusterOf(r.Context()).Name,
+		Status:              billingJobPending,
+		StartDate:           startDate,
+		EndDate:             endDate,
+		CPUPricePerHour:     parseFloat(r.URL.Query().Get("cpu_price_per_hour"), 0.05),
+		MemoryPricePerGB:    parseFloat(r.URL.Query().Get("memory_price_per_gb"), 0.01),
+		DiskPricePerGBMonth: pricing.DiskPricePerGBMonth,
+		IOPricePerGB:        pricing.IOPricePerGB,
+		NetworkPricePerGB:   pricing.NetworkPricePerGB,
+		PricingTiers:        pricing.Tiers != nil,
+		CreatedAt:           time.Now().Format(time.RFC3339),
+	}
+	if expr != nil {
+		job.PricingExpr = expr.String()
+	}
+	if err := saveBillingJob(job); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save billing job", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to save job: %v"}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Billing job created", "job_id", job.ID, "cluster", job.Cluster,
+		"start_date", startDate, "end_date", endDate)
+	go runBillingJob(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/billing/cluster/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, job)
+}
+
+// GET /api/v1/billing/cluster/jobs/{id}
+func getClusterBillingJob(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if !cacheEnabled() {
+		http.Error(w, `{"error":"billing jobs require Redis (REDIS_HOST), which is not configured or unreachable"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	var job BillingJob
+	ok, err := loadBillingJob(mux.Vars(r)["id"], &job, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"failed to load job: %v"}`, err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"error":"job not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, job)
+}
+
+// GET /api/v1/billing/cluster/jobs/{id}/result
+func getClusterBillingJobResult(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if !cacheEnabled() {
+		http.Error(w, `{"error":"billing jobs require Redis (REDIS_HOST), which is not configured or unreachable"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	var result ClusterBillingResult
+	ok, err := loadBillingJob(mux.Vars(r)["id"], &result, ":result")
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"failed to load result: %v"}`, err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"error":"result not found (job unknown, not finished or expired)"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, result)
+}
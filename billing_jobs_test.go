@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBillInstancesRecoversPanics(t *testing.T) {
+	// Billing through a nil client panics in the workers
+	instances := []GnocchiInstance{{ID: "i-1", ProjectID: "p-1"}, {ID: "i-2", ProjectID: "p-2"}}
+	reports, err := billInstances(nil, instances, "2026-01-01T00:00:00", "2026-02-01T00:00:00",
+		0.05, 0.01, ReportPricing{}, nil)
+	if err == nil || !strings.Contains(err.Error(), ": internal error: ") {
+		t.Errorf("err = %v, want the panic as an error", err)
+	}
+	if reports != nil {
+		t.Errorf("%d reports despite the failure", len(reports))
+	}
+}
+
+func TestBillInstancesPricesLikeTheReport(t *testing.T) {
+	// 2 GB of memory and a 100 GiB volume for the 744 hours of January
+	client := newConstantGnocchi(t, map[string]float64{"mu-1": 2048, "mem-1": 4096, "vs-1": 100})
+	instances := []GnocchiInstance{{ID: "i-1", ProjectID: "p-1", StartedAt: "2025-12-01T00:00:00+00:00",
+		Metrics: map[string]string{"memory.usage": "mu-1", "memory": "mem-1", "volume.size": "vs-1"}}}
+	pricing := ReportPricing{
+		DiskPricePerGBMonth: 0.1,
+		Tiers:               &PricingConfig{Memory: []PricingTier{{UpTo: upTo(1000), Price: 0.001}, {Price: 0.0005}}},
+	}
+	reports, err := billInstances(client, instances, "2026-01-01T00:00:00", "2026-02-01T00:00:00", 0.05, 0.01, pricing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reports[0]
+	if want := 1000*0.001 + 488*0.0005; !almostEqual(report.MemoryCost, want) {
+		t.Errorf("memory cost %v, want %v from the tiers", report.MemoryCost, want)
+	}
+	if want := 100 * 744 / hoursPerBillingMonth * 0.1; !almostEqual(report.DiskCost, want) {
+		t.Errorf("disk cost %v, want %v", report.DiskCost, want)
+	}
+	if !almostEqual(report.TotalCost, report.MemoryCost+report.DiskCost) {
+		t.Errorf("total cost %v, want memory + disk", report.TotalCost)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TagBillingSummary is the response of GET /api/v1/billing/by-tag: the
+// period's instance costs grouped by the value of one Nova metadata tag
+// (e.g. cost_center) for chargeback.
+type TagBillingSummary struct {
+	Tag           string         `json:"tag"`
+	StartDate     string         `json:"start_date"`
+	EndDate       string         `json:"end_date"`
+	GeneratedAt   string         `json:"generated_at"`
+	Currency      string         `json:"currency"`
+	InstanceCount int            `json:"instance_count"`
+	TotalCost     float64        `json:"total_cost"`
+	Groups        []TagCostGroup `json:"groups"`   // by total cost, highest first
+	Untagged      TagCostGroup   `json:"untagged"` // no or empty tag, or no longer in Nova
+	NotInNova     int            `json:"not_in_nova"`
+}
+
+// TagCostGroup is the subtotal of the instances sharing one tag value.
+type TagCostGroup struct {
+	Value         string   `json:"value,omitempty"`
+	InstanceCount int      `json:"instance_count"`
+	CPUCost       float64  `json:"cpu_cost"`
+	MemoryCost    float64  `json:"memory_cost"`
+	TotalCost     float64  `json:"total_cost"`
+	InstanceIDs   []string `json:"instance_ids"`
+}
+
+func (g *TagCostGroup) add(r BillingReport) {
+	g.InstanceCount++
+	g.CPUCost += r.CPUCost
+	g.MemoryCost += r.MemoryCost
+	g.TotalCost += r.TotalCost
+	g.InstanceIDs = append(g.InstanceIDs, r.InstanceID)
+}
+
+// summarizeByTag groups reports by the tag value of their Nova server.
+// Instances missing from servers (deleted during or after the period) are untagged.
+func summarizeByTag(tag string, reports []BillingReport, servers []NovaServer) TagBillingSummary {
+	metadata := make(map[string]map[string]string, len(servers))
+	for _, s := range servers {
+		metadata[s.ID] = s.Metadata
+	}
+
+	summary := TagBillingSummary{
+		Tag:         tag,
+		GeneratedAt: time.Now().Format(time.RFC3339),
+		Currency:    "USD",
+		Groups:      []TagCostGroup{},
+		Untagged:    TagCostGroup{InstanceIDs: []string{}},
+	}
+	groups := make(map[string]*TagCostGroup)
+	for _, r := range reports {
+		summary.InstanceCount++
+		summary.TotalCost += r.TotalCost
+
+		md, ok := metadata[r.InstanceID]
+		if !ok {
+			summary.NotInNova++
+		}
+		value := strings.TrimSpace(md[tag])
+		if value == "" {
+			summary.Untagged.add(r)
+			continue
+		}
+		g := groups[value]
+		if g == nil {
+			g = &TagCostGroup{Value: value}
+			groups[value] = g
+		}
+		g.add(r)
+	}
+
+	for _, g := range groups {
+		summary.Groups = append(summary.Groups, *g)
+	}
+	sort.Slice(summary.Groups, func(i, j int) bool {
+		if summary.Groups[i].TotalCost != summary.Groups[j].TotalCost {
+			return summary.Groups[i].TotalCost > summary.Groups[j].TotalCost
+		}
+		return summary.Groups[i].Value < summary.Groups[j].Value
+	})
+	return summary
+}
+
+// GET /api/v1/billing/by-tag?tag=cost_center&start=...&end=...&cpu_price_per_hour=...&memory_price_per_gb=...
+// start/end (or start_date/end_date) default to the previous calendar month.
+// Optional ?disk_price_per_gb_month=, ?io_price_per_gb=, ?network_price_per_gb=
+// and ?pricing_expr= (default PRICING_EXPR), priced like /billing/report.
+func getBillingByTag(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	tag := strings.TrimSpace(q.Get("tag"))
+	if tag == "" {
+		http.Error(w, `{"error":"tag is required"}`, http.StatusBadRequest)
+		return
+	}
+	if clusterEnv(r.Context(), "NOVA_URL", "") == "" || clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"NOVA_URL and GNOCCHI_URL must both be configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	startDate, endDate := q.Get("start"), q.Get("end")
+	if startDate == "" || endDate == "" {
+		startDate, endDate = q.Get("start_date"), q.Get("end_date")
+	}
+	if startDate == "" || endDate == "" {
+		// Previous calendar month, like /billing/report
+		now := time.Now()
+		startDate = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02T15:04:05")
+		endDate = time.Date(now.Year(), now.Month(), 0, 23, 59, 59, 0, time.UTC).Format("2006-01-02T15:04:05")
+	}
+	cpuPricePerHour := parseFloat(q.Get("cpu_price_per_hour"), 0.05)
+	memoryPricePerGB := parseFloat(q.Get("memory_price_per_gb"), 0.01)
+
+	expr, err := pricingExprFromRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid pricing_expr: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+	pricing := reportPricingFromQuery(q, expr)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+
+	novaClient := NewNovaClient(NovaConfig{
+		BaseURL:  clusterEnv(r.Context(), "NOVA_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+
+	var (
+		servers    []NovaServer
+		serversErr error
+		instances  []GnocchiInstance
+		gnocchiErr error
+		wg         sync.WaitGroup
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		servers, serversErr = novaClient.ListAllServers()
+	}()
+	go func() {
+		defer wg.Done()
+		instances, gnocchiErr = gnocchiClient.GetAllInstances()
+	}()
+	wg.Wait()
+
+	// Without Nova every instance would land in the untagged bucket
+	if serversErr != nil {
+		slog.ErrorContext(r.Context(), "Nova servers failed", "service", "nova", "error", serversErr)
+		http.Error(w, fmt.Sprintf(`{"error":"Nova servers failed: %v"}`, serversErr), http.StatusBadGateway)
+		return
+	}
+	if gnocchiErr != nil {
+		slog.ErrorContext(r.Context(), "Gnocchi instances failed", "service", "gnocchi", "error", gnocchiErr)
+		http.Error(w, fmt.Sprintf(`{"error":"Gnocchi instances failed: %v"}`, gnocchiErr), http.StatusBadGateway)
+		return
+	}
+
+	instances = instancesActiveSince(instances, startDate)
+	reports, err := billInstances(gnocchiClient, instances, startDate, endDate,
+		cpuPricePerHour, memoryPricePerGB, pricing, nil)
+	var fetchErr *measuresError
+	if errors.As(err, &fetchErr) {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	summary := summarizeByTag(tag, reports, servers)
+	summary.StartDate = startDate
+	summary.EndDate = endDate
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, summary)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cpuSeries returns cumulative cpu measures (ns) every step from start, one
+// per percent: interval i runs at percents[i] of vcpus.
+func cpuSeries(start time.Time, step time.Duration, vcpus int, percents ...float64) []MetricMeasure {
+	measures := []MetricMeasure{{Timestamp: start.Format(time.RFC3339), Granularity: step.Seconds()}}
+	counter := 0.0
+	for i, p := range percents {
+		counter += p / 100 * step.Seconds() * float64(vcpus) * 1e9
+		measures = append(measures, MetricMeasure{
+			Timestamp:   start.Add(time.Duration(i+1) * step).Format(time.RFC3339),
+			Granularity: step.Seconds(),
+			Value:       counter,
+		})
+	}
+	return measures
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestCalculateCPUUsageDailyAverages(t *testing.T) {
+	// Hourly from 22:00: 10%, 20%, eleven hours of 50%, then 100%
+	start := time.Date(2026, 1, 1, 22, 0, 0, 0, time.UTC)
+	percents := []float64{10, 20}
+	for i := 0; i < 11; i++ {
+		percents = append(percents, 50)
+	}
+	percents = append(percents, 100)
+	stats := CalculateCPUUsage(cpuSeries(start, time.Hour, 2, percents...), 2, nil)
+
+	if stats.TotalDataPoints != 14 || len(stats.UsageByHour) != 14 {
+		t.Fatalf("data points = %d, hours = %d, want 14", stats.TotalDataPoints, len(stats.UsageByHour))
+	}
+	days := map[string]DailyUsage{}
+	for _, d := range stats.UsageByDay {
+		days[d.Date] = d
+	}
+	if len(days) != 2 {
+		t.Fatalf("days = %+v, want 2", stats.UsageByDay)
+	}
+
+	// The 23:00 and 00:00 samples close the intervals starting at 22:00 and 23:00
+	day1 := days["2026-01-01"]
+	if day1.AverageCPU != 10 || day1.MinCPU != 10 || day1.MaxCPU != 10 {
+		t.Errorf("day 1 = %+v, want one 10%% interval", day1)
+	}
+	day2 := days["2026-01-02"]
+	wantAvg := (20 + 11*50 + 100) / 13.0
+	if !almostEqual(day2.AverageCPU, wantAvg) || day2.MinCPU != 20 || day2.MaxCPU != 100 {
+		t.Errorf("day 2 = %+v, want average %v, min 20, max 100", day2, wantAvg)
+	}
+	// p95 of the day's own 13 points: rank 11.4 between 50 and 100
+	if !almostEqual(day2.P95CPU, 50+50*0.4) {
+		t.Errorf("day 2 p95 = %v, want 70", day2.P95CPU)
+	}
+	// 2 vCPUs: 20% for an hour is 0.4 CPU hours
+	wantHours := (20 + 11*50 + 100) / 100.0 * 2
+	if !almostEqual(day2.TotalCPUHours, wantHours) {
+		t.Errorf("day 2 cpu hours = %v, want %v", day2.TotalCPUHours, wantHours)
+	}
+
+	overall := (10 + 20 + 11*50 + 100) / 14.0
+	if !almostEqual(stats.AveragePercent, overall) || stats.MinPercent != 10 || stats.MaxPercent != 100 {
+		t.Errorf("overall avg %v min %v max %v, want avg %v", stats.AveragePercent, stats.MinPercent, stats.MaxPercent, overall)
+	}
+	if stats.MedianPercent != 50 {
+		t.Errorf("median = %v, want 50", stats.MedianPercent)
+	}
+}
+
+func TestCalculateCPUUsageSkipsCounterResets(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	measures := cpuSeries(start, 5*time.Minute, 1, 40, 40)
+	// VM restart: the counter starts over, then runs at 40% again
+	reset := cpuSeries(start.Add(10*time.Minute), 5*time.Minute, 1, 40)
+	measures = append(measures, reset[1])
+
+	stats := CalculateCPUUsage(measures, 1, nil)
+	if stats.TotalDataPoints != 2 || !almostEqual(stats.AveragePercent, 40) {
+		t.Errorf("data points %d, average %v; want the 2 intervals before the reset at 40%%",
+			stats.TotalDataPoints, stats.AveragePercent)
+	}
+}
+
+func TestCalculateCPUUsageDaysInZone(t *testing.T) {
+	// 23:00-01:00 UTC is one day in Jakarta (UTC+7)
+	start := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	jakarta := time.FixedZone("WIB", 7*3600)
+	stats := CalculateCPUUsage(cpuSeries(start, time.Hour, 1, 30, 60), 1, jakarta)
+	if len(stats.UsageByDay) != 1 || stats.UsageByDay[0].Date != "2026-01-02" || !almostEqual(stats.UsageByDay[0].AverageCPU, 45) {
+		t.Errorf("days = %+v, want 2026-01-02 averaging 45%%", stats.UsageByDay)
+	}
+}
+
+func TestPercentileSorted(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{"empty", nil, 95, 0},
+		{"single sample p0", []float64{7}, 0, 7},
+		{"single sample p50", []float64{7}, 50, 7},
+		{"single sample p100", []float64{7}, 100, 7},
+		{"p0 is the minimum", []float64{1, 2, 3, 4}, 0, 1},
+		{"p100 is the maximum", []float64{1, 2, 3, 4}, 100, 4},
+		{"exact rank", []float64{10, 20, 30}, 50, 20},
+		{"interpolated", []float64{10, 20, 30, 40}, 50, 25},
+		{"interpolated p95", []float64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100}, 95, 95},
+		{"interpolated p90 of two", []float64{0, 100}, 90, 90},
+		{"p99.9", []float64{0, 1000}, 99.9, 999},
+		{"equal samples", []float64{5, 5, 5}, 33, 5},
+		{"below range", []float64{1, 2}, -5, 1},
+		{"above range", []float64{1, 2}, 150, 2},
+	}
+	for _, tt := range tests {
+		if got := percentileSorted(tt.sorted, tt.p); !almostEqual(got, tt.want) {
+			t.Errorf("%s: percentileSorted(%v, %v) = %v, want %v", tt.name, tt.sorted, tt.p, got, tt.want)
+		}
+	}
+
+	// percentile sorts a copy
+	values := []float64{40, 10, 30, 20}
+	if got := percentile(values, 50); got != 25 || values[0] != 40 {
+		t.Errorf("percentile = %v, values %v", got, values)
+	}
+}
+
+func TestParsePercentiles(t *testing.T) {
+	valid := []struct {
+		in   string
+		want []float64
+	}{
+		{"", nil},
+		{"95", []float64{95}},
+		{"50,90, 99.9 ,100", []float64{50, 90, 99.9, 100}},
+		{"0,,100,", []float64{0, 100}},
+	}
+	for _, tt := range valid {
+		got, err := parsePercentiles(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q = %v, want %v", tt.in, got, tt.want)
+			}
+		}
+	}
+
+	tooMany := strings.Repeat("50,", maxPercentiles) + "50"
+	for _, in := range []string{"abc", "95,x", "-1", "100.5", "NaN", "Inf", "1e3", tooMany} {
+		if got, err := parsePercentiles(in); err == nil {
+			t.Errorf("%q = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestCPUPercentiles(t *testing.T) {
+	usage := CPUUsageStats{UsageByHour: []HourlyUsage{{CPUPercent: 30}, {CPUPercent: 10}, {CPUPercent: 20}}}
+	got := CPUPercentiles(usage, []float64{0, 50, 75, 99.9})
+	want := map[string]float64{"p0": 10, "p50": 20, "p75": 25, "p99.9": 29.98}
+	for k, v := range want {
+		if !almostEqual(got[k], v) {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+// memSeries returns measures at the given times (RFC 3339) with the values.
+func memSeries(points map[string]float64) []MetricMeasure {
+	var measures []MetricMeasure
+	for ts, v := range points {
+		measures = append(measures, MetricMeasure{Timestamp: ts, Granularity: 300, Value: v})
+	}
+	sort.Slice(measures, func(i, j int) bool { return measures[i].Timestamp < measures[j].Timestamp })
+	return measures
+}
+
+func TestCalculateMemoryUsageUnevenDays(t *testing.T) {
+	// Day 1 has four samples, day 2 only one (the instance was stopped)
+	usage := memSeries(map[string]float64{
+		"2026-01-01T00:00:00Z": 1024,
+		"2026-01-01T06:00:00Z": 1024,
+		"2026-01-01T12:00:00Z": 2048,
+		"2026-01-01T18:00:00Z": 2048,
+		"2026-01-02T00:00:00Z": 4096,
+	})
+	total := memSeries(map[string]float64{"2026-01-01T00:00:00Z": 8192})
+	stats := CalculateMemoryUsage(usage, total, nil)
+
+	days := map[string]DailyMemUsage{}
+	for _, d := range stats.UsageByDay {
+		days[d.Date] = d
+	}
+	if d := days["2026-01-01"]; d.AverageUsedMB != 1536 || d.AveragePercent != 18.75 {
+		t.Errorf("day 1 = %+v, want 1536 MB, 18.75%%", d)
+	}
+	if d := days["2026-01-02"]; d.AverageUsedMB != 4096 || d.AveragePercent != 50 {
+		t.Errorf("day 2 = %+v, want 4096 MB, 50%%", d)
+	}
+
+	// The period average weighs samples, not days
+	if stats.AverageUsedMB != 2048 || stats.AveragePercent != 25 || stats.AverageUsedGB != 2 {
+		t.Errorf("average %v MB (%v GB), %v%%; want 2048 MB, 25%%", stats.AverageUsedMB, stats.AverageUsedGB, stats.AveragePercent)
+	}
+	if stats.MinUsedMB != 1024 || stats.MaxUsedMB != 4096 || stats.TotalMemoryMB != 8192 {
+		t.Errorf("min %v, max %v, total %v", stats.MinUsedMB, stats.MaxUsedMB, stats.TotalMemoryMB)
+	}
+}
+
+func TestCalculateHourlyCostPartialHours(t *testing.T) {
+	// 5-minute CPU intervals from 10:30 to 11:15 at 50% of 2 vCPUs: 1/12 CPU hour each
+	start := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	percents := make([]float64, 9)
+	for i := range percents {
+		percents[i] = 50
+	}
+	cpu := CalculateCPUUsage(cpuSeries(start, 5*time.Minute, 2, percents...), 2, nil)
+	memory := []MetricMeasure{
+		{Timestamp: "2026-01-01T10:45:00Z", Granularity: 300, Value: 2048},
+		{Timestamp: "2026-01-01T11:30:00Z", Value: 1024}, // counts for memGranularity
+	}
+
+	hours := CalculateHourlyCost(cpu.UsageByHour, memory, 600, 120, 60, nil)
+	if len(hours) != 2 || hours[0].Hour != "2026-01-01T10:00:00Z" || hours[1].Hour != "2026-01-01T11:00:00Z" {
+		t.Fatalf("hours = %+v, want 10:00 and 11:00", hours)
+	}
+	// 10:35..10:55 end five intervals, 11:00..11:15 four
+	if h := hours[0]; !almostEqual(h.CPUHours, 5.0/12) || !almostEqual(h.CPUCost, 50) ||
+		!almostEqual(h.MemoryGBHours, 1.0/6) || !almostEqual(h.MemoryCost, 10) || !almostEqual(h.Cost, 60) {
+		t.Errorf("10:00 = %+v", h)
+	}
+	if h := hours[1]; !almostEqual(h.CPUHours, 4.0/12) || !almostEqual(h.CPUCost, 40) ||
+		!almostEqual(h.MemoryGBHours, 1.0/6) || !almostEqual(h.Cost, 50) {
+		t.Errorf("11:00 = %+v", h)
+	}
+
+	// In UTC+5:30 all intervals end between 16:05 and 16:45, one partial hour
+	ist := time.FixedZone("IST", 5*3600+1800)
+	hours = CalculateHourlyCost(cpu.UsageByHour, nil, 600, 120, 60, ist)
+	if len(hours) != 1 || hours[0].Hour != "2026-01-01T16:00:00+05:30" || !almostEqual(hours[0].CPUHours, 0.75) {
+		t.Errorf("hours in IST = %+v, want one hour 16:00 with 0.75 CPU hours", hours)
+	}
+}
+
+func TestCalculateHourlyCostEmptyWindow(t *testing.T) {
+	hours := CalculateHourlyCost(nil, nil, 300, 120, 60, nil)
+	if hours == nil || len(hours) != 0 {
+		t.Errorf("hours = %#v, want an empty list", hours)
+	}
+	bad := []HourlyUsage{{Timestamp: "not a time", CPUSeconds: 3600}}
+	if hours := CalculateHourlyCost(bad, nil, 300, 120, 60, nil); len(hours) != 0 {
+		t.Errorf("unparsable timestamp was billed: %+v", hours)
+	}
+}
+
+func TestBilledHours(t *testing.T) {
+	tests := []struct {
+		name   string
+		report BillingReport
+		want   float64
+	}{
+		{"zero-length window", BillingReport{StartDate: "2026-01-01T10:00:00", EndDate: "2026-01-01T10:00:00"}, 0},
+		{"partial hours", BillingReport{StartDate: "2026-01-01T10:30:00", EndDate: "2026-01-01T12:15:00"}, 1.75},
+		{"prorated", BillingReport{StartDate: "2026-01-01T00:00:00", EndDate: "2026-02-01T00:00:00",
+			FirstSeen: "2026-01-10T00:00:00Z", EffectiveHours: 12.5}, 12.5},
+		{"prorated to nothing", BillingReport{StartDate: "2026-01-01T00:00:00", EndDate: "2026-02-01T00:00:00",
+			FirstSeen: "2026-01-10T00:00:00Z"}, 0},
+	}
+	for _, tt := range tests {
+		if got := billedHours(&tt.report); !almostEqual(got, tt.want) {
+			t.Errorf("%s: %v hours, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkCalculateCPUUsage(b *testing.B) {
+	// A 31-day month at 5-minute granularity: 8928 intervals
+	percents := make([]float64, 31*24*12)
+	for i := range percents {
+		percents[i] = float64(i%100) + 0.5
+	}
+	measures := cpuSeries(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), 5*time.Minute, 4, percents...)
+	loc := time.FixedZone("WIB", 7*3600)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats := CalculateCPUUsage(measures, 4, loc)
+		if stats.TotalDataPoints != len(percents) {
+			b.Fatalf("%d data points, want %d", stats.TotalDataPoints, len(percents))
+		}
+	}
+}
+
+func TestCalculateMemoryUsageResize(t *testing.T) {
+	// Resized from 4 to 8 GB at 2026-01-02T00:00; the first sample predates
+	// any size measure
+	usage := memSeries(map[string]float64{
+		"2025-12-31T23:00:00Z": 2048,
+		"2026-01-01T00:00:00Z": 2048,
+		"2026-01-01T12:00:00Z": 3072,
+		"2026-01-02T00:00:00Z": 4096,
+		"2026-01-02T12:00:00Z": 6144,
+	})
+	total := memSeries(map[string]float64{
+		"2026-01-01T00:00:00Z": 4096,
+		"2026-01-02T00:00:00Z": 8192,
+	})
+	stats := CalculateMemoryUsage(usage, total, nil)
+
+	days := map[string]DailyMemUsage{}
+	for _, d := range stats.UsageByDay {
+		days[d.Date] = d
+	}
+	tests := []struct {
+		date            string
+		usedMB, percent float64
+	}{
+		{"2025-12-31", 2048, 50},   // the earliest size
+		{"2026-01-01", 2560, 62.5}, // 4 GB
+		{"2026-01-02", 5120, 62.5}, // 8 GB from the resize on
+	}
+	for _, tt := range tests {
+		if d := days[tt.date]; d.AverageUsedMB != tt.usedMB || d.AveragePercent != tt.percent {
+			t.Errorf("%s = %+v, want %v MB, %v%%", tt.date, d, tt.usedMB, tt.percent)
+		}
+	}
+	// Against the latest size alone the average would be 42.5%
+	if stats.AveragePercent != 60 || stats.TotalMemoryMB != 8192 || !almostEqual(stats.AverageUsedMB, 3481.6) {
+		t.Errorf("average %v%%, %v MB of %v MB; want 60%%, 3481.6 MB of 8192 MB",
+			stats.AveragePercent, stats.AverageUsedMB, stats.TotalMemoryMB)
+	}
+}
+
+// counterSeries returns one measure every 5 minutes from 2026-01-01, with the
+// given values.
+func counterSeries(values ...float64) []MetricMeasure {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	measures := make([]MetricMeasure, len(values))
+	for i, v := range values {
+		measures[i] = MetricMeasure{Timestamp: start.Add(time.Duration(i) * 5 * time.Minute).Format(time.RFC3339), Granularity: 300, Value: v}
+	}
+	return measures
+}
+
+func TestCounterIncrease(t *testing.T) {
+	sameTime := counterSeries(10, 20)
+	sameTime[1].Timestamp = sameTime[0].Timestamp
+	tests := []struct {
+		name     string
+		measures []MetricMeasure
+		want     float64
+		resets   int
+	}{
+		{"no measures", nil, 0, 0},
+		{"a single measure", counterSeries(100), 0, 0},
+		{"steady growth", counterSeries(100, 150, 200, 300), 200, 0},
+		{"flat counter", counterSeries(100, 100, 100), 0, 0},
+		// The drop to 5 is skipped; the growth after the reset still counts
+		{"reset mid-period", counterSeries(100, 200, 5, 55), 150, 1},
+		{"two resets", counterSeries(100, 0, 50, 10, 20), 60, 2},
+		{"no time between measures", sameTime, 0, 0},
+	}
+	for _, tt := range tests {
+		got, resets := counterIncrease(tt.measures)
+		if !almostEqual(got, tt.want) || resets != tt.resets {
+			t.Errorf("%s: increase %v with %d resets, want %v with %d", tt.name, got, resets, tt.want, tt.resets)
+		}
+	}
+}
+
+func TestCalculateDiskUsage(t *testing.T) {
+	gb := bytesPerGB
+	tests := []struct {
+		name              string
+		read, write, size []MetricMeasure
+		want              DiskUsageStats
+	}{
+		{"nothing", nil, nil, nil, DiskUsageStats{}},
+		{"read and write", counterSeries(0, gb, 3*gb), counterSeries(gb, 2*gb), counterSeries(20, 20),
+			DiskUsageStats{ReadBytes: 3 * gb, WriteBytes: gb, ReadGB: 3, WriteGB: 1, TotalIOGB: 4, ProvisionedGiB: 20}},
+		{"no read metric", nil, counterSeries(0, 2*gb), counterSeries(10),
+			DiskUsageStats{WriteBytes: 2 * gb, WriteGB: 2, TotalIOGB: 2, ProvisionedGiB: 10}},
+		{"no write metric", counterSeries(0, gb), nil, nil,
+			DiskUsageStats{ReadBytes: gb, ReadGB: 1, TotalIOGB: 1}},
+		{"counter reset", counterSeries(2*gb, 3*gb, 0, gb), counterSeries(gb, 0), nil,
+			DiskUsageStats{ReadBytes: 2 * gb, ReadGB: 2, TotalIOGB: 2, CounterResets: 2}},
+		// A volume resized from 10 to 40 GiB a quarter into the period
+		{"volume.size averaged", nil, nil, counterSeries(10, 40, 40, 40),
+			DiskUsageStats{ProvisionedGiB: 32.5}},
+	}
+	for _, tt := range tests {
+		if got := CalculateDiskUsage(tt.read, tt.write, tt.size); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyDiskPricing(t *testing.T) {
+	month := BillingReport{StartDate: "2026-01-01T00:00:00", EndDate: "2026-01-31T10:00:00"} // 730 hours
+	prorated := month
+	prorated.FirstSeen, prorated.EffectiveHours = "2026-01-16T00:00:00Z", 365
+	tests := []struct {
+		name   string
+		report BillingReport
+		usage  DiskUsageStats
+		want   float64
+	}{
+		{"a billing month", month, DiskUsageStats{ProvisionedGiB: 100}, 100 * 0.1},
+		{"with I/O", month, DiskUsageStats{ProvisionedGiB: 100, TotalIOGB: 50}, 100*0.1 + 50*0.02},
+		{"half the month", prorated, DiskUsageStats{ProvisionedGiB: 100, TotalIOGB: 50}, 100*0.1/2 + 50*0.02},
+		{"a day", BillingReport{StartDate: "2026-01-01T00:00:00", EndDate: "2026-01-02T00:00:00"},
+			DiskUsageStats{ProvisionedGiB: 730}, 24 * 0.1},
+		{"no disk", month, DiskUsageStats{}, 0},
+	}
+	for _, tt := range tests {
+		report := tt.report
+		report.DiskUsage = tt.usage
+		report.DiskCost = 999 // replaced, not added to
+		ApplyDiskPricing(&report, 0.1, 0.02)
+		if !almostEqual(report.DiskCost, tt.want) {
+			t.Errorf("%s: disk cost %v, want %v", tt.name, report.DiskCost, tt.want)
+		}
+		if report.DiskPricePerGBMonth != 0.1 || report.IOPricePerGB != 0.02 {
+			t.Errorf("%s: prices %v, %v", tt.name, report.DiskPricePerGBMonth, report.IOPricePerGB)
+		}
+	}
+}
+
+func TestCalculateNetworkUsage(t *testing.T) {
+	gb := bytesPerGB
+	usage := CalculateNetworkUsage(map[string][2][]MetricMeasure{
+		"tap-b": {counterSeries(0, gb), counterSeries(0, 2*gb, 0, gb)}, // outgoing reset
+		"tap-a": {counterSeries(gb, 3*gb), nil},                        // no outgoing metric
+	})
+	if len(usage.Interfaces) != 2 || usage.Interfaces[0].Interface != "tap-a" {
+		t.Fatalf("interfaces = %+v, want tap-a then tap-b", usage.Interfaces)
+	}
+	if b := usage.Interfaces[1]; b.IncomingGB != 1 || b.OutgoingGB != 3 {
+		t.Errorf("tap-b = %+v", b)
+	}
+	if usage.Total.IncomingGB != 3 || usage.Total.OutgoingGB != 3 || usage.Total.Interface != "" {
+		t.Errorf("total = %+v", usage.Total)
+	}
+
+	// The aggregate metrics count in the total only
+	usage = CalculateNetworkUsage(map[string][2][]MetricMeasure{"": {counterSeries(0, gb), counterSeries(0, 2*gb)}})
+	if len(usage.Interfaces) != 0 || usage.Total.OutgoingBytes != 2*gb {
+		t.Errorf("aggregate usage = %+v", usage)
+	}
+	if usage = CalculateNetworkUsage(nil); usage.Interfaces == nil || usage.Total.OutgoingBytes != 0 {
+		t.Errorf("no counters = %+v", usage)
+	}
+}
@@ -2,39 +2,114 @@ package main
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-// redisClient is the global Redis client, initialized once at startup.
-var redisClient *redis.Client
+// redisClient is the global Redis client, initialized once at startup and kept
+// even while Redis is unreachable (see redis_health.go).
+// Single node, Sentinel (failover) or Cluster depending on the env vars.
+var redisClient redis.UniversalClient
 
-// cacheKey is the Redis key for the cluster usage cache.
-const cacheKey = "vhi:cluster_usage"
+// Redis connection modes, reported in deep health.
+const (
+	redisModeSingle   = "single"
+	redisModeSentinel = "sentinel"
+	redisModeCluster  = "cluster"
+)
 
-// initRedis initializes the Redis client from environment variables.
-// Env vars: REDIS_HOST, REDIS_PORT, REDIS_PASSWORD, REDIS_DB
-// Returns nil if REDIS_HOST is not set (caching disabled).
-func initRedis() *redis.Client {
-	host := os.Getenv("REDIS_HOST")
-	if host == "" {
-		log.Println("REDIS_HOST not set — caching disabled")
-		return nil
-	}
+// redisMode is the connection mode chosen by initRedis ("" when disabled).
+var redisMode string
+
+// Redis keys for the usage caches, without the prefix (see redisKey).
+const (
+	cacheKey         = "cluster_usage"
+	totalUsageKey    = "total_usage"
+	billingReportKey = "billing_report"
+	measuresKey      = "measures" // see measures_cache.go
+)
+
+// defaultRedisKeyPrefix is the REDIS_KEY_PREFIX default and the prefix every
+// key had before it was configurable.
+const defaultRedisKeyPrefix = "vhi:"
+
+// redisKeyPrefix namespaces every key the service writes, so several
+// deployments (staging, production) can share one Redis. Set by initRedis.
+var redisKeyPrefix = defaultRedisKeyPrefix
+
+// redisKey returns the full Redis key for a key name. Every Redis access
+// goes through it.
+func redisKey(name string) string {
+	return redisKeyPrefix + name
+}
 
-	port := os.Getenv("REDIS_PORT")
-	if port == "" {
-		port = "6379"
+// redisLegacyFallback enables the fallback of redisGet while moving to a
+// custom REDIS_KEY_PREFIX (REDIS_LEGACY_KEY_FALLBACK=true). Set by initRedis;
+// turn it off again once the old entries have expired.
+var redisLegacyFallback bool
+
+// legacyKeysTried remembers which names were already looked up under the
+// old prefix, so the rollout fallback costs at most one extra GET per key.
+var legacyKeysTried sync.Map
+
+// redisGet GETs the key for name. With redisLegacyFallback and a custom
+// REDIS_KEY_PREFIX, a miss is retried once per name under the old "vhi:" key,
+// so a rollout doesn't start with an empty cache.
+func redisGet(ctx context.Context, name string) ([]byte, error) {
+	data, err := redisClient.Get(ctx, redisKey(name)).Bytes()
+	if !errors.Is(err, redis.Nil) || !redisLegacyFallback || redisKeyPrefix == defaultRedisKeyPrefix {
+		return data, err
+	}
+	if _, tried := legacyKeysTried.LoadOrStore(name, true); tried {
+		return data, err
+	}
+	legacy, legacyErr := redisClient.Get(ctx, defaultRedisKeyPrefix+name).Bytes()
+	if legacyErr != nil {
+		return data, err
 	}
+	slog.Info("Cache entry read from legacy key", "key", name, "legacy_key", defaultRedisKeyPrefix+name)
+	return legacy, nil
+}
+
+// initRedis initializes the Redis client from environment variables:
+//   - REDIS_CLUSTER_ADDRS (comma-separated) → Redis Cluster
+//   - REDIS_SENTINEL_ADDRS + REDIS_MASTER_NAME → Sentinel-managed master, follows failover
+//   - REDIS_HOST, REDIS_PORT → single node
+//
+// REDIS_USERNAME (ACL user), REDIS_PASSWORD and REDIS_TLS apply to all modes,
+// REDIS_DB to single/sentinel, REDIS_SENTINEL_USERNAME/PASSWORD to the
+// sentinels themselves.
+// Returns nil if none is set or the config is invalid (caching disabled). A
+// failed first ping keeps the client; caching starts once Redis is reachable.
+func initRedis() redis.UniversalClient {
+	redisKeyPrefix = getEnv("REDIS_KEY_PREFIX", defaultRedisKeyPrefix)
+	redisLegacyFallback = getEnv("REDIS_LEGACY_KEY_FALLBACK", "") == "true"
 
+	username := os.Getenv("REDIS_USERNAME")
 	password := os.Getenv("REDIS_PASSWORD")
 
+	tlsConfig, err := redisTLSConfig()
+	if err != nil {
+		slog.Error("Redis TLS config invalid, caching disabled", "service", "redis", "error", err)
+		return nil
+	}
+
 	db := 0
 	if dbStr := os.Getenv("REDIS_DB"); dbStr != "" {
 		if parsed, err := strconv.Atoi(dbStr); err == nil {
@@ -42,26 +117,124 @@ func initRedis() *redis.Client {
 		}
 	}
 
-	addr := fmt.Sprintf("%s:%s", host, port)
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
+	var (
+		client redis.UniversalClient
+		mode   string
+		desc   string
+	)
+	switch {
+	case os.Getenv("REDIS_CLUSTER_ADDRS") != "":
+		addrs := splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS"))
+		if db != 0 {
+			slog.Warn("REDIS_DB ignored, Redis Cluster only has db 0", "db", db)
+		}
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Username:  username,
+			Password:  password,
+			TLSConfig: tlsConfig,
+		})
+		mode, desc = redisModeCluster, strings.Join(addrs, ",")
+
+	case os.Getenv("REDIS_SENTINEL_ADDRS") != "":
+		addrs := splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS"))
+		master := os.Getenv("REDIS_MASTER_NAME")
+		if master == "" {
+			slog.Warn("REDIS_SENTINEL_ADDRS set without REDIS_MASTER_NAME, caching disabled")
+			return nil
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       master,
+			SentinelAddrs:    addrs,
+			SentinelUsername: os.Getenv("REDIS_SENTINEL_USERNAME"),
+			SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+			Username:         username,
+			Password:         password,
+			DB:               db,
+			TLSConfig:        tlsConfig,
+		})
+		mode, desc = redisModeSentinel, fmt.Sprintf("master %s via %s (db=%d)", master, strings.Join(addrs, ","), db)
+
+	case os.Getenv("REDIS_HOST") != "":
+		port := os.Getenv("REDIS_PORT")
+		if port == "" {
+			port = "6379"
+		}
+		addr := fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), port)
+		client = redis.NewClient(&redis.Options{
+			Addr:      addr,
+			Username:  username,
+			Password:  password,
+			DB:        db,
+			TLSConfig: tlsConfig,
+		})
+		mode, desc = redisModeSingle, fmt.Sprintf("%s (db=%d)", addr, db)
+
+	default:
+		slog.Info("REDIS_HOST not set, caching disabled")
+		return nil
+	}
+
+	redisMode = mode
+	if tlsConfig != nil {
+		desc += " [tls]"
+	}
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
-		log.Printf("Warning: Redis connection failed (%s): %v — caching disabled", addr, err)
-		return nil
+		args := []any{"service", "redis", "mode", mode, "addr", desc, "error", err}
+		if tlsConfig != nil {
+			args = append(args, "hint", "TLS enabled: check REDIS_TLS_CA_FILE / REDIS_TLS_SERVER_NAME")
+		}
+		slog.Warn("Redis connection failed, caching paused until it is reachable", args...)
+		redisState.record(err)
+		return client
 	}
 
-	log.Printf("Redis connected: %s (db=%d)", addr, db)
+	redisState.record(nil)
+	slog.Info("Redis connected", "mode", mode, "addr", desc, "key_prefix", redisKeyPrefix)
 	return client
 }
 
+// redisTLSConfig returns the TLS config when REDIS_TLS=true, otherwise nil.
+// REDIS_TLS_CA_FILE adds a CA bundle (PEM) to trust, REDIS_TLS_SERVER_NAME
+// overrides the name checked against the server certificate.
+func redisTLSConfig() (*tls.Config, error) {
+	if os.Getenv("REDIS_TLS") != "true" {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: os.Getenv("REDIS_TLS_SERVER_NAME"),
+	}
+	if caFile := os.Getenv("REDIS_TLS_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading REDIS_TLS_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in REDIS_TLS_CA_FILE %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// splitAddrs splits a comma-separated host:port list, skipping blanks.
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
 // getCacheTTL returns the cache TTL from env (default 60 seconds).
 func getCacheTTL() time.Duration {
 	ttlStr := os.Getenv("CACHE_TTL_SECONDS")
@@ -75,52 +248,299 @@ func getCacheTTL() time.Duration {
 	return time.Duration(ttl) * time.Second
 }
 
-// getCachedClusterUsage tries to get a cached ClusterUsage from Redis.
-// Returns nil if cache miss or Redis unavailable.
-func getCachedClusterUsage() *ClusterUsage {
-	if redisClient == nil {
-		return nil
+// getCacheTTLFor returns the TTL of one cache: CACHE_TTL_<name> in seconds
+// (e.g. CACHE_TTL_CLUSTER), otherwise fallback.
+func getCacheTTLFor(name string, fallback time.Duration) time.Duration {
+	return envSeconds("CACHE_TTL_"+name, fallback)
+}
+
+// envSeconds returns the positive number of seconds in env var name, otherwise fallback.
+func envSeconds(name string, fallback time.Duration) time.Duration {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return fallback
+}
+
+// serveStaleOnError reports whether SERVE_STALE_ON_ERROR=true: when recomputation
+// fails, an expired cache entry is served (marked stale) instead of an error.
+func serveStaleOnError() bool {
+	return os.Getenv("SERVE_STALE_ON_ERROR") == "true"
+}
+
+// getCacheHardTTL returns how long entries are kept in Redis (CACHE_STALE_TTL_SECONDS,
+// default 24h). Entries older than getCacheTTL are only used as stale fallbacks.
+func getCacheHardTTL() time.Duration {
+	ttl := 24 * time.Hour
+	if v := os.Getenv("CACHE_STALE_TTL_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			ttl = time.Duration(parsed) * time.Second
+		}
+	}
+	if soft := getCacheTTL(); ttl < soft {
+		ttl = soft
+	}
+	return ttl
+}
+
+// cacheEntry wraps a cached value with the time it was stored, so freshness
+// is decided by us rather than by the Redis key expiry.
+type cacheEntry struct {
+	StoredAt time.Time       `json:"stored_at"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// cacheGet loads the entry at key into dest and returns its age.
+// ok is false on a miss, a decode error, or when Redis is unavailable.
+func cacheGet(key string, dest interface{}) (age time.Duration, ok bool) {
+	if !cacheEnabled() {
+		return 0, false
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	data, err := redisClient.Get(ctx, cacheKey).Bytes()
+	data, err := redisGet(ctx, key)
 	if err != nil {
 		// Cache miss or error — not a problem
-		return nil
+		if errors.Is(err, redis.Nil) {
+			countCache(key, cacheMiss)
+		} else {
+			countCache(key, cacheError)
+		}
+		return 0, false
 	}
 
-	var usage ClusterUsage
-	if err := json.Unmarshal(data, &usage); err != nil {
-		log.Printf("Warning: failed to unmarshal cached cluster usage: %v", err)
-		return nil
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.StoredAt.IsZero() {
+		slog.Warn("Ignoring unreadable cache entry", "key", key)
+		countCache(key, cacheError)
+		return 0, false
 	}
+	if err := json.Unmarshal(entry.Data, dest); err != nil {
+		slog.Warn("Failed to unmarshal cache entry", "key", key, "error", err)
+		countCache(key, cacheError)
+		return 0, false
+	}
+	return time.Since(entry.StoredAt), true
+}
 
-	log.Printf("Cache HIT — returning cached cluster usage (ts=%s)", usage.Timestamp)
-	return &usage
+// secretCodec encrypts secrets kept in Redis (admin token, panel session)
+// with AES-256-GCM; the key is the SHA-256 of an env secret. The stored form
+// is base64(nonce || ciphertext), so nothing is ever written in plain text.
+type secretCodec struct {
+	aead cipher.AEAD
 }
 
-// setCachedClusterUsage stores ClusterUsage in Redis with TTL.
-func setCachedClusterUsage(usage *ClusterUsage) {
-	if redisClient == nil {
+func newSecretCodec(secret string) (*secretCodec, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretCodec{aead: aead}, nil
+}
+
+func (c *secretCodec) seal(plain []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func (c *secretCodec) open(stored string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return nil, errors.New("malformed secret")
+	}
+	nonce, sealed := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		// Usually a rotated key
+		return nil, errors.New("secret cannot be decrypted")
+	}
+	return plain, nil
+}
+
+// cacheSetSecret stores value encrypted at key with the given expiry.
+func cacheSetSecret(ctx context.Context, rdb redis.UniversalClient, codec *secretCodec, key string, value []byte, ttl time.Duration) error {
+	sealed, err := codec.seal(value)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, redisKey(key), sealed, ttl).Err()
+}
+
+// cacheGetSecret returns the decrypted value at key; redis.Nil when there is none.
+func cacheGetSecret(ctx context.Context, rdb redis.UniversalClient, codec *secretCodec, key string) ([]byte, error) {
+	stored, err := rdb.Get(ctx, redisKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return codec.open(stored)
+}
+
+// cacheDeleteSecret removes the secret at key.
+func cacheDeleteSecret(ctx context.Context, rdb redis.UniversalClient, key string) error {
+	return rdb.Del(ctx, redisKey(key)).Err()
+}
+
+// cacheDelete removes the entry at key.
+func cacheDelete(key string) {
+	if !cacheEnabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := redisClient.Del(ctx, redisKey(key)).Err(); err != nil {
+		slog.Warn("Failed to delete cache entry", "service", "redis", "key", key, "error", err)
+	}
+}
+
+// cacheSet stores value at key. The Redis expiry is the hard TTL when stale
+// serving is enabled (so an old copy survives outages), otherwise the soft TTL.
+func cacheSet(key string, value interface{}) {
+	expiry := getCacheTTL()
+	if serveStaleOnError() {
+		expiry = getCacheHardTTL()
+	}
+	cacheSetExpiry(key, value, expiry)
+}
+
+// cacheSetExpiry stores value at key with the given Redis expiry.
+func cacheSetExpiry(key string, value interface{}, expiry time.Duration) {
+	if !cacheEnabled() {
 		return
 	}
 
-	data, err := json.Marshal(usage)
+	data, err := json.Marshal(value)
+	if err != nil {
+		slog.Warn("Failed to marshal value for cache", "key", key, "error", err)
+		return
+	}
+	entry, err := json.Marshal(cacheEntry{StoredAt: time.Now(), Data: data})
 	if err != nil {
-		log.Printf("Warning: failed to marshal cluster usage for cache: %v", err)
+		slog.Warn("Failed to marshal cache entry", "key", key, "error", err)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	ttl := getCacheTTL()
-	if err := redisClient.Set(ctx, cacheKey, data, ttl).Err(); err != nil {
-		log.Printf("Warning: failed to set cache: %v", err)
+	if err := redisClient.Set(ctx, redisKey(key), entry, expiry).Err(); err != nil {
+		slog.Warn("Failed to set cache entry", "service", "redis", "key", key, "error", err)
 		return
 	}
 
-	log.Printf("Cache SET — stored cluster usage (TTL=%s)", ttl)
+	slog.Debug("Cache entry stored", "key", key, "expiry", expiry)
+}
+
+// getCachedClusterUsage returns the cached ClusterUsage and whether it is fresh
+// (within getClusterUsageTTL). An entry past the TTL but within the
+// stale-while-revalidate window (CLUSTER_USAGE_MAX_STALE_SECONDS) is returned
+// marked stale, so the caller can serve it and refresh in the background.
+// Returns nil if cache miss, too old, or Redis unavailable. key is the
+// cluster's cacheKey (see Cluster.key).
+func getCachedClusterUsage(key string) (*ClusterUsage, bool) {
+	var usage ClusterUsage
+	age, ok := cacheGet(key, &usage)
+	if !ok {
+		return nil, false
+	}
+	ttl := getClusterUsageTTL()
+	if age <= ttl {
+		slog.Debug("Cluster usage cache hit", "key", key, "timestamp", usage.Timestamp)
+		countCache(key, cacheHit)
+		return &usage, true
+	}
+	if age > ttl+maxStaleFromEnv("CLUSTER_USAGE_MAX_STALE_SECONDS") {
+		countCache(key, cacheMiss)
+		return nil, false
+	}
+	countCache(key, cacheStale)
+	usage.Stale = true
+	usage.StalenessSeconds = int64(age.Seconds())
+	return &usage, false
+}
+
+// getStaleClusterUsage returns the cached ClusterUsage regardless of age,
+// marked stale, for SERVE_STALE_ON_ERROR. Returns nil if nothing is cached.
+func getStaleClusterUsage(key string) *ClusterUsage {
+	var usage ClusterUsage
+	age, ok := cacheGet(key, &usage)
+	if !ok {
+		return nil
+	}
+	countCache(key, cacheStale)
+	usage.Stale = true
+	usage.StalenessSeconds = int64(age.Seconds())
+	return &usage
+}
+
+// setCachedClusterUsage stores ClusterUsage in Redis.
+func setCachedClusterUsage(key string, usage *ClusterUsage) {
+	cacheSetExpiry(key, usage, swrExpiry(getClusterUsageTTL(), maxStaleFromEnv("CLUSTER_USAGE_MAX_STALE_SECONDS")))
+}
+
+// getClusterUsageTTL returns how long cluster usage is fresh
+// (CACHE_TTL_CLUSTER, default CACHE_TTL_SECONDS).
+func getClusterUsageTTL() time.Duration {
+	return getCacheTTLFor("CLUSTER", getCacheTTL())
+}
+
+// maxStaleFromEnv returns an endpoint's stale-while-revalidate window: how long
+// past its TTL an entry is still served (while refreshed in the background)
+// before requests block for fresh data. Default 300s; 0 disables.
+func maxStaleFromEnv(name string) time.Duration {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 300 * time.Second
+}
+
+// swrExpiry returns the Redis expiry for an entry with the given TTL and
+// stale-while-revalidate window (the hard TTL if longer and SERVE_STALE_ON_ERROR is on).
+func swrExpiry(ttl, maxStale time.Duration) time.Duration {
+	expiry := ttl + maxStale
+	if serveStaleOnError() && getCacheHardTTL() > expiry {
+		expiry = getCacheHardTTL()
+	}
+	return expiry
+}
+
+// billingReportCacheKey returns the cache key of one instance's billing report.
+func billingReportCacheKey(instanceID, startDate, endDate string, cpuPrice, memoryPrice float64) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%g:%g", billingReportKey, instanceID, startDate, endDate, cpuPrice, memoryPrice)
+}
+
+// getBillingReportTTL returns how long a billing report is cached: CACHE_TTL_BILLING
+// (default CACHE_TTL_SECONDS) while the period is still open, and
+// CACHE_TTL_BILLING_CLOSED (default CACHE_TTL_BILLING) once it has ended — a
+// closed period's usage no longer changes, so it can be cached for days.
+func getBillingReportTTL(endDate string) time.Duration {
+	ttl := getCacheTTLFor("BILLING", getCacheTTL())
+	if end, err := time.Parse("2006-01-02T15:04:05", endDate); err == nil && end.Before(time.Now().UTC()) {
+		return getCacheTTLFor("BILLING_CLOSED", ttl)
+	}
+	return ttl
+}
+
+// getCachedBillingReport loads a billing report younger than getBillingReportTTL.
+func getCachedBillingReport(key, endDate string, dest *BillingReport) bool {
+	age, ok := cacheGet(key, dest)
+	if !ok {
+		return false
+	}
+	if age > getBillingReportTTL(endDate) {
+		countCache(key, cacheMiss)
+		return false
+	}
+	countCache(key, cacheHit)
+	return true
 }
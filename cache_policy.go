@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Cache bypass for cached endpoints:
+//
+//	?refresh=true   skip the cached read, recompute and overwrite the cache
+//	?no_store=true  recompute without reading or writing the cache
+//
+// Both load the backends, so they need the refresh scope (API_TOKEN_SCOPES);
+// read-only dashboard tokens get 403. A refresh goes through the endpoint's
+// flight group like any miss: it joins a computation that is already running
+// for the same key, or leads one that concurrent misses then join — never a
+// second one. no_store computations share a separate flight per key, so their
+// results never reach the cache.
+
+// cachePolicy is how a request uses the cache.
+type cachePolicy int
+
+const (
+	policyDefault cachePolicy = iota // read, compute on miss, store
+	policyRefresh                    // don't read, compute, store
+	policyNoStore                    // don't read, compute, don't store
+)
+
+// Cache results of bypassing requests, for X-Cache (see cache_stats.go).
+const (
+	cacheBypass  = "bypass"
+	cacheNoStore = "no-store"
+)
+
+// readsCache reports whether cached entries may be served.
+func (p cachePolicy) readsCache() bool { return p == policyDefault }
+
+// writesCache reports whether computed results are stored.
+func (p cachePolicy) writesCache() bool { return p != policyNoStore }
+
+// result is the X-Cache result of a computation under p.
+func (p cachePolicy) result() string {
+	switch p {
+	case policyRefresh:
+		return cacheBypass
+	case policyNoStore:
+		return cacheNoStore
+	}
+	return cacheMiss
+}
+
+// flightKey is the flight group key for computing key under p.
+func (p cachePolicy) flightKey(key string) string {
+	if p == policyNoStore {
+		return key + ":no_store"
+	}
+	return key
+}
+
+// requestCachePolicy reads ?refresh / ?no_store without checking the scope;
+// no_store wins when both are set.
+func requestCachePolicy(r *http.Request) cachePolicy {
+	switch {
+	case r.URL.Query().Get("no_store") == "true":
+		return policyNoStore
+	case r.URL.Query().Get("refresh") == "true":
+		return policyRefresh
+	}
+	return policyDefault
+}
+
+// parseCachePolicy returns the request's cache policy. A bypass by a token
+// without the refresh scope is answered with 403 (ok is false).
+func parseCachePolicy(w http.ResponseWriter, r *http.Request) (cachePolicy, bool) {
+	policy := requestCachePolicy(r)
+	if policy == policyDefault {
+		return policy, true
+	}
+	if !allowRefresh(w, r) {
+		return policy, false
+	}
+	metrics.IncCounter("vhi_cache_bypass_total",
+		"Requests that bypassed the cache, by mode (bypass, no-store).",
+		map[string]string{"mode": policy.result()})
+	return policy, true
+}
+
+// allowRefresh reports whether the request's token may force recomputation;
+// otherwise it writes 403.
+func allowRefresh(w http.ResponseWriter, r *http.Request) bool {
+	if hasScope(r, scopeRefresh) {
+		return true
+	}
+	slog.WarnContext(r.Context(), "Token denied cache bypass", "token_label", tokenLabel(r), "path", r.URL.Path)
+	http.Error(w, `{"error":"refresh and no_store require a token with the refresh scope"}`, http.StatusForbidden)
+	return false
+}
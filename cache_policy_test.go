@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clusterUsageRequest runs GET /usage/cluster<query> as the token label.
+func clusterUsageRequest(t *testing.T, query, label string) (*httptest.ResponseRecorder, ClusterUsage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	getClusterUsage(rec, withTokenLabel(httptest.NewRequest("GET", "/api/v1/usage/cluster"+query, nil), label))
+	var usage ClusterUsage
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, usage
+}
+
+// statCallCount returns how many stat requests reached the fake panel.
+func (p *fakePanel) statCallCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.statCalls
+}
+
+// setServers makes the panel report n servers from now on.
+func (p *fakePanel) setServers(n string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statBody = strings.Replace(fakePanelStat, `"count": 12`, `"count": `+n, 1)
+}
+
+func TestClusterUsageRefreshAndNoStore(t *testing.T) {
+	useMiniredis(t)
+	t.Setenv("NOVA_URL", "")
+	panel := newFakePanel(t)
+	usePanel(t, newFakePanelClient(t, panel))
+
+	steps := []struct {
+		query     string
+		servers   string // panel server count before the request ("" keeps it)
+		xCache    string
+		wantVMs   int
+		wantCalls int
+	}{
+		{"", "", "MISS", 12, 1},
+		{"", "13", "HIT", 12, 1},                  // cached
+		{"?no_store=true", "", "NO-STORE", 13, 2}, // recomputed ...
+		{"", "", "HIT", 12, 2},                    // ... but not stored
+		{"?refresh=true", "", "BYPASS", 13, 3},    // recomputed and stored
+		{"", "14", "HIT", 13, 3},
+	}
+	for i, s := range steps {
+		if s.servers != "" {
+			panel.setServers(s.servers)
+		}
+		rec, usage := clusterUsageRequest(t, s.query, "ops")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("step %d %q: status %d: %s", i, s.query, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != s.xCache {
+			t.Errorf("step %d %q: X-Cache %s, want %s", i, s.query, got, s.xCache)
+		}
+		if usage.TotalVMs != s.wantVMs {
+			t.Errorf("step %d %q: total_vms %d, want %d", i, s.query, usage.TotalVMs, s.wantVMs)
+		}
+		if got := panel.statCallCount(); got != s.wantCalls {
+			t.Errorf("step %d %q: panel stat calls %d, want %d", i, s.query, got, s.wantCalls)
+		}
+	}
+}
+
+func TestClusterUsageBypassNeedsRefreshScope(t *testing.T) {
+	t.Setenv("API_TOKEN_SCOPES", "dashboard:read")
+	for _, query := range []string{"?refresh=true", "?no_store=true"} {
+		if rec, _ := clusterUsageRequest(t, query, "dashboard"); rec.Code != http.StatusForbidden {
+			t.Errorf("%s with a read-only token: status %d, want 403", query, rec.Code)
+		}
+	}
+}
+
+// concurrentClusterUsage starts the requests while the panel holds the stat
+// call, releases it once all of them are waiting and returns the responses.
+func concurrentClusterUsage(t *testing.T, panel *fakePanel, queries ...string) []*httptest.ResponseRecorder {
+	t.Helper()
+	hold := make(chan struct{})
+	panel.mu.Lock()
+	panel.statHold = hold
+	panel.mu.Unlock()
+
+	recs := make([]*httptest.ResponseRecorder, len(queries))
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i], _ = clusterUsageRequest(t, query, "ops")
+		}()
+		if i == 0 {
+			// The first request leads; wait for its collection to reach the panel
+			for panel.statCallCount() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // the others join or start their flights
+	close(hold)
+	wg.Wait()
+	return recs
+}
+
+func TestClusterUsageRefreshJoinsRunningCollection(t *testing.T) {
+	useMiniredis(t)
+	t.Setenv("NOVA_URL", "")
+	panel := newFakePanel(t)
+	usePanel(t, newFakePanelClient(t, panel))
+
+	recs := concurrentClusterUsage(t, panel, "?refresh=true", "?refresh=true", "")
+	if got := panel.statCallCount(); got != 1 {
+		t.Errorf("panel stat calls = %d, want 1 shared collection", got)
+	}
+	for i, want := range []string{"BYPASS", "COALESCED", "COALESCED"} {
+		if got := recs[i].Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestClusterUsageNoStoreHasItsOwnFlight(t *testing.T) {
+	useMiniredis(t)
+	t.Setenv("NOVA_URL", "")
+	panel := newFakePanel(t)
+	usePanel(t, newFakePanelClient(t, panel))
+
+	recs := concurrentClusterUsage(t, panel, "?refresh=true", "?no_store=true", "?no_store=true")
+	if got := panel.statCallCount(); got != 2 {
+		t.Errorf("panel stat calls = %d, want 2 (refresh and no_store apart)", got)
+	}
+	if got := recs[0].Header().Get("X-Cache"); got != "BYPASS" {
+		t.Errorf("refresh: X-Cache %s, want BYPASS", got)
+	}
+	// Either no_store request may lead; the other joins it
+	got := []string{recs[1].Header().Get("X-Cache"), recs[2].Header().Get("X-Cache")}
+	if !(got[0] == "NO-STORE" && got[1] == "COALESCED") && !(got[0] == "COALESCED" && got[1] == "NO-STORE") {
+		t.Errorf("no_store X-Cache = %v, want one NO-STORE and one COALESCED", got)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache results, as used in the "result" label and X-Cache header.
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale" // expired entry served (stale-while-revalidate or stale-on-error)
+	cacheError = "error" // Redis or decode failure
+
+	cacheNegativeHit = "negative_hit" // cached not-found answered without the backend
+
+	// X-Cache only: the response shares a computation another request started
+	cacheCoalesced = "coalesced"
+)
+
+// cacheFamily returns the key family of a key name (total_usage:ab12… → total_usage).
+func cacheFamily(key string) string {
+	family := key
+	// cluster:<name>:<key> (non-default clusters) belongs to <key>'s family
+	if rest, ok := strings.CutPrefix(family, "cluster:"); ok {
+		if _, after, found := strings.Cut(rest, ":"); found {
+			family = after
+		}
+	}
+	if i := strings.IndexByte(family, ':'); i >= 0 {
+		family = family[:i]
+	}
+	return family
+}
+
+var (
+	cacheCountsMu sync.Mutex
+	cacheCounts   = make(map[string]map[string]int64) // family → result → count
+)
+
+// countCache records a cache lookup result for key's family on /metrics and
+// in the admin stats. cacheGet counts misses and errors; callers count hit,
+// stale, or miss for an entry that was found but is too old. No-op when
+// caching is disabled.
+func countCache(key, result string) {
+	if redisClient == nil {
+		return
+	}
+	family := cacheFamily(key)
+	metrics.IncCounter("vhi_cache_requests_total",
+		"Cache lookups by key family and result (hit, miss, stale, error, negative_hit).",
+		map[string]string{"cache": family, "result": result})
+
+	cacheCountsMu.Lock()
+	defer cacheCountsMu.Unlock()
+	if cacheCounts[family] == nil {
+		cacheCounts[family] = make(map[string]int64)
+	}
+	cacheCounts[family][result]++
+}
+
+// setXCache sets the X-Cache header from a cache result (HIT, MISS, STALE, ...).
+func setXCache(w http.ResponseWriter, result string) {
+	w.Header().Set("X-Cache", strings.ToUpper(result))
+}
+
+// CacheFamilyStats summarizes one key family for GET /api/v1/admin/cache/stats.
+type CacheFamilyStats struct {
+	Family     string           `json:"family"`
+	Keys       int              `json:"keys"`
+	Bytes      int64            `json:"bytes"`                     // sum of value sizes
+	MinTTLSecs *int64           `json:"min_ttl_seconds,omitempty"` // remaining Redis expiry
+	MaxTTLSecs *int64           `json:"max_ttl_seconds,omitempty"`
+	NoExpiry   int              `json:"keys_without_expiry,omitempty"`
+	Lookups    map[string]int64 `json:"lookups"` // since process start, by result
+}
+
+// CacheStats is the response of GET /api/v1/admin/cache/stats.
+type CacheStats struct {
+	Enabled   bool               `json:"enabled"`
+	KeyPrefix string             `json:"key_prefix"`
+	Time      string             `json:"time"`
+	Families  []CacheFamilyStats `json:"families"`
+	Truncated bool               `json:"truncated,omitempty"` // more than cacheStatsMaxKeys keys
+}
+
+// cacheStatsMaxKeys bounds how many keys the stats endpoint inspects.
+const cacheStatsMaxKeys = 10000
+
+// collectCacheStats scans the service's keys (REDIS_KEY_PREFIX*) and groups them by family.
+func collectCacheStats(ctx context.Context) (*CacheStats, error) {
+	stats := &CacheStats{Enabled: redisClient != nil, KeyPrefix: redisKeyPrefix, Time: time.Now().Format(time.RFC3339), Families: []CacheFamilyStats{}}
+	if redisClient == nil {
+		return stats, nil
+	}
+
+	var keys []string
+	scan := func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, redisKey("*"), 500).Iterator()
+		for iter.Next(ctx) {
+			if len(keys) >= cacheStatsMaxKeys {
+				stats.Truncated = true
+				break
+			}
+			keys = append(keys, iter.Val())
+		}
+		return iter.Err()
+	}
+	var err error
+	if cluster, ok := redisClient.(*redis.ClusterClient); ok {
+		// SCAN is per node; walk the masters one at a time (keys is shared)
+		var mu sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scan(ctx, node)
+		})
+	} else {
+		err = scan(ctx, redisClient)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scan failed: %w", err)
+	}
+
+	// One round trip for all TTLs and sizes
+	pipe := redisClient.Pipeline()
+	ttls := make([]func() (time.Duration, error), len(keys))
+	sizes := make([]func() (int64, error), len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(ctx, key).Result
+		sizes[i] = pipe.StrLen(ctx, key).Result
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Non-string keys fail STRLEN; the other results are still usable
+		slog.Warn("Cache stats pipeline partly failed", "service", "redis", "error", err)
+	}
+
+	byFamily := make(map[string]*CacheFamilyStats)
+	for i, key := range keys {
+		family := cacheFamily(strings.TrimPrefix(key, redisKeyPrefix))
+		fs := byFamily[family]
+		if fs == nil {
+			fs = &CacheFamilyStats{Family: family}
+			byFamily[family] = fs
+		}
+		fs.Keys++
+		if size, err := sizes[i](); err == nil {
+			fs.Bytes += size
+		}
+		ttl, err := ttls[i]()
+		if err != nil {
+			continue
+		}
+		if ttl < 0 {
+			fs.NoExpiry++
+			continue
+		}
+		secs := int64(ttl.Seconds())
+		if fs.MinTTLSecs == nil || secs < *fs.MinTTLSecs {
+			fs.MinTTLSecs = &secs
+		}
+		if fs.MaxTTLSecs == nil || secs > *fs.MaxTTLSecs {
+			fs.MaxTTLSecs = &secs
+		}
+	}
+
+	// Families that were looked up but have no keys right now are listed too
+	cacheCountsMu.Lock()
+	for family, counts := range cacheCounts {
+		fs := byFamily[family]
+		if fs == nil {
+			fs = &CacheFamilyStats{Family: family}
+			byFamily[family] = fs
+		}
+		fs.Lookups = make(map[string]int64, len(counts))
+		for result, n := range counts {
+			fs.Lookups[result] = n
+		}
+	}
+	cacheCountsMu.Unlock()
+
+	for _, fs := range byFamily {
+		if fs.Lookups == nil {
+			fs.Lookups = map[string]int64{}
+		}
+		stats.Families = append(stats.Families, *fs)
+	}
+	sort.Slice(stats.Families, func(i, j int) bool { return stats.Families[i].Family < stats.Families[j].Family })
+	return stats, nil
+}
+
+// GET /api/v1/admin/cache/stats
+func getCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	stats, err := collectCacheStats(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Cache stats failed", "service", "redis", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"cache stats failed: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, stats)
+}
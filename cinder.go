@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 )
@@ -16,6 +17,7 @@ type CinderConfig struct {
 	Token     string
 	ProjectID string // admin project ID, required for Cinder v3 API path
 	Insecure  bool
+	Calls     *upstreamCalls // request counter (upstreamCallsOf); nil counts nothing
 }
 
 // CinderClient adalah HTTP client untuk Cinder Block Storage API.
@@ -73,6 +75,13 @@ type StorageStats struct {
 	BootAttached *StorageBreakdown
 }
 
+// cinderProjectID returns CINDER_PROJECT_ID of ctx's cluster, or the admin
+// project from its last Keystone admin token when it is not set.
+func cinderProjectID(ctx context.Context) string {
+	c := clusterOf(ctx)
+	return c.env("CINDER_PROJECT_ID", c.tokens.ProjectID())
+}
+
 // NewCinderClient membuat Cinder client baru.
 func NewCinderClient(config CinderConfig) *CinderClient {
 	tr := &http.Transport{}
@@ -82,7 +91,7 @@ func NewCinderClient(config CinderConfig) *CinderClient {
 	}
 
 	httpClient := &http.Client{
-		Transport: tr,
+		Transport: &countingTransport{base: tr, service: "cinder", calls: config.Calls},
 		Timeout:   60 * time.Second,
 	}
 
@@ -93,18 +102,24 @@ func NewCinderClient(config CinderConfig) *CinderClient {
 }
 
 // ListAllVolumes mengambil semua Cinder volumes di cluster.
+// Volume yang muncul lagi di batas halaman (marker overlap) hanya dihitung sekali.
 func (c *CinderClient) ListAllVolumes() ([]CinderVolume, error) {
 	if c.config.ProjectID == "" {
 		return nil, fmt.Errorf("project_id is required for Cinder API")
 	}
 
 	var allVolumes []CinderVolume
+	seen := make(map[string]bool)
 
 	baseURL := fmt.Sprintf("%s/v3/%s/volumes/detail?all_tenants=true&limit=500",
 		c.config.BaseURL, c.config.ProjectID)
 	nextURL := baseURL
 
-	for nextURL != "" {
+	for page := 0; nextURL != ""; page++ {
+		if page >= maxListPages {
+			return nil, fmt.Errorf("Cinder volumes pagination exceeded %d pages", maxListPages)
+		}
+
 		req, err := http.NewRequest("GET", nextURL, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
@@ -133,8 +148,21 @@ func (c *CinderClient) ListAllVolumes() ([]CinderVolume, error) {
 			break
 		}
 
-		allVolumes = append(allVolumes, result.Volumes...)
+		added := 0
+		for _, vol := range result.Volumes {
+			if seen[vol.ID] {
+				continue
+			}
+			seen[vol.ID] = true
+			allVolumes = append(allVolumes, vol)
+			added++
+		}
 
+		// A page with nothing new means the marker isn't advancing — stop
+		if added == 0 {
+			slog.Warn("Cinder returned a page of already seen volumes, stopping pagination", "service", "cinder")
+			break
+		}
 		if len(result.Volumes) >= 500 {
 			lastID := result.Volumes[len(result.Volumes)-1].ID
 			nextURL = fmt.Sprintf("%s&marker=%s", baseURL, lastID)
@@ -143,10 +171,46 @@ func (c *CinderClient) ListAllVolumes() ([]CinderVolume, error) {
 		}
 	}
 
-	log.Printf("Fetched %d total Cinder volumes", len(allVolumes))
+	slog.Debug("Fetched Cinder volumes", "service", "cinder", "volumes", len(allVolumes))
 	return allVolumes, nil
 }
 
+// GetVolume mengambil detail satu volume.
+// GET /v3/{project_id}/volumes/{volume_id}
+func (c *CinderClient) GetVolume(volumeID string) (*CinderVolume, error) {
+	if c.config.ProjectID == "" {
+		return nil, fmt.Errorf("project_id is required for Cinder API")
+	}
+
+	url := fmt.Sprintf("%s/v3/%s/volumes/%s", c.config.BaseURL, c.config.ProjectID, volumeID)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Volume CinderVolume `json:"volume"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &result.Volume, nil
+}
+
 func addToBreakdown(m map[string]*StorageBreakdown, key string, sizeGiB int) {
 	if _, ok := m[key]; !ok {
 		m[key] = &StorageBreakdown{}
@@ -216,36 +280,11 @@ func (c *CinderClient) GetProvisionedStorage() (*StorageStats, error) {
 		}
 	}
 
-	// Log semua breakdown
-	log.Printf("===== CINDER VOLUME BREAKDOWN =====")
-	log.Printf("Total: %d volumes, %d GiB (%.2f TiB)", stats.TotalVolumes, stats.AllSizeGiB, float64(stats.AllSizeGiB)/1024.0)
-
-	log.Printf("\n--- By Status ---")
-	for k, v := range stats.ByStatus {
-		log.Printf("  %s: %d volumes, %.2f TiB", k, v.Count, v.SizeTiB)
-	}
-
-	log.Printf("\n--- By Bootable ---")
-	for k, v := range stats.ByBootable {
-		log.Printf("  bootable=%s: %d volumes, %.2f TiB", k, v.Count, v.SizeTiB)
-	}
-
-	log.Printf("\n--- By Volume Type ---")
-	for k, v := range stats.ByVolumeType {
-		log.Printf("  %s: %d volumes, %.2f TiB", k, v.Count, v.SizeTiB)
-	}
-
-	log.Printf("\n--- By Availability Zone ---")
-	for k, v := range stats.ByAZ {
-		log.Printf("  %s: %d volumes, %.2f TiB", k, v.Count, v.SizeTiB)
-	}
-
-	log.Printf("\n--- Attached vs Unattached ---")
-	log.Printf("  Attached: %d volumes, %.2f TiB", stats.Attached.Count, stats.Attached.SizeTiB)
-	log.Printf("  Unattached: %d volumes, %.2f TiB", stats.Unattached.Count, stats.Unattached.SizeTiB)
-	log.Printf("  Boot+Attached: %d volumes, %.2f TiB", stats.BootAttached.Count, stats.BootAttached.SizeTiB)
-
-	log.Printf("===================================")
+	// Ringkasan breakdown (the full breakdown is in the response)
+	slog.Debug("Cinder volume breakdown", "service", "cinder",
+		"volumes", stats.TotalVolumes, "size_gib", stats.AllSizeGiB,
+		"attached", stats.Attached.Count, "unattached", stats.Unattached.Count,
+		"boot_attached", stats.BootAttached.Count, "volume_types", len(stats.ByVolumeType))
 
 	return stats, nil
 }
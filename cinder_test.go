@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestListAllVolumesDeduplicatesPageOverlap(t *testing.T) {
+	api := newPagedAPI(t, "volumes", 1200, 500, false)
+	cinder := NewCinderClient(CinderConfig{BaseURL: api.URL, Token: "token", ProjectID: "admin"})
+
+	volumes, err := cinder.ListAllVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1200 {
+		t.Errorf("volumes = %d, want 1200", len(volumes))
+	}
+	seen := map[string]bool{}
+	for _, vol := range volumes {
+		if seen[vol.ID] {
+			t.Errorf("volume %s listed twice", vol.ID)
+		}
+		seen[vol.ID] = true
+	}
+}
+
+func TestListAllVolumesStopsOnRepeatedPage(t *testing.T) {
+	api := newPagedAPI(t, "volumes", 1200, 500, true)
+	cinder := NewCinderClient(CinderConfig{BaseURL: api.URL, Token: "token", ProjectID: "admin"})
+
+	volumes, err := cinder.ListAllVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 500 || api.pages != 2 {
+		t.Errorf("volumes = %d after %d pages, want 500 after 2", len(volumes), api.pages)
+	}
+}
+
+func TestListAllVolumesNeedsProject(t *testing.T) {
+	if _, err := NewCinderClient(CinderConfig{BaseURL: "http://cinder.invalid"}).ListAllVolumes(); err == nil {
+		t.Error("no error without a project id")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,6 +15,7 @@ import (
 // ClusterUsage merepresentasikan total resource usage untuk seluruh cluster.
 type ClusterUsage struct {
 	Timestamp string `json:"timestamp"`
+	Source    string `json:"source"` // panel or nova
 
 	// VM counts
 	TotalVMs   int `json:"total_vms"`
@@ -21,17 +24,29 @@ type ClusterUsage struct {
 	ShelvedVMs int `json:"shelved_vms"`
 	OtherVMs   int `json:"other_vms"`
 
-	// Cluster capacity (sum of individual hypervisors)
+	// Cluster capacity (sum of individual hypervisors). TotalVCPUs is logical
+	// capacity (physical cores × CPU allocation ratio); RAM is physical.
 	TotalVCPUs  int     `json:"total_vcpus"`
 	TotalRAMTiB float64 `json:"total_ram_tib"`
 
+	// Physical capacity before overcommit. The Nova path derives the cores
+	// from CPU_ALLOCATION_RATIO and leaves them null without it.
+	PhysicalVCPUs  *int    `json:"physical_vcpus"`
+	PhysicalRAMGiB float64 `json:"physical_ram_gib"`
+
 	// Fenced capacity (nodes that are down)
 	FencedVCPUs  int     `json:"fenced_vcpus"`
 	FencedRAMGiB float64 `json:"fenced_ram_gib"`
 
-	// Reserved = resources on hypervisor (Active + Shutoff only)
-	ReservedVCPUs  int     `json:"reserved_vcpus"`
-	ReservedRAMGiB float64 `json:"reserved_ram_gib"`
+	// Reserved = resources on hypervisor (Active + Shutoff only). The Nova path
+	// computes it as RESERVED_SOURCE says (see reservedSources)
+	ReservedVCPUs       int     `json:"reserved_vcpus"`
+	ReservedRAMGiB      float64 `json:"reserved_ram_gib"`
+	ReservedSource      string  `json:"reserved_source"` // panel, flavor_active, hypervisor_used or placement
+	ReservedSourceError string  `json:"reserved_source_error,omitempty"`
+
+	// Reserved per project (tenant ID); only the Nova path has the server list
+	ReservedByProject map[string]ProjectReservation `json:"reserved_by_project,omitempty"`
 
 	// System = hypervisor/system overhead
 	SystemVCPUs  int     `json:"system_vcpus"`
@@ -46,53 +61,359 @@ type ClusterUsage struct {
 	LogicalStorageUsedTiB  float64 `json:"logical_storage_used_tib"`
 	LogicalStorageFreeTiB  float64 `json:"logical_storage_free_tib"`
 
+	// Usable storage = logical storage / redundancy factor (see storage.go)
+	UsableStorageTotalTiB float64 `json:"usable_storage_total_tib"`
+	UsableStorageUsedTiB  float64 `json:"usable_storage_used_tib"`
+	UsableStorageFreeTiB  float64 `json:"usable_storage_free_tib"`
+	StorageRedundancy     string  `json:"storage_redundancy,omitempty"`
+
 	StorageError string `json:"storage_error,omitempty"`
+
+	// Hypervisors and overcommit. The panel reports the configured allocation
+	// ratios; Nova does not expose them, so the Nova path uses CPU_ALLOCATION_RATIO /
+	// RAM_ALLOCATION_RATIO when set and null otherwise.
+	HypervisorCount    int      `json:"hypervisor_count"` // active (up and enabled) hypervisors
+	CPUAllocationRatio *float64 `json:"cpu_allocation_ratio"`
+	RAMAllocationRatio *float64 `json:"ram_allocation_ratio"`
+	HypervisorSource   string   `json:"hypervisor_source"` // panel or nova
+	HypervisorNote     string   `json:"hypervisor_note,omitempty"`
+
+	// Set with ?overcommit=: total, fenced and free vCPUs are recomputed at this
+	// CPU allocation ratio instead of the configured cpu_allocation_ratio
+	WhatIfCPUAllocationRatio *float64 `json:"what_if_cpu_allocation_ratio,omitempty"`
+
+	// Volume counts by state (panel stat, or Cinder in the Nova path)
+	Volumes      *ClusterVolumeCounts `json:"volumes"`
+	VolumesError string               `json:"volumes_error,omitempty"`
+
+	// Local hypervisor disk (ephemeral storage) — Nova local_gb / local_gb_used / free_disk_gb.
+	// Only available from the Nova path; null with a note when the panel is the source.
+	LocalDiskTotalGiB *float64 `json:"local_disk_total_gib"`
+	LocalDiskUsedGiB  *float64 `json:"local_disk_used_gib"`
+	LocalDiskFreeGiB  *float64 `json:"local_disk_free_gib"`
+	LocalDiskNote     string   `json:"local_disk_note,omitempty"`
+
+	// Active panel alerts (only when CLUSTER_USAGE_INCLUDE_ALERTS=true)
+	Alerts *AlertSummary `json:"alerts,omitempty"`
+
+	// Set when served from an expired cache entry because collection failed
+	Stale            bool  `json:"stale,omitempty"`
+	StalenessSeconds int64 `json:"staleness_seconds,omitempty"`
+
+	// Exact byte counts, only returned with ?precision=raw
+	Bytes *ClusterUsageBytes `json:"bytes,omitempty"`
+}
+
+// ClusterVolumeCounts holds the number of volumes per state.
+type ClusterVolumeCounts struct {
+	Source        string `json:"source"` // panel or cinder
+	Count         int    `json:"count"`
+	Available     int    `json:"available"`
+	InUse         int    `json:"in_use"`
+	Error         int    `json:"error"`
+	ErrorDeleting int    `json:"error_deleting"`
+	BackingUp     int    `json:"backing_up"`
+	Reserved      int    `json:"reserved"`
+	Other         int    `json:"other"` // any other state (creating, attaching, ...)
+}
+
+// volumeCountsFromCinder counts Cinder volumes by status.
+func volumeCountsFromCinder(volumes []CinderVolume) *ClusterVolumeCounts {
+	counts := &ClusterVolumeCounts{Source: "cinder", Count: len(volumes)}
+	for _, v := range volumes {
+		switch v.Status {
+		case "available":
+			counts.Available++
+		case "in-use":
+			counts.InUse++
+		case "error":
+			counts.Error++
+		case "error_deleting":
+			counts.ErrorDeleting++
+		case "backing-up":
+			counts.BackingUp++
+		case "reserved":
+			counts.Reserved++
+		default:
+			counts.Other++
+		}
+	}
+	return counts
+}
+
+// allocationRatioFromEnv returns a ratio configured in env, nil when unset or invalid.
+func allocationRatioFromEnv(key string) *float64 {
+	v := parseFloat(getEnv(key, ""), 0)
+	if v <= 0 {
+		return nil
+	}
+	return &v
 }
 
+// ClusterUsageBytes holds the unconverted byte values behind the GiB/TiB fields.
+type ClusterUsageBytes struct {
+	TotalRAM            int64   `json:"total_ram"`
+	FencedRAM           int64   `json:"fenced_ram"`
+	ReservedRAM         int64   `json:"reserved_ram"`
+	SystemRAM           int64   `json:"system_ram"`
+	FreeRAM             int64   `json:"free_ram"`
+	LogicalStorageTotal float64 `json:"logical_storage_total,omitempty"`
+	LogicalStorageUsed  float64 `json:"logical_storage_used,omitempty"`
+	LogicalStorageFree  float64 `json:"logical_storage_free,omitempty"`
+}
+
+// withPrecision returns the usage as it should be rendered. ClusterUsage is
+// collected and cached unrounded; the default (rounded) output applies the
+// dashboard rounding here: RAM TiB ceil to 2 decimals, RAM GiB ceil to whole
+// GiB, storage TiB rounded to 2 decimals.
+func (u ClusterUsage) withPrecision(p Precision) ClusterUsage {
+	if p == PrecisionRaw {
+		return u
+	}
+
+	u.TotalRAMTiB = math.Ceil(u.TotalRAMTiB*100) / 100
+	u.PhysicalRAMGiB = math.Ceil(u.PhysicalRAMGiB)
+	u.FencedRAMGiB = math.Ceil(u.FencedRAMGiB)
+	u.ReservedRAMGiB = math.Ceil(u.ReservedRAMGiB)
+	u.SystemRAMGiB = math.Ceil(u.SystemRAMGiB)
+	u.FreeRAMGiB = math.Ceil(u.FreeRAMGiB)
+	u.LogicalStorageTotalTiB = math.Round(u.LogicalStorageTotalTiB*100) / 100
+	u.LogicalStorageUsedTiB = math.Round(u.LogicalStorageUsedTiB*100) / 100
+	u.LogicalStorageFreeTiB = math.Round(u.LogicalStorageFreeTiB*100) / 100
+	u.UsableStorageTotalTiB = math.Round(u.UsableStorageTotalTiB*100) / 100
+	u.UsableStorageUsedTiB = math.Round(u.UsableStorageUsedTiB*100) / 100
+	u.UsableStorageFreeTiB = math.Round(u.UsableStorageFreeTiB*100) / 100
+	u.Bytes = nil
+	return u
+}
+
+// parseOvercommit reads ?overcommit=<ratio>, a positive finite number; 0 when
+// not set.
+func parseOvercommit(r *http.Request) (float64, error) {
+	v := r.URL.Query().Get("overcommit")
+	if v == "" {
+		return 0, nil
+	}
+	ratio, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(ratio) || math.IsInf(ratio, 0) || ratio <= 0 {
+		return 0, errors.New("overcommit must be a positive number")
+	}
+	return ratio, nil
+}
+
+// withOvercommit returns the usage with vCPU capacity at a what-if CPU
+// allocation ratio: total and fenced vCPUs scale with the ratio, and free vCPUs
+// change by the difference in non-fenced capacity (reserved and system vCPUs
+// don't depend on the ratio). Needs the physical cores, i.e. a known ratio.
+func (u ClusterUsage) withOvercommit(ratio float64) (ClusterUsage, error) {
+	if u.PhysicalVCPUs == nil || u.CPUAllocationRatio == nil || *u.CPUAllocationRatio <= 0 {
+		return u, errors.New("overcommit needs the configured CPU allocation ratio (set CPU_ALLOCATION_RATIO for the Nova source)")
+	}
+	factor := ratio / *u.CPUAllocationRatio
+	total := int(math.Round(float64(*u.PhysicalVCPUs) * ratio))
+	fenced := int(math.Round(float64(u.FencedVCPUs) * factor))
+	u.FreeVCPUs += (total - u.TotalVCPUs) - (fenced - u.FencedVCPUs)
+	u.TotalVCPUs, u.FencedVCPUs = total, fenced
+	u.WhatIfCPUAllocationRatio = &ratio
+	return u, nil
+}
+
+// errPanelNotInitialized is returned when VHI_PANEL_URL is not configured.
+var errPanelNotInitialized = errors.New("VHI Panel client not initialized")
+
 // GET /api/v1/usage/cluster
 func getClusterUsage(w http.ResponseWriter, r *http.Request) {
-	// ---- Check Redis cache first ----
-	if cached := getCachedClusterUsage(); cached != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(cached)
+	if !allowClusterWide(w, r) {
+		return
+	}
+	precision, err := parsePrecision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	// What-if CPU allocation ratio, for this response only
+	overcommit, err := parseOvercommit(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
 		return
 	}
 
-	// ---- VHI Panel stat (only source) ----
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
 
-	if panelClient == nil {
-		log.Printf("Error: VHI Panel client not initialized")
-		http.Error(w, `{"error":"VHI Panel client not initialized"}`, http.StatusServiceUnavailable)
+	usage, result, err := loadClusterUsage(r.Context(), policy)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Cluster usage failed", "error", err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errPanelNotInitialized) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), status)
 		return
 	}
 
+	response := *usage
+	if overcommit > 0 {
+		if response, err = usage.withOvercommit(overcommit); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if redisClient != nil {
+		setXCache(w, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response.withPrecision(precision))
+}
+
+// clusterUsageFlight coalesces concurrent cluster usage collections.
+var clusterUsageFlight = newFlightGroup("usage_cluster")
+
+// loadClusterUsage returns the cached ClusterUsage if present, otherwise
+// collects a fresh one and stores it in the cache. An entry within the
+// stale-while-revalidate window is returned (marked stale) while one background
+// collection refreshes it. Concurrent callers share one collection; ctx only
+// bounds how long this caller waits for it. The cache result (hit, stale,
+// miss, bypass, no-store, or coalesced when it joined another caller's
+// collection) is returned for the X-Cache header.
+// Shared by the HTTP handler and the WebSocket stream. The cluster is ctx's.
+func loadClusterUsage(ctx context.Context, policy cachePolicy) (*ClusterUsage, string, error) {
+	cluster := clusterOf(ctx)
+	key := cluster.key(cacheKey)
+	if policy == policyNoStore {
+		v, err, shared := clusterUsageFlight.Do(ctx, policy.flightKey(key), func() (interface{}, error) {
+			return collectClusterUsage(cluster, upstreamCallsOf(ctx))
+		})
+		if err != nil {
+			return nil, cacheNoStore, err
+		}
+		if shared {
+			return v.(*ClusterUsage), cacheCoalesced, nil
+		}
+		return v.(*ClusterUsage), cacheNoStore, nil
+	}
+
+	// ---- Check Redis cache first (not for ?refresh=true, which joins or leads the collection below) ----
+	if policy.readsCache() {
+		if cached, fresh := getCachedClusterUsage(key); cached != nil {
+			if !fresh && clusterUsageFlight.Start(key, refreshClusterUsage(cluster, nil)) {
+				slog.InfoContext(ctx, "Serving stale cluster usage and refreshing in background",
+					"cluster", cluster.Name, "staleness_seconds", cached.StalenessSeconds)
+			}
+			if !fresh {
+				return cached, cacheStale, nil
+			}
+			return cached, cacheHit, nil
+		}
+	}
+
+	v, err, shared := clusterUsageFlight.Do(ctx, key, refreshClusterUsage(cluster, upstreamCallsOf(ctx)))
+	if err != nil {
+		if serveStaleOnError() {
+			if stale := getStaleClusterUsage(key); stale != nil {
+				slog.WarnContext(ctx, "Cluster usage collection failed, serving stale cache",
+					"cluster", cluster.Name, "staleness_seconds", stale.StalenessSeconds, "error", err)
+				return stale, cacheStale, nil
+			}
+		}
+		return nil, policy.result(), err
+	}
+	if shared {
+		return v.(*ClusterUsage), cacheCoalesced, nil
+	}
+	return v.(*ClusterUsage), policy.result(), nil
+}
+
+// refreshClusterUsage returns the flight body that collects the cluster's
+// usage and stores it in the cache. calls counts the backend calls for the
+// request that leads the flight (nil in the background).
+func refreshClusterUsage(cluster *Cluster, calls *upstreamCalls) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		usage, err := collectClusterUsage(cluster, calls)
+		if err != nil {
+			return nil, err
+		}
+		// Store in Redis cache
+		setCachedClusterUsage(cluster.key(cacheKey), usage)
+		return usage, nil
+	}
+}
+
+// collectClusterUsage builds a fresh ClusterUsage. The VHI panel is the primary
+// source (exact dashboard numbers); when it is not configured or its stat call
+// fails and NOVA_URL is set, the usage is computed from Nova instead.
+func collectClusterUsage(cluster *Cluster, calls *upstreamCalls) (*ClusterUsage, error) {
+	panel := cluster.panel
+	var panelErr error
+	if panel != nil && panel.BreakerStatus().State == breakerOpen {
+		// Panel is known to be down — go straight to Nova instead of waiting for timeouts
+		panelErr = errPanelCircuitOpen
+	} else if panel != nil {
+		usage, err := collectClusterUsageFromPanel(panel)
+		if err == nil {
+			return usage, nil
+		}
+		panelErr = err
+	} else {
+		panelErr = errPanelNotInitialized
+	}
+
+	if cluster.env("NOVA_URL", "") == "" {
+		return nil, panelErr
+	}
+
+	slog.Warn("Falling back to Nova for cluster usage", "service", "panel", "cluster", cluster.Name, "error", panelErr)
+	ctx, cancel := context.WithTimeout(withUpstreamCalls(withCluster(context.Background(), cluster), calls), 2*time.Minute)
+	defer cancel()
+	return collectClusterUsageFromNova(ctx)
+}
+
+// collectClusterUsageFromPanel builds ClusterUsage from the VHI panel stat.
+func collectClusterUsageFromPanel(panel PanelAPI) (*ClusterUsage, error) {
 	// Run GetStat() and GetStorageStat() in parallel
 	var (
 		stat        *PanelStat
 		panelErr    error
 		storageStat *VStorageStat
+		capacity    *VStorageCapacity
 		storageErr  error
+		alerts      *AlertSummary
 		wg          sync.WaitGroup
 	)
 
 	wg.Add(2)
 
+	if getEnv("CLUSTER_USAGE_INCLUDE_ALERTS", "false") == "true" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			list, err := getActiveAlerts(panel)
+			summary := summarizeAlerts(list, err)
+			alerts = &summary
+		}()
+	}
+
 	go func() {
 		defer wg.Done()
-		stat, panelErr = panelClient.GetStat()
+		stat, panelErr = panel.GetStat()
 	}()
 
 	go func() {
 		defer wg.Done()
-		storageStat, storageErr = panelClient.GetStorageStat()
+		storageStat, storageErr = panel.GetStorageStat()
+		if storageErr == nil {
+			capacity = vstorageCapacityFromStat(panel, storageStat)
+		}
 	}()
 
 	wg.Wait()
 
 	if panelErr != nil {
-		log.Printf("Error: VHI Panel stat failed: %v", panelErr)
-		http.Error(w, fmt.Sprintf(`{"error":"VHI Panel stat failed: %v"}`, panelErr), http.StatusBadGateway)
-		return
+		return nil, fmt.Errorf("VHI Panel stat failed: %w", panelErr)
 	}
 
 	// Panel stat available - use exact dashboard data
@@ -101,6 +422,7 @@ func getClusterUsage(w http.ResponseWriter, r *http.Request) {
 
 	response := ClusterUsage{
 		Timestamp:  time.Now().Format(time.RFC3339),
+		Source:     "panel",
 		TotalVMs:   stat.Servers.Count,
 		ActiveVMs:  stat.Servers.Active,
 		ShutoffVMs: stat.Servers.Shutoff,
@@ -108,38 +430,347 @@ func getClusterUsage(w http.ResponseWriter, r *http.Request) {
 		OtherVMs:   stat.Servers.Error + stat.Servers.InProgress,
 
 		TotalVCPUs:  stat.Physical.VCPUsTotal,
-		TotalRAMTiB: math.Ceil(float64(stat.Physical.MemTotal)/bytesToTiB*100) / 100,
+		TotalRAMTiB: float64(stat.Physical.MemTotal) / bytesToTiB,
+
+		PhysicalVCPUs:  &stat.Physical.CPUCores,
+		PhysicalRAMGiB: float64(stat.Physical.MemTotal) / bytesToGiB,
 
 		FencedVCPUs:  stat.Fenced.VCPUs,
-		FencedRAMGiB: math.Ceil(float64(stat.Fenced.PhysicalMemTotal) / bytesToGiB),
+		FencedRAMGiB: float64(stat.Fenced.PhysicalMemTotal) / bytesToGiB,
 
 		ReservedVCPUs:  stat.Compute.VCPUs,
-		ReservedRAMGiB: math.Ceil(float64(stat.Compute.VmMemReserved) / bytesToGiB),
+		ReservedRAMGiB: float64(stat.Compute.VmMemReserved) / bytesToGiB,
+		ReservedSource: "panel",
 
 		SystemVCPUs:  stat.Reserved.VCPUs,
-		SystemRAMGiB: math.Ceil(float64(stat.Reserved.Memory) / bytesToGiB),
+		SystemRAMGiB: float64(stat.Reserved.Memory) / bytesToGiB,
 
 		FreeVCPUs:  stat.Compute.VCPUsFree,
-		FreeRAMGiB: math.Ceil(float64(stat.Compute.VmMemFree) / bytesToGiB),
+		FreeRAMGiB: float64(stat.Compute.VmMemFree) / bytesToGiB,
+
+		HypervisorCount:    stat.Compute.Hypervisors,
+		CPUAllocationRatio: &stat.Compute.CPUAllocationRatio,
+		RAMAllocationRatio: &stat.Compute.RAMAllocationRatio,
+		HypervisorSource:   "panel",
+
+		Volumes: &ClusterVolumeCounts{
+			Source:        "panel",
+			Count:         stat.Volumes.Count,
+			Available:     stat.Volumes.Available,
+			InUse:         stat.Volumes.InUse,
+			Error:         stat.Volumes.Error,
+			ErrorDeleting: stat.Volumes.ErrorDelete,
+			BackingUp:     stat.Volumes.BackingUp,
+			Reserved:      stat.Volumes.ReservedVol,
+		},
+
+		LocalDiskNote: "local hypervisor disk is not reported by the VHI panel",
+
+		Alerts: alerts,
+
+		Bytes: &ClusterUsageBytes{
+			TotalRAM:    stat.Physical.MemTotal,
+			FencedRAM:   stat.Fenced.PhysicalMemTotal,
+			ReservedRAM: stat.Compute.VmMemReserved,
+			SystemRAM:   stat.Reserved.Memory,
+			FreeRAM:     stat.Compute.VmMemFree,
+		},
 	}
 
 	// Attach logical storage from parallel GetStorageStat()
 	if storageErr != nil {
-		log.Printf("Warning: VHI Panel storage stat failed: %v", storageErr)
+		slog.Warn("VHI Panel storage stat failed", "service", "panel", "error", storageErr)
 		response.StorageError = storageErr.Error()
 	} else {
-		response.LogicalStorageTotalTiB = math.Round(storageStat.TotalBytes/bytesToTiB*100) / 100
-		response.LogicalStorageUsedTiB = math.Round(storageStat.UsedBytes/bytesToTiB*100) / 100
-		response.LogicalStorageFreeTiB = math.Round(storageStat.FreeBytes/bytesToTiB*100) / 100
+		response.LogicalStorageTotalTiB = storageStat.TotalBytes / bytesToTiB
+		response.LogicalStorageUsedTiB = storageStat.UsedBytes / bytesToTiB
+		response.LogicalStorageFreeTiB = storageStat.FreeBytes / bytesToTiB
+		response.Bytes.LogicalStorageTotal = storageStat.TotalBytes
+		response.Bytes.LogicalStorageUsed = storageStat.UsedBytes
+		response.Bytes.LogicalStorageFree = storageStat.FreeBytes
+		response.UsableStorageTotalTiB = capacity.UsableTotalTiB
+		response.UsableStorageUsedTiB = capacity.UsableUsedTiB
+		response.UsableStorageFreeTiB = capacity.UsableFreeTiB
+		response.StorageRedundancy = capacity.RedundancyAssumption
 	}
 
-	log.Printf("Using VHI Panel stat: Total=%d vCPUs | System=%d | VMs=%d | Free=%d | Fenced=%d",
-		response.TotalVCPUs, response.SystemVCPUs, response.ReservedVCPUs,
-		response.FreeVCPUs, response.FencedVCPUs)
+	v := response.Volumes
+	if other := v.Count - v.Available - v.InUse - v.Error - v.ErrorDeleting - v.BackingUp - v.Reserved; other > 0 {
+		v.Other = other
+	}
 
-	// Store in Redis cache
-	setCachedClusterUsage(&response)
+	slog.Debug("Cluster usage from VHI Panel stat", "service", "panel",
+		"total_vcpus", response.TotalVCPUs, "system_vcpus", response.SystemVCPUs, "vm_vcpus", response.ReservedVCPUs,
+		"free_vcpus", response.FreeVCPUs, "fenced_vcpus", response.FencedVCPUs)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return &response, nil
+}
+
+// RESERVED_SOURCE (per cluster) selects what reserved_vcpus / reserved_ram_gib
+// mean in the Nova path; the panel path always reports the panel's numbers.
+//
+//	flavor_active    (default) flavor vCPUs/RAM of ACTIVE servers. SHUTOFF
+//	                 servers are not counted although Nova keeps their
+//	                 resources claimed on the host.
+//	hypervisor_used  vcpus_used / memory_mb_used of the hypervisors: every
+//	                 server on a host, SHUTOFF included; memory_mb_used also
+//	                 contains the host's reserved_host_memory_mb. Nova drops
+//	                 these fields from microversion 2.88 (GetHypervisors asks
+//	                 for the default).
+//	placement        VCPU / MEMORY_MB allocations in Placement (PLACEMENT_URL):
+//	                 what the scheduler treats as taken, i.e. every server
+//	                 holding an allocation (SHUTOFF and SHELVED that is not
+//	                 offloaded) plus both hosts of a migration in progress.
+//
+// reserved_by_project always comes from the ACTIVE servers' flavors. When the
+// selected source fails, flavor_active is reported with reserved_source_error.
+const (
+	reservedFlavorActive   = "flavor_active"
+	reservedHypervisorUsed = "hypervisor_used"
+	reservedPlacement      = "placement"
+)
+
+var reservedSources = map[string]bool{reservedFlavorActive: true, reservedHypervisorUsed: true, reservedPlacement: true}
+
+// reservedSource returns ctx's cluster's RESERVED_SOURCE; unknown values fall
+// back to flavor_active with a warning.
+func reservedSource(ctx context.Context) string {
+	source := clusterEnv(ctx, "RESERVED_SOURCE", reservedFlavorActive)
+	if !reservedSources[source] {
+		slog.WarnContext(ctx, "Unknown RESERVED_SOURCE, using flavor_active", "reserved_source", source)
+		return reservedFlavorActive
+	}
+	return source
+}
+
+// collectClusterUsageFromNova builds ClusterUsage from Nova hypervisors and servers.
+// Capacity is the sum of the hypervisors; reserved is the flavor vCPUs/RAM of ACTIVE
+// servers unless RESERVED_SOURCE says otherwise; hypervisors that are down or
+// disabled count as fenced.
+// Logical storage is still taken from Prometheus when the panel client exists.
+// The cluster is ctx's.
+func collectClusterUsageFromNova(ctx context.Context) (*ClusterUsage, error) {
+	panel := panelFor(ctx)
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin token: %w", err)
+	}
+
+	novaClient := NewNovaClient(NovaConfig{
+		BaseURL:  clusterEnv(ctx, "NOVA_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
+	})
+
+	var (
+		hypervisors []Hypervisor
+		hvErr       error
+		servers     []NovaServer
+		serversErr  error
+		storageStat *VStorageStat
+		capacity    *VStorageCapacity
+		storageErr  error
+		volumes     []CinderVolume
+		volumesErr  error
+		allocated   *PlacementUsage
+		placeErr    error
+		wg          sync.WaitGroup
+	)
+
+	source := reservedSource(ctx)
+	wg.Add(2)
+
+	if source == reservedPlacement {
+		if placementURL := clusterEnv(ctx, "PLACEMENT_URL", ""); placementURL != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				allocated, placeErr = NewPlacementClient(PlacementConfig{
+					BaseURL:  placementURL,
+					Token:    adminToken,
+					Insecure: true,
+					Calls:    upstreamCallsOf(ctx),
+				}).GetAllocatedUsage()
+			}()
+		} else {
+			placeErr = errors.New("PLACEMENT_URL is not configured")
+		}
+	}
+
+	go func() {
+		defer wg.Done()
+		hypervisors, hvErr = novaClient.GetHypervisors()
+	}()
+
+	if cinderURL := clusterEnv(ctx, "CINDER_URL", ""); cinderURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			volumes, volumesErr = NewCinderClient(CinderConfig{
+				BaseURL:   cinderURL,
+				Token:     adminToken,
+				ProjectID: cinderProjectID(ctx),
+				Insecure:  true,
+				Calls:     upstreamCallsOf(ctx),
+			}).ListAllVolumes()
+		}()
+	} else {
+		volumesErr = errors.New("CINDER_URL is not configured")
+	}
+
+	go func() {
+		defer wg.Done()
+		servers, serversErr = novaClient.ListAllServers()
+	}()
+
+	if panel != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storageStat, storageErr = panel.GetStorageStat()
+			if storageErr == nil {
+				capacity = vstorageCapacityFromStat(panel, storageStat)
+			}
+		}()
+	} else {
+		storageErr = errPanelNotInitialized
+	}
+
+	wg.Wait()
+
+	if hvErr != nil {
+		return nil, fmt.Errorf("Nova hypervisors failed: %w", hvErr)
+	}
+	if serversErr != nil {
+		return nil, fmt.Errorf("Nova servers failed: %w", serversErr)
+	}
+
+	response := ClusterUsage{
+		Timestamp:          time.Now().Format(time.RFC3339),
+		Source:             "nova",
+		HypervisorSource:   "nova",
+		CPUAllocationRatio: allocationRatioFromEnv("CPU_ALLOCATION_RATIO"),
+		RAMAllocationRatio: allocationRatioFromEnv("RAM_ALLOCATION_RATIO"),
+		Bytes:              &ClusterUsageBytes{},
+	}
+	if response.CPUAllocationRatio == nil || response.RAMAllocationRatio == nil {
+		response.HypervisorNote = "allocation ratios are not exposed by Nova; set CPU_ALLOCATION_RATIO / RAM_ALLOCATION_RATIO"
+	}
+
+	// ---- Capacity from hypervisors ----
+	var totalMB, fencedMB, localTotalGB, localUsedGB, localFreeGB int
+	for _, h := range hypervisors {
+		response.TotalVCPUs += h.VCPUs
+		totalMB += h.MemoryMB
+		if h.State == "down" || h.Status == "disabled" {
+			response.FencedVCPUs += h.VCPUs
+			fencedMB += h.MemoryMB
+		} else {
+			response.HypervisorCount++
+		}
+		localTotalGB += h.LocalGB
+		localUsedGB += h.LocalGBUsed
+		localFreeGB += h.FreeDiskGB
+	}
+
+	// ---- Reserved and VM counts from servers ----
+	var reservedVCPUs, reservedMB int
+	for _, srv := range servers {
+		response.TotalVMs++
+		switch srv.Status {
+		case "ACTIVE":
+			response.ActiveVMs++
+			reservedVCPUs += srv.Flavor.VCPUs
+			reservedMB += srv.Flavor.RAM
+		case "SHUTOFF":
+			response.ShutoffVMs++
+		case "SHELVED_OFFLOADED", "SHELVED":
+			response.ShelvedVMs++
+		default:
+			response.OtherVMs++
+		}
+	}
+
+	response.ReservedByProject = reservedByProject(servers)
+
+	// ---- Reserved as RESERVED_SOURCE defines it ----
+	response.ReservedSource = reservedFlavorActive
+	switch source {
+	case reservedHypervisorUsed:
+		reservedVCPUs, reservedMB = 0, 0
+		for _, h := range hypervisors {
+			reservedVCPUs += h.VCPUsUsed
+			reservedMB += h.MemoryMBUsed
+		}
+		response.ReservedSource = source
+	case reservedPlacement:
+		if placeErr != nil {
+			slog.WarnContext(ctx, "Placement allocations unavailable, reserved from ACTIVE flavors", "service", "placement", "error", placeErr)
+			response.ReservedSourceError = placeErr.Error()
+			break
+		}
+		reservedVCPUs, reservedMB = allocated.VCPUs, allocated.MemoryMB
+		response.ReservedSource = source
+	}
+	response.ReservedVCPUs = reservedVCPUs
+
+	mbToBytes := int64(1024 * 1024)
+	response.TotalRAMTiB = float64(totalMB) / (1024.0 * 1024.0)
+	response.PhysicalRAMGiB = float64(totalMB) / 1024.0
+	if ratio := response.CPUAllocationRatio; ratio != nil && *ratio > 0 {
+		// Nova reports hypervisor vCPUs already multiplied by the allocation ratio
+		physical := int(math.Round(float64(response.TotalVCPUs) / *ratio))
+		response.PhysicalVCPUs = &physical
+	}
+	response.FencedRAMGiB = float64(fencedMB) / 1024.0
+	response.ReservedRAMGiB = float64(reservedMB) / 1024.0
+	response.FreeVCPUs = response.TotalVCPUs - response.FencedVCPUs - response.ReservedVCPUs
+	freeMB := totalMB - fencedMB - reservedMB
+	response.FreeRAMGiB = float64(freeMB) / 1024.0
+
+	response.Bytes.TotalRAM = int64(totalMB) * mbToBytes
+	response.Bytes.FencedRAM = int64(fencedMB) * mbToBytes
+	response.Bytes.ReservedRAM = int64(reservedMB) * mbToBytes
+	response.Bytes.FreeRAM = int64(freeMB) * mbToBytes
+
+	localTotal := float64(localTotalGB)
+	localUsed := float64(localUsedGB)
+	localFree := float64(localFreeGB)
+	response.LocalDiskTotalGiB = &localTotal
+	response.LocalDiskUsedGiB = &localUsed
+	response.LocalDiskFreeGiB = &localFree
+
+	// ---- Volume counts from Cinder ----
+	if volumesErr != nil {
+		slog.WarnContext(ctx, "Cinder volume counts unavailable", "service", "cinder", "error", volumesErr)
+		response.VolumesError = volumesErr.Error()
+	} else {
+		response.Volumes = volumeCountsFromCinder(volumes)
+	}
+
+	// ---- Logical storage ----
+	bytesToTiB := 1024.0 * 1024.0 * 1024.0 * 1024.0
+	if storageErr != nil {
+		slog.WarnContext(ctx, "Storage stat failed", "service", "panel", "error", storageErr)
+		response.StorageError = storageErr.Error()
+	} else {
+		response.LogicalStorageTotalTiB = storageStat.TotalBytes / bytesToTiB
+		response.LogicalStorageUsedTiB = storageStat.UsedBytes / bytesToTiB
+		response.LogicalStorageFreeTiB = storageStat.FreeBytes / bytesToTiB
+		response.Bytes.LogicalStorageTotal = storageStat.TotalBytes
+		response.Bytes.LogicalStorageUsed = storageStat.UsedBytes
+		response.Bytes.LogicalStorageFree = storageStat.FreeBytes
+		response.UsableStorageTotalTiB = capacity.UsableTotalTiB
+		response.UsableStorageUsedTiB = capacity.UsableUsedTiB
+		response.UsableStorageFreeTiB = capacity.UsableFreeTiB
+		response.StorageRedundancy = capacity.RedundancyAssumption
+	}
+
+	slog.DebugContext(ctx, "Cluster usage from Nova fallback", "service", "nova",
+		"total_vcpus", response.TotalVCPUs, "vm_vcpus", response.ReservedVCPUs, "free_vcpus", response.FreeVCPUs,
+		"fenced_vcpus", response.FencedVCPUs, "local_disk_used_gib", localUsedGB, "local_disk_total_gib", localTotalGB)
+
+	return &response, nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetClusterUsageFromPanel(t *testing.T) {
+	t.Setenv("NOVA_URL", "")
+	panel := newFakePanel(t)
+	usePanel(t, newFakePanelClient(t, panel))
+
+	rec := httptest.NewRecorder()
+	getClusterUsage(rec, httptest.NewRequest("GET", "/api/v1/usage/cluster", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var usage ClusterUsage
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Source != "panel" || usage.TotalVCPUs != 384 || usage.TotalVMs != 12 {
+		t.Errorf("usage = source %s, total_vcpus %d, total_vms %d", usage.Source, usage.TotalVCPUs, usage.TotalVMs)
+	}
+	if usage.PhysicalRAMGiB != 768 || usage.LogicalStorageTotalTiB != 4 {
+		t.Errorf("physical_ram_gib %v, logical_storage_total_tib %v", usage.PhysicalRAMGiB, usage.LogicalStorageTotalTiB)
+	}
+}
+
+func TestGetClusterUsagePanelErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"non-200", http.StatusInternalServerError, `{"error":"boom"}`, "status 500"},
+		{"malformed JSON", 0, `{"compute": [`, "failed to decode stat response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NOVA_URL", "")
+			panel := newFakePanel(t)
+			panel.statStatus, panel.statBody = tt.status, tt.body
+			usePanel(t, newFakePanelClient(t, panel))
+
+			rec := httptest.NewRecorder()
+			getClusterUsage(rec, httptest.NewRequest("GET", "/api/v1/usage/cluster", nil))
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("status %d, want 502", rec.Code)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("body %s, want it to mention %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOvercommit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"", 0, true},
+		{"4", 4, true},
+		{"1.5", 1.5, true},
+		{"0", 0, false},
+		{"-2", 0, false},
+		{"NaN", 0, false},
+		{"nan", 0, false},
+		{"Inf", 0, false},
+		{"+Inf", 0, false},
+		{"1e400", 0, false},
+		{"four", 0, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/cluster/usage?overcommit="+tt.value, nil)
+		ratio, err := parseOvercommit(req)
+		if (err == nil) != tt.ok || ratio != tt.want {
+			t.Errorf("overcommit=%s: %v, %v; want %v, ok %v", tt.value, ratio, err, tt.want, tt.ok)
+		}
+	}
+}
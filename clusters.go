@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Named clusters. The default cluster is configured by the plain variables
+// (KEYSTONE_URL, GNOCCHI_URL, NOVA_URL, CINDER_URL, VHI_PANEL_URL, ADMIN_*,
+// DOMAINS_FILE, ...) and named by CLUSTER_NAME (default "default"). Every
+// cluster listed in CLUSTERS is configured by the same variables prefixed with
+// CLUSTER_<NAME>_, e.g. for CLUSTERS="dc-2":
+//
+//	CLUSTER_DC_2_KEYSTONE_URL, CLUSTER_DC_2_GNOCCHI_URL, CLUSTER_DC_2_ADMIN_PASSWORD, ...
+//
+// Cluster-scoped endpoints take ?cluster=<name> (default: the default cluster).
+// Cache keys of the non-default clusters are prefixed with cluster:<name>:, so
+// the default cluster keeps its existing keys.
+
+// Cluster is one VHI cluster served by this API.
+type Cluster struct {
+	Name      string
+	envPrefix string             // "" for the default cluster
+	panel     PanelAPI           // nil without VHI_PANEL_URL
+	tokens    *adminTokenManager // Keystone admin token of this cluster
+}
+
+// env reads a variable of this cluster (prefixed for the non-default ones).
+func (c *Cluster) env(key, defaultValue string) string {
+	return getEnv(c.envPrefix+key, defaultValue)
+}
+
+// isDefault reports whether c is the cluster of the plain variables.
+func (c *Cluster) isDefault() bool {
+	return c.envPrefix == ""
+}
+
+// key namespaces a cache key for this cluster.
+func (c *Cluster) key(name string) string {
+	if c.isDefault() {
+		return name
+	}
+	return "cluster:" + c.Name + ":" + name
+}
+
+// clusters holds the configured clusters, the default one first. Set once by
+// loadClusters at startup; until then it is the default cluster alone.
+var clusters = []*Cluster{newCluster(defaultClusterName, "")}
+
+const defaultClusterName = "default"
+
+var clusterNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func newCluster(name, envPrefix string) *Cluster {
+	c := &Cluster{Name: name, envPrefix: envPrefix}
+	c.tokens = &adminTokenManager{key: c.key(adminTokenKey)}
+	return c
+}
+
+// loadClusters reads CLUSTER_NAME and CLUSTERS. Invalid or duplicate names
+// are fatal, like other invalid startup configuration.
+func loadClusters() {
+	name := strings.ToLower(strings.TrimSpace(getEnv("CLUSTER_NAME", defaultClusterName)))
+	if !clusterNamePattern.MatchString(name) {
+		fatal("CLUSTER_NAME is invalid (lowercase letters, digits, - and _)", "value", name)
+	}
+	loaded := []*Cluster{newCluster(name, "")}
+	seen := map[string]bool{name: true}
+
+	for _, entry := range strings.Split(getEnv("CLUSTERS", ""), ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if !clusterNamePattern.MatchString(entry) {
+			fatal("CLUSTERS entry is invalid (lowercase letters, digits, - and _)", "value", entry)
+		}
+		if seen[entry] {
+			fatal("CLUSTERS entry is configured twice", "value", entry)
+		}
+		seen[entry] = true
+		prefix := "CLUSTER_" + strings.ToUpper(strings.ReplaceAll(entry, "-", "_")) + "_"
+		loaded = append(loaded, newCluster(entry, prefix))
+	}
+
+	clusters = loaded
+	if len(clusters) > 1 {
+		names := make([]string, len(clusters))
+		for i, c := range clusters {
+			names[i] = c.Name
+		}
+		slog.Info("Clusters configured", "clusters", strings.Join(names, ","), "default", clusters[0].Name)
+	}
+}
+
+// defaultCluster returns the cluster of the plain variables.
+func defaultCluster() *Cluster {
+	return clusters[0]
+}
+
+// findCluster returns the named cluster, or nil.
+func findCluster(name string) *Cluster {
+	for _, c := range clusters {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+type clusterCtxKey struct{}
+
+// withCluster binds c to ctx; clusterOf(ctx) then returns it.
+func withCluster(ctx context.Context, c *Cluster) context.Context {
+	return context.WithValue(ctx, clusterCtxKey{}, c)
+}
+
+// clusterOf returns the cluster bound to ctx, the default one if none.
+func clusterOf(ctx context.Context) *Cluster {
+	if c, ok := ctx.Value(clusterCtxKey{}).(*Cluster); ok && c != nil {
+		return c
+	}
+	return defaultCluster()
+}
+
+// clusterEnv reads a variable of ctx's cluster.
+func clusterEnv(ctx context.Context, key, defaultValue string) string {
+	return clusterOf(ctx).env(key, defaultValue)
+}
+
+// clusterKey namespaces a cache key for ctx's cluster.
+func clusterKey(ctx context.Context, name string) string {
+	return clusterOf(ctx).key(name)
+}
+
+// panelFor returns the VHI panel client of ctx's cluster, nil when it has none.
+func panelFor(ctx context.Context) PanelAPI {
+	return clusterOf(ctx).panel
+}
+
+// clusterSelect binds the ?cluster= cluster to the request; unknown names are 400.
+func clusterSelect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(r.URL.Query().Get("cluster"))
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c := findCluster(strings.ToLower(name))
+		if c == nil {
+			http.Error(w, fmt.Sprintf(`{"error":"unknown cluster: %s"}`, name), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withCluster(r.Context(), c)))
+	})
+}
+
+// locateInstance wraps an /{instance_id} handler: without ?cluster= and with
+// several clusters, the instance is looked up in every cluster's Gnocchi and
+// the request runs against the one that has it (UUIDs are globally unique).
+// When no cluster knows it, the handler runs on the default and reports 404.
+func locateInstance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(clusters) == 1 || r.URL.Query().Get("cluster") != "" {
+			next(w, r)
+			return
+		}
+		if c := findInstanceCluster(r.Context(), mux.Vars(r)["instance_id"], requestCachePolicy(r)); c != nil {
+			r = r.WithContext(withCluster(r.Context(), c))
+		}
+		next(w, r)
+	}
+}
+
+// findInstanceCluster asks every cluster's Gnocchi for the instance in
+// parallel and returns the first cluster (in configuration order) that has it.
+func findInstanceCluster(ctx context.Context, instanceID string, policy cachePolicy) *Cluster {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	found := make([]bool, len(clusters))
+	var wg sync.WaitGroup
+	for i, c := range clusters {
+		gnocchiURL := c.env("GNOCCHI_URL", "")
+		if gnocchiURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c *Cluster, gnocchiURL string) {
+			defer wg.Done()
+			cctx := withCluster(ctx, c)
+			// Same token as the billing endpoints: GNOCCHI_TOKEN, else the admin token
+			token := c.env("GNOCCHI_TOKEN", "")
+			var reauth func(string) (string, error)
+			if token == "" {
+				var err error
+				if token, err = GetAdminToken(cctx); err != nil {
+					slog.WarnContext(ctx, "Admin token for instance lookup failed", "service", "keystone", "cluster", c.Name, "error", err)
+					return
+				}
+				reauth = adminReauth(cctx)
+			}
+			client := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiURL, Token: token, Insecure: true, Calls: upstreamCallsOf(cctx), Reauth: reauth})
+			if _, err := getInstanceResource(cctx, client, instanceID, policy); err == nil {
+				found[i] = true
+			}
+		}(i, c, gnocchiURL)
+	}
+	wg.Wait()
+
+	for i, c := range clusters {
+		if found[i] {
+			return c
+		}
+	}
+	return nil
+}
+
+// ClusterInfo is one entry of GET /api/v1/clusters.
+type ClusterInfo struct {
+	Name      string          `json:"name"`
+	Default   bool            `json:"default"`
+	Status    string          `json:"status"`    // healthy, degraded
+	Endpoints map[string]bool `json:"endpoints"` // configured backends
+	Keystone  ClusterCheck    `json:"keystone"`
+	Panel     *ClusterCheck   `json:"panel,omitempty"`
+}
+
+// ClusterCheck is the result of one backend check.
+type ClusterCheck struct {
+	OK    bool   `json:"ok"`
+	State string `json:"state,omitempty"` // panel circuit breaker state
+	Error string `json:"error,omitempty"`
+}
+
+// GET /api/v1/clusters
+// Lists the configured clusters with their health: Keystone admin login and,
+// when configured, the VHI panel circuit breaker and login state.
+func getClusters(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	infos := make([]ClusterInfo, len(clusters))
+	var wg sync.WaitGroup
+	for i, c := range clusters {
+		wg.Add(1)
+		go func(i int, c *Cluster) {
+			defer wg.Done()
+			infos[i] = clusterInfo(withCluster(ctx, c), c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, map[string]interface{}{
+		"timestamp": time.Now().Format(time.RFC3339),
+		"clusters":  infos,
+	})
+}
+
+func clusterInfo(ctx context.Context, c *Cluster) ClusterInfo {
+	info := ClusterInfo{
+		Name:    c.Name,
+		Default: c.isDefault(),
+		Status:  "healthy",
+		Endpoints: map[string]bool{
+			"keystone": c.env("KEYSTONE_URL", "") != "",
+			"gnocchi":  c.env("GNOCCHI_URL", "") != "",
+			"nova":     c.env("NOVA_URL", "") != "",
+			"cinder":   c.env("CINDER_URL", "") != "",
+			"panel":    c.panel != nil,
+		},
+	}
+
+	if _, err := GetAdminToken(ctx); err != nil {
+		info.Keystone.Error = err.Error()
+		info.Status = "degraded"
+	} else {
+		info.Keystone.OK = true
+	}
+
+	if c.panel != nil {
+		breaker := c.panel.BreakerStatus()
+		login := c.panel.LoginStatus()
+		check := ClusterCheck{OK: breaker.State == breakerClosed && !login.Suspended, State: breaker.State}
+		if login.Suspended {
+			check.Error = "panel login suspended: " + login.LastError
+		}
+		if !check.OK {
+			info.Status = "degraded"
+		}
+		info.Panel = &check
+	}
+	return info
+}
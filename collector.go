@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Background collector: with COLLECTOR_INTERVAL_SECONDS set, cluster usage,
+// total usage (DOMAINS_FILE) and the instance inventory are collected into the
+// cache every interval, so requests are served from the snapshot. With Redis,
+// replicas elect one collector through collectorLockKey (SET NX with a TTL of
+// one interval, renewed while held); the others skip their run and serve the
+// shared snapshot. When the holder dies its lock expires and another replica
+// takes over.
+
+// collectorLockKey is the Redis key of the collector lock; its value is the
+// holder's instance ID.
+const collectorLockKey = "collector_lock"
+
+// collectorRenewScript extends the lock only while it is still ours.
+var collectorRenewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// collectorLock is this replica's view of the collector lock.
+type collectorLock struct {
+	rdb   redis.UniversalClient // nil: single replica, always held
+	owner string                // this replica's instance ID
+	ttl   time.Duration
+
+	mu        sync.Mutex
+	held      bool
+	heldSince time.Time
+	holder    string // holder seen on the last attempt
+	takeovers int
+	lastError string
+}
+
+// Acquire takes the lock, or renews it when already held. Reports whether
+// this replica holds it.
+func (l *collectorLock) Acquire(ctx context.Context) bool {
+	if l.rdb == nil {
+		return true
+	}
+	l.mu.Lock()
+	held := l.held
+	l.mu.Unlock()
+	if held {
+		return l.Renew(ctx)
+	}
+
+	ok, err := l.rdb.SetNX(ctx, redisKey(collectorLockKey), l.owner, l.ttl).Result()
+	if err != nil {
+		l.fail("acquire", err)
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastError = ""
+	if !ok {
+		holder, err := l.rdb.Get(ctx, redisKey(collectorLockKey)).Result()
+		if err == nil {
+			l.holder = holder
+		}
+		countCollectorLock("busy")
+		return false
+	}
+
+	if l.holder != "" && l.holder != l.owner {
+		// The previous holder's lock expired without being released
+		l.takeovers++
+		slog.Warn("Collector lock taken over (lock expired)", "from", l.holder, "owner", l.owner)
+		metrics.IncCounter("vhi_collector_lock_takeovers_total",
+			"Times this replica took the collector lock over from an expired holder.", nil)
+	} else {
+		slog.Info("Collector lock acquired", "owner", l.owner)
+	}
+	l.held, l.heldSince, l.holder = true, time.Now(), l.owner
+	countCollectorLock("acquired")
+	return true
+}
+
+// Renew extends a held lock by another TTL. Reports false (and drops the
+// lock) when another replica has it by now.
+func (l *collectorLock) Renew(ctx context.Context) bool {
+	if l.rdb == nil {
+		return true
+	}
+	n, err := collectorRenewScript.Run(ctx, l.rdb, []string{redisKey(collectorLockKey)},
+		l.owner, l.ttl.Milliseconds()).Int()
+	if err != nil {
+		l.fail("renew", err)
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastError = ""
+	if n == 0 {
+		if l.held {
+			slog.Warn("Collector lock lost", "owner", l.owner)
+			countCollectorLock("lost")
+		}
+		l.held = false
+		return false
+	}
+	countCollectorLock("renewed")
+	return true
+}
+
+// fail records a Redis error. The lock is treated as not held: if Redis is
+// unreachable, so are the other replicas, and nobody collects twice.
+func (l *collectorLock) fail(op string, err error) {
+	slog.Warn("Collector lock operation failed", "service", "redis", "op", op, "error", err)
+	l.mu.Lock()
+	if l.held {
+		countCollectorLock("lost")
+	}
+	l.held = false
+	l.lastError = fmt.Sprintf("%s: %v", op, err)
+	l.mu.Unlock()
+	countCollectorLock("error")
+}
+
+func countCollectorLock(result string) {
+	metrics.IncCounter("vhi_collector_lock_attempts_total",
+		"Collector lock operations by result (acquired, renewed, busy, lost, error).",
+		map[string]string{"result": result})
+}
+
+// backgroundCollector periodically refreshes the cached snapshots.
+type backgroundCollector struct {
+	interval time.Duration
+	lock     *collectorLock
+
+	mu          sync.Mutex
+	lastRun     time.Time
+	lastSkipped time.Time
+	lastError   string
+}
+
+// collector is the process-wide collector, nil when disabled.
+var collector *backgroundCollector
+
+// newCollectorFromEnv reads COLLECTOR_INTERVAL_SECONDS (unset or 0 disables).
+func newCollectorFromEnv() *backgroundCollector {
+	interval := envSeconds("COLLECTOR_INTERVAL_SECONDS", 0)
+	if interval <= 0 {
+		return nil
+	}
+
+	owner, err := os.Hostname()
+	if err != nil || owner == "" {
+		owner = "replica"
+	}
+	if id, err := newBillingJobID(); err == nil {
+		owner += "-" + id[:8] // unique even when hostnames repeat
+	}
+
+	c := &backgroundCollector{
+		interval: interval,
+		lock:     &collectorLock{rdb: redisClient, owner: owner, ttl: interval},
+	}
+	metrics.RegisterGauge("vhi_collector_lock_owner",
+		"1 while this replica holds the collector lock.",
+		func() []metricSample {
+			if c.lock.isHeld() {
+				return []metricSample{{Value: 1}}
+			}
+			return []metricSample{{Value: 0}}
+		})
+	return c
+}
+
+// isHeld reports whether this replica currently holds the lock.
+func (l *collectorLock) isHeld() bool {
+	if l.rdb == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// Start runs the collection loop and, with Redis, the lock renewal loop.
+func (c *backgroundCollector) Start() {
+	if c.lock.rdb != nil {
+		slog.Info("Background collector enabled (Redis lock)", "interval", c.interval, "owner", c.lock.owner)
+		go c.keepAlive()
+	} else {
+		slog.Info("Background collector enabled (no Redis: not coordinated with other replicas)", "interval", c.interval)
+	}
+	go c.run()
+}
+
+func (c *backgroundCollector) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.tick()
+		<-ticker.C
+	}
+}
+
+// keepAlive renews a held lock three times per TTL, so a long collection
+// never loses it midway.
+func (c *backgroundCollector) keepAlive() {
+	ticker := time.NewTicker(c.lock.ttl / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.lock.isHeld() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		c.lock.Renew(ctx)
+		cancel()
+	}
+}
+
+// tick runs one collection if this replica holds the lock.
+func (c *backgroundCollector) tick() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	leader := c.lock.Acquire(ctx)
+	cancel()
+	if !leader {
+		c.mu.Lock()
+		c.lastSkipped = time.Now()
+		c.mu.Unlock()
+		metrics.IncCounter("vhi_collector_runs_total",
+			"Background collection runs by result (ok, error, skipped).",
+			map[string]string{"result": "skipped"})
+		return
+	}
+
+	err := c.collect()
+	result := "ok"
+	c.mu.Lock()
+	c.lastRun = time.Now()
+	c.lastError = ""
+	if err != nil {
+		result = "error"
+		c.lastError = err.Error()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		slog.Warn("Background collection failed", "error", err)
+	}
+	metrics.IncCounter("vhi_collector_runs_total",
+		"Background collection runs by result (ok, error, skipped).",
+		map[string]string{"result": result})
+}
+
+// collect runs collectCluster for every configured cluster, one after another.
+func (c *backgroundCollector) collect() error {
+	var errs []error
+	for _, cluster := range clusters {
+		if err := c.collectCluster(cluster); err != nil {
+			if len(clusters) > 1 {
+				err = fmt.Errorf("cluster %s: %w", cluster.Name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// collectCluster refreshes the cluster's usage and total usage through their
+// flight groups, so a request arriving meanwhile joins the run instead of
+// starting another, and then its instance list. The usage snapshots are handed
+// to the S3 exporter when it is enabled.
+func (c *backgroundCollector) collectCluster(cluster *Cluster) error {
+	ctx, cancel := context.WithTimeout(withCluster(context.Background(), cluster), 5*time.Minute)
+	defer cancel()
+
+	var errs []error
+	if cluster.panel != nil || cluster.env("NOVA_URL", "") != "" {
+		if v, err, _ := clusterUsageFlight.Do(ctx, cluster.key(cacheKey), refreshClusterUsage(cluster, nil)); err != nil {
+			errs = append(errs, fmt.Errorf("cluster usage: %w", err))
+		} else {
+			exporter.exportSnapshot(cluster, exportKindClusterUsage, v)
+		}
+	}
+
+	if domainFile, domainNames, err := fileConfigs.get().domainNames(cluster); domainFile != "" {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("total usage: %w", err))
+		} else if len(domainNames) > 0 {
+			usageKey := totalUsageCacheKey(cluster, domainNames)
+			if v, err, _ := totalUsageFlight.Do(ctx, usageKey, refreshTotalUsage(cluster, domainNames, usageKey, policyDefault, policyDefault, false, nil)); err != nil {
+				errs = append(errs, fmt.Errorf("total usage: %w", err))
+			} else {
+				exporter.exportSnapshot(cluster, exportKindTotalUsage, v)
+			}
+		}
+	}
+
+	if cluster.env("GNOCCHI_URL", "") != "" {
+		if _, _, _, err := loadInstanceList(ctx, policyRefresh); err != nil {
+			errs = append(errs, fmt.Errorf("instance list: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CollectorHealth is the collector section of GET /api/v1/health/deep.
+type CollectorHealth struct {
+	Enabled         bool    `json:"enabled"`
+	IntervalSeconds int     `json:"interval_seconds,omitempty"`
+	Instance        string  `json:"instance,omitempty"`
+	Coordinated     bool    `json:"coordinated"`          // Redis lock in use
+	Leader          bool    `json:"leader"`               // this replica collects
+	Holder          string  `json:"holder,omitempty"`     // current lock holder
+	HeldSince       *string `json:"held_since,omitempty"` // while leader
+	Takeovers       int     `json:"takeovers"`
+	LockError       string  `json:"lock_error,omitempty"`
+	LastRun         *string `json:"last_run,omitempty"`
+	LastSkipped     *string `json:"last_skipped,omitempty"`
+	LastError       string  `json:"last_error,omitempty"`
+}
+
+// Health reports the collector and lock state; the holder is read from Redis.
+func (c *backgroundCollector) Health(ctx context.Context) CollectorHealth {
+	if c == nil {
+		return CollectorHealth{}
+	}
+	h := CollectorHealth{
+		Enabled:         true,
+		IntervalSeconds: int(c.interval / time.Second),
+		Instance:        c.lock.owner,
+		Coordinated:     c.lock.rdb != nil,
+		Leader:          c.lock.isHeld(),
+	}
+
+	c.lock.mu.Lock()
+	if c.lock.held {
+		since := c.lock.heldSince.Format(time.RFC3339)
+		h.HeldSince = &since
+	}
+	h.Holder = c.lock.holder
+	h.Takeovers = c.lock.takeovers
+	h.LockError = c.lock.lastError
+	c.lock.mu.Unlock()
+
+	if c.lock.rdb != nil {
+		holder, err := c.lock.rdb.Get(ctx, redisKey(collectorLockKey)).Result()
+		switch {
+		case err == nil:
+			h.Holder = holder
+		case errors.Is(err, redis.Nil):
+			h.Holder = ""
+		}
+	} else {
+		h.Holder = c.lock.owner
+	}
+
+	c.mu.Lock()
+	if !c.lastRun.IsZero() {
+		t := c.lastRun.Format(time.RFC3339)
+		h.LastRun = &t
+	}
+	if !c.lastSkipped.IsZero() {
+		t := c.lastSkipped.Format(time.RFC3339)
+		h.LastSkipped = &t
+	}
+	h.LastError = c.lastError
+	c.mu.Unlock()
+	return h
+}
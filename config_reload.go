@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The domain list (every cluster's DOMAINS_FILE), the default pricing
+// expression (PRICING_FILE, else PRICING_EXPR) and the pricing tiers
+// (PRICING_TIERS_FILE) are read into memory at startup
+// and re-read by POST /api/v1/admin/reload, so editing them needs no restart.
+// A reload builds a complete new fileConfig and swaps it in under the lock;
+// a request reads one fileConfig for everything it needs and never sees half
+// of a reload. If any file fails to read or parse, the reload is refused and
+// the current config stays in place.
+
+// fileConfig is one consistent snapshot of the files. It is never modified
+// after the swap.
+type fileConfig struct {
+	LoadedAt time.Time
+	domains  map[string]*domainFile // by cluster name; absent without DOMAINS_FILE
+	pricing  string                 // default pricing expression, "" for none
+	source   string                 // where pricing came from: PRICING_FILE path or "PRICING_EXPR"
+	tiers    *PricingConfig         // nil without PRICING_TIERS_FILE
+	tierFile string
+}
+
+// domainFile is one cluster's DOMAINS_FILE as last read.
+type domainFile struct {
+	path    string
+	entries []DomainEntry
+	err     error // read failure at startup, reported per request as before
+}
+
+// reloadableConfig holds the current fileConfig.
+type reloadableConfig struct {
+	mu      sync.RWMutex
+	current *fileConfig
+	reload  sync.Mutex // one reload at a time
+}
+
+// fileConfigs is the process-wide config, loaded in main after the clusters.
+var fileConfigs reloadableConfig
+
+// get returns the current snapshot; callers keep using it for the whole request.
+func (c *reloadableConfig) get() *fileConfig {
+	c.mu.RLock()
+	cfg := c.current
+	c.mu.RUnlock()
+	if cfg == nil {
+		// Not loaded yet (e.g. called before main finished); read directly
+		var err error
+		if cfg, _, err = readFileConfig(false); err != nil {
+			cfg = &fileConfig{LoadedAt: time.Now(), domains: map[string]*domainFile{}}
+		}
+	}
+	return cfg
+}
+
+// loadFileConfig reads the files at startup. An unreadable DOMAINS_FILE is
+// kept as an error and reported by the endpoints that need it, like before;
+// an invalid pricing or pricing tiers file is fatal.
+func loadFileConfig() {
+	cfg, warnings, err := readFileConfig(false)
+	if err != nil {
+		fatal("Invalid pricing configuration", "error", err)
+	}
+	for _, w := range warnings {
+		slog.Warn("Config file warning", "warning", w)
+	}
+	fileConfigs.mu.Lock()
+	fileConfigs.current = cfg
+	fileConfigs.mu.Unlock()
+}
+
+// readFileConfig reads every file into a new snapshot. With strict, a
+// DOMAINS_FILE that cannot be read is an error instead of being kept in the
+// snapshot.
+func readFileConfig(strict bool) (*fileConfig, []string, error) {
+	cfg := &fileConfig{LoadedAt: time.Now(), domains: make(map[string]*domainFile)}
+	var warnings []string
+
+	for _, cluster := range clusters {
+		path := cluster.env("DOMAINS_FILE", "")
+		if path == "" {
+			continue
+		}
+		entries, fileWarnings, err := loadDomainFile(path)
+		if err != nil && strict {
+			return nil, nil, fmt.Errorf("cluster %s: DOMAINS_FILE %s: %w", cluster.Name, path, err)
+		}
+		for _, w := range fileWarnings {
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %s: %s", cluster.Name, path, w))
+		}
+		cfg.domains[cluster.Name] = &domainFile{path: path, entries: entries, err: err}
+	}
+
+	if path := getEnv("PRICING_FILE", ""); path != "" {
+		src, err := readPricingFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("PRICING_FILE %s: %w", path, err)
+		}
+		cfg.pricing, cfg.source = src, path
+		if getEnv("PRICING_EXPR", "") != "" {
+			warnings = append(warnings, "PRICING_EXPR is ignored because PRICING_FILE is set")
+		}
+	} else if src := getEnv("PRICING_EXPR", ""); src != "" {
+		cfg.pricing, cfg.source = src, "PRICING_EXPR"
+	}
+	if cfg.pricing != "" {
+		if _, err := ParsePricingExpr(cfg.pricing); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", cfg.source, err)
+		}
+	}
+
+	if path := getEnv("PRICING_TIERS_FILE", ""); path != "" {
+		tiers, err := loadPricingConfig(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("PRICING_TIERS_FILE %s: %w", path, err)
+		}
+		cfg.tiers, cfg.tierFile = tiers, path
+	}
+	return cfg, warnings, nil
+}
+
+// readPricingFile returns the pricing expression of a PRICING_FILE: its lines
+// joined, without blank lines and '#' comments.
+func readPricingFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts = append(parts, line)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("no pricing expression in the file")
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// loadDomainFile reads a DOMAINS_FILE, with warnings for lines that are
+// accepted but probably not meant that way.
+func loadDomainFile(path string) ([]DomainEntry, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return parseDomainEntries(file)
+}
+
+// parseDomainEntries parses DOMAINS_FILE lines (see DomainEntry).
+func parseDomainEntries(r io.Reader) ([]DomainEntry, []string, error) {
+	var (
+		domains  []DomainEntry
+		warnings []string
+		seen     = make(map[string]int)
+		lineNo   int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, emails, hasEmails := strings.Cut(line, ";")
+		entry := DomainEntry{Name: strings.TrimSpace(name)}
+		for _, email := range strings.Split(emails, ",") {
+			if email = strings.TrimSpace(email); email == "" {
+				continue
+			}
+			if !strings.Contains(email, "@") {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s does not look like an email address", lineNo, email))
+			}
+			entry.Emails = append(entry.Emails, email)
+		}
+		if entry.Name == "" {
+			warnings = append(warnings, fmt.Sprintf("line %d: no domain name, skipped", lineNo))
+			continue
+		}
+		if hasEmails && len(entry.Emails) == 0 {
+			warnings = append(warnings, fmt.Sprintf("line %d: ';' without email addresses", lineNo))
+		}
+		if first, dup := seen[entry.Name]; dup {
+			warnings = append(warnings, fmt.Sprintf("line %d: domain %s is already listed on line %d", lineNo, entry.Name, first))
+		}
+		seen[entry.Name] = lineNo
+		domains = append(domains, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return domains, warnings, nil
+}
+
+// domainEntries returns the cluster's DOMAINS_FILE path and entries; the path
+// is empty when the cluster has no DOMAINS_FILE.
+func (cfg *fileConfig) domainEntries(cluster *Cluster) (string, []DomainEntry, error) {
+	d := cfg.domains[cluster.Name]
+	if d == nil {
+		return "", nil, nil
+	}
+	return d.path, d.entries, d.err
+}
+
+// domainNames is domainEntries without the emails.
+func (cfg *fileConfig) domainNames(cluster *Cluster) (string, []string, error) {
+	path, entries, err := cfg.domainEntries(cluster)
+	if err != nil {
+		return path, nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return path, names, nil
+}
+
+// pricingExpr returns the default pricing expression parsed; nil when none is configured.
+func (cfg *fileConfig) pricingExpr() (*PricingExpr, error) {
+	if cfg.pricing == "" {
+		return nil, nil
+	}
+	return ParsePricingExpr(cfg.pricing)
+}
+
+// ReloadResponse is the response of POST /api/v1/admin/reload.
+type ReloadResponse struct {
+	LoadedAt string          `json:"loaded_at"`
+	Domains  []ReloadDomains `json:"domains"`
+	Pricing  *ReloadPricing  `json:"pricing"`       // null without a default pricing expression
+	Tiers    *PricingConfig  `json:"pricing_tiers"` // null without PRICING_TIERS_FILE
+	Warnings []string        `json:"warnings"`
+}
+
+// ReloadDomains is one cluster's reloaded DOMAINS_FILE.
+type ReloadDomains struct {
+	Cluster string `json:"cluster"`
+	File    string `json:"file"`
+	Domains int    `json:"domains"`
+	Emails  int    `json:"emails"` // recipients of the monthly reports
+}
+
+// ReloadPricing is the reloaded default pricing expression.
+type ReloadPricing struct {
+	Source     string `json:"source"` // PRICING_FILE path or PRICING_EXPR
+	Expression string `json:"expression"`
+}
+
+// POST /api/v1/admin/reload
+// Re-reads every DOMAINS_FILE, the pricing file and the pricing tiers. 422 (and nothing changes)
+// when a file cannot be read or parsed.
+func postReload(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+
+	fileConfigs.reload.Lock()
+	defer fileConfigs.reload.Unlock()
+
+	cfg, warnings, err := readFileConfig(true)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Config reload refused", "token_label", tokenLabel(r), "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"reload refused, current config kept: %s"}`, strings.ReplaceAll(err.Error(), `"`, `'`)), http.StatusUnprocessableEntity)
+		return
+	}
+	fileConfigs.mu.Lock()
+	fileConfigs.current = cfg
+	fileConfigs.mu.Unlock()
+
+	response := ReloadResponse{
+		LoadedAt: cfg.LoadedAt.Format(time.RFC3339),
+		Domains:  []ReloadDomains{},
+		Warnings: warnings,
+	}
+	if response.Warnings == nil {
+		response.Warnings = []string{}
+	}
+	for _, cluster := range clusters {
+		d := cfg.domains[cluster.Name]
+		if d == nil {
+			continue
+		}
+		summary := ReloadDomains{Cluster: cluster.Name, File: d.path, Domains: len(d.entries)}
+		for _, e := range d.entries {
+			summary.Emails += len(e.Emails)
+		}
+		response.Domains = append(response.Domains, summary)
+	}
+	if cfg.pricing != "" {
+		response.Pricing = &ReloadPricing{Source: cfg.source, Expression: cfg.pricing}
+	}
+	response.Tiers = cfg.tiers
+	slog.InfoContext(r.Context(), "Config reloaded", "token_label", tokenLabel(r),
+		"clusters_with_domains", len(response.Domains), "pricing", cfg.source, "warnings", len(warnings))
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
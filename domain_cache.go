@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// domainProjectsKey prefixes the cached domain name → projects mapping.
+const domainProjectsKey = "domain_projects"
+
+// getDomainCacheTTL returns how long a domain's project list is cached:
+// CACHE_TTL_DOMAINS in seconds (default 10 minutes). Projects rarely change.
+func getDomainCacheTTL() time.Duration {
+	return getCacheTTLFor("DOMAINS", 10*time.Minute)
+}
+
+// resolveDomainProjects returns the projects of a domain, from the cache when
+// possible; otherwise Keystone is asked (two calls) and the result cached.
+// The policy decides whether the cache is read and written. Empty results are
+// not cached, so a domain that is being set up shows up as soon as it has projects.
+// The domain is looked up in ctx's cluster.
+func resolveDomainProjects(ctx context.Context, adminToken, domainName string, policy cachePolicy) ([]KeystoneProject, error) {
+	key := clusterKey(ctx, domainProjectsKey) + ":" + domainName
+	if policy.readsCache() {
+		var projects []KeystoneProject
+		if age, ok := cacheGet(key, &projects); ok {
+			if age <= getDomainCacheTTL() {
+				countCache(key, cacheHit)
+				return projects, nil
+			}
+			countCache(key, cacheMiss)
+		}
+	}
+
+	projects, err := ListProjectsForDomainName(ctx, adminToken, domainName)
+	if err != nil {
+		return nil, err
+	}
+	if len(projects) > 0 && policy.writesCache() {
+		cacheSetExpiry(key, projects, getDomainCacheTTL())
+	}
+	return projects, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DomainUsage is the usage snapshot of a single domain.
+type DomainUsage struct {
+	Timestamp    string                        `json:"timestamp"`
+	DomainName   string                        `json:"domain_name"`
+	TotalVMs     int                           `json:"total_vms"`
+	CPUCoresUsed float64                       `json:"cpu_cores_used"`
+	RAMUsedGB    float64                       `json:"ram_used_gb"`
+	Projects     map[string]DomainProjectUsage `json:"projects"` // by project ID
+	Note         string                        `json:"note,omitempty"`
+	Errors       []UsageError                  `json:"errors,omitempty"`
+}
+
+// DomainProjectUsage is one project's subtotal in DomainUsage.
+type DomainProjectUsage struct {
+	ProjectName string `json:"project_name"`
+	ProjectUsage
+}
+
+// GET /api/v1/usage/domain/{domain_name}
+//
+// Same totals as /usage/total, for one domain, with per-project subtotals.
+// Unknown domains are 404; a domain without projects returns zeros and a note.
+// Partial errors are returned with 206, like /usage/total. ?refresh=true
+// re-resolves the domain's projects in Keystone.
+func getDomainUsage(w http.ResponseWriter, r *http.Request) {
+	domainName := mux.Vars(r)["domain_name"]
+
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+
+	projects, err := resolveDomainProjects(ctx, adminToken, domainName, policy)
+	if errors.Is(err, errDomainNotFound) {
+		http.Error(w, fmt.Sprintf(`{"error":"domain %q not found"}`, domainName), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list projects for domain", "service", "keystone", "domain", domainName, "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to list projects for domain: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+	for _, p := range projects {
+		if !allowProject(w, r, p.ID) {
+			return
+		}
+	}
+
+	response := DomainUsage{
+		Timestamp:  time.Now().Format(time.RFC3339),
+		DomainName: domainName,
+		Projects:   make(map[string]DomainProjectUsage, len(projects)),
+	}
+	if len(projects) == 0 {
+		response.Note = "no projects found for domain"
+		writeDomainUsage(w, &response)
+		return
+	}
+
+	projectToDomain := make(map[string]string, len(projects))
+	for _, p := range projects {
+		projectToDomain[p.ID] = domainName
+	}
+
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+	targets, err := domainUsageTargets(gnocchiClient, projectToDomain)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Domain usage failed", "domain", domainName, "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	sums := sumInstanceUsage(ctx, gnocchiClient, targets, "", "")
+	response.TotalVMs = sums.TotalVMs
+	response.CPUCoresUsed = sums.CPUCoresUsed
+	response.RAMUsedGB = sums.RAMUsedGB
+	response.Errors = sums.Errors
+
+	// Semua project domain ikut ditampilkan, juga yang tanpa instance
+	for _, p := range projects {
+		subtotal := DomainProjectUsage{ProjectName: p.Name}
+		if u := sums.ByProject[p.ID]; u != nil {
+			subtotal.ProjectUsage = *u
+		}
+		response.Projects[p.ID] = subtotal
+	}
+
+	writeDomainUsage(w, &response)
+}
+
+// writeDomainUsage writes usage, with 206 Partial Content when it has partial errors.
+func writeDomainUsage(w http.ResponseWriter, usage *DomainUsage) {
+	w.Header().Set("Content-Type", "application/json")
+	if len(usage.Errors) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	writeJSON(w, usage)
+}
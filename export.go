@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ?format=csv of the per-instance billing endpoints, for spreadsheet imports:
+// one "day" row per date of UsageByDay and a "total" row for the period. The
+// total row's date is the period as start/end. Numbers have 2 decimals unless
+// ?precision=raw. writeCSV is the generic part other endpoints can reuse.
+//
+// Instance and flavor names are user-controlled: a text cell starting with
+// =, +, - or @ gets a ' prefix so spreadsheets don't run it as a formula.
+// Numbers (e.g. a negative adjustment) are written as they are.
+
+const csvContentType = "text/csv; charset=utf-8"
+
+// writeCSV writes header and rows as a CSV attachment named filename.
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) error {
+	w.Header().Set("Content-Type", csvContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		safe := make([]string, len(row))
+		for i, cell := range row {
+			safe[i] = csvSafe(cell)
+		}
+		if err := cw.Write(safe); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvSafe prefixes a text cell that a spreadsheet would read as a formula.
+func csvSafe(cell string) string {
+	if cell == "" || !strings.ContainsRune("=+-@", rune(cell[0])) {
+		return cell
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return cell
+	}
+	return "'" + cell
+}
+
+// usageCSVHeader is the header of the per-instance usage CSV. Day rows and
+// the resource usage export leave the cost columns empty.
+var usageCSVHeader = []string{
+	"row_type", "date", "instance_id", "instance_name", "flavor_name",
+	"cpu_hours", "avg_cpu_percent", "max_cpu_percent", "avg_memory_used_mb", "avg_memory_percent",
+	"currency", "cpu_cost", "memory_cost", "disk_cost", "network_cost", "adjustments_total", "total_cost",
+}
+
+// usageCSVCosts is the number of currency and cost columns at the end of usageCSVHeader.
+const usageCSVCosts = 7
+
+// csvNumber renders a number with 2 decimals, or exactly with ?precision=raw.
+func csvNumber(v float64, p Precision) string {
+	if p == PrecisionRaw {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// csvDate returns the date part of a start_date/end_date value, for file names.
+func csvDate(date string) string {
+	if len(date) >= 10 {
+		return date[:10]
+	}
+	return date
+}
+
+// usageCSVRows returns the day rows, in date order, and the total row without
+// the cost columns (the caller appends them).
+func usageCSVRows(instanceID, name, flavor, startDate, endDate string, cpu CPUUsageStats, memory MemoryUsageStats, p Precision) ([][]string, []string) {
+	type day struct {
+		cpu    *DailyUsage
+		memory *DailyMemUsage
+	}
+	days := make(map[string]*day)
+	dayOf := func(date string) *day {
+		d := days[date]
+		if d == nil {
+			d = &day{}
+			days[date] = d
+		}
+		return d
+	}
+	for i := range cpu.UsageByDay {
+		dayOf(cpu.UsageByDay[i].Date).cpu = &cpu.UsageByDay[i]
+	}
+	for i := range memory.UsageByDay {
+		dayOf(memory.UsageByDay[i].Date).memory = &memory.UsageByDay[i]
+	}
+	dates := make([]string, 0, len(days))
+	for date := range days {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	rows := make([][]string, 0, len(dates)+1)
+	totalCPUHours := 0.0
+	for _, date := range dates {
+		d := days[date]
+		row := []string{"day", date, instanceID, name, flavor, "", "", "", "", ""}
+		if d.cpu != nil {
+			row[5], row[6], row[7] = csvNumber(d.cpu.TotalCPUHours, p), csvNumber(d.cpu.AverageCPU, p), csvNumber(d.cpu.MaxCPU, p)
+			totalCPUHours += d.cpu.TotalCPUHours
+		}
+		if d.memory != nil {
+			row[8], row[9] = csvNumber(d.memory.AverageUsedMB, p), csvNumber(d.memory.AveragePercent, p)
+		}
+		rows = append(rows, append(row, make([]string, usageCSVCosts)...))
+	}
+
+	total := []string{
+		"total", startDate + "/" + endDate, instanceID, name, flavor,
+		csvNumber(totalCPUHours, p), csvNumber(cpu.AveragePercent, p), csvNumber(cpu.MaxPercent, p),
+		csvNumber(memory.AverageUsedMB, p), csvNumber(memory.AveragePercent, p),
+	}
+	return rows, total
+}
+
+// writeBillingReportCSV writes the report (after pricing and adjustments) as CSV.
+func writeBillingReportCSV(w http.ResponseWriter, report BillingReport, p Precision) error {
+	rows, total := usageCSVRows(report.InstanceID, report.InstanceName, report.FlavorName,
+		report.StartDate, report.EndDate, report.CPUUsage, report.MemoryUsage, p)
+	total = append(total, report.Currency,
+		csvNumber(report.CPUCost, p), csvNumber(report.MemoryCost, p), csvNumber(report.DiskCost, p), csvNumber(report.NetworkCost, p),
+		csvNumber(report.AdjustmentsTotal, p), csvNumber(report.TotalCost, p))
+	filename := fmt.Sprintf("billing-report-%s-%s.csv", report.InstanceID, csvDate(report.StartDate))
+	return writeCSV(w, filename, usageCSVHeader, append(rows, total))
+}
+
+// writeResourceUsageCSV writes the resource usage as CSV, without costs.
+func writeResourceUsageCSV(w http.ResponseWriter, usage ResourceUsage, p Precision) error {
+	rows, total := usageCSVRows(usage.InstanceID, usage.InstanceName, usage.FlavorName,
+		usage.StartDate, usage.EndDate, usage.CPU, usage.Memory, p)
+	total = append(total, make([]string, usageCSVCosts)...)
+	filename := fmt.Sprintf("resource-usage-%s-%s.csv", usage.InstanceID, csvDate(usage.StartDate))
+	return writeCSV(w, filename, usageCSVHeader, append(rows, total))
+}
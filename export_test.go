@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readCSV parses the CSV written to rec.
+func readCSV(t *testing.T, rec *httptest.ResponseRecorder) [][]string {
+	t.Helper()
+	records, err := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v\n%s", err, rec.Body.String())
+	}
+	return records
+}
+
+func TestWriteBillingReportCSV(t *testing.T) {
+	report := BillingReport{
+		InstanceID:   "inst-1",
+		InstanceName: `web "front", eu`,
+		FlavorName:   "m1.small",
+		StartDate:    "2026-01-01T00:00:00",
+		EndDate:      "2026-01-03T00:00:00",
+		Currency:     "IDR",
+		CPUUsage: CPUUsageStats{AveragePercent: 25, MaxPercent: 50, UsageByDay: []DailyUsage{
+			{Date: "2026-01-02", TotalCPUHours: 12, AverageCPU: 25, MaxCPU: 50},
+			{Date: "2026-01-01", TotalCPUHours: 6.5, AverageCPU: 13.546, MaxCPU: 20},
+		}},
+		MemoryUsage: MemoryUsageStats{AverageUsedMB: 1024, AveragePercent: 50, UsageByDay: []DailyMemUsage{
+			{Date: "2026-01-01", AverageUsedMB: 1024, AveragePercent: 50},
+		}},
+		CPUCost:          100,
+		AdjustmentsTotal: -15.5,
+		TotalCost:        84.5,
+	}
+	rec := httptest.NewRecorder()
+	if err := writeBillingReportCSV(rec, report, PrecisionRounded); err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != csvContentType {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="billing-report-inst-1-2026-01-01.csv"` {
+		t.Errorf("Content-Disposition = %s", cd)
+	}
+	if !strings.Contains(rec.Body.String(), `"web ""front"", eu"`) {
+		t.Errorf("name is not quoted:\n%s", rec.Body.String())
+	}
+
+	records := readCSV(t, rec)
+	if len(records) != 4 {
+		t.Fatalf("%d records, want header, 2 days and total", len(records))
+	}
+	if got := strings.Join(records[0], ","); got != strings.Join(usageCSVHeader, ",") {
+		t.Errorf("header = %s", got)
+	}
+	for _, row := range records {
+		if len(row) != len(usageCSVHeader) {
+			t.Errorf("row %v has %d columns, want %d", row, len(row), len(usageCSVHeader))
+		}
+	}
+
+	day1, day2, total := records[1], records[2], records[3]
+	if day1[0] != "day" || day1[1] != "2026-01-01" || day2[1] != "2026-01-02" {
+		t.Errorf("day rows out of date order: %v, %v", day1, day2)
+	}
+	if day1[3] != `web "front", eu` || day1[6] != "13.55" || day1[8] != "1024.00" {
+		t.Errorf("day 1 = %v", day1)
+	}
+	if day2[8] != "" || day2[11] != "" {
+		t.Errorf("day 2 has memory or cost cells: %v", day2)
+	}
+	if total[0] != "total" || total[1] != "2026-01-01T00:00:00/2026-01-03T00:00:00" || total[5] != "18.50" {
+		t.Errorf("total = %v", total)
+	}
+	if total[10] != "IDR" || total[15] != "-15.50" || total[16] != "84.50" {
+		t.Errorf("total costs = %v", total[10:])
+	}
+}
+
+func TestWriteCSVBlocksFormulas(t *testing.T) {
+	usage := ResourceUsage{
+		InstanceID:   "inst-1",
+		InstanceName: "=HYPERLINK(\"http://evil\",\"x\")",
+		FlavorName:   "@SUM(A1:A9)",
+		StartDate:    "2026-01-01T00:00:00",
+		EndDate:      "2026-01-02T00:00:00",
+	}
+	rec := httptest.NewRecorder()
+	if err := writeResourceUsageCSV(rec, usage, PrecisionRounded); err != nil {
+		t.Fatal(err)
+	}
+	total := readCSV(t, rec)[1]
+	if total[3] != `'=HYPERLINK("http://evil","x")` || total[4] != "'@SUM(A1:A9)" {
+		t.Errorf("formula cells not prefixed: %v", total[3:5])
+	}
+
+	tests := []struct{ cell, want string }{
+		{"=1+2", "'=1+2"},
+		{"+cmd|' /C calc'!A0", "'+cmd|' /C calc'!A0"},
+		{"-2+3", "'-2+3"},
+		{"@A1", "'@A1"},
+		{"-15.50", "-15.50"},
+		{"+3", "+3"},
+		{"web-1", "web-1"},
+		{"a=b", "a=b"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := csvSafe(tt.cell); got != tt.want {
+			t.Errorf("csvSafe(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// runFair runs tasks on a fixed number of workers, taking them round-robin
+// across groups (projects) so a project with thousands of instances doesn't
+// hold the whole pool while small projects wait. Each group also has its own
+// budget: at most perGroup of its tasks run at once (<= 0 = no limit). Workers
+// are never left idle while an eligible task is waiting. Returns when every
+// task has finished.
+func runFair(workers, perGroup int, tasks map[string][]func()) {
+	s := &fairScheduler{
+		queues:   make(map[string][]func()),
+		running:  make(map[string]int),
+		perGroup: perGroup,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for group, groupTasks := range tasks {
+		if len(groupTasks) == 0 {
+			continue
+		}
+		s.order = append(s.order, group)
+		s.queues[group] = groupTasks
+		s.pending += len(groupTasks)
+	}
+	sort.Strings(s.order) // deterministic rotation
+
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > s.pending {
+		workers = s.pending
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				group, task, ok := s.take()
+				if !ok {
+					return
+				}
+				task()
+				s.done(group)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type fairScheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	order    []string
+	queues   map[string][]func()
+	running  map[string]int
+	next     int // position in order to look at first
+	pending  int // tasks not yet taken
+	perGroup int
+}
+
+// take returns the next task: the first group from the rotation position that
+// has work and is under its budget. Blocks while every group with work is at
+// its budget; ok is false once all tasks have been taken.
+func (s *fairScheduler) take() (group string, task func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.pending == 0 {
+			return "", nil, false
+		}
+		for i := range s.order {
+			g := s.order[(s.next+i)%len(s.order)]
+			if len(s.queues[g]) == 0 || (s.perGroup > 0 && s.running[g] >= s.perGroup) {
+				continue
+			}
+			task = s.queues[g][0]
+			s.queues[g] = s.queues[g][1:]
+			s.running[g]++
+			s.pending--
+			s.next = (s.next + i + 1) % len(s.order)
+			return g, task, true
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *fairScheduler) done(group string) {
+	s.mu.Lock()
+	s.running[group]--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// projectConcurrency returns the per-project budget of runFair
+// (PROJECT_MAX_CONCURRENCY, default 0: no budget). Without one a project
+// may use the whole pool, as before runFair; the round-robin still starts the
+// tasks of small projects ahead of a large project's backlog.
+func projectConcurrency() int {
+	if v, err := strconv.Atoi(getEnv("PROJECT_MAX_CONCURRENCY", "")); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
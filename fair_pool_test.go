@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// peakConcurrency runs n tasks of one project on workers and returns how many
+// ran at once at most.
+func peakConcurrency(workers, perGroup, n int) int {
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+		tasks   = make(map[string][]func())
+	)
+	for i := 0; i < n; i++ {
+		tasks["p-1"] = append(tasks["p-1"], func() {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	runFair(workers, perGroup, tasks)
+	return peak
+}
+
+func TestProjectConcurrencyDefaultUsesThePool(t *testing.T) {
+	if got := peakConcurrency(4, projectConcurrency(), 8); got != 4 {
+		t.Errorf("one project ran %d tasks at once on 4 workers, want 4", got)
+	}
+
+	t.Setenv("PROJECT_MAX_CONCURRENCY", "2")
+	if got := peakConcurrency(4, projectConcurrency(), 8); got != 2 {
+		t.Errorf("with PROJECT_MAX_CONCURRENCY=2: %d at once, want 2", got)
+	}
+}
+
+func TestRunFairRoundRobin(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	task := func(g string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, g)
+			mu.Unlock()
+		}
+	}
+	tasks := map[string][]func(){
+		"big":   {task("big"), task("big"), task("big"), task("big")},
+		"small": {task("small")},
+	}
+	runFair(1, projectConcurrency(), tasks)
+	if len(order) != 5 || order[1] != "small" {
+		t.Errorf("order = %v, want the small project second", order)
+	}
+}
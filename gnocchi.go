@@ -2,21 +2,48 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type GnocchiConfig struct {
-	BaseURL  string
-	Token    string
-	Insecure bool
+	BaseURL    string
+	Token      string
+	Insecure   bool
+	Calls      *upstreamCalls // request counter (upstreamCallsOf); nil counts nothing
+	MaxRetries int            // retries of network errors and 5xx; 0 = defaultGnocchiRetries, < 0 = none
+	NoCache    bool           // skip the measures cache (?nocache=true, see measures_cache.go)
+
+	// Context cancels requests and retry waits (e.g. the batch request or
+	// job); nil: never cancelled.
+	Context context.Context
+
+	// Reauth returns a new token when Gnocchi rejects Token with 401; the
+	// request is retried once with it (adminReauth). nil: 401 is returned.
+	Reauth func(stale string) (string, error)
 }
 
+// defaultGnocchiRetries is GnocchiConfig.MaxRetries when unset; with
+// gnocchiRetryBackoff the waits are about 200ms, 400ms, 800ms (jittered down
+// to half so parallel clients don't retry in step). Retries stop once the
+// waits would exceed gnocchiMaxRetryWait.
+const (
+	defaultGnocchiRetries = 3
+	gnocchiRetryBackoff   = 200 * time.Millisecond
+	gnocchiMaxRetryWait   = 5 * time.Second
+)
+
 type GnocchiClient struct {
 	config     GnocchiConfig
 	httpClient *http.Client
@@ -31,6 +58,7 @@ type InstanceResource struct {
 	Host        string            `json:"host"`
 	CreatedAt   string            `json:"created_at"`
 	StartedAt   string            `json:"started_at"`
+	EndedAt     *string           `json:"ended_at"` // set once the instance was deleted
 	Metrics     map[string]string `json:"metrics"`
 	ProjectID   string            `json:"project_id"`
 	UserID      string            `json:"user_id"`
@@ -49,8 +77,12 @@ func NewGnocchiClient(config GnocchiConfig) *GnocchiClient {
 		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	var transport http.RoundTripper = &countingTransport{base: tr, service: "gnocchi", calls: config.Calls}
+	if config.Reauth != nil {
+		transport = &reauthTransport{base: transport, reauth: config.Reauth}
+	}
 	httpClient := &http.Client{
-		Transport: tr,
+		Transport: transport,
 		Timeout:   30 * time.Second,
 	}
 
@@ -60,10 +92,69 @@ func NewGnocchiClient(config GnocchiConfig) *GnocchiClient {
 	}
 }
 
+// do sends req, retrying network errors and 5xx answers with exponential
+// backoff (Gnocchi under load during billing runs). 4xx answers are returned
+// at once. Every Gnocchi call only reads, so POST searches are retried too;
+// their body is re-sent through req.GetBody. After the last attempt the
+// error or the 5xx response is returned as is. A cancelled request context
+// ends the waits with its error.
+func (c *GnocchiClient) do(req *http.Request) (*http.Response, error) {
+	retries := c.config.MaxRetries
+	if retries == 0 {
+		retries = defaultGnocchiRetries
+	}
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		resp, err := c.httpClient.Do(req)
+		if attempt >= retries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		wait := gnocchiRetryWait(attempt)
+		if waited+wait > gnocchiMaxRetryWait || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err != nil {
+			slog.Warn("Gnocchi request failed, retrying", "service", "gnocchi", "attempt", attempt+1, "error", err)
+		} else {
+			slog.Warn("Gnocchi returned a server error, retrying", "service", "gnocchi", "attempt", attempt+1, "status", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, bodyErr
+			}
+			req.Body = body
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		waited += wait
+	}
+}
+
+// gnocchiRetryWait returns the wait before retry attempt+1: the exponential
+// backoff, with jitter, between half and all of it.
+func gnocchiRetryWait(attempt int) time.Duration {
+	d := gnocchiRetryBackoff << attempt
+	return d/2 + rand.N(d/2+1)
+}
+
+// context returns the context of the client's requests.
+func (c *GnocchiClient) context() context.Context {
+	if c.config.Context != nil {
+		return c.config.Context
+	}
+	return context.Background()
+}
+
 func (c *GnocchiClient) GetInstanceResource(instanceID string) (*InstanceResource, error) {
 	url := fmt.Sprintf("%s/resource/instance/%s", c.config.BaseURL, instanceID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(c.context(), "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -71,7 +162,7 @@ func (c *GnocchiClient) GetInstanceResource(instanceID string) (*InstanceResourc
 	req.Header.Set("X-Auth-Token", c.config.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
@@ -79,7 +170,7 @@ func (c *GnocchiClient) GetInstanceResource(instanceID string) (*InstanceResourc
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		return nil, &gnocchiStatusError{Status: resp.StatusCode, Body: string(body)}
 	}
 
 	var instance InstanceResource
@@ -90,9 +181,31 @@ func (c *GnocchiClient) GetInstanceResource(instanceID string) (*InstanceResourc
 	return &instance, nil
 }
 
+// GetMetricMeasures returns the mean measures of a metric in [startDate, endDate).
+// Windows that have ended are served from the measures cache when possible.
 func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, granularity int) ([]MetricMeasure, error) {
-	url := fmt.Sprintf("%s/metric/%s/measures?granularity=%d&aggregation=mean",
-		c.config.BaseURL, metricID, granularity)
+	if c.config.NoCache || !measuresCacheable(endDate) {
+		return c.fetchMetricMeasures(metricID, startDate, endDate, granularity)
+	}
+	key := measuresCacheKey(c.config.BaseURL, metricID, startDate, endDate, granularity)
+	var measures []MetricMeasure
+	if getCachedMeasures(key, &measures) {
+		return measures, nil
+	}
+	measures, err := c.fetchMetricMeasures(metricID, startDate, endDate, granularity)
+	if err != nil {
+		return nil, err
+	}
+	cacheSetExpiry(key, measures, getMeasuresTTL())
+	return measures, nil
+}
+
+// fetchMetricMeasures asks Gnocchi for the measures, without the cache.
+func (c *GnocchiClient) fetchMetricMeasures(metricID, startDate, endDate string, granularity int) ([]MetricMeasure, error) {
+	url := fmt.Sprintf("%s/metric/%s/measures?aggregation=mean", c.config.BaseURL, metricID)
+	if granularity > 0 {
+		url += fmt.Sprintf("&granularity=%d", granularity)
+	}
 
 	if startDate != "" {
 		url += fmt.Sprintf("&start=%s", startDate)
@@ -100,9 +213,7 @@ func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, g
 	if endDate != "" {
 		url += fmt.Sprintf("&stop=%s", endDate)
 	}
-	// fmt.Println(startDate)
-	// fmt.Println(endDate)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(c.context(), "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -110,7 +221,7 @@ func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, g
 	req.Header.Set("X-Auth-Token", c.config.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
@@ -118,7 +229,7 @@ func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, g
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		return nil, &gnocchiStatusError{Status: resp.StatusCode, Body: string(body)}
 	}
 
 	// Gnocchi returns array of [timestamp, granularity, value]
@@ -127,8 +238,128 @@ func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, g
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	// Convert to structured format
-	measures := make([]MetricMeasure, 0, len(rawMeasures))
+	measures, recovered := parseGnocchiMeasures(rawMeasures)
+	if recovered > 0 {
+		slog.Debug("Gnocchi metric returned string-encoded numbers (parsed)", "service", "gnocchi", "metric_id", metricID, "count", recovered)
+	}
+	if dropped := len(rawMeasures) - len(measures); dropped > 0 {
+		slog.Warn("Gnocchi metric returned malformed measures, dropped", "service", "gnocchi", "metric_id", metricID, "count", dropped)
+	}
+
+	clipped := clipMeasures(measures, startDate, endDate)
+	if outside := len(measures) - len(clipped); outside > 0 {
+		slog.Debug("Gnocchi metric returned measures outside the requested window, dropped", "service", "gnocchi", "metric_id", metricID, "count", outside)
+	}
+	return clipped, nil
+}
+
+// gnocchiStatusError is a non-200 Gnocchi response.
+type gnocchiStatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *gnocchiStatusError) Error() string {
+	return fmt.Sprintf("API returned status %d: %s", e.Status, e.Body)
+}
+
+// GetMetricMeasuresNegotiated fetches measures at the requested granularity.
+// When the metric's archive policy doesn't have it (Gnocchi answers 400), all
+// granularities are fetched and the closest one is used: the finest that is
+// coarser than requested, otherwise the coarsest available. Returns the
+// measures and the granularity (seconds) they are at.
+func (c *GnocchiClient) GetMetricMeasuresNegotiated(metricID, startDate, endDate string, requested int) ([]MetricMeasure, int, error) {
+	measures, err := c.GetMetricMeasures(metricID, startDate, endDate, requested)
+	var statusErr *gnocchiStatusError
+	if err == nil || !errors.As(err, &statusErr) || statusErr.Status != http.StatusBadRequest ||
+		!strings.Contains(strings.ToLower(statusErr.Body), "granularity") {
+		return measures, requested, err
+	}
+
+	all, err := c.GetMetricMeasures(metricID, startDate, endDate, 0)
+	if err != nil {
+		return nil, requested, err
+	}
+	used := pickGranularity(all, requested)
+	if used == 0 {
+		return nil, requested, nil // no data at any granularity
+	}
+	slog.Debug("Gnocchi metric lacks the requested granularity", "service", "gnocchi", "metric_id", metricID,
+		"requested_seconds", requested, "used_seconds", used)
+
+	filtered := make([]MetricMeasure, 0, len(all))
+	for _, m := range all {
+		if int(m.Granularity) == used {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered, used, nil
+}
+
+// GetCounterMeasures is GetMetricMeasuresNegotiated for cumulative counters
+// (cpu, disk and network bytes). Their usage is the growth between samples, so
+// the last sample before startDate is kept as the baseline: without it the
+// growth up to the first sample of the period would be lost. The baseline is
+// looked for within two buckets (at least an hour) before startDate.
+func (c *GnocchiClient) GetCounterMeasures(metricID, startDate, endDate string, requested int) ([]MetricMeasure, int, error) {
+	start, ok := parseGnocchiTime(startDate)
+	if !ok {
+		return c.GetMetricMeasuresNegotiated(metricID, startDate, endDate, requested)
+	}
+	lookback := 2 * time.Duration(requested) * time.Second
+	if lookback < time.Hour {
+		lookback = time.Hour
+	}
+	from := start.Add(-lookback).UTC().Format("2006-01-02T15:04:05")
+	measures, used, err := c.GetMetricMeasuresNegotiated(metricID, from, endDate, requested)
+	if err != nil {
+		return nil, used, err
+	}
+	return keepCounterBaseline(measures, start), used, nil
+}
+
+// keepCounterBaseline drops the measures before start except the last one,
+// the counter's value when the period began.
+func keepCounterBaseline(measures []MetricMeasure, start time.Time) []MetricMeasure {
+	first := 0
+	for i, m := range measures {
+		t, ok := parseGnocchiTime(m.Timestamp)
+		if !ok || !t.Before(start) {
+			break
+		}
+		first = i
+	}
+	return measures[first:]
+}
+
+// pickGranularity chooses among the granularities present in measures:
+// the smallest one >= requested, else the largest. 0 when there are none.
+func pickGranularity(measures []MetricMeasure, requested int) int {
+	coarser, finer := 0, 0
+	for _, m := range measures {
+		g := int(m.Granularity)
+		if g <= 0 {
+			continue
+		}
+		if g >= requested && (coarser == 0 || g < coarser) {
+			coarser = g
+		}
+		if g < requested && g > finer {
+			finer = g
+		}
+	}
+	if coarser != 0 {
+		return coarser
+	}
+	return finer
+}
+
+// parseGnocchiMeasures converts Gnocchi's [timestamp, granularity, value] rows.
+// Some Gnocchi versions encode numbers as JSON strings ("300.0"); those are
+// parsed instead of dropped and counted in recovered. Rows that still don't fit
+// are skipped.
+func parseGnocchiMeasures(rawMeasures [][]interface{}) (measures []MetricMeasure, recovered int) {
+	measures = make([]MetricMeasure, 0, len(rawMeasures))
 	for _, raw := range rawMeasures {
 		if len(raw) != 3 {
 			continue
@@ -139,15 +370,17 @@ func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, g
 			continue
 		}
 
-		granularity, ok := raw[1].(float64)
+		granularity, fromString, ok := gnocchiNumber(raw[1])
 		if !ok {
 			continue
 		}
-
-		value, ok := raw[2].(float64)
+		value, valueFromString, ok := gnocchiNumber(raw[2])
 		if !ok {
 			continue
 		}
+		if fromString || valueFromString {
+			recovered++
+		}
 
 		measures = append(measures, MetricMeasure{
 			Timestamp:   timestamp,
@@ -155,15 +388,62 @@ func (c *GnocchiClient) GetMetricMeasures(metricID, startDate, endDate string, g
 			Value:       value,
 		})
 	}
+	return measures, recovered
+}
 
-	return measures, nil
+// clipMeasures keeps the measures whose timestamp is within [startDate, endDate).
+// Gnocchi may return the bucket that starts just before start (it straddles the
+// boundary); its usage belongs to the previous period. An empty or unparseable
+// bound doesn't clip that side, and neither does an unparseable timestamp.
+func clipMeasures(measures []MetricMeasure, startDate, endDate string) []MetricMeasure {
+	start, hasStart := parseGnocchiTime(startDate)
+	end, hasEnd := parseGnocchiTime(endDate)
+	if !hasStart && !hasEnd {
+		return measures
+	}
+	clipped := measures[:0:0]
+	for _, m := range measures {
+		t, ok := parseGnocchiTime(m.Timestamp)
+		if ok && ((hasStart && t.Before(start)) || (hasEnd && !t.Before(end))) {
+			continue
+		}
+		clipped = append(clipped, m)
+	}
+	return clipped
+}
+
+// parseGnocchiTime parses Gnocchi timestamps and the API's dates (UTC when no
+// zone is given).
+func parseGnocchiTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// gnocchiNumber returns v as a float64, accepting numeric strings
+// (fromString reports that case).
+func gnocchiNumber(v interface{}) (f float64, fromString bool, ok bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, false, true
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return 0, true, false
+		}
+		return parsed, true, true
+	}
+	return 0, false, false
 }
 
 // GetAllInstances retrieves all instance resources from Gnocchi
 func (c *GnocchiClient) GetAllInstances() ([]GnocchiInstance, error) {
 	url := fmt.Sprintf("%s/resource/instance", c.config.BaseURL)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(c.context(), "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -171,7 +451,7 @@ func (c *GnocchiClient) GetAllInstances() ([]GnocchiInstance, error) {
 	req.Header.Set("X-Auth-Token", c.config.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +462,41 @@ func (c *GnocchiClient) GetAllInstances() ([]GnocchiInstance, error) {
 		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
 	}
 
-	//fmt.Println(resp.Body)
+	var instances []GnocchiInstance
+	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// SearchInstancesByProject retrieves the instance resources of one project
+// through Gnocchi's resource search, instead of listing every instance.
+func (c *GnocchiClient) SearchInstancesByProject(projectID string) ([]GnocchiInstance, error) {
+	url := fmt.Sprintf("%s/search/resource/instance", c.config.BaseURL)
+
+	query, err := json.Marshal(map[string]map[string]string{"=": {"project_id": projectID}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(c.context(), "POST", url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
 
 	var instances []GnocchiInstance
 	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
@@ -192,12 +506,61 @@ func (c *GnocchiClient) GetAllInstances() ([]GnocchiInstance, error) {
 	return instances, nil
 }
 
+// GnocchiInterface is an instance_network_interface resource: one tap device
+// of an instance, with its own network.* metrics.
+type GnocchiInterface struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"` // tap device
+	InstanceID string            `json:"instance_id"`
+	Metrics    map[string]string `json:"metrics"`
+}
+
+// GetInstanceInterfaces lists the instance_network_interface resources of an
+// instance through Gnocchi's resource search.
+func (c *GnocchiClient) GetInstanceInterfaces(instanceID string) ([]GnocchiInterface, error) {
+	url := fmt.Sprintf("%s/search/resource/instance_network_interface", c.config.BaseURL)
+
+	query, err := json.Marshal(map[string]map[string]string{"=": {"instance_id": instanceID}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(c.context(), "POST", url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var interfaces []GnocchiInterface
+	if err := json.NewDecoder(resp.Body).Decode(&interfaces); err != nil {
+		return nil, err
+	}
+
+	return interfaces, nil
+}
+
 // GnocchiInstance is the simplified structure for instance list
 type GnocchiInstance struct {
 	ID          string            `json:"id"`
 	DisplayName string            `json:"display_name"`
 	Metrics     map[string]string `json:"metrics"`
 	ProjectID   string            `json:"project_id"`
+	FlavorName  string            `json:"flavor_name"`
+	Host        string            `json:"host"`
+	StartedAt   string            `json:"started_at"`
+	EndedAt     *string           `json:"ended_at"` // set once the instance was deleted
 }
 
 // GnocchiProvisionedStorage berisi hasil aggregate provisioned storage dari Gnocchi.
@@ -241,10 +604,9 @@ func (c *GnocchiClient) GetProvisionedStorage() (*GnocchiProvisionedStorage, err
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	log.Printf("Gnocchi aggregates URL: %s", url)
-	log.Printf("Gnocchi aggregates body: %s", string(bodyJSON))
+	slog.Debug("Gnocchi aggregates request", "service", "gnocchi", "url", url, "body", string(bodyJSON))
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyJSON))
+	req, err := http.NewRequestWithContext(c.context(), "POST", url, bytes.NewReader(bodyJSON))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -252,7 +614,7 @@ func (c *GnocchiClient) GetProvisionedStorage() (*GnocchiProvisionedStorage, err
 	req.Header.Set("X-Auth-Token", c.config.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -263,8 +625,7 @@ func (c *GnocchiClient) GetProvisionedStorage() (*GnocchiProvisionedStorage, err
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	log.Printf("Gnocchi aggregates response status: %d", resp.StatusCode)
-	log.Printf("Gnocchi aggregates response: %s", string(respBody))
+	slog.Debug("Gnocchi aggregates response", "service", "gnocchi", "status", resp.StatusCode, "body", string(respBody))
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
@@ -283,7 +644,7 @@ func (c *GnocchiClient) GetProvisionedStorage() (*GnocchiProvisionedStorage, err
 			last := rawArray[len(rawArray)-1]
 			if len(last) >= 3 {
 				if val, ok := last[2].(float64); ok {
-					log.Printf("Gnocchi provisioned storage (raw array): %.2f GiB = %.4f TiB", val, val/1024.0)
+					slog.Debug("Gnocchi provisioned storage (raw array)", "service", "gnocchi", "gib", val)
 					return &GnocchiProvisionedStorage{
 						TotalGiB: val,
 						TotalTiB: val / 1024.0,
@@ -310,10 +671,70 @@ func (c *GnocchiClient) GetProvisionedStorage() (*GnocchiProvisionedStorage, err
 		return nil, fmt.Errorf("invalid value type in data point")
 	}
 
-	log.Printf("Gnocchi provisioned storage: %.2f GiB = %.4f TiB", value, value/1024.0)
+	slog.Debug("Gnocchi provisioned storage", "service", "gnocchi", "gib", value)
 
 	return &GnocchiProvisionedStorage{
 		TotalGiB: value,
 		TotalTiB: value / 1024.0,
 	}, nil
 }
+
+// GetLatestMeasuresByProjects returns the latest value of metric (mean at
+// granularity) within [now-lookback, now] for every instance resource of the
+// given projects, keyed by resource ID, in one POST /v1/aggregates request.
+// Resources without a measure in the window are absent from the result.
+func (c *GnocchiClient) GetLatestMeasuresByProjects(metric string, projectIDs []string, granularity int, lookback time.Duration) (map[string]float64, error) {
+	now := time.Now().UTC()
+	url := fmt.Sprintf("%s/aggregates?details=False&granularity=%d&start=%s&stop=%s",
+		c.config.BaseURL, granularity, now.Add(-lookback).Format("2006-01-02T15:04:05"), now.Format("2006-01-02T15:04:05"))
+
+	bodyJSON, err := json.Marshal(map[string]interface{}{
+		"operations":    fmt.Sprintf("(metric %s mean)", metric),
+		"search":        map[string]interface{}{"in": map[string]interface{}{"project_id": projectIDs}},
+		"resource_type": "instance",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(c.context(), "POST", url, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &gnocchiStatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+
+	// {"measures": {"<resource_id>": {"<metric>": {"mean": [[timestamp, granularity, value], ...]}}}}
+	var result struct {
+		Measures map[string]json.RawMessage `json:"measures"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	latest := make(map[string]float64, len(result.Measures))
+	for resourceID, raw := range result.Measures {
+		var byMetric map[string]map[string][][]interface{}
+		if err := json.Unmarshal(raw, &byMetric); err != nil {
+			continue // "aggregated" or "references", not a resource
+		}
+		for _, rows := range byMetric[metric] {
+			measures, _ := parseGnocchiMeasures(rows)
+			if len(measures) > 0 {
+				latest[resourceID] = measures[len(measures)-1].Value
+			}
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseGnocchiMeasuresMixedNumbers(t *testing.T) {
+	body := `[
+		["2026-01-01T00:00:00+00:00", 300.0, 1.5],
+		["2026-01-01T00:05:00+00:00", "300.0", "2.5"],
+		["2026-01-01T00:10:00+00:00", 300, " 3 "],
+		["2026-01-01T00:15:00+00:00", 300.0, "n/a"],
+		["2026-01-01T00:20:00+00:00", "NaN", 4.0],
+		["2026-01-01T00:25:00+00:00", 300.0, null],
+		["2026-01-01T00:30:00+00:00", 300.0],
+		[1767226200, 300.0, 5.0]
+	]`
+	var rows [][]interface{}
+	if err := json.Unmarshal([]byte(body), &rows); err != nil {
+		t.Fatal(err)
+	}
+
+	measures, recovered := parseGnocchiMeasures(rows)
+	want := []MetricMeasure{
+		{Timestamp: "2026-01-01T00:00:00+00:00", Granularity: 300, Value: 1.5},
+		{Timestamp: "2026-01-01T00:05:00+00:00", Granularity: 300, Value: 2.5},
+		{Timestamp: "2026-01-01T00:10:00+00:00", Granularity: 300, Value: 3},
+	}
+	if len(measures) != len(want) {
+		t.Fatalf("measures = %+v, want %+v", measures, want)
+	}
+	for i := range want {
+		if measures[i] != want[i] {
+			t.Errorf("measure %d = %+v, want %+v", i, measures[i], want[i])
+		}
+	}
+	if recovered != 2 {
+		t.Errorf("recovered = %d, want 2", recovered)
+	}
+}
+
+func TestGnocchiNumber(t *testing.T) {
+	tests := []struct {
+		in         interface{}
+		want       float64
+		fromString bool
+		ok         bool
+	}{
+		{42.5, 42.5, false, true},
+		{"42.5", 42.5, true, true},
+		{"-1e3", -1000, true, true},
+		{"", 0, true, false},
+		{"abc", 0, true, false},
+		{"Inf", 0, true, false},
+		{true, 0, false, false},
+		{nil, 0, false, false},
+	}
+	for _, tt := range tests {
+		got, fromString, ok := gnocchiNumber(tt.in)
+		if got != tt.want || fromString != tt.fromString || ok != tt.ok {
+			t.Errorf("gnocchiNumber(%#v) = %v, %v, %v; want %v, %v, %v",
+				tt.in, got, fromString, ok, tt.want, tt.fromString, tt.ok)
+		}
+	}
+}
+
+func TestClipMeasures(t *testing.T) {
+	measures := []MetricMeasure{
+		{Timestamp: "2026-01-31T23:55:00+00:00", Value: 1}, // bucket straddling the start
+		{Timestamp: "2026-02-01T00:00:00+00:00", Value: 2}, // exactly on the start: kept
+		{Timestamp: "2026-02-14T12:00:00+00:00", Value: 3},
+		{Timestamp: "2026-02-28T23:55:00+00:00", Value: 4}, // last bucket before the end
+		{Timestamp: "2026-03-01T00:00:00+00:00", Value: 5}, // exactly on the end: dropped
+		{Timestamp: "2026-03-01T00:05:00+00:00", Value: 6},
+	}
+	values := func(ms []MetricMeasure) []float64 {
+		var v []float64
+		for _, m := range ms {
+			v = append(v, m.Value)
+		}
+		return v
+	}
+	tests := []struct {
+		name       string
+		start, end string
+		want       []float64
+	}{
+		{"both bounds", "2026-02-01T00:00:00", "2026-03-01T00:00:00", []float64{2, 3, 4}},
+		{"dates only", "2026-02-01", "2026-03-01", []float64{2, 3, 4}},
+		{"start only", "2026-02-01T00:00:00", "", []float64{2, 3, 4, 5, 6}},
+		{"end only", "", "2026-03-01T00:00:00", []float64{1, 2, 3, 4}},
+		{"zone offset", "2026-02-01T07:00:00+07:00", "2026-03-01T07:00:00+07:00", []float64{2, 3, 4}},
+		{"no bounds", "", "", []float64{1, 2, 3, 4, 5, 6}},
+		{"unparseable bound", "yesterday", "2026-03-01T00:00:00", []float64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		got := values(clipMeasures(measures, tt.start, tt.end))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// An unparseable timestamp is kept; the input is not modified
+	odd := []MetricMeasure{{Timestamp: "not a time", Value: 7}}
+	if got := clipMeasures(odd, "2026-02-01", "2026-03-01"); len(got) != 1 {
+		t.Errorf("unparseable timestamp dropped: %v", got)
+	}
+	if len(measures) != 6 || measures[0].Value != 1 {
+		t.Errorf("input modified: %v", values(measures))
+	}
+}
+
+// newScriptedGnocchi answers the nth request with statuses[n] (the last one
+// once they run out) and counts the requests.
+func newScriptedGnocchi(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		if n >= len(statuses) {
+			n = len(statuses) - 1
+		}
+		status := statuses[n]
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`{"id": "i-1", "display_name": "web-1"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestGnocchiRetriesServerErrors(t *testing.T) {
+	srv, calls := newScriptedGnocchi(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL})
+
+	instance, err := client.GetInstanceResource("i-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.DisplayName != "web-1" || calls.Load() != 3 {
+		t.Errorf("instance %+v after %d calls, want web-1 after 3", instance, calls.Load())
+	}
+}
+
+func TestGnocchiDoesNotRetryClientErrors(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		srv, calls := newScriptedGnocchi(t, status, http.StatusOK)
+		client := NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL})
+
+		_, err := client.GetInstanceResource("i-1")
+		var statusErr *gnocchiStatusError
+		if !errors.As(err, &statusErr) || statusErr.Status != status {
+			t.Errorf("%d: err = %v, want the status error", status, err)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("%d: %d calls, want 1", status, calls.Load())
+		}
+	}
+}
+
+func TestGnocchiRetryStopsOnCancel(t *testing.T) {
+	srv, calls := newScriptedGnocchi(t, http.StatusServiceUnavailable)
+	ctx, cancel := context.WithCancel(context.Background())
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL, MaxRetries: 10, Context: ctx})
+
+	// Cancel during the first wait
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := client.GetInstanceResource("i-1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > gnocchiRetryBackoff/2 {
+		t.Errorf("returned after %v, want it to stop waiting at the cancel", elapsed)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d calls, want 1", calls.Load())
+	}
+
+	// An already cancelled context sends nothing
+	if _, err := client.GetInstanceResource("i-1"); !errors.Is(err, context.Canceled) || calls.Load() != 1 {
+		t.Errorf("after cancel: err = %v, %d calls", err, calls.Load())
+	}
+}
+
+func TestGnocchiRetryWait(t *testing.T) {
+	total := time.Duration(0)
+	for attempt := 0; attempt < defaultGnocchiRetries; attempt++ {
+		full := gnocchiRetryBackoff << attempt
+		for i := 0; i < 100; i++ {
+			if wait := gnocchiRetryWait(attempt); wait < full/2 || wait > full {
+				t.Fatalf("attempt %d: wait %v, want %v to %v", attempt, wait, full/2, full)
+			}
+		}
+		total += full
+	}
+	if total > gnocchiMaxRetryWait {
+		t.Errorf("default retries wait up to %v, above the cap %v", total, gnocchiMaxRetryWait)
+	}
+}
+
+func TestGetCounterMeasuresKeepsBaseline(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("start")
+		w.Write([]byte(`[
+			["2026-01-31T23:00:00+00:00", 300, 50],
+			["2026-01-31T23:55:00+00:00", 300, 100],
+			["2026-02-01T00:05:00+00:00", 300, 160],
+			["2026-02-01T00:10:00+00:00", 300, 200]
+		]`))
+	}))
+	t.Cleanup(srv.Close)
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL, NoCache: true})
+
+	measures, used, err := client.GetCounterMeasures("m-1", "2026-02-01T00:00:00", "2026-03-01T00:00:00", 300)
+	if err != nil || used != 300 {
+		t.Fatalf("used %d, err %v", used, err)
+	}
+	if query != "2026-01-31T23:00:00" {
+		t.Errorf("start = %s, want an hour before the period", query)
+	}
+	if len(measures) != 3 || measures[0].Value != 100 {
+		t.Fatalf("measures = %v, want the last one before the start and the period's", measures)
+	}
+	// The growth from 100 to 160 across the start is billed in the period
+	if increase, _ := counterIncrease(measures); increase != 100 {
+		t.Errorf("increase = %v, want 100", increase)
+	}
+
+	// Nothing before the start: nothing to keep
+	inPeriod := []MetricMeasure{{Timestamp: "2026-02-01T00:00:00+00:00", Value: 1}}
+	start := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	if got := keepCounterBaseline(inPeriod, start); len(got) != 1 {
+		t.Errorf("in-period measures dropped: %v", got)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Client-chosen resolutions (e.g. ?step= of history queries) are bounded by
+// MIN_GRANULARITY_SECONDS (default 60), so a fine step over a long window
+// can't make the backend return millions of points. Below the minimum a
+// request is rejected, or with GRANULARITY_BELOW_MIN=raise served at the
+// minimum instead.
+
+// minGranularity returns MIN_GRANULARITY_SECONDS (default 60s).
+func minGranularity() time.Duration {
+	return envSeconds("MIN_GRANULARITY_SECONDS", time.Minute)
+}
+
+// checkGranularity applies the minimum to a requested resolution (name is the
+// parameter, for the error message) and returns the resolution to use.
+func checkGranularity(name string, requested time.Duration) (time.Duration, error) {
+	floor := minGranularity()
+	if requested >= floor {
+		return requested, nil
+	}
+	if os.Getenv("GRANULARITY_BELOW_MIN") == "raise" {
+		slog.Warn("Granularity below the minimum, using the minimum", "param", name, "requested", requested, "minimum", floor)
+		return floor, nil
+	}
+	return 0, fmt.Errorf("%s must be at least %s (MIN_GRANULARITY_SECONDS)", name, floor)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// DeepHealth is the response of GET /api/v1/health/deep.
+// Unlike /health it reports the state of the backends the API depends on.
+type DeepHealth struct {
+	Status     string                     `json:"status"` // healthy, degraded
+	Time       string                     `json:"time"`
+	Panel      PanelHealth                `json:"panel"`
+	Prometheus []PrometheusEndpointStatus `json:"prometheus,omitempty"` // direct PROMETHEUS_URL endpoints
+	Redis      RedisHealth                `json:"redis"`
+	Collector  CollectorHealth            `json:"collector"`
+}
+
+// PanelHealth describes the VHI panel client state.
+type PanelHealth struct {
+	Configured bool                 `json:"configured"`
+	Breaker    *BreakerStatus       `json:"circuit_breaker,omitempty"`
+	Login      *PanelLoginStatus    `json:"login,omitempty"`
+	Platform   *PanelPlatformStatus `json:"platform,omitempty"` // license and HA
+	Alerts     *AlertSummary        `json:"alerts,omitempty"`
+}
+
+// RedisHealth describes the cache backend state.
+type RedisHealth struct {
+	Enabled       bool    `json:"enabled"`
+	Mode          string  `json:"mode,omitempty"` // single, sentinel, cluster
+	Reachable     bool    `json:"reachable"`
+	Error         string  `json:"error,omitempty"`
+	DegradedSince *string `json:"degraded_since,omitempty"` // unreachable since
+	LastError     string  `json:"last_error,omitempty"`     // most recent failure, also after recovery
+}
+
+// GET /api/v1/health/deep
+func deepHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	health := DeepHealth{
+		Status: "healthy",
+		Time:   time.Now().Format(time.RFC3339),
+		Panel:  PanelHealth{Configured: panelClient != nil},
+		Redis:  RedisHealth{Enabled: redisClient != nil, Mode: redisMode},
+	}
+
+	if redisClient != nil {
+		err := pingRedis(r.Context())
+		health.Redis.Reachable = err == nil
+		if err != nil {
+			health.Redis.Error = err.Error()
+			health.Status = "degraded"
+		}
+		state := redisState.snapshot()
+		health.Redis.LastError = state.LastError
+		if !state.DownSince.IsZero() {
+			since := state.DownSince.Format(time.RFC3339)
+			health.Redis.DegradedSince = &since
+		}
+	}
+
+	health.Collector = collector.Health(r.Context())
+
+	if pool := prometheusPoolFromEnv(); pool != nil {
+		health.Prometheus = pool.Status(true)
+		for _, e := range health.Prometheus {
+			if !e.Reachable {
+				health.Status = "degraded"
+			}
+		}
+	}
+
+	if panelClient != nil {
+		breaker := panelClient.BreakerStatus()
+		health.Panel.Breaker = &breaker
+		if breaker.State != breakerClosed {
+			health.Status = "degraded"
+		}
+
+		login := panelClient.LoginStatus()
+		health.Panel.Login = &login
+		if login.Suspended {
+			health.Status = "degraded"
+		}
+
+		platform := getPanelPlatformStatus(panelClient)
+		health.Panel.Platform = &platform
+		if platform.Degraded() {
+			health.Status = "degraded"
+		}
+
+		alerts, err := getActiveAlerts(panelClient)
+		summary := summarizeAlerts(alerts, err)
+		health.Panel.Alerts = &summary
+		if err != nil || severityRank[summary.Highest] >= severityRank["error"] {
+			health.Status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, health)
+}
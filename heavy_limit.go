@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Heavy endpoints fan out to every instance, project or backend of a cluster.
+// MAX_CONCURRENT_HEAVY_REQUESTS bounds how many of them run at once across
+// all clients; a request that finds no free slot within
+// HEAVY_REQUEST_WAIT_SECONDS gets 429 with Retry-After instead of piling onto
+// the backends. Single-instance billing and health endpoints are not heavy.
+
+// heavyRequestRetryAfter is the Retry-After sent with a 429.
+const heavyRequestRetryAfter = 5 * time.Second
+
+// heavyLimiter is a semaphore over the heavy requests in progress.
+type heavyLimiter struct {
+	slots chan struct{}
+	wait  time.Duration // how long a request may wait for a slot
+}
+
+// heavyRequests is nil (no limit) unless MAX_CONCURRENT_HEAVY_REQUESTS is set.
+var heavyRequests *heavyLimiter
+
+// newHeavyLimiterFromEnv reads MAX_CONCURRENT_HEAVY_REQUESTS (unset or 0: no
+// limit) and HEAVY_REQUEST_WAIT_SECONDS (default 1).
+func newHeavyLimiterFromEnv() *heavyLimiter {
+	max, err := strconv.Atoi(getEnv("MAX_CONCURRENT_HEAVY_REQUESTS", ""))
+	if err != nil || max <= 0 {
+		return nil
+	}
+	l := &heavyLimiter{
+		slots: make(chan struct{}, max),
+		wait:  envSeconds("HEAVY_REQUEST_WAIT_SECONDS", time.Second),
+	}
+	metrics.RegisterGauge("vhi_heavy_requests_in_flight",
+		"Heavy (cluster-wide) requests in progress.",
+		func() []metricSample {
+			return []metricSample{{Value: float64(len(l.slots))}}
+		})
+	slog.Info("Heavy request limit enabled", "max", max, "wait", l.wait)
+	return l
+}
+
+// acquire takes a slot, waiting up to l.wait or until the request is cancelled.
+func (l *heavyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *heavyLimiter) release() {
+	<-l.slots
+}
+
+// heavy wraps a heavy endpoint with the global in-flight limit.
+func heavy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := heavyRequests
+		if l == nil {
+			next(w, r)
+			return
+		}
+		if !l.acquire(r) {
+			metrics.IncCounter("vhi_heavy_requests_rejected_total",
+				"Heavy requests rejected with 429 because every slot was busy.",
+				map[string]string{"path": routePath(r)})
+			slog.WarnContext(r.Context(), "Heavy request limit reached, rejecting", "path", r.URL.Path, "max", cap(l.slots))
+			w.Header().Set("Retry-After", strconv.Itoa(int(heavyRequestRetryAfter.Seconds())))
+			http.Error(w, `{"error":"too many heavy requests in progress, retry later"}`, http.StatusTooManyRequests)
+			return
+		}
+		defer l.release()
+		next(w, r)
+	}
+}
+
+// routePath returns the route template (/usage/project/{project_id}), so the
+// metric label doesn't grow with every project or domain.
+func routePath(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
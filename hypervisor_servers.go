@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HypervisorServer is one server placed on a hypervisor.
+type HypervisorServer struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Flavor    string `json:"flavor"`
+	VCPUs     int    `json:"vcpus"`
+	RAMMB     int    `json:"ram_mb"`
+	Status    string `json:"status"`
+	ProjectID string `json:"project_id"`
+}
+
+// HypervisorServersResponse is the response of GET /api/v1/hypervisors/{hostname}/servers.
+type HypervisorServersResponse struct {
+	Timestamp  string             `json:"timestamp"`
+	Hypervisor string             `json:"hypervisor"` // hypervisor_hostname as Nova reports it
+	Host       string             `json:"host"`       // compute service host
+	Status     string             `json:"status"`
+	State      string             `json:"state"`
+	Count      int                `json:"count"`
+	VCPUs      int                `json:"vcpus"`  // sum over the servers' flavors
+	RAMMB      int                `json:"ram_mb"` // sum over the servers' flavors
+	Servers    []HypervisorServer `json:"servers"`
+}
+
+// findHypervisor returns the hypervisor named hostname: its exact
+// hypervisor_hostname, else the same short name (see nodeKey), so both
+// node1 and node1.example.com work. nil when none matches.
+func findHypervisor(hypervisors []Hypervisor, hostname string) *Hypervisor {
+	for i := range hypervisors {
+		if hypervisors[i].HypervisorHostname == hostname {
+			return &hypervisors[i]
+		}
+	}
+	key := nodeKey(hostname)
+	for i := range hypervisors {
+		if nodeKey(hypervisors[i].HypervisorHostname) == key {
+			return &hypervisors[i]
+		}
+	}
+	return nil
+}
+
+// GET /api/v1/hypervisors/{hostname}/servers
+// Servers placed on one hypervisor (all projects), for rebalancing. Nova is
+// asked with the admin host filter; each server's OS-EXT-SRV-ATTR:host (or
+// hypervisor_hostname) is checked again, so an older Nova that ignores the
+// filter still gives the right list.
+func getHypervisorServers(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	hostname := mux.Vars(r)["hostname"]
+
+	novaURL := clusterEnv(r.Context(), "NOVA_URL", "")
+	if novaURL == "" {
+		http.Error(w, `{"error":"NOVA_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+	novaClient := NewNovaClient(NovaConfig{
+		BaseURL:  novaURL,
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
+	})
+
+	hypervisors, err := novaClient.GetHypervisors()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get hypervisors", "service", "nova", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to get hypervisors from Nova: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+	hypervisor := findHypervisor(hypervisors, hostname)
+	if hypervisor == nil {
+		http.Error(w, fmt.Sprintf(`{"error":"hypervisor %s not found"}`, hostname), http.StatusNotFound)
+		return
+	}
+	host := hypervisor.Service.Host
+	if host == "" {
+		host = hypervisor.HypervisorHostname
+	}
+
+	servers, err := novaClient.ListServersOnHost(host)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list servers on hypervisor", "service", "nova", "host", host, "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to get servers from Nova: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	response := HypervisorServersResponse{
+		Timestamp:  time.Now().Format(time.RFC3339),
+		Hypervisor: hypervisor.HypervisorHostname,
+		Host:       host,
+		Status:     hypervisor.Status,
+		State:      hypervisor.State,
+		Servers:    []HypervisorServer{},
+	}
+	key := nodeKey(host)
+	for _, srv := range servers {
+		if nodeKey(srv.Host) != key && nodeKey(srv.HypervisorHostname) != nodeKey(hypervisor.HypervisorHostname) {
+			continue
+		}
+		response.Servers = append(response.Servers, HypervisorServer{
+			ID:        srv.ID,
+			Name:      srv.Name,
+			Flavor:    srv.Flavor.OriginalName,
+			VCPUs:     srv.Flavor.VCPUs,
+			RAMMB:     srv.Flavor.RAM,
+			Status:    srv.Status,
+			ProjectID: srv.TenantID,
+		})
+		response.VCPUs += srv.Flavor.VCPUs
+		response.RAMMB += srv.Flavor.RAM
+	}
+	sort.Slice(response.Servers, func(i, j int) bool {
+		a, b := response.Servers[i], response.Servers[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	response.Count = len(response.Servers)
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
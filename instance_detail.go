@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// InstanceDetail is the response of GET /api/v1/instances/{instance_id}. Each
+// section carries its own error, so one failing backend doesn't blank the rest.
+type InstanceDetail struct {
+	Timestamp   string                     `json:"timestamp"`
+	InstanceID  string                     `json:"instance_id"`
+	ProjectID   string                     `json:"project_id"`
+	Nova        InstanceNovaDetail         `json:"nova"`
+	Gnocchi     InstanceGnocchiDetail      `json:"gnocchi"`
+	Utilization InstanceUtilizationDetail  `json:"utilization"`
+	Volumes     InstanceVolumesDetail      `json:"volumes"`
+	Billing     InstanceBillingDomainState `json:"billing"`
+}
+
+// InstanceNovaDetail is the server as Nova sees it.
+type InstanceNovaDetail struct {
+	Error            string      `json:"error,omitempty"`
+	Name             string      `json:"name,omitempty"`
+	Status           string      `json:"status,omitempty"`
+	Host             string      `json:"host,omitempty"`
+	AvailabilityZone string      `json:"availability_zone,omitempty"`
+	Created          string      `json:"created,omitempty"`
+	Flavor           *NovaFlavor `json:"flavor,omitempty"`
+}
+
+// InstanceGnocchiDetail is the Gnocchi instance resource.
+type InstanceGnocchiDetail struct {
+	Error       string   `json:"error,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+	FlavorName  string   `json:"flavor_name,omitempty"`
+	FlavorID    string   `json:"flavor_id,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+	StartedAt   string   `json:"started_at,omitempty"`
+	UserID      string   `json:"user_id,omitempty"`
+	Metrics     []string `json:"metrics,omitempty"` // available metric names
+}
+
+// InstanceUtilizationDetail is the current CPU and memory use, from the latest
+// Gnocchi measures of the last hour.
+type InstanceUtilizationDetail struct {
+	Error         string   `json:"error,omitempty"`
+	CPUPercent    *float64 `json:"cpu_percent,omitempty"`
+	MemoryUsedMB  *float64 `json:"memory_used_mb,omitempty"`
+	MemoryTotalMB *float64 `json:"memory_total_mb,omitempty"`
+	MemoryPercent *float64 `json:"memory_percent,omitempty"`
+	MeasuredAt    string   `json:"measured_at,omitempty"`
+}
+
+// InstanceVolume is one attached Cinder volume.
+type InstanceVolume struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	SizeGiB    int    `json:"size_gib"`
+	VolumeType string `json:"volume_type,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Bootable   bool   `json:"bootable"`
+	Device     string `json:"device,omitempty"`
+}
+
+// InstanceVolumesDetail lists the volumes Nova reports as attached.
+type InstanceVolumesDetail struct {
+	Error    string           `json:"error,omitempty"`
+	Volumes  []InstanceVolume `json:"volumes"`
+	TotalGiB int              `json:"total_gib"`
+}
+
+// InstanceBillingDomainState tells which DOMAINS_FILE domain bills the instance.
+type InstanceBillingDomainState struct {
+	Error           string `json:"error,omitempty"`
+	InBillingDomain bool   `json:"in_billing_domain"`
+	DomainName      string `json:"domain_name,omitempty"`
+}
+
+// GET /api/v1/instances/{instance_id}
+//
+// Everything about one VM: Nova server and flavor, Gnocchi resource and
+// metrics, current utilization, attached volumes (Cinder) and billing domain.
+// Sources are queried concurrently; a failing one only sets its section's
+// error (206). 404 only when neither Nova nor Gnocchi knows the ID.
+func getInstanceDetail(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+
+	gnocchiURL := clusterEnv(r.Context(), "GNOCCHI_URL", "")
+	novaURL := clusterEnv(r.Context(), "NOVA_URL", "")
+	if gnocchiURL == "" && novaURL == "" {
+		http.Error(w, `{"error":"neither GNOCCHI_URL nor NOVA_URL is configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiURL, Token: adminToken, Reauth: adminReauth(ctx), Insecure: true, Calls: upstreamCallsOf(r.Context())})
+
+	detail := InstanceDetail{
+		Timestamp:  time.Now().Format(time.RFC3339),
+		InstanceID: instanceID,
+		Volumes:    InstanceVolumesDetail{Volumes: []InstanceVolume{}},
+	}
+	partial := false
+
+	// Tahap 1: Nova dan Gnocchi bersamaan
+	var (
+		server                 *NovaServer
+		resource               *InstanceResource
+		serverErr, resourceErr error
+		wg                     sync.WaitGroup
+	)
+	if novaURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server, serverErr = NewNovaClient(NovaConfig{BaseURL: novaURL, Token: adminToken, Reauth: adminReauth(ctx), Insecure: true, Calls: upstreamCallsOf(r.Context())}).GetServer(instanceID)
+		}()
+	} else {
+		serverErr = errors.New("NOVA_URL is not configured")
+	}
+	if gnocchiURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resource, resourceErr = getInstanceResource(ctx, gnocchiClient, instanceID, policy)
+		}()
+	} else {
+		resourceErr = errors.New("GNOCCHI_URL is not configured")
+	}
+	wg.Wait()
+
+	novaMissing := server == nil && (novaURL == "" || errors.Is(serverErr, errNovaServerNotFound))
+	gnocchiMissing := resource == nil && (gnocchiURL == "" || errors.Is(resourceErr, errInstanceNotFound))
+	if novaMissing && gnocchiMissing {
+		http.Error(w, fmt.Sprintf(`{"error":"instance %s not found in Nova or Gnocchi"}`, instanceID), http.StatusNotFound)
+		return
+	}
+
+	if server != nil {
+		detail.ProjectID = server.TenantID
+		flavor := server.Flavor
+		detail.Nova = InstanceNovaDetail{
+			Name:             server.Name,
+			Status:           server.Status,
+			Host:             server.Host,
+			AvailabilityZone: server.AvailabilityZone,
+			Created:          server.Created,
+			Flavor:           &flavor,
+		}
+	} else {
+		detail.Nova.Error = serverErr.Error()
+		partial = partial || !novaMissing
+	}
+	if resource != nil {
+		detail.ProjectID = resource.ProjectID
+		detail.Gnocchi = InstanceGnocchiDetail{
+			DisplayName: resource.DisplayName,
+			FlavorName:  resource.FlavorName,
+			FlavorID:    resource.FlavorID,
+			Host:        resource.Host,
+			CreatedAt:   resource.CreatedAt,
+			StartedAt:   resource.StartedAt,
+			UserID:      resource.UserID,
+			Metrics:     getMetricKeys(resource.Metrics),
+		}
+		sort.Strings(detail.Gnocchi.Metrics)
+	} else {
+		detail.Gnocchi.Error = resourceErr.Error()
+		partial = partial || !gnocchiMissing
+	}
+	if !allowProject(w, r, detail.ProjectID) {
+		return
+	}
+
+	// Tahap 2: utilization, volumes dan domain bersamaan
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if resource == nil {
+			detail.Utilization.Error = "no Gnocchi resource"
+			return
+		}
+		detail.Utilization = latestUtilization(gnocchiClient, resource.Metrics)
+	}()
+	go func() {
+		defer wg.Done()
+		if server == nil {
+			detail.Volumes.Error = "no Nova server (attachments unknown)"
+			return
+		}
+		detail.Volumes = attachedVolumes(ctx, adminToken, instanceID, server)
+	}()
+	go func() {
+		defer wg.Done()
+		if detail.ProjectID == "" {
+			detail.Billing.Error = "project unknown"
+			return
+		}
+		domainName, errs := billingDomainOf(ctx, adminToken, detail.ProjectID)
+		detail.Billing = InstanceBillingDomainState{InBillingDomain: domainName != "", DomainName: domainName}
+		if len(errs) > 0 {
+			detail.Billing.Error = errs[0].Error
+		}
+	}()
+	wg.Wait()
+
+	if detail.Utilization.Error != "" || detail.Billing.Error != "" ||
+		(detail.Volumes.Error != "" && server != nil && clusterEnv(r.Context(), "CINDER_URL", "") != "") {
+		partial = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if partial {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	writeJSON(w, detail)
+}
+
+// latestUtilization reads the last hour of cpu, memory.usage and memory and
+// reports the latest values. CPU percent is derived from the last two cumulative
+// cpu measures, like CalculateCPUUsage.
+func latestUtilization(client *GnocchiClient, metrics map[string]string) InstanceUtilizationDetail {
+	var u InstanceUtilizationDetail
+	start := time.Now().UTC().Add(-time.Hour).Format("2006-01-02T15:04:05")
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []string
+		last = make(map[string][]MetricMeasure)
+	)
+	for _, name := range []string{"cpu", "vcpus", "memory.usage", "memory"} {
+		id, ok := metrics[name]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(name, id string) {
+			defer wg.Done()
+			measures, err := client.GetMetricMeasures(id, start, "", 300)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			last[name] = measures
+		}(name, id)
+	}
+	wg.Wait()
+
+	if cpu := last["cpu"]; len(cpu) >= 2 {
+		numVCPUs := 1
+		if vcpus := last["vcpus"]; len(vcpus) > 0 && vcpus[len(vcpus)-1].Value > 0 {
+			numVCPUs = int(vcpus[len(vcpus)-1].Value)
+		}
+		stats := CalculateCPUUsage(cpu[len(cpu)-2:], numVCPUs, nil)
+		if stats.TotalDataPoints > 0 {
+			u.CPUPercent = &stats.UsageByHour[0].CPUPercent
+			u.MeasuredAt = cpu[len(cpu)-1].Timestamp
+		}
+	}
+	if used := last["memory.usage"]; len(used) > 0 {
+		v := used[len(used)-1].Value
+		u.MemoryUsedMB = &v
+		if u.MeasuredAt == "" {
+			u.MeasuredAt = used[len(used)-1].Timestamp
+		}
+	}
+	if total := last["memory"]; len(total) > 0 {
+		v := total[len(total)-1].Value
+		u.MemoryTotalMB = &v
+		if u.MemoryUsedMB != nil && v > 0 {
+			pct := *u.MemoryUsedMB / v * 100
+			u.MemoryPercent = &pct
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		u.Error = fmt.Sprintf("failed to read measures: %v", errs)
+	}
+	return u
+}
+
+// attachedVolumes looks up the server's attached volumes in Cinder, in parallel.
+// Volumes Cinder fails on are listed with their ID only and noted in Error.
+func attachedVolumes(ctx context.Context, adminToken, instanceID string, server *NovaServer) InstanceVolumesDetail {
+	detail := InstanceVolumesDetail{Volumes: make([]InstanceVolume, len(server.VolumesAttached))}
+	for i, att := range server.VolumesAttached {
+		detail.Volumes[i] = InstanceVolume{ID: att.ID}
+	}
+	if len(server.VolumesAttached) == 0 {
+		return detail
+	}
+	cinderURL := clusterEnv(ctx, "CINDER_URL", "")
+	if cinderURL == "" {
+		detail.Error = "CINDER_URL is not configured"
+		return detail
+	}
+	cinder := NewCinderClient(CinderConfig{
+		BaseURL:   cinderURL,
+		Token:     adminToken,
+		ProjectID: cinderProjectID(ctx),
+		Insecure:  true,
+		Calls:     upstreamCallsOf(ctx),
+	})
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []string
+	)
+	for i := range detail.Volumes {
+		wg.Add(1)
+		go func(v *InstanceVolume) {
+			defer wg.Done()
+			vol, err := cinder.GetVolume(v.ID)
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %v", v.ID, err))
+				mu.Unlock()
+				return
+			}
+			v.Name = vol.Name
+			v.SizeGiB = vol.Size
+			v.VolumeType = vol.VolumeType
+			v.Status = vol.Status
+			v.Bootable = vol.Bootable == "true"
+			for _, a := range vol.Attachments {
+				if serverID, _ := a["server_id"].(string); serverID == instanceID {
+					v.Device, _ = a["device"].(string)
+				}
+			}
+		}(&detail.Volumes[i])
+	}
+	wg.Wait()
+
+	for _, v := range detail.Volumes {
+		detail.TotalGiB += v.SizeGiB
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		detail.Error = fmt.Sprintf("failed to read volumes: %v", failed)
+	}
+	return detail
+}
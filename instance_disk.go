@@ -0,0 +1,50 @@
+package main
+
+// Per-instance disk activity from the Gnocchi instance metrics: the cumulative
+// disk.device.read.bytes / disk.device.write.bytes counters (the older
+// disk.read.bytes / disk.write.bytes when those are absent) and the volume
+// size (volume.size, else disk.root.size).
+
+// diskMetricNames lists, for read, write and size, the metric names tried in order.
+var diskMetricNames = [3][]string{
+	{"disk.device.read.bytes", "disk.read.bytes"},
+	{"disk.device.write.bytes", "disk.write.bytes"},
+	{"volume.size", "disk.root.size"},
+}
+
+// collectInstanceDiskUsage reads the disk counters and size of the instance
+// for the period. nil when the instance has none of the metrics. The
+// granularity each metric was read at goes into granularityUsed (may be nil).
+// A failed fetch is a *measuresError.
+func collectInstanceDiskUsage(client *GnocchiClient, metrics map[string]string, startDate, endDate string, granularityUsed map[string]int) (*DiskUsageStats, error) {
+	var measures [3][]MetricMeasure
+	found := false
+	for i, names := range diskMetricNames {
+		for _, name := range names {
+			if metricID, ok := metrics[name]; ok {
+				var (
+					used int
+					err  error
+				)
+				if i < 2 { // read and write bytes are counters
+					measures[i], used, err = client.GetCounterMeasures(metricID, startDate, endDate, 300)
+				} else {
+					measures[i], used, err = client.GetMetricMeasuresNegotiated(metricID, startDate, endDate, 300)
+				}
+				if err != nil {
+					return nil, &measuresError{Metric: name, Err: err}
+				}
+				if granularityUsed != nil {
+					granularityUsed[name] = used
+				}
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	usage := CalculateDiskUsage(measures[0], measures[1], measures[2])
+	return &usage, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Inventory page sizes for GET /api/v1/instances.
+const (
+	defaultInventoryLimit = 100
+	maxInventoryLimit     = 1000
+)
+
+// InstanceInventory is the response of GET /api/v1/instances.
+type InstanceInventory struct {
+	Timestamp   string                `json:"timestamp"`
+	CollectedAt string                `json:"collected_at"` // when the inventory was read from Gnocchi/Nova
+	AgeSeconds  int64                 `json:"age_seconds"`
+	Cached      bool                  `json:"cached"`
+	Filters     map[string]string     `json:"filters"`
+	Total       int                   `json:"total"` // matches over all pages
+	Count       int                   `json:"count"`
+	Limit       int                   `json:"limit"`
+	NextMarker  string                `json:"next_marker,omitempty"` // pass as ?marker= for the next page
+	Instances   []InstanceSearchEntry `json:"instances"`
+}
+
+// inventoryFilter selects instances: project and domain exact, name a
+// case-insensitive substring, status case-insensitive (Nova status).
+type inventoryFilter struct {
+	ProjectID string
+	Domain    string
+	Name      string
+	Status    string
+	Allowed   map[string]bool // projects of a restricted token, nil: all
+}
+
+func (f inventoryFilter) match(e InstanceSearchEntry) bool {
+	if f.Allowed != nil && !f.Allowed[e.ProjectID] {
+		return false
+	}
+	if f.ProjectID != "" && e.ProjectID != f.ProjectID {
+		return false
+	}
+	if f.Domain != "" && e.DomainName != f.Domain {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(e.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	if f.Status != "" && !strings.EqualFold(e.Status, f.Status) {
+		return false
+	}
+	return true
+}
+
+// pageInstances returns up to limit of the ID-sorted entries whose ID sorts after
+// marker, and the marker of the next page (empty on the last page). A marker
+// that has disappeared meanwhile (instance deleted) still pages correctly.
+func pageInstances(entries []InstanceSearchEntry, marker string, limit int) (page []InstanceSearchEntry, next string) {
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].ID > marker })
+	end := start + limit
+	if end >= len(entries) {
+		return entries[start:], ""
+	}
+	return entries[start:end], entries[end-1].ID
+}
+
+// GET /api/v1/instances?project_id=&domain=&name=&status=&limit=100&marker=<id>
+//
+// Inventory of the instances known to Gnocchi, with Nova status, flavor size
+// and host. Served from the cached instance list (kept by the background
+// collector when enabled); collected_at tells how fresh it is. Sorted by ID;
+// restricted tokens only see their projects.
+func getInstances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := inventoryFilter{
+		ProjectID: strings.TrimSpace(query.Get("project_id")),
+		Domain:    strings.TrimSpace(query.Get("domain")),
+		Name:      strings.TrimSpace(query.Get("name")),
+		Status:    strings.TrimSpace(query.Get("status")),
+	}
+	if allowed, restricted := tokenProjects(tokenLabel(r)); restricted {
+		filter.Allowed = allowed
+	}
+
+	limit := defaultInventoryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxInventoryLimit {
+			http.Error(w, fmt.Sprintf(`{"error":"limit must be between 1 and %d"}`, maxInventoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	marker := query.Get("marker")
+
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	entries, collectedAt, cached, err := loadInstanceList(ctx, policy)
+	if err != nil {
+		slog.ErrorContext(ctx, "Instance inventory failed", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"instance inventory failed: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	matches := []InstanceSearchEntry{}
+	for _, e := range entries {
+		if filter.match(e) {
+			matches = append(matches, e)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+
+	page, next := pageInstances(matches, marker, limit)
+
+	response := InstanceInventory{
+		Timestamp:   time.Now().Format(time.RFC3339),
+		CollectedAt: collectedAt.Format(time.RFC3339),
+		AgeSeconds:  int64(time.Since(collectedAt).Seconds()),
+		Cached:      cached,
+		Filters: map[string]string{
+			"project_id": filter.ProjectID,
+			"domain":     filter.Domain,
+			"name":       filter.Name,
+			"status":     filter.Status,
+		},
+		Total:      len(matches),
+		Count:      len(page),
+		Limit:      limit,
+		NextMarker: next,
+		Instances:  page,
+	}
+
+	if cached {
+		setXCache(w, cacheHit)
+	} else {
+		setXCache(w, policy.result())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Negative cache for instance lookups: a Gnocchi 404 is remembered under
+// instance_not_found:<id> for CACHE_TTL_NOT_FOUND seconds (default 60), so a
+// consumer polling a long-deleted instance doesn't reach Gnocchi every time.
+// ?refresh=true skips it (?no_store=true neither reads nor writes it), and it is cleared when the ID shows up in a fresh
+// instance list.
+
+const instanceNotFoundKey = "instance_not_found"
+
+// errInstanceNotFound matches (errors.Is) every instance-not-found error.
+var errInstanceNotFound = errors.New("instance not found")
+
+// instanceNotFoundError is returned for an unknown instance ID.
+type instanceNotFoundError struct {
+	ID     string
+	Cached bool // answered from the negative cache
+}
+
+func (e *instanceNotFoundError) Error() string { return fmt.Sprintf("instance %s not found", e.ID) }
+
+func (e *instanceNotFoundError) Is(target error) bool { return target == errInstanceNotFound }
+
+// measuresError is a failed measures fetch of an instance's usage. The usage
+// would otherwise read as zero (a $0 report), so the report is neither
+// returned nor cached; writeInstanceError answers 502.
+type measuresError struct {
+	Metric string // metric name, e.g. memory.usage
+	Err    error
+}
+
+func (e *measuresError) Error() string {
+	return fmt.Sprintf("failed to fetch %s measures from Gnocchi: %v", e.Metric, e.Err)
+}
+
+func (e *measuresError) Unwrap() error { return e.Err }
+
+// getInstanceNotFoundTTL returns how long a not-found result is cached.
+func getInstanceNotFoundTTL() time.Duration {
+	return getCacheTTLFor("NOT_FOUND", time.Minute)
+}
+
+// getInstanceResource looks up an instance in Gnocchi through the negative
+// cache of ctx's cluster.
+func getInstanceResource(ctx context.Context, client *GnocchiClient, instanceID string, policy cachePolicy) (*InstanceResource, error) {
+	key := clusterKey(ctx, instanceNotFoundKey) + ":" + instanceID
+	if policy.readsCache() {
+		var missing bool
+		if age, ok := cacheGet(key, &missing); ok && age <= getInstanceNotFoundTTL() {
+			countCache(key, cacheNegativeHit)
+			return nil, &instanceNotFoundError{ID: instanceID, Cached: true}
+		}
+	}
+
+	instance, err := client.GetInstanceResource(instanceID)
+	var statusErr *gnocchiStatusError
+	if errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound {
+		if policy.writesCache() {
+			cacheSetExpiry(key, true, getInstanceNotFoundTTL())
+		}
+		return nil, &instanceNotFoundError{ID: instanceID}
+	}
+	if err == nil && policy == policyRefresh {
+		cacheDelete(key)
+	}
+	return instance, err
+}
+
+// writeInstanceError writes 404 for an unknown instance, 502 for a failed
+// measures fetch, otherwise 500.
+func writeInstanceError(w http.ResponseWriter, err error) {
+	var fetchErr *measuresError
+	if errors.As(err, &fetchErr) {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadGateway)
+		return
+	}
+	var notFound *instanceNotFoundError
+	if errors.As(err, &notFound) {
+		if notFound.Cached {
+			setXCache(w, cacheNegativeHit)
+		}
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to get instance: %v", err), http.StatusInternalServerError)
+}
+
+// clearInstanceNotFound drops negative entries of ctx's cluster for IDs that
+// exist now. Called with each freshly fetched instance list.
+func clearInstanceNotFound(ctx context.Context, ids map[string]bool) {
+	if !cacheEnabled() {
+		return
+	}
+	prefix := redisKey(clusterKey(ctx, instanceNotFoundKey) + ":")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	iter := redisClient.Scan(ctx, 0, prefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		id := iter.Val()[len(prefix):]
+		if ids[id] {
+			slog.InfoContext(ctx, "Instance exists again, dropping its not-found cache entry", "instance_id", id)
+			redisClient.Del(ctx, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.WarnContext(ctx, "Clearing not-found cache entries failed", "service", "redis", "error", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Per-instance network traffic from Gnocchi. Ceilometer's network.incoming.bytes
+// / network.outgoing.bytes are cumulative counters, kept on one
+// instance_network_interface resource per tap device. Older deployments put
+// them on the instance resource instead, named network.incoming.bytes.<tap>
+// with one metric per interface.
+
+const (
+	netIncomingMetric = "network.incoming.bytes"
+	netOutgoingMetric = "network.outgoing.bytes"
+)
+
+// NetworkUsageStats is the traffic of one interface, or of the whole instance.
+type NetworkUsageStats struct {
+	Interface     string  `json:"interface,omitempty"` // tap device; empty for the total
+	IncomingBytes float64 `json:"incoming_bytes"`
+	OutgoingBytes float64 `json:"outgoing_bytes"`
+	IncomingGB    float64 `json:"incoming_gb"`
+	OutgoingGB    float64 `json:"outgoing_gb"`
+}
+
+// InstanceNetworkUsage is the network section of the resource billing. With
+// only the aggregate metrics (no per-interface ones) Interfaces is empty.
+type InstanceNetworkUsage struct {
+	Total      NetworkUsageStats   `json:"total"`
+	Interfaces []NetworkUsageStats `json:"interfaces"`
+}
+
+// networkInterfaceMetrics maps each interface to its incoming and outgoing
+// metric IDs. Without per-interface metrics, the aggregate ones are returned
+// under the empty interface name.
+func networkInterfaceMetrics(metrics map[string]string) map[string][2]string {
+	ifaces := make(map[string][2]string)
+	for name, id := range metrics {
+		for dir, prefix := range []string{netIncomingMetric + ".", netOutgoingMetric + "."} {
+			if tap := strings.TrimPrefix(name, prefix); tap != name && tap != "" {
+				ids := ifaces[tap]
+				ids[dir] = id
+				ifaces[tap] = ids
+			}
+		}
+	}
+	if len(ifaces) > 0 {
+		return ifaces
+	}
+
+	in, hasIn := metrics[netIncomingMetric]
+	out, hasOut := metrics[netOutgoingMetric]
+	if hasIn || hasOut {
+		ifaces[""] = [2]string{in, out}
+	}
+	return ifaces
+}
+
+// instanceNetworkInterfaces maps each interface of the instance to its incoming
+// and outgoing metric IDs, from the instance_network_interface resources, or
+// from the instance metrics when there are none.
+func instanceNetworkInterfaces(client *GnocchiClient, instanceID string, metrics map[string]string) map[string][2]string {
+	interfaces, err := client.GetInstanceInterfaces(instanceID)
+	if err != nil {
+		slog.Debug("Gnocchi interface search failed, using the instance metrics", "service", "gnocchi",
+			"instance_id", instanceID, "error", err)
+	}
+	ifaces := make(map[string][2]string)
+	for _, iface := range interfaces {
+		in, hasIn := iface.Metrics[netIncomingMetric]
+		out, hasOut := iface.Metrics[netOutgoingMetric]
+		if !hasIn && !hasOut {
+			continue
+		}
+		name := iface.Name
+		if name == "" {
+			name = iface.ID
+		}
+		ifaces[name] = [2]string{in, out}
+	}
+	if len(ifaces) > 0 {
+		return ifaces
+	}
+	return networkInterfaceMetrics(metrics)
+}
+
+// collectInstanceNetworkUsage reads the traffic of every interface in the
+// period, in parallel. nil when the instance has no network metrics. A failed
+// fetch of any interface is a *measuresError, rather than traffic left out of
+// the total.
+func collectInstanceNetworkUsage(client *GnocchiClient, instanceID string, metrics map[string]string, startDate, endDate string) (*InstanceNetworkUsage, error) {
+	ifaces := instanceNetworkInterfaces(client, instanceID, metrics)
+	if len(ifaces) == 0 {
+		return nil, nil
+	}
+
+	counters := make(map[string][2][]MetricMeasure, len(ifaces))
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		fetchErr error
+	)
+	for tap, ids := range ifaces {
+		wg.Add(1)
+		go func(tap string, ids [2]string) {
+			defer wg.Done()
+			var measures [2][]MetricMeasure
+			for dir, id := range ids {
+				if id == "" {
+					continue
+				}
+				var err error
+				if measures[dir], _, err = client.GetCounterMeasures(id, startDate, endDate, 300); err != nil {
+					mu.Lock()
+					if fetchErr == nil {
+						fetchErr = &measuresError{Metric: networkMetricName(dir, tap), Err: err}
+					}
+					mu.Unlock()
+					return
+				}
+			}
+			mu.Lock()
+			counters[tap] = measures
+			mu.Unlock()
+		}(tap, ids)
+	}
+	wg.Wait()
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	usage := CalculateNetworkUsage(counters)
+	return &usage, nil
+}
+
+// networkMetricName names the incoming (dir 0) or outgoing metric of tap in
+// errors; the aggregate metric for the empty interface.
+func networkMetricName(dir int, tap string) string {
+	name := netIncomingMetric
+	if dir == 1 {
+		name = netOutgoingMetric
+	}
+	if tap != "" {
+		name += "." + tap
+	}
+	return name
+}
+
+// NetworkBillingResponse is the body of GET /api/v1/billing/network/{instance_id}.
+// Egress (outgoing) traffic is billed; incoming traffic is reported only.
+type NetworkBillingResponse struct {
+	InstanceID        string               `json:"instance_id"`
+	InstanceName      string               `json:"instance_name"`
+	StartDate         string               `json:"start_date"`
+	EndDate           string               `json:"end_date"`
+	Currency          string               `json:"currency"`
+	Usage             InstanceNetworkUsage `json:"usage"`
+	NetworkPricePerGB float64              `json:"network_price_per_gb"`
+	EgressGB          float64              `json:"egress_gb"`
+	Cost              float64              `json:"cost"`
+}
+
+// GET /api/v1/billing/network/{instance_id}?start_date=&end_date=&network_price_per_gb=
+// Network traffic of the instance in the period (default: previous month) and
+// its egress cost.
+func getNetworkBilling(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+
+	startDate := r.URL.Query().Get("start_date")
+	endDate := r.URL.Query().Get("end_date")
+	if startDate == "" || endDate == "" {
+		now := time.Now()
+		firstDay := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+		lastDay := time.Date(now.Year(), now.Month(), 0, 23, 59, 59, 0, time.UTC)
+		startDate = firstDay.Format("2006-01-02T15:04:05")
+		endDate = lastDay.Format("2006-01-02T15:04:05")
+	}
+	pricePerGB := parseFloat(r.URL.Query().Get("network_price_per_gb"), 0)
+
+	client := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    clusterEnv(r.Context(), "GNOCCHI_TOKEN", ""),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	instance, err := getInstanceResource(r.Context(), client, instanceID, policy)
+	if err != nil {
+		writeInstanceError(w, err)
+		return
+	}
+	if !allowProject(w, r, instance.ProjectID) {
+		return
+	}
+
+	response := NetworkBillingResponse{
+		InstanceID:        instanceID,
+		InstanceName:      instance.DisplayName,
+		StartDate:         startDate,
+		EndDate:           endDate,
+		Currency:          "USD",
+		Usage:             InstanceNetworkUsage{Interfaces: []NetworkUsageStats{}},
+		NetworkPricePerGB: pricePerGB,
+	}
+	usage, err := collectInstanceNetworkUsage(client, instanceID, instance.Metrics, startDate, endDate)
+	if err != nil {
+		writeInstanceError(w, err)
+		return
+	}
+	if usage != nil {
+		response.Usage = *usage
+	}
+	response.EgressGB = response.Usage.Total.OutgoingGB
+	response.Cost = response.EgressGB * pricePerGB
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instanceListKey is the Redis key for the joined instance list used by search.
+const instanceListKey = "instance_list"
+
+// InstanceSearchEntry is one billable instance (Gnocchi resource), with name,
+// flavor, size, status and host taken from Nova when the server still exists.
+type InstanceSearchEntry struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	ProjectID  string  `json:"project_id"`
+	DomainName string  `json:"domain_name,omitempty"` // DOMAINS_FILE domain of the project
+	Flavor     string  `json:"flavor,omitempty"`
+	VCPUs      int     `json:"vcpus,omitempty"`  // from the Nova flavor
+	RAMMB      int     `json:"ram_mb,omitempty"` // from the Nova flavor
+	Status     string  `json:"status,omitempty"` // Nova status, empty when the server is gone
+	Host       string  `json:"host,omitempty"`
+	CreatedAt  string  `json:"created_at,omitempty"`
+	EndedAt    *string `json:"ended_at,omitempty"` // set once the instance was deleted
+}
+
+// InstanceSearchResult is the response of GET /api/v1/instances/search.
+type InstanceSearchResult struct {
+	Timestamp string                `json:"timestamp"`
+	Query     map[string]string     `json:"query"`
+	Count     int                   `json:"count"`
+	Instances []InstanceSearchEntry `json:"instances"`
+	Cached    bool                  `json:"cached"`
+}
+
+// getInstanceListTTL returns how long the instance list is reused
+// (CACHE_TTL_INSTANCES, older name INSTANCE_LIST_CACHE_SECONDS, default 30).
+// Searches come in bursts. With the background collector, which refreshes the
+// list every interval, it is at least two intervals.
+func getInstanceListTTL() time.Duration {
+	ttl := getCacheTTLFor("INSTANCES", envSeconds("INSTANCE_LIST_CACHE_SECONDS", 30*time.Second))
+	if collector != nil && 2*collector.interval > ttl {
+		ttl = 2 * collector.interval
+	}
+	return ttl
+}
+
+// loadInstanceList returns the joined Gnocchi/Nova instance list and when it was
+// collected, from Redis when it is younger than getInstanceListTTL and the
+// policy allows. Nova is optional: without NOVA_URL (or when it fails) only the
+// Gnocchi attributes are used. Domain names come from DOMAINS_FILE. All of it
+// for ctx's cluster.
+func loadInstanceList(ctx context.Context, policy cachePolicy) ([]InstanceSearchEntry, time.Time, bool, error) {
+	key := clusterKey(ctx, instanceListKey)
+	var entries []InstanceSearchEntry
+	if policy.readsCache() {
+		if age, ok := cacheGet(key, &entries); ok {
+			if age <= getInstanceListTTL() {
+				countCache(key, cacheHit)
+				return entries, time.Now().Add(-age), true, nil
+			}
+			countCache(key, cacheMiss)
+		}
+	}
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("failed to authenticate admin: %w", err)
+	}
+	collectedAt := time.Now()
+
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(ctx, "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
+	})
+
+	var (
+		instances  []GnocchiInstance
+		gnocchiErr error
+		servers    []NovaServer
+		serversErr error
+		domains    map[string]string
+		wg         sync.WaitGroup
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		instances, gnocchiErr = gnocchiClient.GetAllInstances()
+	}()
+	go func() {
+		defer wg.Done()
+		var domainErrs []UsageError
+		domains, domainErrs = billingDomainProjects(ctx, adminToken)
+		for _, e := range domainErrs {
+			slog.WarnContext(ctx, "Instance list built without domain", "domain", e.DomainName, "error", e.Error)
+		}
+	}()
+	if novaURL := clusterEnv(ctx, "NOVA_URL", ""); novaURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			servers, serversErr = NewNovaClient(NovaConfig{
+				BaseURL:  novaURL,
+				Token:    adminToken,
+				Reauth:   adminReauth(ctx),
+				Insecure: true,
+				Calls:    upstreamCallsOf(ctx),
+			}).ListAllServers()
+		}()
+	}
+	wg.Wait()
+
+	if gnocchiErr != nil {
+		return nil, time.Time{}, false, fmt.Errorf("Gnocchi instances failed: %w", gnocchiErr)
+	}
+	if serversErr != nil {
+		slog.WarnContext(ctx, "Nova servers failed, searching Gnocchi attributes only", "service", "nova", "error", serversErr)
+		servers = nil
+	}
+
+	entries = joinInstanceList(instances, servers, domains)
+	if !policy.writesCache() {
+		return entries, collectedAt, false, nil
+	}
+	cacheSetExpiry(key, entries, getInstanceListTTL())
+
+	ids := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		ids[e.ID] = true
+	}
+	clearInstanceNotFound(ctx, ids)
+	return entries, collectedAt, false, nil
+}
+
+// joinInstanceList merges Nova server details into the Gnocchi instance list by
+// UUID and sets the domain of each project found in projectToDomain.
+func joinInstanceList(instances []GnocchiInstance, servers []NovaServer, projectToDomain map[string]string) []InstanceSearchEntry {
+	serverByID := make(map[string]NovaServer, len(servers))
+	for _, srv := range servers {
+		serverByID[srv.ID] = srv
+	}
+
+	entries := make([]InstanceSearchEntry, 0, len(instances))
+	for _, inst := range instances {
+		entry := InstanceSearchEntry{
+			ID:         inst.ID,
+			Name:       inst.DisplayName,
+			ProjectID:  inst.ProjectID,
+			DomainName: projectToDomain[inst.ProjectID],
+			Flavor:     inst.FlavorName,
+			Host:       inst.Host,
+			CreatedAt:  inst.StartedAt,
+			EndedAt:    inst.EndedAt,
+		}
+		if srv, ok := serverByID[inst.ID]; ok {
+			// Nova has the current name (servers can be renamed)
+			if srv.Name != "" {
+				entry.Name = srv.Name
+			}
+			if srv.Flavor.OriginalName != "" {
+				entry.Flavor = srv.Flavor.OriginalName
+			}
+			entry.Status = srv.Status
+			entry.VCPUs = srv.Flavor.VCPUs
+			entry.RAMMB = srv.Flavor.RAM
+			if srv.Host != "" {
+				entry.Host = srv.Host
+			}
+			if srv.Created != "" {
+				entry.CreatedAt = srv.Created
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// searchInstances filters entries: q is a case-insensitive substring of the name,
+// project an exact project ID, flavor a case-insensitive substring of the flavor.
+func searchInstances(entries []InstanceSearchEntry, q, project, flavor string) []InstanceSearchEntry {
+	q = strings.ToLower(q)
+	flavor = strings.ToLower(flavor)
+
+	matches := []InstanceSearchEntry{}
+	for _, e := range entries {
+		if q != "" && !strings.Contains(strings.ToLower(e.Name), q) {
+			continue
+		}
+		if project != "" && e.ProjectID != project {
+			continue
+		}
+		if flavor != "" && !strings.Contains(strings.ToLower(e.Flavor), flavor) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Name != matches[j].Name {
+			return matches[i].Name < matches[j].Name
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches
+}
+
+// GET /api/v1/instances/search?q=web&project=<project_id>&flavor=medium
+func getInstanceSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	project := strings.TrimSpace(r.URL.Query().Get("project"))
+	flavor := strings.TrimSpace(r.URL.Query().Get("flavor"))
+	if q == "" && project == "" && flavor == "" {
+		http.Error(w, `{"error":"at least one of q, project or flavor is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	entries, _, cached, err := loadInstanceList(ctx, policy)
+	if err != nil {
+		slog.ErrorContext(ctx, "Instance search failed", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"instance search failed: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	// Restricted tokens only find instances of their projects
+	if allowed, restricted := tokenProjects(tokenLabel(r)); restricted {
+		visible := entries[:0:0]
+		for _, e := range entries {
+			if allowed[e.ProjectID] {
+				visible = append(visible, e)
+			}
+		}
+		entries = visible
+	}
+
+	matches := searchInstances(entries, q, project, flavor)
+	response := InstanceSearchResult{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Query:     map[string]string{"q": q, "project": project, "flavor": flavor},
+		Count:     len(matches),
+		Instances: matches,
+		Cached:    cached,
+	}
+
+	if cached {
+		setXCache(w, cacheHit)
+	} else {
+		setXCache(w, policy.result())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Uptime from the Nova action log (os-instance-actions): every successful
+// lifecycle action moves the instance into a state, up (create, start, reboot,
+// resume, unpause, unshelve, ...) or down (stop, suspend, pause, shelve,
+// rescue, soft delete). Actions that failed (message set) change nothing;
+// when Nova reports the server in ERROR now, the time since its last action
+// is counted as ERROR downtime. Time before the instance was created or after
+// it was deleted is outside the observed window. Gnocchi keeps no state
+// history for instances in VHI, so Nova is the only history source.
+
+// InstanceUptime is the response of GET /api/v1/instances/{instance_id}/uptime.
+type InstanceUptime struct {
+	Timestamp        string             `json:"timestamp"`
+	InstanceID       string             `json:"instance_id"`
+	Start            string             `json:"start"`
+	End              string             `json:"end"`
+	Source           string             `json:"source"` // nova_instance_actions
+	HistoryAvailable bool               `json:"history_available"`
+	Note             string             `json:"note,omitempty"`
+	CurrentStatus    string             `json:"current_status,omitempty"`
+	ObservedSeconds  float64            `json:"observed_seconds"` // part of the period the instance existed
+	UptimeSeconds    float64            `json:"uptime_seconds"`
+	DowntimeSeconds  float64            `json:"downtime_seconds"`
+	UptimePct        *float64           `json:"uptime_pct"` // null without history or observed time
+	Downtime         []DowntimeInterval `json:"downtime"`
+	FailedActions    int                `json:"failed_actions"`
+}
+
+// DowntimeInterval is one period the instance was not ACTIVE.
+type DowntimeInterval struct {
+	Start   string  `json:"start"`
+	End     string  `json:"end"`
+	Seconds float64 `json:"seconds"`
+	State   string  `json:"state"`            // SHUTOFF, SUSPENDED, PAUSED, SHELVED, RESCUED, SOFT_DELETED, ERROR
+	Action  string  `json:"action,omitempty"` // action that started it
+}
+
+const (
+	uptimeStateActive  = "ACTIVE"
+	uptimeStateDeleted = "DELETED"
+	uptimeStateError   = "ERROR"
+)
+
+// uptimeActionStates maps the lifecycle actions to the state they leave the
+// instance in. Other actions (resize, migrate, attach, ...) keep the state.
+var uptimeActionStates = map[string]string{
+	"create":        uptimeStateActive,
+	"start":         uptimeStateActive,
+	"reboot":        uptimeStateActive,
+	"resume":        uptimeStateActive,
+	"unpause":       uptimeStateActive,
+	"unshelve":      uptimeStateActive,
+	"unrescue":      uptimeStateActive,
+	"rebuild":       uptimeStateActive,
+	"evacuate":      uptimeStateActive,
+	"restore":       uptimeStateActive,
+	"stop":          "SHUTOFF",
+	"suspend":       "SUSPENDED",
+	"pause":         "PAUSED",
+	"shelve":        "SHELVED",
+	"shelveOffload": "SHELVED",
+	"rescue":        "RESCUED",
+	"softDelete":    "SOFT_DELETED",
+	"delete":        uptimeStateDeleted,
+	"forceDelete":   uptimeStateDeleted,
+}
+
+// uptimeSegment is the instance's state from since until the next segment.
+type uptimeSegment struct {
+	since  time.Time
+	state  string
+	action string
+}
+
+// GET /api/v1/instances/{instance_id}/uptime?start=...&end=...
+// start/end (or start_date/end_date) default to the previous calendar month.
+func getInstanceUptime(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	novaURL := clusterEnv(r.Context(), "NOVA_URL", "")
+	if novaURL == "" {
+		http.Error(w, `{"error":"NOVA_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	start, end, err := uptimePeriod(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+	novaClient := NewNovaClient(NovaConfig{BaseURL: novaURL, Token: adminToken, Reauth: adminReauth(ctx), Insecure: true, Calls: upstreamCallsOf(r.Context())})
+
+	var (
+		server     *NovaServer
+		serverErr  error
+		actions    []NovaInstanceAction
+		actionsErr error
+		wg         sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		server, serverErr = novaClient.GetServer(instanceID)
+	}()
+	go func() {
+		defer wg.Done()
+		actions, actionsErr = novaClient.ListInstanceActions(instanceID)
+	}()
+	wg.Wait()
+
+	if server == nil && errors.Is(actionsErr, errNovaServerNotFound) {
+		http.Error(w, fmt.Sprintf(`{"error":"instance %s not found in Nova"}`, instanceID), http.StatusNotFound)
+		return
+	}
+	// Deleted servers are only in the action log; their project comes from Gnocchi
+	if server != nil {
+		if !allowProject(w, r, server.TenantID) {
+			return
+		}
+	} else if gnocchiURL := clusterEnv(r.Context(), "GNOCCHI_URL", ""); gnocchiURL != "" {
+		gnocchiClient := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiURL, Token: adminToken, Reauth: adminReauth(ctx), Insecure: true, Calls: upstreamCallsOf(r.Context())})
+		if !allowInstance(w, r, gnocchiClient, instanceID) {
+			return
+		}
+	} else if _, restricted := tokenProjects(tokenLabel(r)); restricted {
+		http.Error(w, `{"error":"instance is not in a project allowed for this token"}`, http.StatusForbidden)
+		return
+	}
+	if serverErr != nil && !errors.Is(serverErr, errNovaServerNotFound) {
+		slog.WarnContext(r.Context(), "Nova server lookup failed", "service", "nova", "instance_id", instanceID, "error", serverErr)
+	}
+
+	uptime := InstanceUptime{
+		Timestamp:  time.Now().Format(time.RFC3339),
+		InstanceID: instanceID,
+		Start:      start.Format(time.RFC3339),
+		End:        end.Format(time.RFC3339),
+		Source:     "nova_instance_actions",
+		Downtime:   []DowntimeInterval{},
+	}
+	if server != nil {
+		uptime.CurrentStatus = server.Status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if actionsErr != nil {
+		slog.WarnContext(r.Context(), "Nova instance actions failed", "service", "nova", "instance_id", instanceID, "error", actionsErr)
+		uptime.Note = fmt.Sprintf("history unavailable: Nova instance actions failed (%v); only the current state is known", actionsErr)
+		writeJSON(w, uptime)
+		return
+	}
+	uptime.HistoryAvailable = true
+
+	segments, failed, note := uptimeTimeline(actions, server)
+	uptime.FailedActions = failed
+	uptime.Note = note
+	computeUptime(&uptime, segments, start, end)
+	writeJSON(w, uptime)
+}
+
+// uptimePeriod parses start/end (2006-01-02T15:04:05 or 2006-01-02, UTC). The
+// end is capped at now.
+func uptimePeriod(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	startStr, endStr := q.Get("start"), q.Get("end")
+	if startStr == "" || endStr == "" {
+		startStr, endStr = q.Get("start_date"), q.Get("end_date")
+	}
+	now := time.Now().UTC()
+	if startStr == "" || endStr == "" {
+		// Previous calendar month, like /billing/report
+		return time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	parse := func(s string) (time.Time, error) {
+		if t, err := time.Parse("2006-01-02T15:04:05", s); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02", s)
+	}
+	start, err := parse(startStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start %s (use 2006-01-02T15:04:05)", startStr)
+	}
+	end, err := parse(endStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end %s (use 2006-01-02T15:04:05)", endStr)
+	}
+	if end.After(now) {
+		end = now
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end must be after start (and start in the past)")
+	}
+	return start, end, nil
+}
+
+// uptimeTimeline turns the action log into state segments, oldest first. It
+// returns the number of failed actions and a note when the history is incomplete.
+func uptimeTimeline(actions []NovaInstanceAction, server *NovaServer) ([]uptimeSegment, int, string) {
+	type event struct {
+		at     time.Time
+		action string
+		failed bool
+	}
+	var events []event
+	for _, a := range actions {
+		at, err := parseNovaTime(a.StartTime)
+		if err != nil {
+			continue
+		}
+		events = append(events, event{at: at, action: a.Action, failed: a.Message != ""})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+
+	var (
+		segments []uptimeSegment
+		failed   int
+		note     string
+		last     time.Time
+	)
+	for _, e := range events {
+		last = e.at
+		if e.failed {
+			failed++
+			continue
+		}
+		state, ok := uptimeActionStates[e.action]
+		if !ok {
+			continue
+		}
+		if len(segments) == 0 && e.action != "create" {
+			// The log starts after creation (purged or imported): the state
+			// before the first transition is its opposite
+			before := uptimeStateActive
+			if state == uptimeStateActive && e.action != "reboot" {
+				before = "SHUTOFF"
+			}
+			since := time.Time{}
+			if server != nil {
+				if created, err := time.Parse(time.RFC3339, server.Created); err == nil {
+					since = created
+				}
+			}
+			segments = append(segments, uptimeSegment{since: since, state: before})
+			note = "the action log does not start with create; the state before " + e.at.Format(time.RFC3339) + " is inferred from the first action"
+		}
+		if n := len(segments); n > 0 && segments[n-1].state == state {
+			continue
+		}
+		segments = append(segments, uptimeSegment{since: e.at, state: state, action: e.action})
+	}
+
+	if server != nil && server.Status == uptimeStateError && len(segments) > 0 &&
+		segments[len(segments)-1].state != uptimeStateError && !last.IsZero() {
+		segments = append(segments, uptimeSegment{since: last, state: uptimeStateError})
+	}
+	if len(segments) == 0 && note == "" {
+		note = "no lifecycle actions recorded for this instance"
+	}
+	return segments, failed, note
+}
+
+// computeUptime fills the totals and downtime intervals of u for [start, end).
+func computeUptime(u *InstanceUptime, segments []uptimeSegment, start, end time.Time) {
+	for i, seg := range segments {
+		segEnd := end
+		if i+1 < len(segments) {
+			segEnd = segments[i+1].since
+		}
+		from, to := seg.since, segEnd
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if !to.After(from) || seg.state == uptimeStateDeleted {
+			continue
+		}
+		seconds := to.Sub(from).Seconds()
+		u.ObservedSeconds += seconds
+		if seg.state == uptimeStateActive {
+			u.UptimeSeconds += seconds
+			continue
+		}
+		u.DowntimeSeconds += seconds
+		u.Downtime = append(u.Downtime, DowntimeInterval{
+			Start:   from.Format(time.RFC3339),
+			End:     to.Format(time.RFC3339),
+			Seconds: seconds,
+			State:   seg.state,
+			Action:  seg.action,
+		})
+	}
+	if u.ObservedSeconds > 0 {
+		pct := u.UptimeSeconds / u.ObservedSeconds * 100
+		u.UptimePct = &pct
+	}
+}
+
+// parseNovaTime parses Nova timestamps, with or without zone and microseconds (UTC).
+func parseNovaTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unparseable Nova time %q", s)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// invoiceSchemaVersion is bumped whenever a field is renamed or removed.
+// Adding fields does not change the version; importers must ignore unknown fields.
+const invoiceSchemaVersion = "1"
+
+// invoiceJSONLContentType is the Content-Type of ?format=invoice_jsonl responses.
+const invoiceJSONLContentType = "application/x-ndjson"
+
+// InvoiceLineItem is one line of the invoice_jsonl format (one per instance).
+type InvoiceLineItem struct {
+	SchemaVersion    string  `json:"schema_version"`
+	RecordType       string  `json:"record_type"` // always "line_item"
+	InstanceID       string  `json:"instance_id"`
+	InstanceName     string  `json:"instance_name"`
+	FlavorName       string  `json:"flavor_name"`
+	PeriodStart      string  `json:"period_start"` // RFC3339, UTC
+	PeriodEnd        string  `json:"period_end"`
+	Currency         string  `json:"currency"`
+	VCPUs            int     `json:"vcpus"`
+	CPUHours         float64 `json:"cpu_hours"`
+	CPUCost          float64 `json:"cpu_cost"`
+	MemoryGBHours    float64 `json:"memory_gb_hours"`
+	MemoryCost       float64 `json:"memory_cost"`
+	DiskCost         float64 `json:"disk_cost"`
+	NetworkCost      float64 `json:"network_cost"`
+	UsageCost        float64 `json:"usage_cost"`
+	AdjustmentsTotal float64 `json:"adjustments_total"`
+	TotalCost        float64 `json:"total_cost"`
+}
+
+// InvoiceSummary is the last line of the invoice_jsonl format.
+type InvoiceSummary struct {
+	SchemaVersion    string  `json:"schema_version"`
+	RecordType       string  `json:"record_type"` // always "summary"
+	LineItems        int     `json:"line_items"`
+	PeriodStart      string  `json:"period_start"`
+	PeriodEnd        string  `json:"period_end"`
+	Currency         string  `json:"currency"`
+	UsageCost        float64 `json:"usage_cost"`
+	AdjustmentsTotal float64 `json:"adjustments_total"`
+	TotalCost        float64 `json:"total_cost"`
+	GeneratedAt      string  `json:"generated_at"`
+}
+
+// validateExportFormat checks the ?format= value of billing exports.
+func validateExportFormat(format string) error {
+	switch format {
+	case "", "json", "invoice_jsonl", "csv":
+		return nil
+	}
+	return fmt.Errorf("unsupported format %s (supported: json, invoice_jsonl, csv)", format)
+}
+
+// invoicePeriod converts the billing date format into RFC3339 UTC.
+func invoicePeriod(date string) string {
+	t, err := time.Parse("2006-01-02T15:04:05", date)
+	if err != nil {
+		return date
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newInvoiceLineItem maps a BillingReport onto the versioned line item.
+func newInvoiceLineItem(report BillingReport) InvoiceLineItem {
+	cpuBilling := CalculateCPUBilling(report.CPUUsage, report.StartDate, report.EndDate)
+	memoryGBHours := report.MemoryUsage.AverageUsedMB / 1024.0 * cpuBilling.BillingPeriodHours
+
+	return InvoiceLineItem{
+		SchemaVersion:    invoiceSchemaVersion,
+		RecordType:       "line_item",
+		InstanceID:       report.InstanceID,
+		InstanceName:     report.InstanceName,
+		FlavorName:       report.FlavorName,
+		PeriodStart:      invoicePeriod(report.StartDate),
+		PeriodEnd:        invoicePeriod(report.EndDate),
+		Currency:         report.Currency,
+		VCPUs:            report.VCPUs,
+		CPUHours:         cpuBilling.TotalCPUHours,
+		CPUCost:          report.CPUCost,
+		MemoryGBHours:    memoryGBHours,
+		MemoryCost:       report.MemoryCost,
+		DiskCost:         report.DiskCost,
+		NetworkCost:      report.NetworkCost,
+		UsageCost:        report.UsageCost,
+		AdjustmentsTotal: report.AdjustmentsTotal,
+		TotalCost:        report.TotalCost,
+	}
+}
+
+// writeInvoiceJSONL writes one line item per report followed by a summary line.
+// All reports are expected to share the same period and currency.
+func writeInvoiceJSONL(w http.ResponseWriter, reports []BillingReport, startDate, endDate, currency string) {
+	w.Header().Set("Content-Type", invoiceJSONLContentType)
+	encodeInvoiceJSONL(w, reports, startDate, endDate, currency)
+}
+
+// encodeInvoiceJSONL writes the invoice_jsonl lines of reports to w.
+func encodeInvoiceJSONL(w io.Writer, reports []BillingReport, startDate, endDate, currency string) {
+	summary := InvoiceSummary{
+		SchemaVersion: invoiceSchemaVersion,
+		RecordType:    "summary",
+		PeriodStart:   invoicePeriod(startDate),
+		PeriodEnd:     invoicePeriod(endDate),
+		Currency:      currency,
+		GeneratedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	for _, report := range reports {
+		item := newInvoiceLineItem(report)
+		writeJSON(w, item) // one object per line
+
+		summary.LineItems++
+		summary.UsageCost += item.UsageCost
+		summary.AdjustmentsTotal += item.AdjustmentsTotal
+		summary.TotalCost += item.TotalCost
+	}
+
+	writeJSON(w, summary)
+}
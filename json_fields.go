@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ?fields=total_cost,instance_id trims a JSON response to the listed fields.
+// Nested fields use dot notation (memory_usage.average_used_gb); on arrays the
+// projection applies to every element (reports.total_cost). Unknown fields are
+// left out silently. Only responses written through writeJSON are projected;
+// error bodies and non-JSON exports are unchanged.
+
+// fieldTree is a parsed ?fields= list. A nil subtree keeps the whole value.
+type fieldTree map[string]fieldTree
+
+// parseFieldTree parses a comma-separated field list; nil when it is empty.
+func parseFieldTree(s string) fieldTree {
+	var tree fieldTree
+	for _, path := range strings.Split(s, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if tree == nil {
+			tree = fieldTree{}
+		}
+		tree.add(strings.Split(path, "."))
+	}
+	return tree
+}
+
+func (t fieldTree) add(parts []string) {
+	key := parts[0]
+	if len(parts) == 1 {
+		t[key] = nil // whole value wins over any nested selection
+		return
+	}
+	sub, exists := t[key]
+	if exists && sub == nil {
+		return // already selected whole
+	}
+	if sub == nil {
+		sub = fieldTree{}
+		t[key] = sub
+	}
+	sub.add(parts[1:])
+}
+
+// project returns v with only the selected fields.
+func (t fieldTree) project(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for key, sub := range t {
+			val, ok := x[key]
+			if !ok {
+				continue
+			}
+			if sub == nil {
+				out[key] = val
+			} else {
+				out[key] = sub.project(val)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, el := range x {
+			out[i] = t.project(el)
+		}
+		return out
+	}
+	return v // scalar: nothing to select from
+}
+
+// projectJSON applies the projection to an encoded JSON document.
+// Numbers are kept as written (json.Number).
+func projectJSON(data []byte, fields fieldTree) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields.project(v))
+}
+
+// projectingWriter carries the request's ?fields=, ?units= (see
+// json_units.go), ?meta=true (see upstream_calls.go) and ?precision=raw (see
+// precision.go) to writeJSON.
+type projectingWriter struct {
+	http.ResponseWriter
+	fields fieldTree
+	units  unitSelection
+	meta   *upstreamCalls // set with ?meta=true
+	raw    bool           // ?precision=raw: JSON_FLOAT_PRECISION is not applied
+}
+
+// fieldProjection is a middleware that enables ?fields=, ?units=,
+// ?meta=true and ?precision=raw for the wrapped handlers. WebSocket upgrades are passed through untouched (they need
+// the raw writer).
+func fieldProjection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := parseFieldTree(r.URL.Query().Get("fields"))
+		units, err := parseUnits(r.URL.Query().Get("units"))
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+			return
+		}
+		precision, err := parsePrecision(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+			return
+		}
+		var meta *upstreamCalls
+		if r.URL.Query().Get("meta") == "true" {
+			meta = upstreamCallsOf(r.Context())
+		}
+		raw := precision == PrecisionRaw
+		if (fields == nil && units == nil && meta == nil && !raw) || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&projectingWriter{ResponseWriter: w, fields: fields, units: units, meta: meta, raw: raw}, r)
+	})
+}
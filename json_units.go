@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ?units=memory:GiB,cpu:seconds converts the memory and CPU-time fields of
+// the billing structs (BillingReport, CPUUsageStats, MemoryUsageStats,
+// CPUBillingInfo, InvoiceLineItem, billing jobs) and renames them after the
+// unit: average_used_mb becomes average_used_gib, total_cpu_hours becomes
+// total_cpu_seconds, memory_price_per_gb_hour becomes
+// memory_price_per_gib_hour. Without ?units the current units are kept
+// (memory in MB and GB, CPU time in seconds and hours, depending on the field).
+//
+// Memory MB are the values Gnocchi reports (mebibytes); GiB = MB / 1024, which
+// is what the existing *_gb fields hold, and GB is decimal (10^9 bytes). CPU
+// time is core time (cpu_seconds, cpu_hours, total_cpu_core_hours). Costs stay
+// the same: prices per unit are converted inversely. The conversion runs in
+// writeJSON before ?fields=, so projections use the converted names.
+
+// unitDimension is a kind of quantity ?units can convert.
+type unitDimension string
+
+const (
+	unitMemory  unitDimension = "memory"
+	unitCPUTime unitDimension = "cpu"
+)
+
+// outputUnit is one unit a dimension can be written in.
+type outputUnit struct {
+	token    string  // in the field name, plural for quantities
+	per      string  // in the field name of prices, e.g. price_per_<per>_hour
+	baseSize float64 // size in the dimension's base unit (MB, seconds)
+}
+
+var outputUnits = map[unitDimension]map[string]outputUnit{
+	unitMemory: {
+		"mb":  {token: "mb", per: "mb", baseSize: 1},
+		"gib": {token: "gib", per: "gib", baseSize: 1024},
+		"gb":  {token: "gb", per: "gb", baseSize: 1e9 / (1 << 20)},
+	},
+	unitCPUTime: {
+		"seconds": {token: "seconds", per: "second", baseSize: 1},
+		"hours":   {token: "hours", per: "hour", baseSize: 3600},
+	},
+}
+
+// unitField is a JSON field holding a convertible value. name is the field
+// name with %s where the unit goes.
+type unitField struct {
+	dim   unitDimension
+	unit  string // current unit of the field
+	name  string
+	price bool // value is per unit (converted inversely, named with outputUnit.per)
+}
+
+// unitFields lists the convertible fields of the billing structs by JSON name.
+var unitFields = map[string]unitField{
+	"average_used_mb":          {dim: unitMemory, unit: "mb", name: "average_used_%s"},
+	"max_used_mb":              {dim: unitMemory, unit: "mb", name: "max_used_%s"},
+	"min_used_mb":              {dim: unitMemory, unit: "mb", name: "min_used_%s"},
+	"total_memory_mb":          {dim: unitMemory, unit: "mb", name: "total_memory_%s"},
+	"average_used_gb":          {dim: unitMemory, unit: "gib", name: "average_used_%s"},
+	"memory_gb_hours":          {dim: unitMemory, unit: "gib", name: "memory_%s_hours"},
+	"memory_price_per_gb_hour": {dim: unitMemory, unit: "gib", name: "memory_price_per_%s_hour", price: true},
+
+	"cpu_seconds":          {dim: unitCPUTime, unit: "seconds", name: "cpu_%s"},
+	"cpu_hours":            {dim: unitCPUTime, unit: "hours", name: "cpu_%s"},
+	"total_cpu_hours":      {dim: unitCPUTime, unit: "hours", name: "total_cpu_%s"},
+	"total_cpu_core_hours": {dim: unitCPUTime, unit: "hours", name: "total_cpu_core_%s"},
+	"cpu_price_per_hour":   {dim: unitCPUTime, unit: "hours", name: "cpu_price_per_%s", price: true},
+}
+
+// unitSelection is a parsed ?units=; dimensions not listed keep their units.
+type unitSelection map[unitDimension]string
+
+// parseUnits parses ?units= (memory:MB|GB|GiB, cpu:seconds|hours), nil when empty.
+func parseUnits(s string) (unitSelection, error) {
+	var sel unitSelection
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		dim, unit, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid units %s (expected memory:MB|GB|GiB,cpu:seconds|hours)", part)
+		}
+		d := unitDimension(strings.ToLower(strings.TrimSpace(dim)))
+		units, known := outputUnits[d]
+		if !known {
+			return nil, fmt.Errorf("unknown unit dimension %s (memory or cpu)", dim)
+		}
+		u := strings.ToLower(strings.TrimSpace(unit))
+		if _, known := units[u]; !known {
+			return nil, fmt.Errorf("unknown %s unit %s", d, unit)
+		}
+		if sel == nil {
+			sel = unitSelection{}
+		}
+		sel[d] = u
+	}
+	return sel, nil
+}
+
+// convert returns v with the unit fields converted, recursively.
+func (sel unitSelection) convert(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for key, val := range x {
+			newKey, newVal := sel.convertField(key, val)
+			// average_used_mb and average_used_gb land on the same name with
+			// the same value; the first one wins
+			if _, dup := out[newKey]; dup {
+				continue
+			}
+			out[newKey] = newVal
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, el := range x {
+			out[i] = sel.convert(el)
+		}
+		return out
+	}
+	return v
+}
+
+func (sel unitSelection) convertField(key string, val interface{}) (string, interface{}) {
+	field, ok := unitFields[key]
+	target, selected := sel[field.dim]
+	if !ok || !selected {
+		return key, sel.convert(val)
+	}
+	from := outputUnits[field.dim][field.unit]
+	to := outputUnits[field.dim][target]
+	token := to.token
+	if field.price {
+		token = to.per
+	}
+	newKey := fmt.Sprintf(field.name, token)
+
+	num, isNumber := val.(json.Number)
+	if !isNumber || from == to {
+		return newKey, val
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return newKey, val
+	}
+	if field.price {
+		return newKey, f * to.baseSize / from.baseSize
+	}
+	return newKey, f * from.baseSize / to.baseSize
+}
+
+// convertUnitsJSON applies the unit selection to an encoded JSON document.
+func convertUnitsJSON(data []byte, sel unitSelection) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sel.convert(v))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// encoding/json writes large and tiny floats in exponent notation (1.234e+12,
+// 5e-07), which some downstream parsers reject. All API responses therefore go
+// through fixedPointJSON, which rewrites every such number in fixed-point form.
+// With JSON_FLOAT_PRECISION=N every fractional number is additionally rounded
+// to N decimals (trailing zeros trimmed); the default keeps full precision.
+
+// jsonFloatPrecision returns JSON_FLOAT_PRECISION, or -1 (shortest exact form).
+func jsonFloatPrecision() int {
+	if v, err := strconv.Atoi(getEnv("JSON_FLOAT_PRECISION", "")); err == nil && v >= 0 {
+		return v
+	}
+	return -1
+}
+
+// marshalJSON is json.Marshal with fixed-point floats.
+func marshalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fixedPointJSON(data, jsonFloatPrecision()), nil
+}
+
+// writeJSON writes v like json.NewEncoder(w).Encode(v), with fixed-point floats.
+// When w carries ?units= (see json_units.go) the unit fields are converted, and
+// with a ?fields= projection (see fieldProjection) only those fields are written.
+// ?meta=true adds _meta (see upstream_calls.go) after the projection, and
+// ?precision=raw keeps full float precision (see precision.go).
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	precision := jsonFloatPrecision()
+	if pw, ok := w.(*projectingWriter); ok {
+		if pw.raw {
+			precision = -1
+		}
+		if pw.units != nil {
+			if data, err = convertUnitsJSON(data, pw.units); err != nil {
+				return err
+			}
+		}
+		if pw.fields != nil {
+			if data, err = projectJSON(data, pw.fields); err != nil {
+				return err
+			}
+		}
+		if pw.meta != nil {
+			if data, err = addMetaJSON(data, pw.meta); err != nil {
+				return err
+			}
+		}
+	}
+	data = fixedPointJSON(data, precision)
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// fixedPointJSON rewrites the numbers of an encoded JSON document. Numbers with
+// an exponent are always rewritten; with precision >= 0 every number with a
+// fraction or exponent is rounded to that many decimals. Integers and string
+// contents are left alone.
+func fixedPointJSON(data []byte, precision int) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data))
+
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+			out.WriteByte(c)
+			continue
+		}
+		if c != '-' && (c < '0' || c > '9') {
+			out.WriteByte(c)
+			continue
+		}
+
+		// Number literal
+		j := i + 1
+		for j < len(data) && strings.IndexByte("0123456789+-.eE", data[j]) >= 0 {
+			j++
+		}
+		out.WriteString(formatJSONNumber(string(data[i:j]), precision))
+		i = j - 1
+	}
+	return out.Bytes()
+}
+
+// formatJSONNumber returns num in fixed-point notation (see fixedPointJSON).
+func formatJSONNumber(num string, precision int) string {
+	hasExp := strings.ContainsAny(num, "eE")
+	if !hasExp && (precision < 0 || !strings.Contains(num, ".")) {
+		return num
+	}
+
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return num
+	}
+	s := strconv.FormatFloat(f, 'f', precision, 64)
+	if precision > 0 {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
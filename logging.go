@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Logging goes through log/slog. LOG_LEVEL (debug, info, warn, error; default
+// info) and LOG_FORMAT (text or json; default text) configure it, and
+// PUT /api/v1/admin/log-level changes the level at runtime. Records logged with
+// a request context carry its request_id; attributes whose key names a secret
+// (password, token, cookie, ...) are always redacted.
+
+// logLevel is the current minimum level of the default logger.
+var logLevel = new(slog.LevelVar)
+
+// initLogging installs the default slog logger from LOG_LEVEL and LOG_FORMAT.
+// The standard log package is routed through it as well (at info level).
+func initLogging() {
+	level, levelErr := parseLogLevel(getEnv("LOG_LEVEL", "info"))
+	if levelErr == nil {
+		logLevel.Set(level)
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	format := strings.ToLower(getEnv("LOG_FORMAT", "text"))
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+
+	if levelErr != nil {
+		slog.Warn("LOG_LEVEL ignored, using info", "error", levelErr)
+	}
+	if format != "json" && format != "text" {
+		slog.Warn("LOG_FORMAT ignored, using text", "value", format)
+	}
+}
+
+// parseLogLevel parses debug, info, warn (warning) or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// secretAttrSuffixes are attribute keys (or key suffixes, e.g. grafana_cookie)
+// whose values never reach the log.
+var secretAttrSuffixes = []string{"password", "token", "cookie", "secret", "api_key", "authorization"}
+
+// redactAttr replaces the value of secret attributes.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, suffix := range secretAttrSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return slog.String(a.Key, "[REDACTED]")
+		}
+	}
+	return a
+}
+
+// requestIDHandler adds the request_id of the record's context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDOf(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// requestIDOf returns the request ID stored by requestID, empty outside requests.
+func requestIDOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID is a middleware that takes the caller's X-Request-ID (when it is
+// short and printable) or generates one, echoes it in the response and stores
+// it in the request context for the log records of the request.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// LogLevelResponse is the body of GET and PUT /api/v1/admin/log-level.
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// GET /api/v1/admin/log-level
+// PUT /api/v1/admin/log-level  {"level":"debug"}  (or ?level=debug)
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		value := r.URL.Query().Get("level")
+		if value == "" {
+			var req LogLevelResponse
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+				http.Error(w, `{"error":"body must be {\"level\":\"debug|info|warn|error\"}"}`, http.StatusBadRequest)
+				return
+			}
+			value = req.Level
+		}
+		level, err := parseLogLevel(value)
+		if err != nil || value == "" {
+			http.Error(w, `{"error":"level must be debug, info, warn or error"}`, http.StatusBadRequest)
+			return
+		}
+		if old := logLevel.Level(); old != level {
+			logLevel.Set(level)
+			slog.WarnContext(r.Context(), "Log level changed", "from", old.String(), "to", level.String(), "token_label", tokenLabel(r))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, LogLevelResponse{Level: strings.ToLower(logLevel.Level().String())})
+}
+
+// fatal logs at error level and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
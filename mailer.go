@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPConfig is the outgoing mail server (SMTP_*).
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	TLS      string // starttls (default), tls (implicit, port 465) or none
+	Insecure bool
+}
+
+// smtpConfigFromEnv reads SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD,
+// SMTP_FROM, SMTP_TLS and SMTP_INSECURE.
+func smtpConfigFromEnv() SMTPConfig {
+	return SMTPConfig{
+		Host:     getEnv("SMTP_HOST", ""),
+		Port:     getEnv("SMTP_PORT", "587"),
+		Username: getEnv("SMTP_USERNAME", ""),
+		Password: getEnv("SMTP_PASSWORD", ""),
+		From:     getEnv("SMTP_FROM", ""),
+		TLS:      strings.ToLower(getEnv("SMTP_TLS", "starttls")),
+		Insecure: getEnv("SMTP_INSECURE", "false") == "true",
+	}
+}
+
+// mailAttachment is one file attached to an email.
+type mailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// sendMail sends a text email with attachments to every recipient.
+func sendMail(cfg SMTPConfig, to []string, subject, body string, attachments []mailAttachment) error {
+	if cfg.Host == "" || cfg.From == "" {
+		return fmt.Errorf("SMTP_HOST and SMTP_FROM must be configured")
+	}
+	msg, err := buildMail(cfg.From, to, subject, body, attachments)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	tlsConfig := &tls.Config{ServerName: cfg.Host, InsecureSkipVerify: cfg.Insecure}
+	var conn net.Conn
+	if cfg.TLS == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("SMTP connect: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP hello: %w", err)
+	}
+	defer client.Close()
+
+	if cfg.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server does not offer STARTTLS (set SMTP_TLS=none to send in plain text)")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("SMTP STARTTLS: %w", err)
+		}
+	}
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return fmt.Errorf("SMTP auth: %w", err)
+		}
+	}
+	if err := client.Mail(cfg.From); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM: %w", err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("SMTP RCPT TO %s: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("SMTP DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP DATA: %w", err)
+	}
+	return client.Quit()
+}
+
+// buildMail builds a multipart/mixed message: the text body, then the attachments base64-encoded.
+func buildMail(from string, to []string, subject, body string, attachments []mailAttachment) ([]byte, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	boundary := "vhi-" + hex.EncodeToString(b)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&msg, "--%s\r\n", boundary)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	for _, a := range attachments {
+		fmt.Fprintf(&msg, "--%s\r\n", boundary)
+		fmt.Fprintf(&msg, "Content-Type: %s\r\n", a.ContentType)
+		msg.WriteString("Content-Transfer-Encoding: base64\r\n")
+		fmt.Fprintf(&msg, "Content-Disposition: attachment; filename=%q\r\n\r\n", a.Filename)
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			msg.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		msg.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	return msg.Bytes(), nil
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -14,99 +19,311 @@ import (
 
 // panelClient is a singleton initialized once at startup.
 // Re-using the client across requests avoids re-login on every call.
-var panelClient *VHIPanelClient
+// Nil when VHI_PANEL_URL is not set — only ever assign a non-nil client so nil checks hold.
+var panelClient PanelAPI
 
 func main() {
+	flag.Parse()
+
 	// Load .env file at startup so all getEnv() calls can read values
-	if err := godotenv.Load("./.env"); err != nil {
-		log.Printf("Warning: could not load .env file: %v", err)
-	}
-
-	// Initialize VHI panel client singleton (login once at startup)
-	if url := getEnv("VHI_PANEL_URL", ""); url != "" {
-		panelClient = NewVHIPanelClient(VHIPanelConfig{
-			BaseURL:  url,
-			Username: getEnv("ADMIN_USERNAME", "admin"),
-			Password: getEnv("ADMIN_PASSWORD", ""),
-			Domain:   getEnv("ADMIN_DOMAIN_NAME", "Default"),
-			Insecure: true,
-		})
-		if err := panelClient.Login(); err != nil {
-			log.Printf("Warning: VHI Panel initial login failed: %v", err)
-		}
+	envErr := godotenv.Load("./.env")
+
+	// Leveled, structured logging (LOG_LEVEL, LOG_FORMAT)
+	initLogging()
+	if envErr != nil {
+		slog.Warn("Could not load .env file", "error", envErr)
 	}
 
 	// Initialize Redis cache (optional — caching disabled if REDIS_HOST is not set)
 	redisClient = initRedis()
 
-	// Proactive token refresh — re-login every hour to prevent token expiry (401)
-	if panelClient != nil {
-		go func() {
-			for range time.Tick(1 * time.Hour) {
-				if err := panelClient.Login(); err != nil {
-					log.Printf("Warning: VHI Panel token refresh failed: %v", err)
-				} else {
-					log.Println("VHI Panel token refreshed successfully")
-				}
-			}
-		}()
+	// Named clusters (CLUSTER_NAME, CLUSTERS) — the default one alone unless configured
+	loadClusters()
+
+	// DOMAINS_FILE of every cluster and the default pricing expression, reloadable via /admin/reload
+	loadFileConfig()
+
+	// Pre-flight check for deployment pipelines: test the dependencies and exit
+	if selftestRequested() {
+		os.Exit(runSelftest())
 	}
 
+	startRedisProbe()
+	initAdminTokenStore()
+
+	// Initialize the VHI panel client of every cluster (login once at startup)
+	for _, c := range clusters {
+		initPanelClient(c)
+	}
+
+	// Live cluster usage stream hub (WebSocket)
+	usageStream = newClusterStream()
+
+	// Optional billing event publishing (BILLING_EVENT_SINK)
+	billingEvents = newEventBusFromEnv()
+
+	// Optional background collection (COLLECTOR_INTERVAL_SECONDS), one replica at a time
+	if collector = newCollectorFromEnv(); collector != nil {
+		collector.Start()
+	}
+
+	// Optional S3 export of snapshots and billing results (S3_EXPORT_ENDPOINT, S3_EXPORT_BUCKET)
+	exporter = newS3ExporterFromEnv()
+
+	// Optional scheduled monthly domain reports by email (MONTHLY_REPORT_SCHEDULE)
+	if monthlyReports = newMonthlyReporterFromEnv(); monthlyReports != nil {
+		monthlyReports.Start()
+	}
+
+	// Optional push of rating records to an external billing system (RATING_PUSH_CONFIG)
+	if ratingPush = newRatingPusherFromEnv(); ratingPush != nil {
+		ratingPush.Start()
+	}
+
+	// Optional global limit on heavy requests in progress (MAX_CONCURRENT_HEAVY_REQUESTS)
+	heavyRequests = newHeavyLimiterFromEnv()
+
 	r := mux.NewRouter()
 
+	// Request ID (X-Request-ID) for the response and every log record of the request
+	r.Use(requestID)
+
+	// Backend calls per request (X-Upstream-Calls, ?meta=true)
+	r.Use(countUpstreamCalls)
+
 	// Global rate limiting per IP
 	r.Use(rateLimitMiddleware)
 
+	// ?fields=a,b.c response projection for every JSON endpoint
+	r.Use(fieldProjection)
+
 	// Health check — no auth required
 	r.HandleFunc("/health", healthCheck).Methods("GET")
 
+	// Build version plus panel license/HA state (same bearer token as the API)
+	r.Handle("/version", bearerAuth(http.HandlerFunc(getVersion))).Methods("GET")
+
+	// Prometheus metrics (same bearer token as the API)
+	r.Handle("/metrics", bearerAuth(http.HandlerFunc(serveMetrics))).Methods("GET")
+
 	// All /api/v1 routes require Bearer token auth
 	api := r.PathPrefix("/api/v1").Subrouter()
 	api.Use(bearerAuth)
 
+	// ?cluster=<name> selects the cluster (default: the default cluster)
+	api.Use(clusterSelect)
+
+	// Configured clusters and their health
+	api.HandleFunc("/clusters", getClusters).Methods("GET")
+
+	// Deep health — backend state, panel alert summary
+	api.HandleFunc("/health/deep", deepHealthCheck).Methods("GET")
+
+	// Panel/Grafana/Prometheus call statistics (durations, errors, session refreshes)
+	api.HandleFunc("/diagnostics", getDiagnostics).Methods("GET")
+	api.HandleFunc("/admin/cache/stats", getCacheStats).Methods("GET")
+
+	// Runtime log level (debug, info, warn, error)
+	api.HandleFunc("/admin/log-level", logLevelHandler).Methods("GET", "PUT")
+
+	// Re-read DOMAINS_FILE and the pricing file without a restart
+	api.HandleFunc("/admin/reload", postReload).Methods("POST")
+
+	// Re-upload stored snapshots of a date range to S3 (?start=&end=)
+	api.HandleFunc("/admin/export/backfill", postExportBackfill).Methods("POST")
+	api.HandleFunc("/admin/billing/push", postRatingPush).Methods("POST")
+	api.HandleFunc("/admin/billing/push/runs", getRatingPushRuns).Methods("GET")
+	api.HandleFunc("/admin/billing/push/runs/{id}", getRatingPushRun).Methods("GET")
+
+	// Active VHI panel alerts
+	api.HandleFunc("/cluster/alerts", getClusterAlerts).Methods("GET")
+
+	// Heavy endpoints (wrapped in heavy) share MAX_CONCURRENT_HEAVY_REQUESTS
+
 	// Total usage snapshot endpoint (per-domain filtered, uses domain.txt)
-	api.HandleFunc("/usage/total", getTotalUsage).Methods("GET")
+	api.HandleFunc("/usage/total", heavy(getTotalUsage)).Methods("GET")
+
+	// Usage snapshot of a single domain, with per-project subtotals
+	api.HandleFunc("/usage/domain/{domain_name}", heavy(getDomainUsage)).Methods("GET")
+
+	// Usage of an explicit set of projects (POST body: project_ids)
+	api.HandleFunc("/usage/projects", heavy(getProjectsUsage)).Methods("POST")
+
+	// Usage of one project, per instance (any project, not only DOMAINS_FILE ones)
+	api.HandleFunc("/usage/project/{project_id}", heavy(getProjectUsage)).Methods("GET")
 
 	// Cluster-wide usage endpoint (all VMs in cluster, uses Nova API)
-	api.HandleFunc("/usage/cluster", getClusterUsage).Methods("GET")
+	api.HandleFunc("/usage/cluster", heavy(getClusterUsage)).Methods("GET")
+
+	// Live cluster usage over WebSocket (pushes a ClusterUsage every STREAM_INTERVAL_SECONDS)
+	api.HandleFunc("/usage/cluster/stream", streamClusterUsage).Methods("GET")
+
+	// Reserved capacity (ACTIVE flavor vCPUs/RAM) per project
+	api.HandleFunc("/usage/reserved", heavy(getReservedCapacity)).Methods("GET")
+
+	// Per-node usage (Nova hypervisors + Prometheus node_exporter + VHI panel nodes)
+	api.HandleFunc("/usage/nodes", heavy(getNodeUsage)).Methods("GET")
+
+	// Servers placed on one hypervisor (Nova), for rebalancing
+	api.HandleFunc("/hypervisors/{hostname}/servers", getHypervisorServers).Methods("GET")
+
+	// Cluster network throughput (optional ?history=1h&step=60s)
+	api.HandleFunc("/usage/network", getNetworkUsage).Methods("GET")
+
+	// vstorage physical vs usable capacity (redundancy-adjusted)
+	api.HandleFunc("/storage/vstorage", getVStorageCapacity).Methods("GET")
 
-	// Billing endpoints
-	api.HandleFunc("/billing/cpu/{instance_id}", getCPUBilling).Methods("GET")
-	api.HandleFunc("/billing/resources/{instance_id}", getResourceBilling).Methods("GET")
-	api.HandleFunc("/billing/report/{instance_id}", getBillingReport).Methods("GET")
+	// vstorage IOPS, throughput and p99 latency (optional ?history=1h&step=60s)
+	api.HandleFunc("/storage/performance", getStoragePerformance).Methods("GET")
+
+	// Nova vs Gnocchi instance reconciliation (billing coverage gaps)
+	api.HandleFunc("/reconcile/instances", heavy(getInstanceReconciliation)).Methods("GET")
+
+	// Instance search by name / project / flavor (returns IDs for the billing endpoints)
+	api.HandleFunc("/instances/search", heavy(getInstanceSearch)).Methods("GET")
+
+	// Instance inventory with filters and limit/marker pagination
+	api.HandleFunc("/instances", heavy(getInstances)).Methods("GET")
+
+	// Instance detail: Nova, Gnocchi, utilization, Cinder volumes and billing domain
+	api.HandleFunc("/instances/{instance_id}", locateInstance(getInstanceDetail)).Methods("GET")
+
+	// Uptime / SLA of one instance over a period, from the Nova action log
+	api.HandleFunc("/instances/{instance_id}/uptime", locateInstance(getInstanceUptime)).Methods("GET")
+
+	// Many instances of one cluster billed in one call; registered before
+	// /billing/report/{instance_id}, which would match "batch"
+	api.HandleFunc("/billing/report/batch", heavy(postBillingReportBatch)).Methods("POST")
+
+	// Billing endpoints (without ?cluster= the instance is looked up in every cluster)
+	api.HandleFunc("/billing/cpu/{instance_id}", locateInstance(getCPUBilling)).Methods("GET")
+	api.HandleFunc("/billing/resources/{instance_id}", locateInstance(getResourceBilling)).Methods("GET")
+	api.HandleFunc("/billing/report/{instance_id}", locateInstance(getBillingReport)).Methods("GET", "POST")
+	api.HandleFunc("/billing/compare/{instance_id}", locateInstance(getBillingComparison)).Methods("GET")
+
+	// Network traffic and egress cost of one instance
+	api.HandleFunc("/billing/network/{instance_id}", locateInstance(getNetworkBilling)).Methods("GET")
+
+	// Cost allocation: every instance billed, grouped by a Nova metadata tag
+	api.HandleFunc("/billing/by-tag", heavy(getBillingByTag)).Methods("GET")
+
+	// Async cluster billing: start a job, poll its status, fetch the result
+	api.HandleFunc("/billing/cluster/jobs", createClusterBillingJob).Methods("POST")
+	api.HandleFunc("/billing/cluster/jobs/{id}", getClusterBillingJob).Methods("GET")
+	api.HandleFunc("/billing/cluster/jobs/{id}/result", getClusterBillingJobResult).Methods("GET")
+
+	// Storage billing from Cinder volumes, priced per volume type
+	api.HandleFunc("/billing/storage", getStorageBilling).Methods("GET")
 
 	// Server configuration
 	port := getEnv("PORT", "8080")
-	log.Printf("Starting billing API server on port :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	slog.Info("Starting billing API server", "port", port)
+	fatal("HTTP server stopped", "error", http.ListenAndServe(":"+port, r))
+}
+
+// initPanelClient creates the cluster's VHI panel client when its VHI_PANEL_URL
+// is set, restores or logs in the session and starts the hourly re-login.
+// The default cluster's client is also panelClient and exports the panel metrics.
+func initPanelClient(c *Cluster) {
+	url := c.env("VHI_PANEL_URL", "")
+	if url == "" {
+		return
+	}
+	client, err := NewVHIPanelClient(VHIPanelConfig{
+		BaseURL:       url,
+		Username:      c.env("ADMIN_USERNAME", "admin"),
+		Password:      c.env("ADMIN_PASSWORD", ""),
+		Domain:        c.env("ADMIN_DOMAIN_NAME", "Default"),
+		CACertFile:    c.env("VHI_PANEL_CACERT", ""),
+		Insecure:      c.env("VHI_PANEL_INSECURE", "false") == "true",
+		PrometheusURL: c.env("PROMETHEUS_URL", ""),
+		GrafanaAPIKey: c.env("GRAFANA_API_KEY", ""),
+	})
+	if err != nil {
+		fatal("VHI Panel client configuration invalid", "cluster", c.Name, "error", err)
+	}
+	c.panel = client
+	if c.isDefault() {
+		panelClient = client
+		registerPanelBreakerMetrics(client)
+		registerNetworkMetrics(client)
+		registerPanelLicenseMetrics(client)
+	}
+
+	// Reuse the session shared in Redis if there is one; the stat call validates it
+	// (a 401 there falls back to a normal login).
+	if store := newPanelSessionStore(redisClient, c.key("")); store != nil {
+		client.EnableSessionSharing(store)
+	}
+	if client.RestoreSession() {
+		if _, err := client.GetStat(); err != nil {
+			slog.Warn("VHI Panel restored session check failed", "service", "panel", "cluster", c.Name, "error", err)
+		}
+	} else if err := client.Login(); err != nil {
+		slog.Warn("VHI Panel initial login failed", "service", "panel", "cluster", c.Name, "error", err)
+	}
+
+	// Proactive token refresh — re-login every hour to prevent token expiry (401)
+	go func() {
+		for range time.Tick(1 * time.Hour) {
+			if err := client.Login(); err != nil {
+				slog.Warn("VHI Panel token refresh failed", "service", "panel", "cluster", c.Name, "error", err)
+			} else {
+				slog.Info("VHI Panel token refreshed", "service", "panel", "cluster", c.Name)
+			}
+		}
+	}()
 }
 
 // bearerAuth is a middleware that validates the Authorization: Bearer <token> header
-// against the API_BEARER_TOKEN environment variable.
+// against API_BEARER_TOKEN and the labelled API_TOKENS (see token_access.go).
+// With ALLOW_QUERY_TOKEN=true, ?access_token=<token> is accepted when the
+// header is absent.
 func bearerAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		expected := getEnv("API_BEARER_TOKEN", "")
-		if expected == "" {
-			log.Printf("ERROR: API_BEARER_TOKEN is not configured")
+		tokens := apiTokens()
+		if len(tokens) == 0 {
+			slog.ErrorContext(r.Context(), "API_BEARER_TOKEN is not configured")
 			http.Error(w, `{"error":"server misconfiguration"}`, http.StatusInternalServerError)
 			return
 		}
 
 		auth := r.Header.Get("Authorization")
-		if auth == "" || len(auth) < 8 || auth[:7] != "Bearer " {
+		var token string
+		switch {
+		case auth != "":
+			if len(auth) < 8 || auth[:7] != "Bearer " {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="VHI Billing API"`)
+				http.Error(w, `{"error":"missing or invalid Authorization header"}`, http.StatusUnauthorized)
+				return
+			}
+			token = auth[7:]
+		case queryTokenAllowed() && r.URL.Query().Has("access_token"):
+			token = takeQueryToken(r)
+		default:
 			w.Header().Set("WWW-Authenticate", `Bearer realm="VHI Billing API"`)
 			http.Error(w, `{"error":"missing or invalid Authorization header"}`, http.StatusUnauthorized)
 			return
 		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="VHI Billing API"`)
+			http.Error(w, `{"error":"invalid bearer token"}`, http.StatusUnauthorized)
+			return
+		}
 
-		token := auth[7:]
-		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		label := ""
+		for l, expected := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				label = l
+			}
+		}
+		if label == "" {
 			w.Header().Set("WWW-Authenticate", `Bearer realm="VHI Billing API"`)
 			http.Error(w, `{"error":"invalid bearer token"}`, http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withTokenLabel(r, label))
 	})
 }
 
@@ -116,17 +333,24 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 		"time":   time.Now().Format(time.RFC3339),
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, response)
 }
 
 func getCPUBilling(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
-	log.Printf("Fetching CPU billing for instance ID: %s", instanceID)
+	slog.DebugContext(r.Context(), "Fetching CPU billing", "instance_id", instanceID)
 	// Get query parameters
 	startDate := r.URL.Query().Get("start_date")
 	endDate := r.URL.Query().Get("end_date")
 
+	// Extra percentiles of CPU %, e.g. ?percentiles=50,90,95,99
+	percentiles, err := parsePercentiles(r.URL.Query().Get("percentiles"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid percentiles: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+
 	// Default to last month if not provided
 	if startDate == "" || endDate == "" {
 		now := time.Now()
@@ -136,18 +360,35 @@ func getCPUBilling(w http.ResponseWriter, r *http.Request) {
 		endDate = lastDay.Format("2006-01-02T15:04:05")
 	}
 
+	noCache, ok := parseMeasuresCache(w, r)
+	if !ok {
+		return
+	}
 	config := GnocchiConfig{
-		BaseURL:  getEnv("GNOCCHI_URL", ""),
-		Token:    getEnv("GNOCCHI_TOKEN", ""),
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    clusterEnv(r.Context(), "GNOCCHI_TOKEN", ""),
 		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+		NoCache:  noCache,
 	}
 
 	client := NewGnocchiClient(config)
 
 	// Get instance resource
-	instance, err := client.GetInstanceResource(instanceID)
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	loc, ok := parseTimezone(w, r)
+	if !ok {
+		return
+	}
+	instance, err := getInstanceResource(r.Context(), client, instanceID, policy)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get instance: %v", err), http.StatusInternalServerError)
+		writeInstanceError(w, err)
+		return
+	}
+	if !allowProject(w, r, instance.ProjectID) {
 		return
 	}
 
@@ -159,22 +400,28 @@ func getCPUBilling(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get CPU measures
-	measures, err := client.GetMetricMeasures(cpuMetricID, startDate, endDate, 300) // 1 hour granularity
+	granularityUsed := make(map[string]int)
+	measures, cpuGranularity, err := client.GetCounterMeasures(cpuMetricID, startDate, endDate, 300)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get CPU measures: %v", err), http.StatusInternalServerError)
 		return
 	}
+	granularityUsed["cpu"] = cpuGranularity
 
 	// Calculate CPU usage
 	numVCPUs := 2 // Default, should get from flavor
 	if vcpuMetricID, ok := instance.Metrics["vcpus"]; ok {
-		vcpuMeasures, _ := client.GetMetricMeasures(vcpuMetricID, startDate, endDate, 3600)
+		vcpuMeasures, vcpuGranularity, _ := client.GetMetricMeasuresNegotiated(vcpuMetricID, startDate, endDate, 3600)
 		if len(vcpuMeasures) > 0 {
 			numVCPUs = int(vcpuMeasures[0].Value)
+			granularityUsed["vcpus"] = vcpuGranularity
 		}
 	}
 
-	usage := CalculateCPUUsage(measures, numVCPUs)
+	usage := CalculateCPUUsage(measures, numVCPUs, loc)
+	if len(percentiles) > 0 {
+		usage.Percentiles = CPUPercentiles(usage, percentiles)
+	}
 	billing := CalculateCPUBilling(usage, startDate, endDate)
 
 	response := CPUBillingResponse{
@@ -185,10 +432,12 @@ func getCPUBilling(w http.ResponseWriter, r *http.Request) {
 		VCPUs:        numVCPUs,
 		Usage:        usage,
 		Billing:      billing,
+
+		GranularityUsed: granularityUsed,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, response)
 }
 
 func getResourceBilling(w http.ResponseWriter, r *http.Request) {
@@ -198,6 +447,18 @@ func getResourceBilling(w http.ResponseWriter, r *http.Request) {
 	startDate := r.URL.Query().Get("start_date")
 	endDate := r.URL.Query().Get("end_date")
 
+	// Output format: json (default) or csv
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, `{"error":"unsupported format (supported: json, csv)"}`, http.StatusBadRequest)
+		return
+	}
+	precision, err := parsePrecision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
 	if startDate == "" || endDate == "" {
 		now := time.Now()
 		firstDay := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
@@ -206,59 +467,151 @@ func getResourceBilling(w http.ResponseWriter, r *http.Request) {
 		endDate = lastDay.Format("2006-01-02T15:04:05")
 	}
 
+	noCache, ok := parseMeasuresCache(w, r)
+	if !ok {
+		return
+	}
 	config := GnocchiConfig{
-		BaseURL:  getEnv("GNOCCHI_URL", ""),
-		Token:    getEnv("GNOCCHI_TOKEN", ""),
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    clusterEnv(r.Context(), "GNOCCHI_TOKEN", ""),
 		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+		NoCache:  noCache,
 	}
 
 	client := NewGnocchiClient(config)
 
 	// Get instance resource
-	instance, err := client.GetInstanceResource(instanceID)
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	loc, ok := parseTimezone(w, r)
+	if !ok {
+		return
+	}
+	instance, err := getInstanceResource(r.Context(), client, instanceID, policy)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get instance: %v", err), http.StatusInternalServerError)
+		writeInstanceError(w, err)
+		return
+	}
+	if !allowProject(w, r, instance.ProjectID) {
 		return
 	}
 
-	// Get all resource metrics
+	// Concurrent identical requests share one collection
+	flightKey := clusterKey(r.Context(), fmt.Sprintf("resource_usage:%s:%s:%s", instanceID, startDate, endDate))
+	if loc != nil {
+		flightKey += ":tz=" + zoneName(loc)
+	}
+	v, err, shared := resourceUsageFlight.Do(r.Context(), measuresFlightKey(client, flightKey), func() (interface{}, error) {
+		return collectResourceUsage(client, instanceID, instance, startDate, endDate, loc)
+	})
+	if err != nil {
+		writeInstanceError(w, err)
+		return
+	}
+	if shared {
+		setXCache(w, cacheCoalesced)
+	}
+	resourceUsage := v.(ResourceUsage)
+
+	if format == "csv" {
+		writeResourceUsageCSV(w, resourceUsage, precision)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, resourceUsage)
+}
+
+// resourceUsageFlight coalesces concurrent /billing/resources collections.
+var resourceUsageFlight = newFlightGroup("resource_usage")
+
+// collectResourceUsage reads the CPU, memory, network and disk usage of the
+// instance for the period. Timestamps and day buckets are in loc. A failed
+// measures fetch is a *measuresError.
+func collectResourceUsage(client *GnocchiClient, instanceID string, instance *InstanceResource,
+	startDate, endDate string, loc *time.Location) (ResourceUsage, error) {
 	resourceUsage := ResourceUsage{
 		InstanceID:   instanceID,
 		InstanceName: instance.DisplayName,
 		StartDate:    startDate,
 		EndDate:      endDate,
 		FlavorName:   instance.FlavorName,
+		CPU:          emptyCPUUsageStats(),
+		Memory:       emptyMemoryUsageStats(),
 	}
 
 	// CPU
 	if cpuMetricID, ok := instance.Metrics["cpu"]; ok {
-		measures, _ := client.GetMetricMeasures(cpuMetricID, startDate, endDate, 300)
+		measures, _, err := client.GetCounterMeasures(cpuMetricID, startDate, endDate, 300)
+		if err != nil {
+			return resourceUsage, &measuresError{Metric: "cpu", Err: err}
+		}
 		numVCPUs := 2
 		if vcpuMetricID, ok := instance.Metrics["vcpus"]; ok {
-			vcpuMeasures, _ := client.GetMetricMeasures(vcpuMetricID, startDate, endDate, 3600)
+			vcpuMeasures, err := client.GetMetricMeasures(vcpuMetricID, startDate, endDate, 3600)
+			if err != nil {
+				return resourceUsage, &measuresError{Metric: "vcpus", Err: err}
+			}
 			if len(vcpuMeasures) > 0 {
 				numVCPUs = int(vcpuMeasures[0].Value)
 			}
 		}
-		cpuUsage := CalculateCPUUsage(measures, numVCPUs)
+		cpuUsage := CalculateCPUUsage(measures, numVCPUs, loc)
 		resourceUsage.CPU = cpuUsage
 		resourceUsage.VCPUs = numVCPUs
 	}
 
 	// Memory
 	if memUsageMetricID, ok := instance.Metrics["memory.usage"]; ok {
-		memMeasures, _ := client.GetMetricMeasures(memUsageMetricID, startDate, endDate, 3600)
+		memMeasures, err := client.GetMetricMeasures(memUsageMetricID, startDate, endDate, 3600)
+		if err != nil {
+			return resourceUsage, &measuresError{Metric: "memory.usage", Err: err}
+		}
 		if memTotalMetricID, ok := instance.Metrics["memory"]; ok {
-			memTotalMeasures, _ := client.GetMetricMeasures(memTotalMetricID, startDate, endDate, 3600)
+			memTotalMeasures, err := client.GetMetricMeasures(memTotalMetricID, startDate, endDate, 3600)
+			if err != nil {
+				return resourceUsage, &measuresError{Metric: "memory", Err: err}
+			}
 			if len(memTotalMeasures) > 0 {
-				memUsage := CalculateMemoryUsage(memMeasures, memTotalMeasures)
+				memUsage := CalculateMemoryUsage(memMeasures, memTotalMeasures, loc)
 				resourceUsage.Memory = memUsage
 			}
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resourceUsage)
+	// Network, per interface and total
+	network, err := collectInstanceNetworkUsage(client, instanceID, instance.Metrics, startDate, endDate)
+	if err != nil {
+		return resourceUsage, err
+	}
+	resourceUsage.Network = network
+
+	// Disk read/write and size; omitted without disk metrics
+	disk, err := collectInstanceDiskUsage(client, instance.Metrics, startDate, endDate, nil)
+	if err != nil {
+		return resourceUsage, err
+	}
+	resourceUsage.Disk = disk
+	return resourceUsage, nil
+}
+
+// reportPricingFromQuery reads ?disk_price_per_gb_month, ?io_price_per_gb and
+// ?network_price_per_gb (default 0). PRICING_TIERS_FILE prices the reports
+// unless the request gives its own CPU, memory or disk price.
+func reportPricingFromQuery(q url.Values, expr *PricingExpr) ReportPricing {
+	pricing := ReportPricing{
+		DiskPricePerGBMonth: parseFloat(q.Get("disk_price_per_gb_month"), 0),
+		IOPricePerGB:        parseFloat(q.Get("io_price_per_gb"), 0),
+		NetworkPricePerGB:   parseFloat(q.Get("network_price_per_gb"), 0),
+		Expr:                expr,
+	}
+	if !q.Has("cpu_price_per_hour") && !q.Has("memory_price_per_gb") && !q.Has("disk_price_per_gb_month") {
+		pricing.Tiers = fileConfigs.get().tiers
+	}
+	return pricing
 }
 
 func getBillingReport(w http.ResponseWriter, r *http.Request) {
@@ -271,6 +624,46 @@ func getBillingReport(w http.ResponseWriter, r *http.Request) {
 	// Pricing from query params or use default
 	cpuPricePerHour := parseFloat(r.URL.Query().Get("cpu_price_per_hour"), 0.05)
 	memoryPricePerGB := parseFloat(r.URL.Query().Get("memory_price_per_gb"), 0.01)
+	includeHourlyCost := r.URL.Query().Get("include_hourly_cost") == "true"
+
+	// Refuse to bill when too little of the period has metric data (0 = disabled)
+	minCoverage := parseFloat(r.URL.Query().Get("min_coverage_pct"), parseFloat(getEnv("BILLING_MIN_COVERAGE_PCT", ""), 0))
+	if minCoverage < 0 || minCoverage > 100 {
+		http.Error(w, `{"error":"min_coverage_pct must be between 0 and 100"}`, http.StatusBadRequest)
+		return
+	}
+	allowLowCoverage := r.URL.Query().Get("allow_low_coverage") == "true"
+
+	// Output format: json (default), invoice_jsonl or csv
+	format := r.URL.Query().Get("format")
+	if err := validateExportFormat(format); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+	precision, err := parsePrecision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	// Manual credits/charges (POST body or X-Billing-Adjustments header)
+	adjustments, err := parseAdjustments(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid adjustments: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+	if err := ValidateAdjustments(adjustments, "USD"); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid adjustments: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	// Contract pricing (?pricing_expr= or PRICING_EXPR) replaces the built-in formula
+	expr, err := pricingExprFromRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid pricing_expr: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+	pricing := reportPricingFromQuery(r.URL.Query(), expr)
 
 	if startDate == "" || endDate == "" {
 		now := time.Now()
@@ -280,70 +673,271 @@ func getBillingReport(w http.ResponseWriter, r *http.Request) {
 		endDate = lastDay.Format("2006-01-02T15:04:05")
 	}
 
+	noCache, ok := parseMeasuresCache(w, r)
+	if !ok {
+		return
+	}
 	config := GnocchiConfig{
-		BaseURL:  getEnv("GNOCCHI_URL", ""),
-		Token:    getEnv("GNOCCHI_TOKEN", ""),
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    clusterEnv(r.Context(), "GNOCCHI_TOKEN", ""),
 		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+		NoCache:  noCache,
+	}
+
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	loc, ok := parseTimezone(w, r)
+	if !ok {
+		return
 	}
 
 	client := NewGnocchiClient(config)
-	instance, err := client.GetInstanceResource(instanceID)
+	if !allowInstance(w, r, client, instanceID) {
+		return
+	}
+	report, result, err := loadBillingReport(r.Context(), client, instanceID, startDate, endDate,
+		cpuPricePerHour, memoryPricePerGB, policy, loc, includeHourlyCost)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get instance: %v", err), http.StatusInternalServerError)
+		writeInstanceError(w, err)
+		return
+	}
+	setXCache(w, result)
+
+	coverage := *report.Coverage
+	if minCoverage > 0 && coverage.Percent < minCoverage {
+		if !allowLowCoverage {
+			slog.WarnContext(r.Context(), "Refusing billing report with low metric coverage",
+				"instance_id", instanceID, "coverage_pct", coverage.Percent, "min_coverage_pct", minCoverage)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJSON(w, map[string]interface{}{
+				"error":            "metric coverage below min_coverage_pct; pass allow_low_coverage=true to bill anyway",
+				"instance_id":      instanceID,
+				"coverage":         coverage,
+				"min_coverage_pct": minCoverage,
+			})
+			return
+		}
+		slog.WarnContext(r.Context(), "Billing report has low metric coverage (allowed by request)",
+			"instance_id", instanceID, "coverage_pct", coverage.Percent)
+	}
+
+	if err := PriceReport(&report, pricing, adjustments); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusUnprocessableEntity)
 		return
 	}
+	if result != cacheHit && result != cacheCoalesced {
+		// Only a computed report is new; hits and joined requests repeat it
+		billingEvents.publish(billingEventReportGenerated, newInvoiceLineItem(report))
+	}
+
+	switch format {
+	case "invoice_jsonl":
+		writeInvoiceJSONL(w, []BillingReport{report}, startDate, endDate, report.Currency)
+		return
+	case "csv":
+		writeBillingReportCSV(w, report, precision)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, report)
+}
+
+// billingReportFlight coalesces concurrent computations of the same report.
+var billingReportFlight = newFlightGroup("billing_report")
+
+// loadBillingReport returns the report before adjustments, from the cache
+// (keyed per instance, period, prices and timezone) when the policy allows,
+// otherwise computed (once for concurrent identical requests) and cached. The
+// cache result (coalesced when it shared another request's computation) is
+// returned for X-Cache. ctx selects the cluster; the
+// computation itself is not bound to it (it is shared by concurrent callers).
+// hourlyCost adds the cost_by_hour series (cached separately).
+func loadBillingReport(ctx context.Context, client *GnocchiClient, instanceID, startDate, endDate string,
+	cpuPricePerHour, memoryPricePerGB float64, policy cachePolicy, loc *time.Location, hourlyCost bool) (BillingReport, string, error) {
+	ctx = withCluster(context.Background(), clusterOf(ctx))
+	reportKey := clusterKey(ctx, billingReportCacheKey(instanceID, startDate, endDate, cpuPricePerHour, memoryPricePerGB))
+	if loc != nil {
+		// Day buckets differ per timezone
+		reportKey += ":tz=" + zoneName(loc)
+	}
+	if hourlyCost {
+		reportKey += ":hourly"
+	}
+	var report BillingReport
+	if policy.readsCache() && getCachedBillingReport(reportKey, endDate, &report) {
+		return report, cacheHit, nil
+	}
+
+	v, err, shared := billingReportFlight.Do(ctx, measuresFlightKey(client, policy.flightKey(reportKey)), func() (interface{}, error) {
+		instance, err := getInstanceResource(ctx, client, instanceID, policy)
+		if err != nil {
+			return nil, err
+		}
+		report, err := buildBillingReport(client, instanceID, instance.DisplayName, instance.FlavorName, instance.Metrics,
+			instance.StartedAt, instance.EndedAt, startDate, endDate, cpuPricePerHour, memoryPricePerGB, loc, hourlyCost)
+		if err != nil {
+			return nil, err // never cache a report missing measures
+		}
+		if policy.writesCache() {
+			cacheSetExpiry(reportKey, report, getBillingReportTTL(endDate))
+		}
+		return report, nil
+	})
+	if err != nil {
+		return BillingReport{}, policy.result(), err
+	}
+	if shared {
+		return v.(BillingReport), cacheCoalesced, nil
+	}
+	return v.(BillingReport), policy.result(), nil
+}
 
+// buildBillingReport computes the CPU and memory usage, cost and CPU coverage,
+// and the disk and network usage of one instance for the period. Memory cost
+// and coverage cover only the part of the period between startedAt and endedAt
+// (see BillingWindow). Prices are per CPU-hour and per GB-hour. Timestamps and
+// day buckets are in loc (nil: unchanged). With hourlyCost the CPU + memory
+// cost is also priced per hour (CostByHour). Adjustments are not applied.
+// A failed measures fetch fails the report (*measuresError) rather than
+// billing the metric as unused.
+func buildBillingReport(client *GnocchiClient, instanceID, name, flavor string, metricIDs map[string]string,
+	startedAt string, endedAt *string, startDate, endDate string, cpuPricePerHour, memoryPricePerGB float64,
+	loc *time.Location, hourlyCost bool) (BillingReport, error) {
 	report := BillingReport{
 		InstanceID:       instanceID,
-		InstanceName:     instance.DisplayName,
-		FlavorName:       instance.FlavorName,
+		InstanceName:     name,
+		FlavorName:       flavor,
 		StartDate:        startDate,
 		EndDate:          endDate,
-		GeneratedAt:      time.Now().Format(time.RFC3339),
+		GeneratedAt:      inZone(time.Now(), loc).Format(time.RFC3339),
 		Currency:         "USD",
+		CPUUsage:         emptyCPUUsageStats(),
+		MemoryUsage:      emptyMemoryUsageStats(),
 		CPUPricePerHour:  cpuPricePerHour,
 		MemoryPricePerGB: memoryPricePerGB,
+		Adjustments:      []BillingAdjustment{},
+		GranularityUsed:  make(map[string]int),
 	}
 
+	// Prorate to the instance's lifetime inside the period
+	first, last := BillingWindow(startDate, endDate, startedAt, endedAt)
+	report.FirstSeen = inZone(first, loc).Format(time.RFC3339)
+	report.LastSeen = inZone(last, loc).Format(time.RFC3339)
+	report.EffectiveHours = last.Sub(first).Hours()
+
 	// Calculate CPU billing
-	if cpuMetricID, ok := instance.Metrics["cpu"]; ok {
-		measures, _ := client.GetMetricMeasures(cpuMetricID, startDate, endDate, 300)
+	cpuGranularity := 300
+	cpuValidPoints := 0
+	if cpuMetricID, ok := metricIDs["cpu"]; ok {
+		measures, used, err := client.GetCounterMeasures(cpuMetricID, startDate, endDate, cpuGranularity)
+		if err != nil {
+			return report, &measuresError{Metric: "cpu", Err: err}
+		}
+		cpuGranularity = used
+		report.GranularityUsed["cpu"] = used
 		numVCPUs := 2
-		if vcpuMetricID, ok := instance.Metrics["vcpus"]; ok {
-			vcpuMeasures, _ := client.GetMetricMeasures(vcpuMetricID, startDate, endDate, 300)
+		if vcpuMetricID, ok := metricIDs["vcpus"]; ok {
+			vcpuMeasures, used, err := client.GetMetricMeasuresNegotiated(vcpuMetricID, startDate, endDate, 300)
+			if err != nil {
+				return report, &measuresError{Metric: "vcpus", Err: err}
+			}
 			if len(vcpuMeasures) > 0 {
 				numVCPUs = int(vcpuMeasures[0].Value)
+				report.GranularityUsed["vcpus"] = used
 			}
 		}
-		cpuUsage := CalculateCPUUsage(measures, numVCPUs)
-		cpuBilling := CalculateCPUBilling(cpuUsage, startDate, endDate)
+		cpuUsage := CalculateCPUUsage(measures, numVCPUs, loc)
+		cpuBilling := CalculateCPUBilling(cpuUsage, first.Format("2006-01-02T15:04:05"), last.Format("2006-01-02T15:04:05"))
 
 		report.CPUUsage = cpuUsage
 		report.VCPUs = numVCPUs
 		report.CPUCost = cpuBilling.TotalCPUHours * cpuPricePerHour
+		cpuValidPoints = cpuUsage.TotalDataPoints
 	}
 
+	coverage := CalculateCoverage(cpuValidPoints, first.Format("2006-01-02T15:04:05"), last.Format("2006-01-02T15:04:05"), cpuGranularity)
+	report.Coverage = &coverage
+
 	// Calculate Memory billing
-	if memUsageMetricID, ok := instance.Metrics["memory.usage"]; ok {
-		memMeasures, _ := client.GetMetricMeasures(memUsageMetricID, startDate, endDate, 300)
-		if memTotalMetricID, ok := instance.Metrics["memory"]; ok {
-			memTotalMeasures, _ := client.GetMetricMeasures(memTotalMetricID, startDate, endDate, 300)
+	var memIntervals []MetricMeasure // memory.usage measures billed, for CostByHour
+	memIntervalGranularity := 0
+	if memUsageMetricID, ok := metricIDs["memory.usage"]; ok {
+		memMeasures, memUsageGranularity, err := client.GetMetricMeasuresNegotiated(memUsageMetricID, startDate, endDate, 300)
+		if err != nil {
+			return report, &measuresError{Metric: "memory.usage", Err: err}
+		}
+		if memTotalMetricID, ok := metricIDs["memory"]; ok {
+			memTotalMeasures, memTotalGranularity, err := client.GetMetricMeasuresNegotiated(memTotalMetricID, startDate, endDate, 300)
+			if err != nil {
+				return report, &measuresError{Metric: "memory", Err: err}
+			}
 			if len(memTotalMeasures) > 0 {
-				memUsage := CalculateMemoryUsage(memMeasures, memTotalMeasures)
+				report.GranularityUsed["memory.usage"] = memUsageGranularity
+				report.GranularityUsed["memory"] = memTotalGranularity
+				memUsage := CalculateMemoryUsage(memMeasures, memTotalMeasures, loc)
 				report.MemoryUsage = memUsage
+				memIntervals, memIntervalGranularity = memMeasures, memUsageGranularity
 
-				// Calculate memory cost based on GB-hours
+				// Calculate memory cost based on GB-hours while the instance existed
 				totalMemoryGB := memUsage.AverageUsedMB / 1024.0
-				start, _ := time.Parse("2006-01-02T15:04:05", startDate)
-				end, _ := time.Parse("2006-01-02T15:04:05", endDate)
-				totalHours := end.Sub(start).Hours()
-				report.MemoryCost = totalMemoryGB * totalHours * memoryPricePerGB
+				report.MemoryCost = totalMemoryGB * report.EffectiveHours * memoryPricePerGB
 			}
 		}
 	}
 
-	report.TotalCost = report.CPUCost + report.MemoryCost
+	if hourlyCost {
+		report.CostByHour = CalculateHourlyCost(report.CPUUsage.UsageByHour, memIntervals, memIntervalGranularity,
+			cpuPricePerHour, memoryPricePerGB, loc)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(report)
+	// Disk I/O and provisioned size; priced per request by ApplyDiskPricing
+	disk, err := collectInstanceDiskUsage(client, metricIDs, startDate, endDate, report.GranularityUsed)
+	if err != nil {
+		return report, err
+	}
+	if disk != nil {
+		report.DiskUsage = *disk
+	}
+
+	// Network traffic; egress is priced per request by ApplyNetworkPricing
+	network, err := collectInstanceNetworkUsage(client, instanceID, metricIDs, startDate, endDate)
+	if err != nil {
+		return report, err
+	}
+	report.NetworkUsage = network
+
+	return report, nil
+}
+
+// billingReportRequest is the optional POST body of /billing/report/{instance_id}.
+type billingReportRequest struct {
+	Adjustments []BillingAdjustment `json:"adjustments"`
+}
+
+// parseAdjustments reads adjustments from the POST body, or for GET requests
+// from the X-Billing-Adjustments header (a JSON array).
+func parseAdjustments(r *http.Request) ([]BillingAdjustment, error) {
+	if r.Method == http.MethodPost && r.Body != nil {
+		var req billingReportRequest
+		dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+		if err := dec.Decode(&req); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return req.Adjustments, nil
+	}
+
+	header := r.Header.Get("X-Billing-Adjustments")
+	if header == "" {
+		return nil, nil
+	}
+	var adjustments []BillingAdjustment
+	if err := json.Unmarshal([]byte(header), &adjustments); err != nil {
+		return nil, err
+	}
+	return adjustments, nil
 }
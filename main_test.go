@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newEmptyGnocchi answers every request with an empty list, like Gnocchi for
+// an instance without measures.
+func newEmptyGnocchi(t *testing.T) *GnocchiClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(srv.Close)
+	return NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL, MaxRetries: -1})
+}
+
+func TestEmptyResultsEncodeAsEmptyLists(t *testing.T) {
+	client := newEmptyGnocchi(t)
+	start, end := "2026-01-01T00:00:00", "2026-02-01T00:00:00"
+	metrics := map[string]string{"cpu": "cpu-1", "vcpus": "vcpus-1", "memory.usage": "mu-1", "memory": "mem-1"}
+
+	for name, metricIDs := range map[string]map[string]string{"no measures": metrics, "no metrics": {}} {
+		report, err := buildBillingReport(client, "i-1", "web-1", "m1.small", metricIDs, "2025-12-01T00:00:00+00:00", nil,
+			start, end, 0.05, 0.01, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if null := regexp.MustCompile(`"[a-z_]+":null`).Find(data); null != nil {
+			t.Errorf("%s: report has %s", name, null)
+		}
+		for _, want := range []string{`"usage_by_hour":[]`, `"gaps":[]`, `"adjustments":[]`, `"usage_by_day":[]`} {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("%s: report lacks %s", name, want)
+			}
+		}
+		if name == "no metrics" && !strings.Contains(string(data), `"granularity_used":{}`) {
+			t.Errorf("%s: granularity_used is not {}", name)
+		}
+	}
+}
+
+func TestEmptyUsageStatsEncodeAsEmptyLists(t *testing.T) {
+	for name, stats := range map[string]interface{}{
+		"cpu, no measures":     CalculateCPUUsage(nil, 2, nil),
+		"cpu, one measure":     CalculateCPUUsage([]MetricMeasure{{Timestamp: "2026-01-01T00:00:00Z"}}, 2, nil),
+		"memory, no measures":  CalculateMemoryUsage(nil, nil, nil),
+		"memory, no size":      CalculateMemoryUsage([]MetricMeasure{{Timestamp: "2026-01-01T00:00:00Z", Value: 1}}, nil, nil),
+		"resource usage, zero": ResourceUsage{CPU: emptyCPUUsageStats(), Memory: emptyMemoryUsageStats()},
+	} {
+		data, err := json.Marshal(stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "null") || !strings.Contains(string(data), `"usage_by_day":[]`) {
+			t.Errorf("%s: %s", name, data)
+		}
+	}
+}
+
+// newConstantGnocchi answers the measures of each metric in values with one
+// measure of that value at the requested start.
+func newConstantGnocchi(t *testing.T, values map[string]float64) *GnocchiClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for id, v := range values {
+			if strings.Contains(r.URL.Path, "/"+id+"/") {
+				fmt.Fprintf(w, `[["%s+00:00", 300.0, %v]]`, r.URL.Query().Get("start"), v)
+				return
+			}
+		}
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(srv.Close)
+	return NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL, MaxRetries: -1, NoCache: true})
+}
+
+func TestBuildBillingReportProration(t *testing.T) {
+	// 2 GB used of 4 GB at 0.01 per GB-hour
+	client := newConstantGnocchi(t, map[string]float64{"mu-1": 2048, "mem-1": 4096})
+	metrics := map[string]string{"memory.usage": "mu-1", "memory": "mem-1"}
+	ended := func(ts string) *string { return &ts }
+
+	tests := []struct {
+		name                string
+		startedAt           string
+		endedAt             *string
+		firstSeen, lastSeen string
+		hours               float64
+	}{
+		{"whole month", "2025-12-01T00:00:00+00:00", nil,
+			"2026-01-01T00:00:00Z", "2026-02-01T00:00:00Z", 744},
+		{"mid-month start", "2026-01-16T00:00:00+00:00", nil,
+			"2026-01-16T00:00:00Z", "2026-02-01T00:00:00Z", 384},
+		{"mid-month end", "2025-12-01T00:00:00+00:00", ended("2026-01-11T12:00:00+00:00"),
+			"2026-01-01T00:00:00Z", "2026-01-11T12:00:00Z", 252},
+		{"started and ended mid-month", "2026-01-10T00:00:00+00:00", ended("2026-01-12T06:00:00+00:00"),
+			"2026-01-10T00:00:00Z", "2026-01-12T06:00:00Z", 54},
+		{"ended before the period", "2025-11-01T00:00:00+00:00", ended("2025-12-15T00:00:00+00:00"),
+			"2026-01-01T00:00:00Z", "2026-01-01T00:00:00Z", 0},
+	}
+	for _, tt := range tests {
+		report, err := buildBillingReport(client, "i-1", "web-1", "m1.small", metrics, tt.startedAt, tt.endedAt,
+			"2026-01-01T00:00:00", "2026-02-01T00:00:00", 0.05, 0.01, nil, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if report.FirstSeen != tt.firstSeen || report.LastSeen != tt.lastSeen {
+			t.Errorf("%s: window %s – %s, want %s – %s", tt.name, report.FirstSeen, report.LastSeen, tt.firstSeen, tt.lastSeen)
+		}
+		if !almostEqual(report.EffectiveHours, tt.hours) {
+			t.Errorf("%s: %v effective hours, want %v", tt.name, report.EffectiveHours, tt.hours)
+		}
+		if want := 2 * tt.hours * 0.01; !almostEqual(report.MemoryCost, want) {
+			t.Errorf("%s: memory cost %v, want %v", tt.name, report.MemoryCost, want)
+		}
+	}
+}
+
+func TestBuildBillingReportClampedToNow(t *testing.T) {
+	client := newConstantGnocchi(t, map[string]float64{"mu-1": 2048, "mem-1": 4096})
+	metrics := map[string]string{"memory.usage": "mu-1", "memory": "mem-1"}
+
+	// A period from two days ago to four weeks ahead
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-48 * time.Hour)
+	end := start.Add(30 * 24 * time.Hour)
+	before := time.Now()
+	report, err := buildBillingReport(client, "i-1", "web-1", "m1.small", metrics, "2025-01-01T00:00:00+00:00", nil,
+		start.Format("2006-01-02T15:04:05"), end.Format("2006-01-02T15:04:05"), 0.05, 0.01, nil, false)
+	after := time.Now()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := time.Parse(time.RFC3339, report.LastSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Before(before.Truncate(time.Second)) || last.After(after) {
+		t.Errorf("last seen %s, want now", report.LastSeen)
+	}
+	if min, max := before.Sub(start).Hours(), after.Sub(start).Hours(); report.EffectiveHours < min-1.0/3600 || report.EffectiveHours > max {
+		t.Errorf("%v effective hours, want %v to %v", report.EffectiveHours, min, max)
+	}
+	if want := 2 * report.EffectiveHours * 0.01; math.Abs(report.MemoryCost-want) > 1e-9 {
+		t.Errorf("memory cost %v, want %v", report.MemoryCost, want)
+	}
+
+	// A period that has not started yet bills nothing
+	report, err = buildBillingReport(client, "i-1", "web-1", "m1.small", metrics, "2025-01-01T00:00:00+00:00", nil,
+		end.Format("2006-01-02T15:04:05"), end.Add(24*time.Hour).Format("2006-01-02T15:04:05"), 0.05, 0.01, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.EffectiveHours != 0 || report.MemoryCost != 0 {
+		t.Errorf("future period: %v hours, memory cost %v", report.EffectiveHours, report.MemoryCost)
+	}
+}
+
+// newFailingGnocchi serves instance i-1 with memory metrics; the memory.usage
+// measures answer 403 while *failing is set.
+func newFailingGnocchi(t *testing.T, failing *atomic.Bool) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/resource/instance/i-1"):
+			fmt.Fprint(w, `{"id": "i-1", "display_name": "web-1", "project_id": "proj-a",
+				"started_at": "2025-12-01T00:00:00+00:00", "metrics": {"memory.usage": "mu-1", "memory": "mem-1"}}`)
+		case strings.Contains(r.URL.Path, "/mu-1/") && failing.Load():
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `policy does not allow this`)
+		case strings.Contains(r.URL.Path, "/mu-1/"), strings.Contains(r.URL.Path, "/mem-1/"):
+			fmt.Fprintf(w, `[["%s+00:00", 300.0, 2048]]`, r.URL.Query().Get("start"))
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestBuildBillingReportFetchError(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: newFailingGnocchi(t, &failing), NoCache: true})
+
+	_, err := buildBillingReport(client, "i-1", "web-1", "m1.small", map[string]string{"memory.usage": "mu-1", "memory": "mem-1"},
+		"2025-12-01T00:00:00+00:00", nil, "2026-01-01T00:00:00", "2026-02-01T00:00:00", 0.05, 0.01, nil, false)
+	var fetchErr *measuresError
+	if !errors.As(err, &fetchErr) || fetchErr.Metric != "memory.usage" {
+		t.Errorf("err = %v, want the memory.usage fetch error", err)
+	}
+}
+
+func TestBillingReportFetchErrorIsNotCached(t *testing.T) {
+	mr := useMiniredis(t)
+	var failing atomic.Bool
+	failing.Store(true)
+	t.Setenv("GNOCCHI_URL", newFailingGnocchi(t, &failing))
+
+	report := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/billing/report/i-1?start_date=2026-01-01T00:00:00&end_date=2026-02-01T00:00:00", nil)
+		rec := httptest.NewRecorder()
+		getBillingReport(rec, mux.SetURLVars(req, map[string]string{"instance_id": "i-1"}))
+		return rec
+	}
+
+	rec := report()
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "memory.usage") {
+		t.Fatalf("status %d: %s, want 502 naming memory.usage", rec.Code, rec.Body.String())
+	}
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, billingReportKey) {
+			t.Errorf("failed report cached under %s", key)
+		}
+	}
+
+	// Once Gnocchi answers, the report is computed rather than a cached $0
+	failing.Store(false)
+	rec = report()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var got BillingReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := 2 * 744 * 0.01; !almostEqual(got.MemoryCost, want) {
+		t.Errorf("memory cost %v, want %v", got.MemoryCost, want)
+	}
+}
+
+// recordingPublisher keeps the published events.
+type recordingPublisher struct{ noopPublisher }
+
+func TestBillingReportEventOnlyWhenComputed(t *testing.T) {
+	useMiniredis(t)
+	var failing atomic.Bool
+	t.Setenv("GNOCCHI_URL", newFailingGnocchi(t, &failing))
+	prev := billingEvents
+	billingEvents = &eventBus{publisher: &recordingPublisher{}, queue: make(chan BillingEvent, 8)}
+	t.Cleanup(func() { billingEvents = prev })
+
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		req := httptest.NewRequest("GET", "/api/v1/billing/report/i-1?start_date=2026-01-01T00:00:00&end_date=2026-02-01T00:00:00", nil)
+		rec := httptest.NewRecorder()
+		getBillingReport(rec, mux.SetURLVars(req, map[string]string{"instance_id": "i-1"}))
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != want {
+			t.Fatalf("request %d: status %d, X-Cache %s, want %s", i, rec.Code, rec.Header().Get("X-Cache"), want)
+		}
+	}
+	if n := len(billingEvents.queue); n != 1 {
+		t.Errorf("%d report events for one computation, want 1", n)
+	}
+}
+
+func TestNetworkFetchErrorFailsTheReport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/resource/instance/i-1"):
+			fmt.Fprint(w, `{"id": "i-1", "display_name": "web-1", "started_at": "2025-12-01T00:00:00+00:00",
+				"metrics": {"network.outgoing.bytes.tap1": "out-1", "network.outgoing.bytes.tap2": "out-2"}}`)
+		case strings.Contains(r.URL.Path, "/out-2/"):
+			w.WriteHeader(http.StatusForbidden)
+		case strings.Contains(r.URL.Path, "/out-1/"):
+			fmt.Fprintf(w, `[["%s+00:00", 300.0, 1000]]`, r.URL.Query().Get("start"))
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: srv.URL, MaxRetries: -1, NoCache: true})
+	metrics := map[string]string{"network.outgoing.bytes.tap1": "out-1", "network.outgoing.bytes.tap2": "out-2"}
+
+	// The egress of tap2 is not billed as zero
+	_, err := buildBillingReport(client, "i-1", "web-1", "m1.small", metrics,
+		"2025-12-01T00:00:00+00:00", nil, "2026-01-01T00:00:00", "2026-02-01T00:00:00", 0.05, 0.01, nil, false)
+	var fetchErr *measuresError
+	if !errors.As(err, &fetchErr) || fetchErr.Metric != "network.outgoing.bytes.tap2" {
+		t.Errorf("report err = %v, want the tap2 fetch error", err)
+	}
+
+	t.Setenv("GNOCCHI_URL", srv.URL)
+	req := httptest.NewRequest("GET", "/api/v1/billing/network/i-1?start_date=2026-01-01T00:00:00&end_date=2026-02-01T00:00:00", nil)
+	rec := httptest.NewRecorder()
+	getNetworkBilling(rec, mux.SetURLVars(req, map[string]string{"instance_id": "i-1"}))
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "tap2") {
+		t.Errorf("network billing: status %d: %s, want 502 naming tap2", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gnocchi measures of a window that has ended don't change any more, yet every
+// report recomputation fetched them again. GetMetricMeasures keeps them in
+// Redis under measures:<endpoint>:<metric>:<start>:<stop>:<granularity>:mean,
+// below the billing-report cache, so e.g. /billing/cpu then /billing/report for the same
+// instance and period fetch them once. Windows that reach into the last
+// measuresSettleDelay (or have no stop) are never cached. <endpoint> is a short
+// hash of the Gnocchi URL: metric IDs are only unique within one Gnocchi, and
+// clusters may share a Redis.
+//
+// ?nocache=true skips the measures cache (read and write) for one request; it
+// needs the refresh scope like ?refresh. A cached billing report is still
+// served, so combine it with ?refresh=true to recompute from Gnocchi. Such
+// computations run in their own flights (measuresFlightKey): they neither join
+// a running computation that reads cached measures nor let others join them.
+
+// measuresSettleDelay is how long after a window's stop its measures may
+// still change (metricd processes the backlog late).
+const measuresSettleDelay = time.Hour
+
+// measuresCacheKey returns the cache key of one measures request to the
+// Gnocchi at baseURL.
+func measuresCacheKey(baseURL, metricID, startDate, endDate string, granularity int) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%s:%d:mean", measuresKey, gnocchiEndpointID(baseURL), metricID, startDate, endDate, granularity)
+}
+
+// gnocchiEndpointID returns a short, stable ID of a Gnocchi URL for cache keys.
+func gnocchiEndpointID(baseURL string) string {
+	sum := sha256.Sum256([]byte(strings.TrimRight(strings.ToLower(baseURL), "/")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// measuresFlightKey returns the flight key of a computation reading measures
+// through client: ?nocache ones get their own flight.
+func measuresFlightKey(client *GnocchiClient, key string) string {
+	if client.config.NoCache {
+		return key + ":nocache"
+	}
+	return key
+}
+
+// measuresCacheable reports whether a window ending at endDate is closed.
+func measuresCacheable(endDate string) bool {
+	end, ok := parseGnocchiTime(endDate)
+	return ok && end.Before(time.Now().Add(-measuresSettleDelay))
+}
+
+// getMeasuresTTL returns how long closed-window measures are cached
+// (CACHE_TTL_MEASURES, default 7 days).
+func getMeasuresTTL() time.Duration {
+	return getCacheTTLFor("MEASURES", 7*24*time.Hour)
+}
+
+// getCachedMeasures loads cached measures younger than getMeasuresTTL.
+func getCachedMeasures(key string, dest *[]MetricMeasure) bool {
+	age, ok := cacheGet(key, dest)
+	if !ok {
+		return false
+	}
+	if age > getMeasuresTTL() {
+		countCache(key, cacheMiss)
+		return false
+	}
+	countCache(key, cacheHit)
+	return true
+}
+
+// parseMeasuresCache reads ?nocache=true. Without the refresh scope it is
+// answered with 403 (ok is false).
+func parseMeasuresCache(w http.ResponseWriter, r *http.Request) (noCache bool, ok bool) {
+	if r.URL.Query().Get("nocache") != "true" {
+		return false, true
+	}
+	if !allowRefresh(w, r) {
+		return true, false
+	}
+	return true, true
+}
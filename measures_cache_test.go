@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newFakeGnocchiMeasures serves every metric's measures with value and counts
+// the requests.
+func newFakeGnocchiMeasures(t *testing.T, value float64) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fmt.Fprintf(w, `[["2026-01-01T00:00:00+00:00", 300.0, %v]]`, value)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestMeasuresCacheKeyPerEndpoint(t *testing.T) {
+	a := measuresCacheKey("https://gnocchi-a:8041", "m-1", "2026-01-01", "2026-02-01", 300)
+	b := measuresCacheKey("https://gnocchi-b:8041", "m-1", "2026-01-01", "2026-02-01", 300)
+	if a == b {
+		t.Errorf("same key %s for two Gnocchi endpoints", a)
+	}
+	if same := measuresCacheKey("HTTPS://gnocchi-a:8041/", "m-1", "2026-01-01", "2026-02-01", 300); same != a {
+		t.Errorf("key %s for the same endpoint spelled differently, want %s", same, a)
+	}
+}
+
+func TestGetMetricMeasuresCache(t *testing.T) {
+	useMiniredis(t)
+	gnocchiA, callsA := newFakeGnocchiMeasures(t, 1)
+	gnocchiB, callsB := newFakeGnocchiMeasures(t, 2)
+	clientA := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiA.URL})
+	clientB := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiB.URL})
+	start, end := "2026-01-01T00:00:00", "2026-01-02T00:00:00" // closed window
+
+	get := func(client *GnocchiClient) float64 {
+		t.Helper()
+		measures, err := client.GetMetricMeasures("m-1", start, end, 300)
+		if err != nil || len(measures) != 1 {
+			t.Fatalf("measures = %+v, %v", measures, err)
+		}
+		return measures[0].Value
+	}
+
+	// The same metric ID on two clusters' Gnocchis is cached apart
+	if get(clientA) != 1 || get(clientB) != 2 || get(clientA) != 1 || get(clientB) != 2 {
+		t.Error("measures mixed up between Gnocchi endpoints")
+	}
+	if callsA.Load() != 1 || callsB.Load() != 1 {
+		t.Errorf("Gnocchi calls = %d and %d, want 1 each", callsA.Load(), callsB.Load())
+	}
+
+	// ?nocache reads Gnocchi every time
+	noCache := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiA.URL, NoCache: true})
+	get(noCache)
+	get(noCache)
+	if callsA.Load() != 3 {
+		t.Errorf("Gnocchi calls with nocache = %d, want 3", callsA.Load())
+	}
+
+	// An open window is never cached
+	open := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchiB.URL})
+	for i := 0; i < 2; i++ {
+		if _, err := open.GetMetricMeasures("m-1", start, "", 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if callsB.Load() != 3 {
+		t.Errorf("Gnocchi calls for an open window = %d, want 3", callsB.Load())
+	}
+}
+
+func TestMeasuresFlightKeyNoCache(t *testing.T) {
+	cached := NewGnocchiClient(GnocchiConfig{BaseURL: "http://gnocchi"})
+	noCache := NewGnocchiClient(GnocchiConfig{BaseURL: "http://gnocchi", NoCache: true})
+	key := "billing_report:i-1"
+	if measuresFlightKey(cached, key) != key {
+		t.Errorf("flight key without nocache = %s", measuresFlightKey(cached, key))
+	}
+	if measuresFlightKey(noCache, key) == key {
+		t.Error("a nocache computation shares the flight of cached ones")
+	}
+}
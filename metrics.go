@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A deliberately small Prometheus exporter: counters, histograms and callback
+// gauges, rendered in the text exposition format at GET /metrics.
+
+// metricSample is one labelled value of a metric.
+type metricSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string                      // counter, gauge, histogram
+	values  map[string]*metricSample    // counters, keyed by rendered label set
+	hists   map[string]*histogramSample // histograms, keyed by rendered label set
+	buckets []float64                   // histogram upper bounds, ascending
+	collect func() []metricSample       // gauges, evaluated at scrape time
+}
+
+// histogramSample is one labelled histogram: per-bucket (non-cumulative) counts.
+type histogramSample struct {
+	labels map[string]string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry holds all exported metrics.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// metrics is the process-wide registry served at /metrics.
+var metrics = &metricsRegistry{families: make(map[string]*metricFamily)}
+
+// RegisterGauge registers a gauge whose samples are computed on every scrape.
+// Registering the same name again replaces the callback.
+func (m *metricsRegistry) RegisterGauge(name, help string, collect func() []metricSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.families[name] = &metricFamily{name: name, help: help, kind: "gauge", collect: collect}
+}
+
+// AddCounter adds v to the counter with the given labels, creating it on first use.
+func (m *metricsRegistry) AddCounter(name, help string, labels map[string]string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: "counter", values: make(map[string]*metricSample)}
+		m.families[name] = f
+	}
+	key := renderLabels(labels)
+	s, ok := f.values[key]
+	if !ok {
+		s = &metricSample{Labels: labels}
+		f.values[key] = s
+	}
+	s.Value += v
+}
+
+// ObserveHistogram records v in the histogram with the given labels, creating it
+// on first use. buckets are only used when the histogram is created.
+func (m *metricsRegistry) ObserveHistogram(name, help string, buckets []float64, labels map[string]string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: "histogram", buckets: buckets,
+			hists: make(map[string]*histogramSample)}
+		m.families[name] = f
+	}
+	key := renderLabels(labels)
+	h, ok := f.hists[key]
+	if !ok {
+		h = &histogramSample{labels: labels, counts: make([]uint64, len(f.buckets))}
+		f.hists[key] = h
+	}
+	for i, le := range f.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// renderHistogram writes the _bucket/_sum/_count lines of one histogram.
+// Caller MUST hold the registry lock.
+func renderHistogram(b *strings.Builder, f *metricFamily) {
+	keys := make([]string, 0, len(f.hists))
+	for k := range f.hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		h := f.hists[k]
+		withLE := func(le string) string {
+			labels := map[string]string{"le": le}
+			for name, v := range h.labels {
+				labels[name] = v
+			}
+			return renderLabels(labels)
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, withLE(fmt.Sprintf("%g", le)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, withLE("+Inf"), h.count)
+		fmt.Fprintf(b, "%s_sum%s %g\n", f.name, k, h.sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, k, h.count)
+	}
+}
+
+// IncCounter increments the counter with the given labels by one.
+func (m *metricsRegistry) IncCounter(name, help string, labels map[string]string) {
+	m.AddCounter(name, help, labels, 1)
+}
+
+// renderLabels formats labels as {a="1",b="2"} with sorted keys.
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// GET /metrics
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.mu.Lock()
+	families := make([]*metricFamily, 0, len(metrics.families))
+	for _, f := range metrics.families {
+		families = append(families, f)
+	}
+	// Snapshot counters and histograms so the lock isn't held while gauges are collected
+	counterSamples := make(map[string][]metricSample)
+	histograms := make(map[string]string)
+	for _, f := range families {
+		for _, s := range f.values {
+			counterSamples[f.name] = append(counterSamples[f.name], *s)
+		}
+		if f.kind == "histogram" {
+			var hb strings.Builder
+			renderHistogram(&hb, f)
+			histograms[f.name] = hb.String()
+		}
+	}
+	metrics.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		if f.kind == "histogram" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+			fmt.Fprintf(&b, "# TYPE %s histogram\n", f.name)
+			b.WriteString(histograms[f.name])
+			continue
+		}
+
+		samples := counterSamples[f.name]
+		if f.collect != nil {
+			samples = f.collect()
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			return renderLabels(samples[i].Labels) < renderLabels(samples[j].Labels)
+		})
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range samples {
+			fmt.Fprintf(&b, "%s%s %g\n", f.name, renderLabels(s.Labels), s.Value)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
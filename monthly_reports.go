@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Scheduled monthly reports. With MONTHLY_REPORT_SCHEDULE (a cron expression,
+// e.g. "0 6 1 * *", evaluated in MONTHLY_REPORT_TIMEZONE, default UTC), the
+// previous calendar month is billed for every DOMAINS_FILE domain that lists
+// recipients (domain;a@example.com,b@example.com) in every cluster, and the
+// CSV and PDF report are emailed through SMTP_*. Prices are
+// MONTHLY_REPORT_CPU_PRICE_PER_HOUR / MONTHLY_REPORT_MEMORY_PRICE_PER_GB /
+// MONTHLY_REPORT_DISK_PRICE_PER_GB_MONTH / MONTHLY_REPORT_IO_PRICE_PER_GB /
+// MONTHLY_REPORT_NETWORK_PRICE_PER_GB (defaults as in /billing/report), then,
+// as loaded at the time of the run, PRICING_TIERS_FILE unless a CPU, memory or
+// disk price is set, and the default pricing expression (PRICING_FILE or
+// PRICING_EXPR).
+//
+// A domain that fails is retried MONTHLY_REPORT_RETRIES times, waiting
+// MONTHLY_REPORT_RETRY_DELAY_SECONDS times the attempt number; the final
+// failure is published as billing.report.delivery_failed to
+// BILLING_EVENT_SINK. With Redis, the state of each domain and month
+// (monthly_report:<period>:<domain>: due, sent or failed) is shared, and one
+// replica at a time delivers under a lease (…:lease), so replicas and restarts
+// never send a report twice. The report is marked sent only after delivery: a
+// replica that dies mid-run leaves it due, and it is delivered once the lease
+// expires. A Redis error while claiming is published as
+// billing.report.delivery_failed and the claim is retried every
+// MONTHLY_REPORT_RETRY_DELAY_SECONDS (at least a minute), like a report
+// another replica holds the lease of. MONTHLY_REPORT_DRY_RUN=true generates
+// everything but sends nothing; the attachments are written to
+// MONTHLY_REPORT_DRY_RUN_DIR if set.
+
+const monthlyReportKeyPrefix = "monthly_report:"
+
+// monthlyReportClaimTTL keeps a report's state past the end of the next month's run.
+const monthlyReportClaimTTL = 40 * 24 * time.Hour
+
+// States of a domain's monthly report in Redis.
+const (
+	monthlyReportDue    = "due"
+	monthlyReportSent   = "sent"
+	monthlyReportFailed = "failed" // gave up after the retries; published, not retried
+)
+
+// Results of claimMonthlyReport.
+const (
+	monthlyReportClaimed = iota // this replica delivers
+	monthlyReportBusy           // another replica holds the lease
+	monthlyReportDone           // sent or given up before
+)
+
+// monthlyReporter runs the monthly report schedule.
+type monthlyReporter struct {
+	schedule   *cronSchedule
+	loc        *time.Location
+	dryRun     bool
+	dryRunDir  string
+	retries    int
+	retryDelay time.Duration
+	smtp       SMTPConfig
+	cpuPrice   float64
+	memPrice   float64
+	pricing    ReportPricing // disk, I/O and egress prices; tiers and expression are loaded per run
+	tiers      bool          // PRICING_TIERS_FILE applies (no CPU, memory or disk price set)
+
+	// Reports to claim again (Redis error, or another replica's lease), by
+	// monthlyReportJob.key; only used by the loop goroutine.
+	pending map[string]monthlyReportJob
+}
+
+// monthlyReportJob is the report of one domain of a cluster for the month starting at start.
+type monthlyReportJob struct {
+	cluster *Cluster
+	entry   DomainEntry
+	start   time.Time
+}
+
+func (j monthlyReportJob) period() string { return j.start.Format("2006-01") }
+
+func (j monthlyReportJob) key() string {
+	return j.cluster.Name + ":" + j.period() + ":" + j.entry.Name
+}
+
+// monthlyReports is the process-wide scheduler, nil when disabled.
+var monthlyReports *monthlyReporter
+
+// monthlyReportFailure is the payload of billing.report.delivery_failed.
+type monthlyReportFailure struct {
+	Cluster    string   `json:"cluster"`
+	Domain     string   `json:"domain"`
+	Period     string   `json:"period"` // YYYY-MM
+	Recipients []string `json:"recipients"`
+	Attempts   int      `json:"attempts"`
+	Error      string   `json:"error"`
+}
+
+// newMonthlyReporterFromEnv reads MONTHLY_REPORT_*; nil when no schedule is set.
+// An invalid configuration is fatal, like other invalid startup configuration.
+func newMonthlyReporterFromEnv() *monthlyReporter {
+	expr := getEnv("MONTHLY_REPORT_SCHEDULE", "")
+	if expr == "" {
+		return nil
+	}
+	schedule, err := parseCron(expr)
+	if err != nil {
+		fatal("MONTHLY_REPORT_SCHEDULE is invalid", "error", err)
+	}
+	loc, err := time.LoadLocation(getEnv("MONTHLY_REPORT_TIMEZONE", "UTC"))
+	if err != nil {
+		fatal("MONTHLY_REPORT_TIMEZONE is invalid", "error", err)
+	}
+	retries := 3
+	if v, err := strconv.Atoi(getEnv("MONTHLY_REPORT_RETRIES", "")); err == nil && v >= 0 {
+		retries = v
+	}
+
+	m := &monthlyReporter{
+		schedule:   schedule,
+		loc:        loc,
+		dryRun:     getEnv("MONTHLY_REPORT_DRY_RUN", "false") == "true",
+		dryRunDir:  getEnv("MONTHLY_REPORT_DRY_RUN_DIR", ""),
+		retries:    retries,
+		retryDelay: envSeconds("MONTHLY_REPORT_RETRY_DELAY_SECONDS", 5*time.Minute),
+		smtp:       smtpConfigFromEnv(),
+		cpuPrice:   parseFloat(getEnv("MONTHLY_REPORT_CPU_PRICE_PER_HOUR", ""), 0.05),
+		memPrice:   parseFloat(getEnv("MONTHLY_REPORT_MEMORY_PRICE_PER_GB", ""), 0.01),
+		pricing: ReportPricing{
+			DiskPricePerGBMonth: parseFloat(getEnv("MONTHLY_REPORT_DISK_PRICE_PER_GB_MONTH", ""), 0),
+			IOPricePerGB:        parseFloat(getEnv("MONTHLY_REPORT_IO_PRICE_PER_GB", ""), 0),
+			NetworkPricePerGB:   parseFloat(getEnv("MONTHLY_REPORT_NETWORK_PRICE_PER_GB", ""), 0),
+		},
+		tiers: getEnv("MONTHLY_REPORT_CPU_PRICE_PER_HOUR", "") == "" && getEnv("MONTHLY_REPORT_MEMORY_PRICE_PER_GB", "") == "" &&
+			getEnv("MONTHLY_REPORT_DISK_PRICE_PER_GB_MONTH", "") == "",
+		pending: make(map[string]monthlyReportJob),
+	}
+	if !m.dryRun && (m.smtp.Host == "" || m.smtp.From == "") {
+		fatal("MONTHLY_REPORT_SCHEDULE needs SMTP_HOST and SMTP_FROM (or MONTHLY_REPORT_DRY_RUN=true)")
+	}
+	return m
+}
+
+// Start runs the schedule in the background.
+func (m *monthlyReporter) Start() {
+	next := m.schedule.Next(time.Now().In(m.loc))
+	if next.IsZero() {
+		slog.Error("MONTHLY_REPORT_SCHEDULE never fires, monthly reports disabled")
+		return
+	}
+	slog.Info("Monthly reports enabled", "next_run", next.Format(time.RFC3339), "dry_run", m.dryRun)
+	m.resume(time.Now().In(m.loc))
+	go m.loop(next)
+}
+
+func (m *monthlyReporter) loop(next time.Time) {
+	for !next.IsZero() {
+		wake := next
+		if retryAt := time.Now().Add(m.pendingDelay()); len(m.pending) > 0 && retryAt.Before(next) {
+			wake = retryAt
+		}
+		time.Sleep(time.Until(wake))
+		if wake.Before(next) {
+			m.runPending()
+			continue
+		}
+		m.run(next)
+		next = m.schedule.Next(time.Now().In(m.loc))
+	}
+}
+
+// pendingDelay is the wait before pending reports are claimed again.
+func (m *monthlyReporter) pendingDelay() time.Duration {
+	if m.retryDelay < time.Minute {
+		return time.Minute
+	}
+	return m.retryDelay
+}
+
+// runPending claims the pending reports again.
+func (m *monthlyReporter) runPending() {
+	for _, job := range m.pending {
+		m.handle(job)
+	}
+}
+
+// resume picks up the previous month's reports that are still due in Redis,
+// e.g. after a restart in the middle of the run.
+func (m *monthlyReporter) resume(now time.Time) {
+	if redisClient == nil || m.dryRun {
+		return
+	}
+	start := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, cluster := range clusters {
+		_, entries, err := fileConfigs.get().domainEntries(cluster)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if len(entry.Emails) == 0 {
+				continue
+			}
+			job := monthlyReportJob{cluster: cluster, entry: entry, start: start}
+			if state, _ := redisClient.Get(ctx, monthlyReportKey(job)).Result(); state == monthlyReportDue {
+				slog.Info("Monthly report still due, resuming", "cluster", cluster.Name, "domain", entry.Name, "period", job.period())
+				m.pending[job.key()] = job
+			}
+		}
+	}
+}
+
+// run reports the calendar month before firedAt for every cluster.
+func (m *monthlyReporter) run(firedAt time.Time) {
+	start := time.Date(firedAt.Year(), firedAt.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	period := start.Format("2006-01")
+	slog.Info("Monthly report run started", "period", period, "dry_run", m.dryRun)
+	for _, cluster := range clusters {
+		m.runCluster(cluster, start)
+	}
+	slog.Info("Monthly report run finished", "period", period)
+}
+
+// runCluster delivers the reports of one cluster's domains, one domain at a time.
+func (m *monthlyReporter) runCluster(cluster *Cluster, start time.Time) {
+	domainFile, entries, err := fileConfigs.get().domainEntries(cluster)
+	if domainFile == "" {
+		return
+	}
+	if err != nil {
+		slog.Error("Monthly reports: failed to load domain list", "cluster", cluster.Name, "file", domainFile, "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if len(entry.Emails) == 0 {
+			continue
+		}
+		m.handle(monthlyReportJob{cluster: cluster, entry: entry, start: start})
+	}
+}
+
+// handle claims and delivers one report. A report that can't be claimed now
+// (Redis error, another replica's lease) stays pending for the next try.
+func (m *monthlyReporter) handle(job monthlyReportJob) {
+	cluster, entry, period := job.cluster, job.entry, job.period()
+	if !m.dryRun {
+		claim, err := claimMonthlyReport(job, m.leaseTTL())
+		if err != nil {
+			slog.Error("Monthly report claim failed, retrying later", "service", "redis", "cluster", cluster.Name,
+				"domain", entry.Name, "period", period, "error", err)
+			if _, retried := m.pending[job.key()]; !retried {
+				m.publishFailure(job, 0, fmt.Errorf("claim failed: %w", err))
+			}
+			m.pending[job.key()] = job
+			return
+		}
+		switch claim {
+		case monthlyReportDone:
+			slog.Info("Monthly report already handled, skipping", "cluster", cluster.Name, "domain", entry.Name, "period", period)
+			countMonthlyReport("skipped")
+			delete(m.pending, job.key())
+			return
+		case monthlyReportBusy:
+			// Checked again until sent, in case the other replica dies
+			m.pending[job.key()] = job
+			return
+		}
+	}
+	delete(m.pending, job.key())
+
+	var err error
+	attempts := 0
+	for attempts <= m.retries {
+		if attempts > 0 {
+			time.Sleep(time.Duration(attempts) * m.retryDelay)
+		}
+		attempts++
+		if err = m.deliver(cluster, entry, job.start); err == nil {
+			break
+		}
+		slog.Warn("Monthly report failed", "cluster", cluster.Name, "domain", entry.Name, "period", period,
+			"attempt", attempts, "error", err)
+	}
+	if !m.dryRun {
+		finishMonthlyReport(job, err == nil)
+	}
+	if err != nil {
+		slog.Error("Monthly report gave up", "cluster", cluster.Name, "domain", entry.Name, "period", period,
+			"attempts", attempts, "error", err)
+		countMonthlyReport("failed")
+		m.publishFailure(job, attempts, err)
+		return
+	}
+	if m.dryRun {
+		countMonthlyReport("dry_run")
+	} else {
+		countMonthlyReport("sent")
+	}
+}
+
+// leaseTTL covers a delivery with every retry: 30 minutes per attempt plus the waits.
+func (m *monthlyReporter) leaseTTL() time.Duration {
+	waits := time.Duration(m.retries*(m.retries+1)/2) * m.retryDelay
+	return time.Duration(m.retries+1)*30*time.Minute + waits + 10*time.Minute
+}
+
+func (m *monthlyReporter) publishFailure(job monthlyReportJob, attempts int, err error) {
+	billingEvents.publish(billingEventReportDeliveryFailed, monthlyReportFailure{
+		Cluster:    job.cluster.Name,
+		Domain:     job.entry.Name,
+		Period:     job.period(),
+		Recipients: job.entry.Emails,
+		Attempts:   attempts,
+		Error:      err.Error(),
+	})
+}
+
+// deliver bills the domain for the month starting at start and emails (or,
+// in dry-run mode, only renders) the CSV and PDF report.
+func (m *monthlyReporter) deliver(cluster *Cluster, entry DomainEntry, start time.Time) error {
+	startDate := start.Format("2006-01-02T15:04:05")
+	endDate := start.AddDate(0, 1, 0).Add(-time.Second).Format("2006-01-02T15:04:05")
+	period := start.Format("2006-01")
+
+	ctx, cancel := context.WithTimeout(withCluster(context.Background(), cluster), 30*time.Minute)
+	defer cancel()
+	cfg := fileConfigs.get()
+	pricing := m.pricing
+	if m.tiers {
+		pricing.Tiers = cfg.tiers
+	}
+	var err error
+	if pricing.Expr, err = cfg.pricingExpr(); err != nil {
+		return fmt.Errorf("invalid default pricing expression: %w", err)
+	}
+	reports, projectOf, err := billDomain(ctx, entry.Name, startDate, endDate, m.cpuPrice, m.memPrice, pricing)
+	if err != nil {
+		return err
+	}
+
+	csvData, err := renderReportCSV(entry.Name, reports, projectOf)
+	if err != nil {
+		return fmt.Errorf("render CSV: %w", err)
+	}
+	pdfData := renderReportPDF(entry.Name, period, reports)
+
+	total, currency := 0.0, "USD"
+	for _, r := range reports {
+		total += r.TotalCost
+		currency = r.Currency
+	}
+	base := "usage-" + safeFileName(entry.Name) + "-" + period
+	if len(clusters) > 1 {
+		base = "usage-" + cluster.Name + "-" + safeFileName(entry.Name) + "-" + period
+	}
+
+	if m.dryRun {
+		slog.Info("Monthly report generated (dry run, not sent)", "cluster", cluster.Name, "domain", entry.Name,
+			"period", period, "instances", len(reports), "total_cost", total, "currency", currency,
+			"recipients", strings.Join(entry.Emails, ","), "csv_bytes", len(csvData), "pdf_bytes", len(pdfData))
+		if m.dryRunDir != "" {
+			if err := os.WriteFile(filepath.Join(m.dryRunDir, base+".csv"), csvData, 0o644); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(m.dryRunDir, base+".pdf"), pdfData, 0o644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	subject := fmt.Sprintf("Usage report %s: %s", period, entry.Name)
+	body := fmt.Sprintf("Usage report for domain %s, %s.\n\nInstances: %d\nTotal: %.2f %s\n\nThe per-instance details are attached as CSV and PDF.\n",
+		entry.Name, start.Format("January 2006"), len(reports), total, currency)
+	err = sendMail(m.smtp, entry.Emails, subject, body, []mailAttachment{
+		{Filename: base + ".csv", ContentType: "text/csv", Data: csvData},
+		{Filename: base + ".pdf", ContentType: "application/pdf", Data: pdfData},
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Monthly report sent", "cluster", cluster.Name, "domain", entry.Name, "period", period,
+		"instances", len(reports), "recipients", len(entry.Emails))
+	return nil
+}
+
+// billDomain bills every instance of the domain's projects that existed during
+// the period; projectOf maps the billed instance IDs to their project.
+func billDomain(ctx context.Context, domainName, startDate, endDate string,
+	cpuPricePerHour, memoryPricePerGB float64, pricing ReportPricing) ([]BillingReport, map[string]string, error) {
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to authenticate admin: %w", err)
+	}
+	projects, err := resolveDomainProjects(ctx, adminToken, domainName, policyDefault)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list projects for domain: %w", err)
+	}
+	inDomain := make(map[string]bool, len(projects))
+	for _, p := range projects {
+		inDomain[p.ID] = true
+	}
+
+	client := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(ctx, "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
+		Context:  ctx, // the report's 30 minutes
+	})
+	all, err := client.GetAllInstances()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Gnocchi instances failed: %w", err)
+	}
+	var instances []GnocchiInstance
+	projectOf := make(map[string]string)
+	for _, inst := range instancesActiveSince(all, startDate) {
+		if inDomain[inst.ProjectID] {
+			instances = append(instances, inst)
+			projectOf[inst.ID] = inst.ProjectID
+		}
+	}
+
+	reports, err := billInstances(client, instances, startDate, endDate, cpuPricePerHour, memoryPricePerGB, pricing, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reports, projectOf, nil
+}
+
+// monthlyReportKey is the Redis key of the job's state; its lease is the key plus ":lease".
+func monthlyReportKey(job monthlyReportJob) string {
+	return redisKey(job.cluster.key(monthlyReportKeyPrefix + job.period() + ":" + job.entry.Name))
+}
+
+// claimMonthlyReport marks the report due and takes its lease for lease
+// (monthlyReportClaimed), unless it was handled before or another replica
+// holds the lease. Without Redis every run delivers. An error means nothing
+// is known: the caller must neither send nor give up.
+func claimMonthlyReport(job monthlyReportJob, lease time.Duration) (int, error) {
+	if redisClient == nil {
+		return monthlyReportClaimed, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	key := monthlyReportKey(job)
+	done := func() (bool, error) {
+		state, err := redisClient.Get(ctx, key).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return false, err
+		}
+		return state == monthlyReportSent || state == monthlyReportFailed, nil
+	}
+
+	if handled, err := done(); err != nil || handled {
+		return monthlyReportDone, err
+	}
+	// Due before the lease is taken, so a restart finds it (resume)
+	if err := redisClient.SetNX(ctx, key, monthlyReportDue, monthlyReportClaimTTL).Err(); err != nil {
+		return 0, err
+	}
+	locked, err := redisClient.SetNX(ctx, key+":lease", time.Now().UTC().Format(time.RFC3339), lease).Result()
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		return monthlyReportBusy, nil
+	}
+	// The previous holder may have finished between the check and the lease
+	if handled, err := done(); err != nil || handled {
+		redisClient.Del(ctx, key+":lease")
+		return monthlyReportDone, err
+	}
+	return monthlyReportClaimed, nil
+}
+
+// finishMonthlyReport records the report as sent (or given up) and releases
+// its lease. If that fails the report stays due and is sent again once the
+// lease expires.
+func finishMonthlyReport(job monthlyReportJob, sent bool) {
+	if redisClient == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state := monthlyReportFailed
+	if sent {
+		state = monthlyReportSent
+	}
+	key := monthlyReportKey(job)
+	if err := redisClient.Set(ctx, key, state, monthlyReportClaimTTL).Err(); err != nil {
+		slog.Error("Monthly report state update failed", "service", "redis", "cluster", job.cluster.Name,
+			"domain", job.entry.Name, "period", job.period(), "state", state, "error", err)
+		return
+	}
+	redisClient.Del(ctx, key+":lease")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// safeFileName makes a domain name usable in an attachment file name.
+func safeFileName(s string) string {
+	return strings.Trim(unsafeFileChars.ReplaceAllString(s, "_"), "_")
+}
+
+func countMonthlyReport(result string) {
+	metrics.IncCounter("vhi_monthly_reports_total",
+		"Monthly domain reports by result (sent, dry_run, failed, skipped).",
+		map[string]string{"result": result})
+}
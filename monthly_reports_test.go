@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestRenderReportCSVBlocksFormulas(t *testing.T) {
+	reports := []BillingReport{{InstanceID: "inst-1", InstanceName: "=HYPERLINK(\"http://evil\")", FlavorName: "@SUM(A1)"}}
+	data, err := renderReportCSV("+acme", reports, map[string]string{"inst-1": "-proj"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := records[1]
+	if row[0] != "'+acme" || row[1] != "'-proj" || row[3] != `'=HYPERLINK("http://evil")` || row[4] != "'@SUM(A1)" {
+		t.Errorf("text cells not prefixed: %v", row[:5])
+	}
+}
+
+func newTestMonthlyReportJob() monthlyReportJob {
+	return monthlyReportJob{
+		cluster: defaultCluster(),
+		entry:   DomainEntry{Name: "acme", Emails: []string{"billing@acme.example"}},
+		start:   time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestMonthlyReportClaim(t *testing.T) {
+	mr := useMiniredis(t)
+	job := newTestMonthlyReportJob()
+
+	if claim, err := claimMonthlyReport(job, time.Hour); err != nil || claim != monthlyReportClaimed {
+		t.Fatalf("first claim = %v, %v", claim, err)
+	}
+	if claim, _ := claimMonthlyReport(job, time.Hour); claim != monthlyReportBusy {
+		t.Errorf("claim of another replica = %v, want busy", claim)
+	}
+
+	// The holder died mid-run: the report is still due and claimed again once the lease ends
+	if state, _ := mr.Get(monthlyReportKey(job)); state != monthlyReportDue {
+		t.Errorf("state during delivery = %q, want due", state)
+	}
+	mr.FastForward(time.Hour)
+	if claim, _ := claimMonthlyReport(job, time.Hour); claim != monthlyReportClaimed {
+		t.Errorf("claim after the lease expired = %v, want claimed", claim)
+	}
+
+	finishMonthlyReport(job, true)
+	if claim, _ := claimMonthlyReport(job, time.Hour); claim != monthlyReportDone {
+		t.Errorf("claim after delivery = %v, want done", claim)
+	}
+	if mr.Exists(monthlyReportKey(job) + ":lease") {
+		t.Error("lease kept after delivery")
+	}
+}
+
+func TestMonthlyReportClaimRedisError(t *testing.T) {
+	mr := useMiniredis(t)
+	prev := billingEvents
+	billingEvents = &eventBus{publisher: &recordingPublisher{}, queue: make(chan BillingEvent, 8)}
+	t.Cleanup(func() { billingEvents = prev })
+	m := &monthlyReporter{pending: make(map[string]monthlyReportJob)}
+	job := newTestMonthlyReportJob()
+
+	// Redis is down: nothing is sent or given up, the failure is published once
+	mr.Close()
+	m.handle(job)
+	m.runPending()
+	if _, pending := m.pending[job.key()]; !pending {
+		t.Fatal("report not kept for the next try")
+	}
+	if n := len(billingEvents.queue); n != 1 {
+		t.Fatalf("%d events, want one delivery_failed", n)
+	}
+	if event := <-billingEvents.queue; event.Type != billingEventReportDeliveryFailed {
+		t.Errorf("event type = %s", event.Type)
+	}
+}
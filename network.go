@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default cluster network queries (node_exporter). Override with NETWORK_RX_QUERY /
+// NETWORK_TX_QUERY, e.g. to use SDN exporter metrics instead.
+const (
+	defaultNetworkRxQuery = `sum(rate(node_network_receive_bytes_total{device!~"lo|veth.*|tap.*|docker.*|br.*"}[5m]))`
+	defaultNetworkTxQuery = `sum(rate(node_network_transmit_bytes_total{device!~"lo|veth.*|tap.*|docker.*|br.*"}[5m]))`
+)
+
+// errNetworkMetricsUnavailable means the queries ran but returned no series
+// (the exporters are not deployed).
+var errNetworkMetricsUnavailable = errors.New("network metrics unavailable")
+
+// NetworkUsage is the response of GET /api/v1/usage/network.
+type NetworkUsage struct {
+	Timestamp     string          `json:"timestamp"`
+	Available     bool            `json:"available"`
+	Reason        string          `json:"reason,omitempty"`
+	RxBytesPerSec float64         `json:"rx_bytes_per_sec"`
+	TxBytesPerSec float64         `json:"tx_bytes_per_sec"`
+	RxMbitPerSec  float64         `json:"rx_mbit_per_sec"`
+	TxMbitPerSec  float64         `json:"tx_mbit_per_sec"`
+	History       *NetworkHistory `json:"history,omitempty"`
+	HistoryError  string          `json:"history_error,omitempty"`
+}
+
+// NetworkHistory holds rate series from a Prometheus range query.
+type NetworkHistory struct {
+	Start       string        `json:"start"`
+	End         string        `json:"end"`
+	StepSeconds int           `json:"step_seconds"`
+	Rx          []SeriesPoint `json:"rx_bytes_per_sec"`
+	Tx          []SeriesPoint `json:"tx_bytes_per_sec"`
+}
+
+// SeriesPoint is one point of a time series.
+type SeriesPoint struct {
+	Timestamp string  `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+func networkQueries() (rx, tx string) {
+	return getEnv("NETWORK_RX_QUERY", defaultNetworkRxQuery), getEnv("NETWORK_TX_QUERY", defaultNetworkTxQuery)
+}
+
+// getNetworkRates runs the rx/tx queries. Empty results yield errNetworkMetricsUnavailable.
+func getNetworkRates(c PanelAPI) (rx, tx float64, err error) {
+	fetch, err := c.prometheusFetcher()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rxQuery, txQuery := networkQueries()
+	values := make([]float64, 2)
+	for i, q := range []string{rxQuery, txQuery} {
+		body, err := fetch(q)
+		if err != nil {
+			return 0, 0, err
+		}
+		samples, err := parsePromVector(body, q)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(samples) == 0 {
+			return 0, 0, fmt.Errorf("%w: no series for %q", errNetworkMetricsUnavailable, q)
+		}
+		for _, s := range samples {
+			values[i] += s.Value
+		}
+	}
+	return values[0], values[1], nil
+}
+
+// parsePromMatrix parses a /api/v1/query_range response, merging all series per
+// timestamp with combine (sumValues for rates, maxValues for latencies).
+func parsePromMatrix(body []byte, promql string, combine func(a, b float64) float64) ([]SeriesPoint, error) {
+	var result struct {
+		Status string `json:"status"`
+		Data   struct {
+			Result []struct {
+				Values [][2]json.RawMessage `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("prometheus decode failed: %w (body: %.200s)", err, string(body))
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("prometheus returned status %q for %q", result.Status, promql)
+	}
+
+	sums := make(map[int64]float64)
+	var order []int64
+	for _, series := range result.Data.Result {
+		for _, v := range series.Values {
+			var ts float64
+			var valStr string
+			if json.Unmarshal(v[0], &ts) != nil || json.Unmarshal(v[1], &valStr) != nil {
+				continue
+			}
+			val, err := strconv.ParseFloat(valStr, 64)
+			if err != nil {
+				continue
+			}
+			key := int64(ts)
+			if prev, seen := sums[key]; seen {
+				sums[key] = combine(prev, val)
+			} else {
+				order = append(order, key)
+				sums[key] = val
+			}
+		}
+	}
+
+	points := make([]SeriesPoint, 0, len(order))
+	for _, key := range order {
+		points = append(points, SeriesPoint{
+			Timestamp: time.Unix(key, 0).UTC().Format(time.RFC3339),
+			Value:     sums[key],
+		})
+	}
+	return points, nil
+}
+
+func sumValues(a, b float64) float64 { return a + b }
+
+func maxValues(a, b float64) float64 { return math.Max(a, b) }
+
+// getNetworkHistory runs the rx/tx queries as range queries.
+func getNetworkHistory(c PanelAPI, window, step time.Duration) (*NetworkHistory, error) {
+	fetch, err := c.prometheusAPIFetcher()
+	if err != nil {
+		return nil, err
+	}
+
+	end := time.Now()
+	start := end.Add(-window)
+	history := &NetworkHistory{
+		Start:       start.UTC().Format(time.RFC3339),
+		End:         end.UTC().Format(time.RFC3339),
+		StepSeconds: int(step.Seconds()),
+		Rx:          []SeriesPoint{},
+		Tx:          []SeriesPoint{},
+	}
+
+	rxQuery, txQuery := networkQueries()
+	for _, q := range []struct {
+		promql string
+		dest   *[]SeriesPoint
+	}{{rxQuery, &history.Rx}, {txQuery, &history.Tx}} {
+		body, err := fetch(promRangePath(q.promql, start, end, step))
+		if err != nil {
+			return nil, err
+		}
+		points, err := parsePromMatrix(body, q.promql, sumValues)
+		if err != nil {
+			return nil, err
+		}
+		*q.dest = points
+	}
+	return history, nil
+}
+
+// parseHistoryParams reads ?history=<duration>&step=<duration> for range queries.
+// A zero window means no history was requested.
+func parseHistoryParams(r *http.Request) (window, step time.Duration, err error) {
+	h := r.URL.Query().Get("history")
+	if h == "" {
+		return 0, 0, nil
+	}
+	window, err = time.ParseDuration(h)
+	if err != nil || window <= 0 || window > 7*24*time.Hour {
+		return 0, 0, errors.New("history must be a duration up to 168h, e.g. 1h")
+	}
+	step = minGranularity()
+	if s := r.URL.Query().Get("step"); s != "" {
+		step, err = time.ParseDuration(s)
+		if err != nil || step <= 0 {
+			return 0, 0, errors.New("step must be a duration, e.g. 60s")
+		}
+		if step, err = checkGranularity("step", step); err != nil {
+			return 0, 0, err
+		}
+	}
+	// Prometheus rejects more than 11000 points per series
+	if window/step > 11000 {
+		return 0, 0, errors.New("history/step yields too many points (max 11000)")
+	}
+	return window, step, nil
+}
+
+// GET /api/v1/usage/network?history=1h&step=60s
+func getNetworkUsage(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	window, step, err := parseHistoryParams(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	panel := panelFor(r.Context())
+	if panel == nil {
+		http.Error(w, `{"error":"VHI Panel client not initialized"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	response := NetworkUsage{Timestamp: time.Now().Format(time.RFC3339)}
+
+	rx, tx, err := getNetworkRates(panel)
+	if err != nil {
+		if !errors.Is(err, errNetworkMetricsUnavailable) {
+			slog.ErrorContext(r.Context(), "Network usage failed", "service", "prometheus", "error", err)
+			http.Error(w, fmt.Sprintf(`{"error":"network usage failed: %v"}`, err), http.StatusBadGateway)
+			return
+		}
+		// Exporters not deployed — a clean answer, not an error
+		response.Reason = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, response)
+		return
+	}
+
+	response.Available = true
+	response.RxBytesPerSec = rx
+	response.TxBytesPerSec = tx
+	response.RxMbitPerSec = rx * 8 / 1e6
+	response.TxMbitPerSec = tx * 8 / 1e6
+
+	if window > 0 {
+		history, err := getNetworkHistory(panel, window, step)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Network history failed", "service", "prometheus", "error", err)
+			response.HistoryError = err.Error()
+		} else {
+			response.History = history
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
+
+// registerNetworkMetrics exports the current cluster rates at /metrics.
+// Nothing is emitted when the exporters are missing or Prometheus is unreachable.
+func registerNetworkMetrics(c PanelAPI) {
+	metrics.RegisterGauge("vhi_cluster_network_bytes_per_second",
+		"Cluster-wide network throughput in bytes per second, by direction.",
+		func() []metricSample {
+			rx, tx, err := getNetworkRates(c)
+			if err != nil {
+				return nil
+			}
+			return []metricSample{
+				{Labels: map[string]string{"direction": "rx"}, Value: rx},
+				{Labels: map[string]string{"direction": "tx"}, Value: tx},
+			}
+		})
+}
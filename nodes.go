@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeUsage is the response of GET /api/v1/usage/nodes.
+// Each node merges whatever Nova, Prometheus and the VHI panel know about it.
+type NodeUsage struct {
+	Timestamp string            `json:"timestamp"`
+	Nodes     []NodeStat        `json:"nodes"`
+	Errors    map[string]string `json:"errors,omitempty"` // source -> error
+}
+
+// NodeStat holds per-node data, one optional section per source.
+type NodeStat struct {
+	Hostname   string         `json:"hostname"`
+	Nova       *NodeNovaStat  `json:"nova,omitempty"`
+	Prometheus *NodePromStat  `json:"prometheus,omitempty"`
+	Panel      *NodePanelStat `json:"panel,omitempty"`
+	Sources    []string       `json:"sources"`
+}
+
+// NodeNovaStat is the hypervisor view from Nova /os-hypervisors/detail.
+type NodeNovaStat struct {
+	Status       string `json:"status"`
+	State        string `json:"state"`
+	VCPUs        int    `json:"vcpus"`
+	VCPUsUsed    int    `json:"vcpus_used"`
+	MemoryMB     int    `json:"memory_mb"`
+	MemoryMBUsed int    `json:"memory_mb_used"`
+}
+
+// NodePromStat is the node_exporter view from Prometheus.
+type NodePromStat struct {
+	CPUUsagePercent float64 `json:"cpu_usage_percent"`
+	MemTotalBytes   float64 `json:"mem_total_bytes"`
+	MemUsedBytes    float64 `json:"mem_used_bytes"`
+}
+
+// NodePanelStat is the VHI panel view, including vstorage roles Nova doesn't know about.
+type NodePanelStat struct {
+	State           string   `json:"state"`
+	Roles           []string `json:"roles"`
+	CPUCores        int      `json:"cpu_cores"`
+	CPUUsagePercent float64  `json:"cpu_usage_percent"`
+	MemTotalBytes   int64    `json:"mem_total_bytes"`
+	MemUsedBytes    int64    `json:"mem_used_bytes"`
+}
+
+// Default node_exporter queries; override with NODE_CPU_QUERY / NODE_MEM_TOTAL_QUERY / NODE_MEM_USED_QUERY.
+const (
+	defaultNodeCPUQuery      = `100 - (avg by (instance) (rate(node_cpu_seconds_total{mode="idle"}[5m])) * 100)`
+	defaultNodeMemTotalQuery = `node_memory_MemTotal_bytes`
+	defaultNodeMemUsedQuery  = `node_memory_MemTotal_bytes - node_memory_MemAvailable_bytes`
+)
+
+// nodeKey normalizes a hostname so the three sources can be joined:
+// lowercase, no port, short name only (Nova usually reports the FQDN).
+func nodeKey(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	if i := strings.Index(host, "."); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// GET /api/v1/usage/nodes
+func getNodeUsage(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+
+	var (
+		hypervisors []Hypervisor
+		novaErr     error
+		promStats   map[string]*NodePromStat
+		promErr     error
+		panelNodes  []PanelNode
+		panelErr    error
+		wg          sync.WaitGroup
+	)
+
+	panel := panelFor(r.Context())
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		novaURL := clusterEnv(r.Context(), "NOVA_URL", "")
+		if novaURL == "" {
+			novaErr = fmt.Errorf("NOVA_URL is not set")
+			return
+		}
+		adminToken, err := GetAdminToken(r.Context())
+		if err != nil {
+			novaErr = fmt.Errorf("failed to get admin token: %w", err)
+			return
+		}
+		novaClient := NewNovaClient(NovaConfig{
+			BaseURL:  novaURL,
+			Token:    adminToken,
+			Reauth:   adminReauth(r.Context()),
+			Insecure: true,
+			Calls:    upstreamCallsOf(r.Context()),
+		})
+		hypervisors, novaErr = novaClient.GetHypervisors()
+	}()
+
+	go func() {
+		defer wg.Done()
+		if panel == nil {
+			promErr = fmt.Errorf("VHI Panel client not initialized")
+			return
+		}
+		promStats, promErr = getNodePromStats(panel)
+	}()
+
+	go func() {
+		defer wg.Done()
+		if panel == nil {
+			panelErr = fmt.Errorf("VHI Panel client not initialized")
+			return
+		}
+		panelNodes, panelErr = panel.GetNodes()
+	}()
+
+	wg.Wait()
+
+	nodes := make(map[string]*NodeStat)
+	node := func(host string) *NodeStat {
+		key := nodeKey(host)
+		if n, ok := nodes[key]; ok {
+			return n
+		}
+		n := &NodeStat{Hostname: key}
+		nodes[key] = n
+		return n
+	}
+
+	for _, h := range hypervisors {
+		n := node(h.HypervisorHostname)
+		n.Nova = &NodeNovaStat{
+			Status:       h.Status,
+			State:        h.State,
+			VCPUs:        h.VCPUs,
+			VCPUsUsed:    h.VCPUsUsed,
+			MemoryMB:     h.MemoryMB,
+			MemoryMBUsed: h.MemoryMBUsed,
+		}
+		n.Sources = append(n.Sources, "nova")
+	}
+
+	for host, stat := range promStats {
+		n := node(host)
+		n.Prometheus = stat
+		n.Sources = append(n.Sources, "prometheus")
+	}
+
+	for _, pn := range panelNodes {
+		if pn.Name() == "" {
+			continue
+		}
+		state := pn.State
+		if state == "" {
+			state = pn.Status
+		}
+		n := node(pn.Name())
+		n.Panel = &NodePanelStat{
+			State:           state,
+			Roles:           pn.Roles,
+			CPUCores:        pn.CPUCores,
+			CPUUsagePercent: pn.CPUUsage,
+			MemTotalBytes:   pn.MemTotal,
+			MemUsedBytes:    pn.MemUsage,
+		}
+		if n.Panel.Roles == nil {
+			n.Panel.Roles = []string{}
+		}
+		n.Sources = append(n.Sources, "panel")
+	}
+
+	response := NodeUsage{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Nodes:     make([]NodeStat, 0, len(nodes)),
+	}
+	for _, n := range nodes {
+		response.Nodes = append(response.Nodes, *n)
+	}
+	sort.Slice(response.Nodes, func(i, j int) bool {
+		return response.Nodes[i].Hostname < response.Nodes[j].Hostname
+	})
+
+	for source, err := range map[string]error{"nova": novaErr, "prometheus": promErr, "panel": panelErr} {
+		if err == nil {
+			continue
+		}
+		slog.WarnContext(r.Context(), "Node usage source failed", "service", source, "error", err)
+		if response.Errors == nil {
+			response.Errors = make(map[string]string)
+		}
+		response.Errors[source] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(response.Errors) == 3 {
+		w.WriteHeader(http.StatusBadGateway)
+	} else if len(response.Errors) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	writeJSON(w, response)
+}
+
+// getNodePromStats runs the per-node node_exporter queries through the same
+// Prometheus access path as GetStorageStat and groups the results by host.
+func getNodePromStats(c PanelAPI) (map[string]*NodePromStat, error) {
+	fetch, err := c.prometheusFetcher()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*NodePromStat)
+	queries := []struct {
+		promql string
+		set    func(*NodePromStat, float64)
+	}{
+		{getEnv("NODE_CPU_QUERY", defaultNodeCPUQuery), func(s *NodePromStat, v float64) { s.CPUUsagePercent = v }},
+		{getEnv("NODE_MEM_TOTAL_QUERY", defaultNodeMemTotalQuery), func(s *NodePromStat, v float64) { s.MemTotalBytes = v }},
+		{getEnv("NODE_MEM_USED_QUERY", defaultNodeMemUsedQuery), func(s *NodePromStat, v float64) { s.MemUsedBytes = v }},
+	}
+	label := getEnv("NODE_HOST_LABEL", "instance")
+
+	for _, q := range queries {
+		body, err := fetch(q.promql)
+		if err != nil {
+			return nil, err
+		}
+		samples, err := parsePromVector(body, q.promql)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples {
+			host := nodeKey(s.Labels[label])
+			if host == "" {
+				continue
+			}
+			if _, ok := stats[host]; !ok {
+				stats[host] = &NodePromStat{}
+			}
+			q.set(stats[host], s.Value)
+		}
+	}
+
+	return stats, nil
+}
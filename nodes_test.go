@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getNodeUsageForTest(t *testing.T) (int, NodeUsage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	getNodeUsage(rec, httptest.NewRequest("GET", "/api/v1/usage/nodes", nil))
+	var usage NodeUsage
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+	return rec.Code, usage
+}
+
+func TestGetNodeUsageFromPanel(t *testing.T) {
+	t.Setenv("NOVA_URL", "") // Nova fails, so the response is partial
+	panel := newFakePanel(t)
+	usePanel(t, newFakePanelClient(t, panel))
+
+	code, usage := getNodeUsageForTest(t)
+	if code != http.StatusPartialContent {
+		t.Errorf("status %d, want 206", code)
+	}
+	if len(usage.Nodes) != 1 || usage.Nodes[0].Hostname != "node1" {
+		t.Fatalf("nodes = %+v, want node1 only", usage.Nodes)
+	}
+	node := usage.Nodes[0]
+	if node.Panel == nil || node.Panel.CPUCores != 16 || strings.Join(node.Panel.Roles, ",") != "compute,storage" {
+		t.Errorf("panel = %+v", node.Panel)
+	}
+	if node.Prometheus == nil || node.Prometheus.CPUUsagePercent != 25 {
+		t.Errorf("prometheus = %+v", node.Prometheus)
+	}
+	if _, ok := usage.Errors["nova"]; !ok || len(usage.Errors) != 1 {
+		t.Errorf("errors = %v, want nova only", usage.Errors)
+	}
+}
+
+func TestGetNodeUsagePanelErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"non-200", http.StatusServiceUnavailable, `{"error":"down"}`, "status 503"},
+		{"malformed JSON", 0, `{"data": [{"hostname": `, "failed to decode nodes response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NOVA_URL", "")
+			panel := newFakePanel(t)
+			panel.nodesStatus, panel.nodesBody = tt.status, tt.body
+			usePanel(t, newFakePanelClient(t, panel))
+
+			code, usage := getNodeUsageForTest(t)
+			if code != http.StatusPartialContent {
+				t.Errorf("status %d, want 206 (Prometheus still answers)", code)
+			}
+			if !strings.Contains(usage.Errors["panel"], tt.want) {
+				t.Errorf("panel error %q, want it to mention %q", usage.Errors["panel"], tt.want)
+			}
+			if len(usage.Nodes) != 1 || usage.Nodes[0].Panel != nil {
+				t.Errorf("nodes = %+v, want node1 without panel data", usage.Nodes)
+			}
+		})
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -14,6 +17,10 @@ type NovaConfig struct {
 	BaseURL  string // e.g. https://10.21.0.240:8774
 	Token    string
 	Insecure bool
+	Calls    *upstreamCalls // request counter (upstreamCallsOf); nil counts nothing
+
+	// Reauth returns a new token when Nova rejects Token with 401 (see GnocchiConfig.Reauth).
+	Reauth func(stale string) (string, error)
 }
 
 // NovaClient adalah HTTP client untuk Nova Compute API.
@@ -24,10 +31,14 @@ type NovaClient struct {
 
 // NovaFlavor merepresentasikan flavor dari sebuah server.
 type NovaFlavor struct {
-	ID    string `json:"id"`
-	VCPUs int    `json:"vcpus"`
-	RAM   int    `json:"ram"`  // in MB
-	Disk  int    `json:"disk"` // in GB
+	ID           string            `json:"id"`
+	OriginalName string            `json:"original_name"` // microversion 2.47+
+	VCPUs        int               `json:"vcpus"`
+	RAM          int               `json:"ram"`  // in MB
+	Disk         int               `json:"disk"` // in GB
+	Ephemeral    int               `json:"ephemeral"`
+	Swap         int               `json:"swap"` // in MB
+	ExtraSpecs   map[string]string `json:"extra_specs,omitempty"`
 }
 
 // NovaServer merepresentasikan satu server/VM dari Nova API.
@@ -37,6 +48,16 @@ type NovaServer struct {
 	Status   string     `json:"status"` // ACTIVE, SHUTOFF, SHELVED_OFFLOADED, etc.
 	TenantID string     `json:"tenant_id"`
 	Flavor   NovaFlavor `json:"flavor"`
+	Created  string     `json:"created"`
+	Host     string     `json:"OS-EXT-SRV-ATTR:host"` // admin only
+
+	HypervisorHostname string `json:"OS-EXT-SRV-ATTR:hypervisor_hostname"` // admin only
+
+	AvailabilityZone string            `json:"OS-EXT-AZ:availability_zone"`
+	Metadata         map[string]string `json:"metadata,omitempty"` // user key/value tags
+	VolumesAttached  []struct {
+		ID string `json:"id"`
+	} `json:"os-extended-volumes:volumes_attached"`
 }
 
 // novaServersResponse adalah response wrapper dari Nova list servers.
@@ -71,6 +92,9 @@ type Hypervisor struct {
 	FreeRAMMB          int    `json:"free_ram_mb"`
 	FreeDiskGB         int    `json:"free_disk_gb"`
 	HypervisorHostname string `json:"hypervisor_hostname"`
+	Service            struct {
+		Host string `json:"host"` // compute service host, as in a server's OS-EXT-SRV-ATTR:host
+	} `json:"service"`
 }
 
 // hypervisorsResponse adalah response dari GET /os-hypervisors/detail
@@ -90,8 +114,12 @@ func NewNovaClient(config NovaConfig) *NovaClient {
 		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	var transport http.RoundTripper = &countingTransport{base: tr, service: "nova", calls: config.Calls}
+	if config.Reauth != nil {
+		transport = &reauthTransport{base: transport, reauth: config.Reauth}
+	}
 	httpClient := &http.Client{
-		Transport: tr,
+		Transport: transport,
 		Timeout:   60 * time.Second,
 	}
 
@@ -165,16 +193,37 @@ func (c *NovaClient) GetHypervisors() ([]Hypervisor, error) {
 	return result.Hypervisors, nil
 }
 
+// maxListPages caps marker pagination (Nova servers, Cinder volumes) in case
+// the backend keeps returning full pages.
+const maxListPages = 1000
+
 // ListAllServers mengambil semua servers di cluster menggunakan
 // GET /v2.1/servers/detail?all_tenants=true
 // dengan pagination otomatis menggunakan marker.
+// Server yang muncul lagi di batas halaman (marker overlap) hanya dihitung sekali.
 func (c *NovaClient) ListAllServers() ([]NovaServer, error) {
+	return c.listServers("")
+}
+
+// ListServersOnHost lists the servers of all projects on one compute host
+// (the admin-only host filter, matching OS-EXT-SRV-ATTR:host).
+func (c *NovaClient) ListServersOnHost(host string) ([]NovaServer, error) {
+	return c.listServers("&host=" + url.QueryEscape(host))
+}
+
+// listServers pages through /servers/detail?all_tenants=true plus filter.
+func (c *NovaClient) listServers(filter string) ([]NovaServer, error) {
 	var allServers []NovaServer
+	seen := make(map[string]bool)
 
-	baseURL := fmt.Sprintf("%s/v2.1/servers/detail?all_tenants=true&limit=200", c.config.BaseURL)
+	baseURL := fmt.Sprintf("%s/v2.1/servers/detail?all_tenants=true&limit=200%s", c.config.BaseURL, filter)
 	nextURL := baseURL
 
-	for nextURL != "" {
+	for page := 0; nextURL != ""; page++ {
+		if page >= maxListPages {
+			return nil, fmt.Errorf("Nova servers pagination exceeded %d pages", maxListPages)
+		}
+
 		req, err := http.NewRequest("GET", nextURL, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create Nova request: %w", err)
@@ -205,9 +254,22 @@ func (c *NovaClient) ListAllServers() ([]NovaServer, error) {
 			break
 		}
 
-		allServers = append(allServers, result.Servers...)
+		added := 0
+		for _, srv := range result.Servers {
+			if seen[srv.ID] {
+				continue
+			}
+			seen[srv.ID] = true
+			allServers = append(allServers, srv)
+			added++
+		}
 
-		// Pagination: gunakan marker dari server terakhir
+		// Pagination: gunakan marker dari server terakhir.
+		// A page with nothing new means the marker isn't advancing — stop.
+		if added == 0 {
+			slog.Warn("Nova returned a page of already seen servers, stopping pagination", "service", "nova")
+			break
+		}
 		if len(result.Servers) >= 200 {
 			lastID := result.Servers[len(result.Servers)-1].ID
 			nextURL = fmt.Sprintf("%s&marker=%s", baseURL, lastID)
@@ -218,3 +280,89 @@ func (c *NovaClient) ListAllServers() ([]NovaServer, error) {
 
 	return allServers, nil
 }
+
+// errNovaServerNotFound is returned by GetServer when Nova answers 404.
+var errNovaServerNotFound = errors.New("server not found in Nova")
+
+// GetServer mengambil detail satu server (dengan flavor lengkap, microversion 2.47).
+// GET /v2.1/servers/{id}
+func (c *NovaClient) GetServer(serverID string) (*NovaServer, error) {
+	url := fmt.Sprintf("%s/v2.1/servers/%s", c.config.BaseURL, serverID)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Nova request: %w", err)
+	}
+
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("OpenStack-API-Version", "compute 2.47")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute Nova request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNovaServerNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Nova API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Server NovaServer `json:"server"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode Nova response: %w", err)
+	}
+	return &result.Server, nil
+}
+
+// NovaInstanceAction is one entry of a server's action log (os-instance-actions).
+type NovaInstanceAction struct {
+	Action    string `json:"action"` // create, stop, start, reboot, delete, ...
+	RequestID string `json:"request_id"`
+	StartTime string `json:"start_time"`
+	Message   string `json:"message"` // set when the action failed
+}
+
+// ListInstanceActions mengambil riwayat aksi server via
+// GET /v2.1/servers/{id}/os-instance-actions (juga untuk server yang sudah dihapus).
+func (c *NovaClient) ListInstanceActions(serverID string) ([]NovaInstanceAction, error) {
+	url := fmt.Sprintf("%s/v2.1/servers/%s/os-instance-actions", c.config.BaseURL, serverID)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Nova request: %w", err)
+	}
+
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	// 2.21+ lists the actions of deleted servers too; below 2.58 there is no paging
+	req.Header.Set("OpenStack-API-Version", "compute 2.47")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute Nova request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNovaServerNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Nova API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		InstanceActions []NovaInstanceAction `json:"instanceActions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode Nova response: %w", err)
+	}
+	return result.InstanceActions, nil
+}
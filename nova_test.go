@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pagedAPI is an httptest list endpoint with marker pagination over ids
+// item-0 … item-<total-1>. Like Nova/Cinder after a concurrent delete, every
+// page after the first repeats the marker item. With stuck set the marker is
+// ignored and the first page comes back every time.
+type pagedAPI struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	pages int
+}
+
+func newPagedAPI(t *testing.T, key string, total, limit int, stuck bool) *pagedAPI {
+	t.Helper()
+	p := &pagedAPI{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.pages++
+		p.mu.Unlock()
+
+		start := 0
+		if marker := r.URL.Query().Get("marker"); marker != "" && !stuck {
+			fmt.Sscanf(marker, "item-%d", &start) // marker item again: the overlap
+		}
+		var items []map[string]string
+		for i := start; i < total && len(items) < limit; i++ {
+			items = append(items, map[string]string{"id": fmt.Sprintf("item-%d", i)})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{key: items})
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestListAllServersDeduplicatesPageOverlap(t *testing.T) {
+	api := newPagedAPI(t, "servers", 450, 200, false)
+	nova := NewNovaClient(NovaConfig{BaseURL: api.URL, Token: "token"})
+
+	servers, err := nova.ListAllServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 450 {
+		t.Errorf("servers = %d, want 450", len(servers))
+	}
+	seen := map[string]bool{}
+	for _, srv := range servers {
+		if seen[srv.ID] {
+			t.Errorf("server %s listed twice", srv.ID)
+		}
+		seen[srv.ID] = true
+	}
+	// item-0…199, item-199…398, item-398…449
+	if api.pages != 3 {
+		t.Errorf("pages fetched = %d, want 3", api.pages)
+	}
+}
+
+func TestListAllServersStopsOnRepeatedPage(t *testing.T) {
+	api := newPagedAPI(t, "servers", 450, 200, true)
+	nova := NewNovaClient(NovaConfig{BaseURL: api.URL, Token: "token"})
+
+	servers, err := nova.ListAllServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 200 {
+		t.Errorf("servers = %d, want the 200 of the first page", len(servers))
+	}
+	if api.pages != 2 {
+		t.Errorf("pages fetched = %d, want 2", api.pages)
+	}
+}
+
+func TestListAllServersError(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+
+	_, err := NewNovaClient(NovaConfig{BaseURL: api.URL}).ListAllServers()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("err = %v, want the 503", err)
+	}
+}
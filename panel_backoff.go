@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLoginSuspension caps the exponential login cool-down.
+const maxLoginSuspension = time.Hour
+
+// loginBackoff stops panel logins after repeated authentication failures, so a
+// wrong ADMIN_PASSWORD doesn't turn every incoming request into a login attempt
+// (and lock the admin account out of the VHI UI). After PANEL_LOGIN_MAX_FAILURES
+// rejected logins, logins are suspended for PANEL_LOGIN_BACKOFF_SECONDS, doubling
+// with every further rejection up to maxLoginSuspension.
+//
+// Only rejected credentials count; network errors and 5xx are the circuit breaker's job.
+type loginBackoff struct {
+	mu             sync.Mutex
+	threshold      int
+	base           time.Duration
+	failures       int // consecutive rejected logins
+	suspensions    int // suspensions since the last successful login
+	suspendedUntil time.Time
+	lastError      string
+}
+
+// PanelLoginStatus is the login backoff state as shown in deep health.
+type PanelLoginStatus struct {
+	Suspended           bool   `json:"suspended"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	SuspendedUntil      string `json:"suspended_until,omitempty"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+func newLoginBackoff() *loginBackoff {
+	threshold := 3
+	if v, err := strconv.Atoi(getEnv("PANEL_LOGIN_MAX_FAILURES", "")); err == nil && v > 0 {
+		threshold = v
+	}
+	base := time.Minute
+	if v, err := strconv.Atoi(getEnv("PANEL_LOGIN_BACKOFF_SECONDS", "")); err == nil && v > 0 {
+		base = time.Duration(v) * time.Second
+	}
+	return &loginBackoff{threshold: threshold, base: base}
+}
+
+// Check returns an error while logins are suspended.
+func (b *loginBackoff) Check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.suspendedUntil) {
+		return fmt.Errorf("panel auth suspended due to repeated failures until %s (last error: %s)",
+			b.suspendedUntil.Format(time.RFC3339), b.lastError)
+	}
+	return nil
+}
+
+// Failure records a rejected login and suspends logins once the threshold is reached.
+func (b *loginBackoff) Failure(reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = reason
+	if b.failures < b.threshold {
+		return
+	}
+
+	cooldown := b.base
+	for i := 0; i < b.suspensions && cooldown < maxLoginSuspension; i++ {
+		cooldown *= 2
+	}
+	if cooldown > maxLoginSuspension {
+		cooldown = maxLoginSuspension
+	}
+	b.suspensions++
+	b.suspendedUntil = time.Now().Add(cooldown)
+	slog.Error("VHI Panel login rejected repeatedly, suspending panel logins (check ADMIN_PASSWORD)",
+		"service", "panel", "failures", b.failures, "cooldown", cooldown)
+}
+
+// Reset clears the backoff (successful login, or new credentials).
+func (b *loginBackoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.suspensions > 0 {
+		slog.Info("VHI Panel login backoff cleared", "service", "panel")
+	}
+	b.failures = 0
+	b.suspensions = 0
+	b.suspendedUntil = time.Time{}
+	b.lastError = ""
+}
+
+// Status returns a snapshot for health output.
+func (b *loginBackoff) Status() PanelLoginStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := PanelLoginStatus{
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastError,
+	}
+	if time.Now().Before(b.suspendedUntil) {
+		status.Suspended = true
+		status.SuspendedUntil = b.suspendedUntil.Format(time.RFC3339)
+	}
+	return status
+}
+
+// LoginStatus returns the panel login backoff state.
+func (c *VHIPanelClient) LoginStatus() PanelLoginStatus {
+	return c.loginBackoff.Status()
+}
+
+// ResetLoginBackoff lifts a login suspension, e.g. after the credentials were reloaded.
+func (c *VHIPanelClient) ResetLoginBackoff() {
+	c.loginBackoff.Reset()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errPanelCircuitOpen is returned without contacting the panel while the breaker is open.
+var errPanelCircuitOpen = errors.New("VHI Panel circuit breaker open — panel temporarily skipped")
+
+// Breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker stops sending requests to the panel after repeated failures.
+// After PANEL_BREAKER_THRESHOLD consecutive failures it opens for
+// PANEL_BREAKER_COOLDOWN_SECONDS; then a single probe is let through and its
+// result closes (success) or re-opens (failure) the breaker.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int // consecutive failures
+	openedAt  time.Time
+	probing   bool // a half-open probe is in flight
+	trips     int  // times the breaker opened since start
+}
+
+// BreakerStatus is the breaker state as shown in deep health.
+type BreakerStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Trips               int    `json:"trips"`
+	OpenUntil           string `json:"open_until,omitempty"`
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	threshold := 5
+	if v, err := strconv.Atoi(getEnv("PANEL_BREAKER_THRESHOLD", "")); err == nil && v > 0 {
+		threshold = v
+	}
+	cooldown := 30 * time.Second
+	if v, err := strconv.Atoi(getEnv("PANEL_BREAKER_COOLDOWN_SECONDS", "")); err == nil && v > 0 {
+		cooldown = time.Duration(v) * time.Second
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// Allow reports whether a request may be sent now.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		slog.Info("VHI Panel circuit breaker half-open, probing panel", "service", "panel")
+		return true
+	case breakerHalfOpen:
+		// Only the one probe goes through
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success records a successful call and closes the breaker.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		slog.Info("VHI Panel circuit breaker closed, panel reachable again", "service", "panel")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed call and opens the breaker when the threshold is reached
+// or the half-open probe failed.
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trips++
+		slog.Warn("VHI Panel circuit breaker open, skipping panel", "service", "panel",
+			"failures", b.failures, "cooldown", b.cooldown)
+	}
+}
+
+// Status returns a snapshot for health output and metrics. An open breaker
+// whose cool-down has elapsed is reported as half_open: the next request probes.
+func (b *circuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+	}
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) >= b.cooldown {
+			status.State = breakerHalfOpen
+		} else {
+			status.OpenUntil = b.openedAt.Add(b.cooldown).Format(time.RFC3339)
+		}
+	}
+	return status
+}
+
+// sendPanel sends a panel/Grafana request through the circuit breaker.
+// GET requests are retried once on a network error. Network errors and 5xx
+// responses count as failures; any other response means the panel is up.
+func (c *VHIPanelClient) sendPanel(client *http.Client, req *http.Request) (*http.Response, error) {
+	if !c.breaker.Allow() {
+		return nil, errPanelCircuitOpen
+	}
+
+	resp, err := client.Do(req)
+	if err != nil && req.Method == http.MethodGet {
+		slog.Warn("VHI Panel request failed, retrying once", "service", "panel", "path", req.URL.Path, "error", err)
+		time.Sleep(500 * time.Millisecond)
+		resp, err = client.Do(req)
+	}
+
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		c.breaker.Failure()
+	} else {
+		c.breaker.Success()
+	}
+	return resp, err
+}
+
+// BreakerStatus returns the panel circuit breaker state.
+func (c *VHIPanelClient) BreakerStatus() BreakerStatus {
+	return c.breaker.Status()
+}
+
+// registerPanelBreakerMetrics exports the breaker state at /metrics.
+func registerPanelBreakerMetrics(c PanelAPI) {
+	stateValue := map[string]float64{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}
+
+	metrics.RegisterGauge("vhi_panel_circuit_state",
+		"VHI panel circuit breaker state (0=closed, 1=half_open, 2=open).",
+		func() []metricSample {
+			return []metricSample{{Value: stateValue[c.BreakerStatus().State]}}
+		})
+	metrics.RegisterGauge("vhi_panel_circuit_consecutive_failures",
+		"Consecutive failed VHI panel requests.",
+		func() []metricSample {
+			return []metricSample{{Value: float64(c.BreakerStatus().ConsecutiveFailures)}}
+		})
+	metrics.RegisterGauge("vhi_panel_circuit_trips",
+		"Times the VHI panel circuit breaker opened since start.",
+		func() []metricSample {
+			return []metricSample{{Value: float64(c.BreakerStatus().Trips)}}
+		})
+}
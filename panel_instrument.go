@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every panel, Grafana and direct Prometheus request goes through an
+// instrumentedTransport. The call is classified from the request itself (path,
+// auth header), so the login and cookie code needs no metrics calls of its own.
+
+// Panel call operations, as used in the "op" label.
+const (
+	opPanelLogin       = "login"             // POST /api/v2/login
+	opGrafanaSSO       = "grafana_sso"       // session0 → grafana_session exchange
+	opPanelGet         = "panel_get"         // doAuthGet
+	opGrafanaGet       = "grafana_get"       // other Grafana requests
+	opPrometheusDirect = "prometheus_direct" // PROMETHEUS_URL
+	opPrometheusAPIKey = "prometheus_api_key"
+	opPrometheusSSO    = "prometheus_sso"
+)
+
+// panelCallBuckets are the duration histogram bounds in seconds.
+var panelCallBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// instrumentedTransport records duration, status and auth path of every request.
+type instrumentedTransport struct {
+	base     http.RoundTripper
+	classify func(*http.Request) (op, authPath string)
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op, authPath := t.classify(req)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	labels := map[string]string{"op": op, "auth_path": authPath, "status": status}
+	metrics.ObserveHistogram("vhi_panel_call_duration_seconds",
+		"Duration of VHI panel, Grafana and Prometheus calls.", panelCallBuckets, labels, elapsed.Seconds())
+	panelCalls.record(op, authPath, status, err != nil || resp.StatusCode >= 400, elapsed)
+
+	// A 401 on an authenticated call means the session expired and will be refreshed
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		kind := ""
+		switch op {
+		case opPanelGet:
+			kind = "panel"
+		case opGrafanaGet, opPrometheusSSO:
+			kind = "grafana"
+		}
+		if kind != "" {
+			metrics.IncCounter("vhi_panel_session_refreshes_total",
+				"Expired panel/Grafana sessions (401) that triggered a re-login.", map[string]string{"session": kind})
+			panelCalls.incRefresh(kind)
+		}
+	}
+	return resp, err
+}
+
+// classifyPanelRequest maps a panel/Grafana request to its operation and auth path.
+func classifyPanelRequest(req *http.Request) (string, string) {
+	path := req.URL.Path
+	switch {
+	case path == "/api/v2/login":
+		return opPanelLogin, "password"
+	case path == "/grafana/api/user":
+		return opGrafanaSSO, "session0"
+	case strings.HasPrefix(path, "/grafana/api/datasources/"):
+		if req.Header.Get("Authorization") != "" {
+			return opPrometheusAPIKey, "api_key"
+		}
+		return opPrometheusSSO, "grafana_session"
+	case strings.HasPrefix(path, "/grafana/"):
+		return opGrafanaGet, "grafana_session"
+	}
+	return opPanelGet, "token"
+}
+
+// prometheusDirectTransport instruments PROMETHEUS_URL requests.
+var prometheusDirectTransport http.RoundTripper = &instrumentedTransport{
+	base: http.DefaultTransport,
+	classify: func(*http.Request) (string, string) {
+		return opPrometheusDirect, "none"
+	},
+}
+
+// recordSSOFallback counts Prometheus queries that had to use the Grafana SSO path.
+func recordSSOFallback() {
+	metrics.IncCounter("vhi_prometheus_sso_fallback_total",
+		"Prometheus accesses through the Grafana SSO proxy (no PROMETHEUS_URL or GRAFANA_API_KEY).", nil)
+	panelCalls.mu.Lock()
+	panelCalls.ssoFallbacks++
+	panelCalls.mu.Unlock()
+}
+
+// prometheusSource names the Prometheus access path prometheusAPIFetcher will use.
+func prometheusSource() string {
+	switch {
+	case os.Getenv("PROMETHEUS_URL") != "":
+		return "direct"
+	case os.Getenv("GRAFANA_API_KEY") != "":
+		return "api_key"
+	}
+	return "grafana_sso"
+}
+
+// panelCallStat summarizes one (op, auth_path) pair for the diagnostics endpoint.
+type panelCallStat struct {
+	Op         string  `json:"op"`
+	AuthPath   string  `json:"auth_path"`
+	Count      int64   `json:"count"`
+	Errors     int64   `json:"errors"` // network errors and 4xx/5xx
+	AvgMillis  float64 `json:"avg_ms"`
+	MaxMillis  float64 `json:"max_ms"`
+	LastStatus string  `json:"last_status"`
+	LastAt     string  `json:"last_at"`
+
+	total time.Duration
+}
+
+// panelCallStats is the in-process summary behind GET /api/v1/diagnostics.
+type panelCallStats struct {
+	mu             sync.Mutex
+	calls          map[string]*panelCallStat
+	sessionRefresh map[string]int64
+	ssoFallbacks   int64
+	startedAt      time.Time
+}
+
+var panelCalls = &panelCallStats{
+	calls:          make(map[string]*panelCallStat),
+	sessionRefresh: make(map[string]int64),
+	startedAt:      time.Now(),
+}
+
+func (s *panelCallStats) record(op, authPath, status string, failed bool, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := op + "|" + authPath
+	st, ok := s.calls[key]
+	if !ok {
+		st = &panelCallStat{Op: op, AuthPath: authPath}
+		s.calls[key] = st
+	}
+	st.Count++
+	if failed {
+		st.Errors++
+	}
+	st.total += elapsed
+	if ms := float64(elapsed.Microseconds()) / 1000; ms > st.MaxMillis {
+		st.MaxMillis = ms
+	}
+	st.LastStatus = status
+	st.LastAt = time.Now().Format(time.RFC3339)
+}
+
+func (s *panelCallStats) incRefresh(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessionRefresh[kind]++
+}
+
+// PanelDiagnostics is the response of GET /api/v1/diagnostics.
+type PanelDiagnostics struct {
+	Time             string            `json:"time"`
+	Since            string            `json:"since"` // counters cover the time since process start
+	Calls            []panelCallStat   `json:"calls"`
+	SessionRefreshes map[string]int64  `json:"session_refreshes"`
+	SSOFallbacks     int64             `json:"prometheus_sso_fallbacks"`
+	PrometheusSource string            `json:"prometheus_source"` // direct, api_key, grafana_sso
+	Breaker          *BreakerStatus    `json:"circuit_breaker,omitempty"`
+	Login            *PanelLoginStatus `json:"login,omitempty"`
+}
+
+func (s *panelCallStats) snapshot() PanelDiagnostics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := PanelDiagnostics{
+		Time:             time.Now().Format(time.RFC3339),
+		Since:            s.startedAt.Format(time.RFC3339),
+		Calls:            make([]panelCallStat, 0, len(s.calls)),
+		SessionRefreshes: map[string]int64{"panel": s.sessionRefresh["panel"], "grafana": s.sessionRefresh["grafana"]},
+		SSOFallbacks:     s.ssoFallbacks,
+	}
+	for _, st := range s.calls {
+		c := *st
+		if c.Count > 0 {
+			c.AvgMillis = float64(c.total.Microseconds()) / 1000 / float64(c.Count)
+		}
+		d.Calls = append(d.Calls, c)
+	}
+	sort.Slice(d.Calls, func(i, j int) bool {
+		if d.Calls[i].Op != d.Calls[j].Op {
+			return d.Calls[i].Op < d.Calls[j].Op
+		}
+		return d.Calls[i].AuthPath < d.Calls[j].AuthPath
+	})
+	return d
+}
+
+// GET /api/v1/diagnostics
+func getDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	d := panelCalls.snapshot()
+	d.PrometheusSource = prometheusSource()
+	if panelClient != nil {
+		breaker := panelClient.BreakerStatus()
+		login := panelClient.LoginStatus()
+		d.Breaker, d.Login = &breaker, &login
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, d)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errPanelEndpointUnsupported is returned when the panel answers 404 for an
+// endpoint that only newer panel versions have.
+var errPanelEndpointUnsupported = errors.New("endpoint not supported by this VHI panel version")
+
+// panelStatusError is a non-200 panel response, so callers can tell a 404
+// (feature missing) from other failures.
+type panelStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *panelStatusError) Error() string {
+	return fmt.Sprintf("request returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// PanelLicense is the license as reported by the panel. Field names differ
+// between panel versions, so the common aliases are decoded.
+type PanelLicense struct {
+	Valid      *bool  `json:"valid"`
+	Status     string `json:"status"` // e.g. active, expired
+	Type       string `json:"type"`
+	ExpiresAt  string `json:"expires_at"`
+	Expiration string `json:"expiration_date"`
+	ValidTill  string `json:"valid_till"`
+}
+
+// Expiry returns the license expiry date, zero when the panel didn't report one
+// (perpetual license) or it couldn't be parsed.
+func (l PanelLicense) Expiry() time.Time {
+	for _, s := range []string{l.ExpiresAt, l.Expiration, l.ValidTill} {
+		if s == "" {
+			continue
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t
+			}
+		}
+		if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(secs, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// PanelHA is the management node high availability state.
+type PanelHA struct {
+	Enabled *bool  `json:"enabled"`
+	Status  string `json:"status"`
+	State   string `json:"state"`
+	Nodes   []struct {
+		Hostname string `json:"hostname"`
+		Status   string `json:"status"`
+	} `json:"nodes"`
+}
+
+// GetLicense retrieves the cluster license (PANEL_LICENSE_PATH, default
+// /api/v2/license). Returns errPanelEndpointUnsupported on older panels.
+func (c *VHIPanelClient) GetLicense() (*PanelLicense, error) {
+	var license PanelLicense
+	if err := c.getOptional(getEnv("PANEL_LICENSE_PATH", "/api/v2/license"), &license); err != nil {
+		return nil, err
+	}
+	return &license, nil
+}
+
+// GetHAStatus retrieves the HA cluster state (PANEL_HA_PATH, default /api/v2/ha).
+// Returns errPanelEndpointUnsupported on older panels.
+func (c *VHIPanelClient) GetHAStatus() (*PanelHA, error) {
+	var ha PanelHA
+	if err := c.getOptional(getEnv("PANEL_HA_PATH", "/api/v2/ha"), &ha); err != nil {
+		return nil, err
+	}
+	return &ha, nil
+}
+
+// getOptional GETs an endpoint that may not exist on this panel version and
+// decodes it into dest (also when wrapped in {"data": ...}).
+func (c *VHIPanelClient) getOptional(endpoint string, dest interface{}) error {
+	body, err := c.doAuthGet(endpoint)
+	var statusErr *panelStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return errPanelEndpointUnsupported
+	}
+	if err != nil {
+		return err
+	}
+
+	var wrapped struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(body, &wrapped) == nil && len(wrapped.Data) > 0 && wrapped.Data[0] == '{' {
+		body = wrapped.Data
+	}
+	if err := json.Unmarshal(body, dest); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w (body: %.200s)", endpoint, err, string(body))
+	}
+	return nil
+}
+
+// LicenseStatus is the license view shown in deep health and /version.
+type LicenseStatus struct {
+	Supported       bool   `json:"supported"`
+	Valid           *bool  `json:"valid,omitempty"`
+	Status          string `json:"status,omitempty"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
+	DaysUntilExpiry *int   `json:"days_until_expiry,omitempty"`
+	ExpiringSoon    bool   `json:"expiring_soon,omitempty"` // within PANEL_LICENSE_WARN_DAYS
+	Error           string `json:"error,omitempty"`
+}
+
+// HAStatus is the HA view shown in deep health and /version.
+type HAStatus struct {
+	Supported bool   `json:"supported"`
+	Enabled   *bool  `json:"enabled,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Healthy   *bool  `json:"healthy,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PanelPlatformStatus combines license and HA state.
+type PanelPlatformStatus struct {
+	CheckedAt string        `json:"checked_at"`
+	License   LicenseStatus `json:"license"`
+	HA        HAStatus      `json:"ha"`
+}
+
+// Degraded reports whether the license or HA state needs operator attention.
+func (s PanelPlatformStatus) Degraded() bool {
+	if s.License.Valid != nil && !*s.License.Valid {
+		return true
+	}
+	if s.License.ExpiringSoon {
+		return true
+	}
+	return s.HA.Healthy != nil && !*s.HA.Healthy
+}
+
+// panelPlatformTTL is how long license/HA state is reused; it changes rarely
+// and is read by every health check and metrics scrape.
+const panelPlatformTTL = 5 * time.Minute
+
+var (
+	panelPlatformMu     sync.Mutex
+	panelPlatformCached *PanelPlatformStatus
+	panelPlatformAt     time.Time
+)
+
+// getPanelPlatformStatus returns the license/HA state, cached for panelPlatformTTL.
+func getPanelPlatformStatus(c PanelAPI) PanelPlatformStatus {
+	panelPlatformMu.Lock()
+	defer panelPlatformMu.Unlock()
+	if panelPlatformCached != nil && time.Since(panelPlatformAt) < panelPlatformTTL {
+		return *panelPlatformCached
+	}
+
+	status := PanelPlatformStatus{
+		CheckedAt: time.Now().Format(time.RFC3339),
+		License:   licenseStatus(c.GetLicense()),
+		HA:        haStatus(c.GetHAStatus()),
+	}
+	panelPlatformCached = &status
+	panelPlatformAt = time.Now()
+	return status
+}
+
+func licenseStatus(license *PanelLicense, err error) LicenseStatus {
+	if errors.Is(err, errPanelEndpointUnsupported) {
+		return LicenseStatus{Supported: false}
+	}
+	status := LicenseStatus{Supported: true}
+	if err != nil {
+		slog.Warn("VHI Panel license check failed", "service", "panel", "error", err)
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Status = license.Status
+	valid := true
+	if license.Valid != nil {
+		valid = *license.Valid
+	}
+	switch strings.ToLower(license.Status) {
+	case "expired", "invalid", "inactive":
+		valid = false
+	}
+
+	if expiry := license.Expiry(); !expiry.IsZero() {
+		status.ExpiresAt = expiry.Format(time.RFC3339)
+		days := int(math.Floor(time.Until(expiry).Hours() / 24))
+		status.DaysUntilExpiry = &days
+		if days < 0 {
+			valid = false
+		} else if days <= licenseWarnDays() {
+			status.ExpiringSoon = true
+		}
+	}
+	status.Valid = &valid
+	return status
+}
+
+func haStatus(ha *PanelHA, err error) HAStatus {
+	if errors.Is(err, errPanelEndpointUnsupported) {
+		return HAStatus{Supported: false}
+	}
+	status := HAStatus{Supported: true}
+	if err != nil {
+		slog.Warn("VHI Panel HA check failed", "service", "panel", "error", err)
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Enabled = ha.Enabled
+	status.Status = ha.Status
+	if status.Status == "" {
+		status.Status = ha.State
+	}
+	if ha.Enabled != nil && !*ha.Enabled {
+		// HA not configured — nothing to be unhealthy about
+		return status
+	}
+
+	healthy := haStateOK(status.Status)
+	for _, n := range ha.Nodes {
+		if !haStateOK(n.Status) {
+			healthy = false
+		}
+	}
+	status.Healthy = &healthy
+	return status
+}
+
+// haStateOK reports whether a panel HA state string means healthy.
+// An empty state is not counted against the cluster.
+func haStateOK(s string) bool {
+	switch strings.ToLower(s) {
+	case "", "ok", "healthy", "active", "online", "normal", "up":
+		return true
+	}
+	return false
+}
+
+// licenseWarnDays returns PANEL_LICENSE_WARN_DAYS (default 14).
+func licenseWarnDays() int {
+	if v, err := strconv.Atoi(getEnv("PANEL_LICENSE_WARN_DAYS", "")); err == nil && v >= 0 {
+		return v
+	}
+	return 14
+}
+
+// registerPanelLicenseMetrics exports the days until license expiry at /metrics.
+// Nothing is emitted when the panel has no license endpoint or no expiry date.
+func registerPanelLicenseMetrics(c PanelAPI) {
+	metrics.RegisterGauge("vhi_panel_license_days_until_expiry",
+		"Days until the VHI cluster license expires (negative once expired).",
+		func() []metricSample {
+			days := getPanelPlatformStatus(c).License.DaysUntilExpiry
+			if days == nil {
+				return nil
+			}
+			return []metricSample{{Value: float64(*days)}}
+		})
+}
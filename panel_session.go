@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Panel session sharing via Redis.
+//
+// The panel token and the panel/Grafana cookies are stored encrypted
+// (AES-256-GCM, key derived from PANEL_SESSION_KEY) so that:
+//   - a restart reuses the existing session instead of logging in again
+//     (the panel rate-limits logins and locked us out during crash-loops)
+//   - replicas share one session; only the holder of the login lock logs in
+//
+// A 401 deletes the shared copy so nobody keeps adopting a dead session.
+// Without PANEL_SESSION_KEY nothing is persisted — cookies are never stored in plain text.
+
+const (
+	panelSessionKey     = "panel_session"
+	panelSessionLockKey = "panel_session:login_lock"
+	panelSessionTTL     = 12 * time.Hour
+	panelLoginLockTTL   = 30 * time.Second
+	panelLoginWait      = 10 * time.Second
+)
+
+// panelSession is the persisted form of the panel client session.
+type panelSession struct {
+	Token          string         `json:"token"`
+	Cookies        []storedCookie `json:"cookies"`
+	GrafanaCookies []storedCookie `json:"grafana_cookies,omitempty"`
+	SavedAt        time.Time      `json:"saved_at"`
+}
+
+// storedCookie keeps the cookie fields that matter for sending it back.
+type storedCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Path  string `json:"path,omitempty"`
+}
+
+func toStoredCookies(cookies []*http.Cookie) []storedCookie {
+	out := make([]storedCookie, 0, len(cookies))
+	for _, ck := range cookies {
+		out = append(out, storedCookie{Name: ck.Name, Value: ck.Value, Path: ck.Path})
+	}
+	return out
+}
+
+func fromStoredCookies(cookies []storedCookie) []*http.Cookie {
+	out := make([]*http.Cookie, 0, len(cookies))
+	for _, ck := range cookies {
+		out = append(out, &http.Cookie{Name: ck.Name, Value: ck.Value, Path: ck.Path})
+	}
+	return out
+}
+
+// panelSessionStore persists the panel session in Redis.
+type panelSessionStore struct {
+	rdb    redis.UniversalClient
+	codec  *secretCodec
+	id     string // identifies this process as the login lock holder
+	prefix string // cluster key prefix, "" for the default cluster
+}
+
+// newPanelSessionStore returns a store, or nil when Redis or PANEL_SESSION_KEY
+// is missing. prefix namespaces the keys per cluster (Cluster.key("")).
+func newPanelSessionStore(rdb redis.UniversalClient, prefix string) *panelSessionStore {
+	secret := os.Getenv("PANEL_SESSION_KEY")
+	if rdb == nil || secret == "" {
+		slog.Info("Panel session sharing disabled (requires Redis and PANEL_SESSION_KEY)")
+		return nil
+	}
+
+	codec, err := newSecretCodec(secret)
+	if err != nil {
+		slog.Warn("Panel session cipher init failed, session sharing disabled", "error", err)
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	return &panelSessionStore{
+		rdb:    rdb,
+		codec:  codec,
+		id:     fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano()),
+		prefix: prefix,
+	}
+}
+
+// Load returns the shared session, or nil if there is none (or it can't be decrypted).
+func (s *panelSessionStore) Load() *panelSession {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	plain, err := cacheGetSecret(ctx, s.rdb, s.codec, s.prefix+panelSessionKey)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Warn("Panel session read failed", "service", "redis", "error", err)
+		}
+		return nil
+	}
+
+	var session panelSession
+	if err := json.Unmarshal(plain, &session); err != nil || session.Token == "" {
+		return nil
+	}
+	return &session
+}
+
+// Save stores the session for other replicas and the next restart.
+func (s *panelSessionStore) Save(session panelSession) {
+	plain, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := cacheSetSecret(ctx, s.rdb, s.codec, s.prefix+panelSessionKey, plain, panelSessionTTL); err != nil {
+		slog.Warn("Panel session write failed", "service", "redis", "error", err)
+	}
+}
+
+// Invalidate deletes the shared session if it still holds the rejected token.
+// A newer session saved by another replica is left alone.
+func (s *panelSessionStore) Invalidate(token string) {
+	if current := s.Load(); current == nil || current.Token != token {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := cacheDeleteSecret(ctx, s.rdb, s.prefix+panelSessionKey); err != nil {
+		slog.Warn("Panel session invalidation failed", "service", "redis", "error", err)
+	}
+}
+
+// TryLoginLock takes the cross-replica login lock. Returns false if another
+// process holds it. Redis errors count as acquired so a Redis outage never blocks login.
+func (s *panelSessionStore) TryLoginLock() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ok, err := s.rdb.SetNX(ctx, redisKey(s.prefix+panelSessionLockKey), s.id, panelLoginLockTTL).Result()
+	if err != nil {
+		slog.Warn("Panel login lock failed", "service", "redis", "error", err)
+		return true
+	}
+	return ok
+}
+
+// ReleaseLoginLock releases the login lock if this process still holds it.
+func (s *panelSessionStore) ReleaseLoginLock() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if holder, err := s.rdb.Get(ctx, redisKey(s.prefix+panelSessionLockKey)).Result(); err == nil && holder == s.id {
+		s.rdb.Del(ctx, redisKey(s.prefix+panelSessionLockKey))
+	}
+}
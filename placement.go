@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PlacementConfig menyimpan konfigurasi untuk Placement API client.
+type PlacementConfig struct {
+	BaseURL  string // e.g. https://10.21.0.240:8780
+	Token    string
+	Insecure bool
+	Calls    *upstreamCalls // request counter (upstreamCallsOf); nil counts nothing
+}
+
+// PlacementClient adalah HTTP client untuk Placement API.
+type PlacementClient struct {
+	config     PlacementConfig
+	httpClient *http.Client
+}
+
+// PlacementUsage is the allocated VCPU and MEMORY_MB summed over resource providers.
+type PlacementUsage struct {
+	Providers int
+	VCPUs     int
+	MemoryMB  int
+}
+
+type placementProvidersResponse struct {
+	ResourceProviders []struct {
+		UUID string `json:"uuid"`
+		Name string `json:"name"`
+	} `json:"resource_providers"`
+}
+
+type placementUsagesResponse struct {
+	Usages map[string]int `json:"usages"`
+}
+
+// placementWorkers bounds the parallel per-provider usage requests.
+const placementWorkers = 10
+
+// NewPlacementClient membuat Placement client baru.
+func NewPlacementClient(config PlacementConfig) *PlacementClient {
+	tr := &http.Transport{}
+
+	if config.Insecure {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &PlacementClient{
+		config: config,
+		httpClient: &http.Client{
+			Transport: &countingTransport{base: tr, service: "placement", calls: config.Calls},
+			Timeout:   60 * time.Second,
+		},
+	}
+}
+
+// get decodes a GET of path into v.
+func (c *PlacementClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.config.BaseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create Placement request: %w", err)
+	}
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute Placement request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Placement API returned status %d: %s", resp.StatusCode, string(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode Placement response: %w", err)
+	}
+	return nil
+}
+
+// GetAllocatedUsage sums the VCPU and MEMORY_MB usages of every resource provider.
+// GET /resource_providers, then GET /resource_providers/{uuid}/usages per provider
+func (c *PlacementClient) GetAllocatedUsage() (*PlacementUsage, error) {
+	var providers placementProvidersResponse
+	if err := c.get("/resource_providers", &providers); err != nil {
+		return nil, err
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, placementWorkers)
+		usage    = &PlacementUsage{Providers: len(providers.ResourceProviders)}
+		firstErr error
+	)
+	for _, rp := range providers.ResourceProviders {
+		wg.Add(1)
+		go func(uuid, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var result placementUsagesResponse
+			err := c.get("/resource_providers/"+uuid+"/usages", &result)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("resource provider %s: %w", name, err)
+				}
+				return
+			}
+			usage.VCPUs += result.Usages["VCPU"]
+			usage.MemoryMB += result.Usages["MEMORY_MB"]
+		}(rp.UUID, rp.Name)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return usage, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Precision selects how numeric capacity fields are rendered.
+type Precision int
+
+const (
+	// PrecisionRounded is the default dashboard-style output (ceil/round to display units).
+	PrecisionRounded Precision = iota
+	// PrecisionRaw returns exact unrounded GiB/TiB values plus the underlying byte counts,
+	// for integrators that do their own rounding.
+	PrecisionRaw
+)
+
+// ?precision=raw applies to every JSON response: fieldProjection marks the
+// writer so writeJSON keeps full float precision even with
+// JSON_FLOAT_PRECISION set. Responses that round or convert in their handler
+// (ClusterUsage, VStorageCapacity) also get the exact values and byte counts
+// through their withPrecision.
+
+// parsePrecision reads the ?precision= query param ("rounded" or "raw", default rounded).
+func parsePrecision(r *http.Request) (Precision, error) {
+	switch r.URL.Query().Get("precision") {
+	case "", "rounded":
+		return PrecisionRounded, nil
+	case "raw":
+		return PrecisionRaw, nil
+	default:
+		return PrecisionRounded, fmt.Errorf("invalid precision %s (expected rounded or raw)", r.URL.Query().Get("precision"))
+	}
+}
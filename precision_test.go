@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrecisionRawKeepsFullFloats(t *testing.T) {
+	t.Setenv("JSON_FLOAT_PRECISION", "2")
+	handler := fieldProjection(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]float64{"value": 1.23456})
+	}))
+
+	tests := []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"", http.StatusOK, `{"value":1.23}`},
+		{"?precision=rounded", http.StatusOK, `{"value":1.23}`},
+		{"?precision=raw", http.StatusOK, `{"value":1.23456}`},
+		{"?precision=exact", http.StatusBadRequest, `invalid precision`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/"+tt.query, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%q: status %d, want %d", tt.query, rec.Code, tt.code)
+		}
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%q: body %s, want %s", tt.query, rec.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestVStorageCapacityWithPrecision(t *testing.T) {
+	capacity := VStorageCapacity{Bytes: &VStorageBytes{PhysicalTotal: 1 << 40}}
+	if capacity.withPrecision(PrecisionRounded).Bytes != nil {
+		t.Error("rounded output has byte counts")
+	}
+	if capacity.withPrecision(PrecisionRaw).Bytes == nil {
+		t.Error("raw output lost the byte counts")
+	}
+}
+
+func TestCSVNumberPrecision(t *testing.T) {
+	if got := csvNumber(0.123456, PrecisionRounded); got != "0.12" {
+		t.Errorf("rounded: %s", got)
+	}
+	if got := csvNumber(0.123456, PrecisionRaw); got != "0.123456" {
+		t.Errorf("raw: %s", got)
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Pricing expressions replace the built-in cost formula (cpu_hours × CPU price
+// + GB-hours × memory price) for contracts with other pricing, e.g.
+//
+//	cpu_hours * 0.04 + gb_hours * 0.005 + if(vcpus > 8, 20, 0)
+//	max(25, ceil(hours / 24) * vcpus * 0.9)
+//
+// The language is arithmetic only: numbers, the pricingVariables, + - * /,
+// comparisons (1 or 0), && || !, parentheses and the pricingFunctions. There
+// are no assignments, loops or calls outside that list, and expressions are
+// bounded in length and nesting, so a configured expression cannot do
+// anything but compute a number.
+
+// Limits on pricing expressions.
+const (
+	maxPricingExprLength = 1000
+	maxPricingExprDepth  = 32
+)
+
+// pricingVariables are the names an expression may use, with their meaning.
+var pricingVariables = map[string]string{
+	"cpu_hours":    "CPU hours used in the period (as billed by the built-in formula)",
+	"gb_hours":     "average used memory (GB) × hours",
+	"vcpus":        "vCPUs of the instance",
+	"hours":        "hours of the period the instance existed (effective_hours)",
+	"cpu_price":    "cpu_price_per_hour of the request",
+	"memory_price": "memory_price_per_gb of the request",
+	"disk_gib":     "average provisioned volume size (GiB)",
+	"io_gb":        "disk GB read + written in the period",
+	"disk_cost":    "disk cost from disk_price_per_gb_month and io_price_per_gb",
+	"egress_gb":    "network GB sent by the instance in the period",
+	"network_cost": "egress cost from network_price_per_gb",
+}
+
+// pricingFunctions are the callable functions and their argument counts
+// (-1: one or more).
+var pricingFunctions = map[string]int{
+	"min":   -1,
+	"max":   -1,
+	"ceil":  1,
+	"floor": 1,
+	"round": 1,
+	"abs":   1,
+	"if":    3, // if(cond, then, else); only the chosen branch is evaluated
+}
+
+// PricingExpr is a parsed pricing expression.
+type PricingExpr struct {
+	source string
+	root   exprNode
+}
+
+// String returns the expression as configured.
+func (e *PricingExpr) String() string { return e.source }
+
+// Eval computes the expression. Division by zero and non-finite results are errors.
+func (e *PricingExpr) Eval(vars map[string]float64) (float64, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return v, nil
+}
+
+// ParsePricingExpr parses and validates src: syntax, known variables and
+// functions, argument counts, and the length and nesting limits.
+func ParsePricingExpr(src string) (*PricingExpr, error) {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return nil, errors.New("empty expression")
+	}
+	if len(src) > maxPricingExprLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxPricingExprLength)
+	}
+	tokens, err := tokenizePricingExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos+1)
+	}
+	return &PricingExpr{source: src, root: root}, nil
+}
+
+// PricingResult is the cost of a report computed by a pricing expression.
+type PricingResult struct {
+	Expression string             `json:"expression"`
+	Variables  map[string]float64 `json:"variables"`
+	Cost       float64            `json:"cost"`
+}
+
+// pricingExprFromRequest returns the ?pricing_expr= expression, else the
+// default one (PRICING_FILE or PRICING_EXPR, see config_reload.go), parsed;
+// nil when neither is set.
+func pricingExprFromRequest(r *http.Request) (*PricingExpr, error) {
+	if src := r.URL.Query().Get("pricing_expr"); src != "" {
+		return ParsePricingExpr(src)
+	}
+	return fileConfigs.get().pricingExpr()
+}
+
+// ApplyPricingExpr evaluates expr for the report and stores the result, which
+// ApplyAdjustments then uses as the usage cost instead of CPU + memory + disk +
+// network cost. disk_cost and network_cost are the built-in costs, so an
+// expression can keep them.
+func ApplyPricingExpr(report *BillingReport, expr *PricingExpr) error {
+	hours := billedHours(report)
+
+	cpuHours := 0.0
+	for _, daily := range report.CPUUsage.UsageByDay {
+		cpuHours += daily.TotalCPUHours
+	}
+
+	egressGB := 0.0
+	if report.NetworkUsage != nil {
+		egressGB = report.NetworkUsage.Total.OutgoingGB
+	}
+
+	vars := map[string]float64{
+		"cpu_hours":    cpuHours,
+		"gb_hours":     report.MemoryUsage.AverageUsedMB / 1024.0 * hours,
+		"vcpus":        float64(report.VCPUs),
+		"hours":        hours,
+		"cpu_price":    report.CPUPricePerHour,
+		"memory_price": report.MemoryPricePerGB,
+		"disk_gib":     report.DiskUsage.ProvisionedGiB,
+		"io_gb":        report.DiskUsage.TotalIOGB,
+		"disk_cost":    report.DiskCost,
+		"egress_gb":    egressGB,
+		"network_cost": report.NetworkCost,
+	}
+	cost, err := expr.Eval(vars)
+	if err != nil {
+		return fmt.Errorf("pricing expression: %w", err)
+	}
+	report.Pricing = &PricingResult{Expression: expr.String(), Variables: vars, Cost: cost}
+	return nil
+}
+
+// --- tokenizer ---
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp // operators, parentheses and commas
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+// exprOperators are matched longest first.
+var exprOperators = []string{"<=", ">=", "==", "!=", "&&", "||", "<", ">", "+", "-", "*", "/", "!", "(", ")", ","}
+
+func tokenizePricingExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[i:j], i+1)
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, text: src[i:j], num: n, pos: i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i+1)
+			}
+			tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+// --- parser (recursive descent, lowest precedence first) ---
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken { return p.tokens[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token when it is one of the operators.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		t := p.peek()
+		return fmt.Errorf("expected %q at position %d, got %q", op, t.pos+1, t.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr(depth int) (exprNode, error) {
+	if depth > maxPricingExprDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d", maxPricingExprDepth)
+	}
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd(depth int) (exprNode, error) {
+	left, err := p.parseCompare(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseCompare(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseCompare(depth int) (exprNode, error) {
+	left, err := p.parseAdd(depth)
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("<=", ">=", "==", "!=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdd(depth)
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseAdd(depth int) (exprNode, error) {
+	left, err := p.parseMul(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMul(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseMul(depth int) (exprNode, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary(depth int) (exprNode, error) {
+	if op, ok := p.accept("-", "!"); ok {
+		if depth+1 > maxPricingExprDepth {
+			return nil, fmt.Errorf("expression nested deeper than %d", maxPricingExprDepth)
+		}
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary(depth)
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return numberNode(t.num), nil
+	case tokIdent:
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t, depth)
+		}
+		if _, ok := pricingVariables[t.text]; !ok {
+			return nil, fmt.Errorf("unknown variable %q at position %d", t.text, t.pos+1)
+		}
+		return variableNode(t.text), nil
+	case tokOp:
+		if t.text == "(" {
+			inner, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos+1)
+}
+
+func (p *exprParser) parseCall(name exprToken, depth int) (exprNode, error) {
+	arity, ok := pricingFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos+1)
+	}
+	var args []exprNode
+	if _, closed := p.accept(")"); !closed {
+		for {
+			arg, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, more := p.accept(","); !more {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if (arity < 0 && len(args) == 0) || (arity >= 0 && len(args) != arity) {
+		return nil, fmt.Errorf("%s() called with %d arguments", name.text, len(args))
+	}
+	return callNode{name: name.text, args: args}, nil
+}
+
+// --- evaluation ---
+
+type exprNode interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) (float64, error) { return float64(n), nil }
+
+type variableNode string
+
+func (n variableNode) eval(vars map[string]float64) (float64, error) {
+	v, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("variable %q has no value", string(n))
+	}
+	return v, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n unaryNode) eval(vars map[string]float64) (float64, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "!" {
+		return boolValue(v == 0), nil
+	}
+	return -v, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(vars map[string]float64) (float64, error) {
+	l, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	// Short-circuit like if(): the other side may not be defined
+	switch {
+	case n.op == "&&" && l == 0:
+		return 0, nil
+	case n.op == "||" && l != 0:
+		return 1, nil
+	}
+	r, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	case "<":
+		return boolValue(l < r), nil
+	case "<=":
+		return boolValue(l <= r), nil
+	case ">":
+		return boolValue(l > r), nil
+	case ">=":
+		return boolValue(l >= r), nil
+	case "==":
+		return boolValue(l == r), nil
+	case "!=":
+		return boolValue(l != r), nil
+	}
+	// && and || with the left side not deciding
+	return boolValue(r != 0), nil
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n callNode) eval(vars map[string]float64) (float64, error) {
+	if n.name == "if" {
+		cond, err := n.args[0].eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return n.args[1].eval(vars)
+		}
+		return n.args[2].eval(vars)
+	}
+
+	values := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		values[i] = v
+	}
+	switch n.name {
+	case "min":
+		return min(values), nil
+	case "max":
+		return max(values), nil
+	case "ceil":
+		return math.Ceil(values[0]), nil
+	case "floor":
+		return math.Floor(values[0]), nil
+	case "round":
+		return math.Round(values[0]), nil
+	case "abs":
+		return math.Abs(values[0]), nil
+	}
+	return 0, fmt.Errorf("unknown function %q", n.name)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testPricingVars = map[string]float64{
+	"cpu_hours": 10, "gb_hours": 200, "vcpus": 4, "hours": 720,
+	"cpu_price": 0.05, "memory_price": 0.01, "disk_gib": 0, "io_gb": 0,
+	"disk_cost": 0, "egress_gb": 0, "network_cost": 0,
+}
+
+func TestPricingExprEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3}, // left associative
+		{"12 / 3 / 2", 2},
+		{"-2 * 3 + 1", -5},
+		{"--2", 2},
+		{"2 + 3 > 4", 1}, // arithmetic before comparison
+		{"1 < 2 && 2 < 1", 0},
+		{"1 > 2 || 3 >= 3", 1},
+		{"0 || 1 && 0", 0}, // && before ||
+		{"!0 + 1", 2},
+		{"!(1 == 1)", 0},
+		{"cpu_hours * cpu_price + gb_hours * memory_price", 2.5},
+		{"if(vcpus > 8, 20, 0) + 1", 1},
+		{"max(25, ceil(hours / 24) * vcpus * 0.1)", 25},
+		{"min(3, vcpus, 7)", 3},
+		{"round(2.5) + floor(1.9) + abs(-1)", 5},
+		{"  .5 * 4  ", 2},
+	}
+	for _, tt := range tests {
+		expr, err := ParsePricingExpr(tt.src)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		got, err := expr.Eval(testPricingVars)
+		if err != nil {
+			t.Errorf("%q: eval: %v", tt.src, err)
+			continue
+		}
+		if !almostEqual(got, tt.want) {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestPricingExprEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"cpu_hours / 0", "division by zero"},
+		{"1 / (vcpus - 4)", "division by zero"},
+		{"disk_cost / disk_gib", "division by zero"},
+	}
+	for _, tt := range tests {
+		expr, err := ParsePricingExpr(tt.src)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.src, err)
+		}
+		if _, err := expr.Eval(testPricingVars); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: err = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+
+	// Only the chosen branch is evaluated
+	expr, _ := ParsePricingExpr("if(disk_gib > 0, disk_cost / disk_gib, 0)")
+	if v, err := expr.Eval(testPricingVars); err != nil || v != 0 {
+		t.Errorf("guarded division = %v, %v", v, err)
+	}
+	expr, _ = ParsePricingExpr("disk_gib > 0 && 1 / disk_gib")
+	if v, err := expr.Eval(testPricingVars); err != nil || v != 0 {
+		t.Errorf("short-circuit && = %v, %v", v, err)
+	}
+}
+
+func TestParsePricingExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", "empty expression"},
+		{"cpu_hourz * 2", `unknown variable "cpu_hourz"`},
+		{"exec(1)", `unknown function "exec"`},
+		{"os.Exit", `invalid number "."`},
+		{"ceil(1, 2)", "ceil() called with 2 arguments"},
+		{"max()", "max() called with 0 arguments"},
+		{"if(1, 2)", "if() called with 2 arguments"},
+		{"1 +", "unexpected"},
+		{"(1 + 2", `expected ")"`},
+		{"1 2", `unexpected "2"`},
+		{"1 < 2 < 3", `unexpected "<"`},
+		{"1.2.3", "invalid number"},
+		{"cpu_hours = 1", "unexpected character '='"},
+		{"1 + " + strings.Repeat("1 + ", maxPricingExprLength/4) + "1", "longer than"},
+		{strings.Repeat("(", maxPricingExprDepth+1) + "1" + strings.Repeat(")", maxPricingExprDepth+1), "nested deeper"},
+		{strings.Repeat("abs(", maxPricingExprDepth+1) + "1" + strings.Repeat(")", maxPricingExprDepth+1), "nested deeper"},
+		{strings.Repeat("-", maxPricingExprDepth+1) + "1", "nested deeper"},
+	}
+	for _, tt := range tests {
+		_, err := ParsePricingExpr(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			name := tt.src
+			if len(name) > 40 {
+				name = name[:40] + "…"
+			}
+			t.Errorf("%q: err = %v, want %q", name, err, tt.want)
+		}
+	}
+}
+
+func TestParsePricingExprLimitsAllowed(t *testing.T) {
+	nested := strings.Repeat("(", maxPricingExprDepth) + "1" + strings.Repeat(")", maxPricingExprDepth)
+	if _, err := ParsePricingExpr(nested); err != nil {
+		t.Errorf("nesting of exactly %d: %v", maxPricingExprDepth, err)
+	}
+	long := strings.Repeat("1+", (maxPricingExprLength-1)/2) + "1"
+	if len(long) > maxPricingExprLength {
+		t.Fatalf("test expression is %d characters", len(long))
+	}
+	if _, err := ParsePricingExpr(long); err != nil {
+		t.Errorf("%d characters: %v", len(long), err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Tiered pricing replaces the flat CPU, memory and disk prices with volume
+// tiers, e.g. the first 100 CPU-hours at 0.05 and the rest at 0.04. The tiers
+// are read from PRICING_TIERS_FILE (reloaded with the other files, see
+// config_reload.go):
+//
+//	{
+//	  "cpu":    [{"up_to": 100, "price": 0.05}, {"price": 0.04}],
+//	  "memory": [{"up_to": 1000, "price": 0.01}, {"price": 0.008}],
+//	  "disk":   [{"price": 0.1}]
+//	}
+//
+// Units are CPU-hours, memory GB-hours (average used GB × effective hours, as
+// billed by the flat formula) and provisioned disk GiB-months. up_to is the
+// cumulative upper bound of a tier; the last tier may omit it. Usage above the
+// last bound is billed at the last tier's price. A resource without tiers
+// keeps its flat price.
+
+// PricingTier is one band of a tiered price.
+type PricingTier struct {
+	UpTo  *float64 `json:"up_to,omitempty"` // nil: no upper bound
+	Price float64  `json:"price"`
+}
+
+// PricingConfig holds the tiers per resource, in increasing order of up_to.
+type PricingConfig struct {
+	CPU    []PricingTier `json:"cpu,omitempty"`    // per CPU-hour
+	Memory []PricingTier `json:"memory,omitempty"` // per GB-hour
+	Disk   []PricingTier `json:"disk,omitempty"`   // per provisioned GiB-month
+}
+
+// TierCharge is the usage billed in one tier of a resource.
+type TierCharge struct {
+	Resource string   `json:"resource"` // cpu, memory or disk
+	Tier     int      `json:"tier"`     // index in the resource's tiers
+	UpTo     *float64 `json:"up_to,omitempty"`
+	Quantity float64  `json:"quantity"`
+	Price    float64  `json:"price"`
+	Cost     float64  `json:"cost"`
+}
+
+// loadPricingConfig reads and validates a PRICING_TIERS_FILE. Unknown fields
+// are rejected so a misspelled resource is not silently billed flat.
+func loadPricingConfig(path string) (*PricingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg PricingConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	for name, tiers := range map[string][]PricingTier{"cpu": cfg.CPU, "memory": cfg.Memory, "disk": cfg.Disk} {
+		if err := validatePricingTiers(tiers); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if len(cfg.CPU) == 0 && len(cfg.Memory) == 0 && len(cfg.Disk) == 0 {
+		return nil, errors.New("no tiers for cpu, memory or disk")
+	}
+	return &cfg, nil
+}
+
+// validatePricingTiers checks that prices are not negative, bounds increase
+// and only the last tier is unbounded.
+func validatePricingTiers(tiers []PricingTier) error {
+	prev := 0.0
+	for i, t := range tiers {
+		if t.Price < 0 {
+			return fmt.Errorf("tier %d: negative price", i)
+		}
+		if t.UpTo == nil {
+			if i != len(tiers)-1 {
+				return fmt.Errorf("tier %d: only the last tier may omit up_to", i)
+			}
+			continue
+		}
+		if *t.UpTo <= prev {
+			return fmt.Errorf("tier %d: up_to must be greater than %g", i, prev)
+		}
+		prev = *t.UpTo
+	}
+	return nil
+}
+
+// tieredCost bills quantity through tiers: each tier takes the usage between
+// the previous bound and its own, the last also everything above its bound.
+func tieredCost(resource string, quantity float64, tiers []PricingTier) (float64, []TierCharge) {
+	var (
+		cost    float64
+		charges []TierCharge
+		lower   float64
+	)
+	for i, t := range tiers {
+		if quantity <= lower {
+			break
+		}
+		upper := quantity
+		if t.UpTo != nil && *t.UpTo < quantity && i != len(tiers)-1 {
+			upper = *t.UpTo
+		}
+		q := upper - lower
+		charges = append(charges, TierCharge{Resource: resource, Tier: i, UpTo: t.UpTo, Quantity: q, Price: t.Price, Cost: q * t.Price})
+		cost += q * t.Price
+		lower = upper
+	}
+	return cost, charges
+}
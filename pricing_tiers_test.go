@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func upTo(v float64) *float64 { return &v }
+
+// chargesString renders charges as tier:quantity@price for comparison.
+func chargesString(charges []TierCharge) string {
+	s := ""
+	for _, c := range charges {
+		s += fmt.Sprintf("%s%d:%g@%g ", c.Resource, c.Tier, c.Quantity, c.Price)
+	}
+	return s
+}
+
+func TestTieredCostBoundaries(t *testing.T) {
+	open := []PricingTier{{UpTo: upTo(100), Price: 0.05}, {Price: 0.04}}
+	bounded := []PricingTier{{UpTo: upTo(100), Price: 1}, {UpTo: upTo(200), Price: 0.5}}
+
+	tests := []struct {
+		name     string
+		quantity float64
+		tiers    []PricingTier
+		cost     float64
+		charges  string
+	}{
+		{"nothing used", 0, open, 0, ""},
+		{"inside the first tier", 40, open, 2, "cpu0:40@0.05 "},
+		{"exactly on the first bound", 100, open, 5, "cpu0:100@0.05 "},
+		{"just above the first bound", 100.5, open, 5.02, "cpu0:100@0.05 cpu1:0.5@0.04 "},
+		{"in the open last tier", 300, open, 13, "cpu0:100@0.05 cpu1:200@0.04 "},
+		{"exactly on the top bound", 200, bounded, 150, "cpu0:100@1 cpu1:100@0.5 "},
+		{"above the top bound", 250, bounded, 175, "cpu0:100@1 cpu1:150@0.5 "},
+		{"single bounded tier", 30, []PricingTier{{UpTo: upTo(10), Price: 2}}, 60, "cpu0:30@2 "},
+	}
+	for _, tt := range tests {
+		cost, charges := tieredCost("cpu", tt.quantity, tt.tiers)
+		if !almostEqual(cost, tt.cost) {
+			t.Errorf("%s: cost %v, want %v", tt.name, cost, tt.cost)
+		}
+		if got := chargesString(charges); got != tt.charges {
+			t.Errorf("%s: charges %q, want %q", tt.name, got, tt.charges)
+		}
+	}
+}
+
+func TestApplyTieredPricing(t *testing.T) {
+	report := BillingReport{
+		StartDate: "2026-01-01T00:00:00",
+		EndDate:   "2026-01-31T00:00:00",
+		FirstSeen: "2026-01-01T00:00:00Z", EffectiveHours: 720,
+		CPUUsage: CPUUsageStats{UsageByDay: []DailyUsage{{TotalCPUHours: 60}, {TotalCPUHours: 40}}},
+		// 2 GB × 720 h = 1440 GB-hours
+		MemoryUsage: MemoryUsageStats{AverageUsedMB: 2048},
+		// 20 GiB for 720 of 730 hours, plus 10 GB of I/O
+		DiskUsage:       DiskUsageStats{ProvisionedGiB: 20, TotalIOGB: 10},
+		IOPricePerGB:    0.5,
+		CPUPricePerHour: 9, MemoryPricePerGB: 9, DiskPricePerGBMonth: 9,
+		CostByHour: []HourlyCost{{Hour: "2026-01-01T00:00:00Z"}},
+	}
+	cfg := &PricingConfig{
+		CPU:    []PricingTier{{UpTo: upTo(100), Price: 0.05}, {Price: 0.04}},
+		Memory: []PricingTier{{UpTo: upTo(1000), Price: 0.01}, {UpTo: upTo(1200), Price: 0.008}},
+	}
+	ApplyTieredPricing(&report, cfg)
+
+	// CPU exactly on the bound stays in the first tier
+	if !almostEqual(report.CPUCost, 5) || report.CPUPricePerHour != 0 {
+		t.Errorf("cpu cost %v, price %v; want 5, 0", report.CPUCost, report.CPUPricePerHour)
+	}
+	// Memory above the top bound is billed at the top tier's price
+	if !almostEqual(report.MemoryCost, 10+440*0.008) || report.MemoryPricePerGB != 0 {
+		t.Errorf("memory cost %v, price %v", report.MemoryCost, report.MemoryPricePerGB)
+	}
+	if got := chargesString(report.TierCharges); got != "cpu0:100@0.05 memory0:1000@0.01 memory1:440@0.008 " {
+		t.Errorf("charges = %s", got)
+	}
+	// Disk has no tiers and keeps its flat cost fields
+	if report.DiskPricePerGBMonth != 9 {
+		t.Errorf("disk price = %v, want it untouched", report.DiskPricePerGBMonth)
+	}
+	if report.CostByHour != nil {
+		t.Error("flat hourly costs kept")
+	}
+
+	cfg = &PricingConfig{Disk: []PricingTier{{UpTo: upTo(10), Price: 1}, {Price: 0.5}}}
+	ApplyTieredPricing(&report, cfg)
+	gibMonths := 20 * 720 / hoursPerBillingMonth
+	if want := 10 + (gibMonths-10)*0.5 + 10*0.5; !almostEqual(report.DiskCost, want) {
+		t.Errorf("disk cost %v, want %v (tiers plus I/O)", report.DiskCost, want)
+	}
+	if len(report.TierCharges) != 2 || report.TierCharges[0].Resource != "disk" {
+		t.Errorf("charges of the second run = %s", chargesString(report.TierCharges))
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxUsageProjects bounds the project_ids of one POST /usage/projects call.
+const maxUsageProjects = 500
+
+// projectUsageRequest is the body of POST /api/v1/usage/projects.
+type projectUsageRequest struct {
+	ProjectIDs []string `json:"project_ids"`
+	Start      string   `json:"start"` // optional, 2006-01-02T15:04:05
+	End        string   `json:"end"`
+	Breakdown  bool     `json:"breakdown"` // also ?breakdown=true
+}
+
+// ProjectSetUsage is the usage of an explicit set of projects.
+type ProjectSetUsage struct {
+	Timestamp    string                  `json:"timestamp"`
+	Start        string                  `json:"start,omitempty"`
+	End          string                  `json:"end,omitempty"`
+	ProjectIDs   []string                `json:"project_ids"`
+	TotalVMs     int                     `json:"total_vms"`
+	CPUCoresUsed float64                 `json:"cpu_cores_used"`
+	RAMUsedGB    float64                 `json:"ram_used_gb"`
+	Projects     map[string]ProjectUsage `json:"projects,omitempty"` // only with breakdown
+	Errors       []UsageError            `json:"errors,omitempty"`
+}
+
+// parseProjectUsageRequest decodes and validates the request body. Project IDs
+// are trimmed, de-duplicated and sorted.
+func parseProjectUsageRequest(r *http.Request) (projectUsageRequest, error) {
+	var req projectUsageRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	if err := dec.Decode(&req); err != nil {
+		return req, fmt.Errorf("invalid JSON body: %v", err)
+	}
+
+	seen := make(map[string]bool, len(req.ProjectIDs))
+	ids := make([]string, 0, len(req.ProjectIDs))
+	for _, id := range req.ProjectIDs {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return req, fmt.Errorf("project_ids is required")
+	}
+	if len(ids) > maxUsageProjects {
+		return req, fmt.Errorf("at most %d project_ids per request", maxUsageProjects)
+	}
+	sort.Strings(ids)
+	req.ProjectIDs = ids
+
+	var startTime, endTime time.Time
+	var err error
+	if req.Start != "" {
+		if startTime, err = time.Parse("2006-01-02T15:04:05", req.Start); err != nil {
+			return req, fmt.Errorf("invalid start (use 2006-01-02T15:04:05)")
+		}
+	}
+	if req.End != "" {
+		if endTime, err = time.Parse("2006-01-02T15:04:05", req.End); err != nil {
+			return req, fmt.Errorf("invalid end (use 2006-01-02T15:04:05)")
+		}
+	}
+	if req.Start != "" && req.End != "" && !endTime.After(startTime) {
+		return req, fmt.Errorf("end must be after start")
+	}
+
+	if r.URL.Query().Get("breakdown") == "true" {
+		req.Breakdown = true
+	}
+	return req, nil
+}
+
+// POST /api/v1/usage/projects
+// {"project_ids": ["..."], "start": "", "end": "", "breakdown": true}
+//
+// Sums vCPUs and RAM of the instances of exactly these projects, like
+// /usage/total does for domains. Without start/end the latest measures are
+// used; with them, the latest measure inside the window (allocation as of end).
+func getProjectsUsage(w http.ResponseWriter, r *http.Request) {
+	req, err := parseProjectUsageRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.ProjectIDs {
+		if !allowProject(w, r, id) {
+			return
+		}
+	}
+
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+
+	instances, err := gnocchiClient.GetAllInstances()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get instances from Gnocchi", "service", "gnocchi", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to get instances from Gnocchi: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	wanted := make(map[string]bool, len(req.ProjectIDs))
+	for _, id := range req.ProjectIDs {
+		wanted[id] = true
+	}
+	var targets []usageTarget
+	for _, inst := range instances {
+		if wanted[inst.ProjectID] {
+			targets = append(targets, usageTarget{Instance: inst})
+		}
+	}
+	slog.DebugContext(ctx, "Project usage targets", "instances", len(targets), "projects", len(req.ProjectIDs))
+
+	sums := sumInstanceUsage(ctx, gnocchiClient, targets, req.Start, req.End)
+
+	response := ProjectSetUsage{
+		Timestamp:    time.Now().Format(time.RFC3339),
+		Start:        req.Start,
+		End:          req.End,
+		ProjectIDs:   req.ProjectIDs,
+		TotalVMs:     sums.TotalVMs,
+		CPUCoresUsed: sums.CPUCoresUsed,
+		RAMUsedGB:    sums.RAMUsedGB,
+		Errors:       sums.Errors,
+	}
+	if req.Breakdown {
+		// Every requested project is listed, also those without instances
+		response.Projects = make(map[string]ProjectUsage, len(req.ProjectIDs))
+		for _, id := range req.ProjectIDs {
+			if p := sums.ByProject[id]; p != nil {
+				response.Projects[id] = *p
+			} else {
+				response.Projects[id] = ProjectUsage{}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(response.Errors) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	writeJSON(w, response)
+}
+
+// ProjectUsageDetail is the usage of one project, per instance.
+type ProjectUsageDetail struct {
+	Timestamp       string          `json:"timestamp"`
+	ProjectID       string          `json:"project_id"`
+	InBillingDomain bool            `json:"in_billing_domain"`     // project belongs to a DOMAINS_FILE domain
+	DomainName      string          `json:"domain_name,omitempty"` // that domain
+	TotalVMs        int             `json:"total_vms"`
+	CPUCoresUsed    float64         `json:"cpu_cores_used"`
+	RAMUsedGB       float64         `json:"ram_used_gb"`
+	Instances       []InstanceUsage `json:"instances"`
+	Errors          []UsageError    `json:"errors,omitempty"`
+}
+
+// GET /api/v1/usage/project/{project_id}
+//
+// Latest vCPUs and RAM of each instance of the project and the project totals.
+// Any project can be asked for, also one outside DOMAINS_FILE; in_billing_domain
+// tells whether it is billed through a configured domain. Instances are found
+// with a Gnocchi search on project_id rather than the full instance list.
+func getProjectUsage(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["project_id"]
+	if !allowProject(w, r, projectID) {
+		return
+	}
+
+	if clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"GNOCCHI_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+
+	// Instance search dan cek domain billing berjalan bersamaan
+	var (
+		instances  []GnocchiInstance
+		searchErr  error
+		domainName string
+		domainErrs []UsageError
+		wg         sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		instances, searchErr = gnocchiClient.SearchInstancesByProject(projectID)
+	}()
+	go func() {
+		defer wg.Done()
+		domainName, domainErrs = billingDomainOf(ctx, adminToken, projectID)
+	}()
+	wg.Wait()
+
+	if searchErr != nil {
+		slog.ErrorContext(ctx, "Failed to search instances of project", "service", "gnocchi", "project_id", projectID, "error", searchErr)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to search instances in Gnocchi: %v"}`, searchErr), http.StatusBadGateway)
+		return
+	}
+
+	targets := make([]usageTarget, 0, len(instances))
+	for _, inst := range instances {
+		targets = append(targets, usageTarget{Instance: inst, DomainName: domainName})
+	}
+	sums := sumInstanceUsage(ctx, gnocchiClient, targets, "", "")
+
+	response := ProjectUsageDetail{
+		Timestamp:       time.Now().Format(time.RFC3339),
+		ProjectID:       projectID,
+		InBillingDomain: domainName != "",
+		DomainName:      domainName,
+		TotalVMs:        sums.TotalVMs,
+		CPUCoresUsed:    sums.CPUCoresUsed,
+		RAMUsedGB:       sums.RAMUsedGB,
+		Instances:       make([]InstanceUsage, 0, len(sums.ByInstance)),
+		Errors:          append(domainErrs, sums.Errors...),
+	}
+	for _, inst := range sums.ByInstance {
+		response.Instances = append(response.Instances, *inst)
+	}
+	sort.Slice(response.Instances, func(i, j int) bool {
+		return response.Instances[i].InstanceID < response.Instances[j].InstanceID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(response.Errors) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	writeJSON(w, response)
+}
+
+// billingDomainOf returns the DOMAINS_FILE domain the project belongs to, empty
+// when none (or no DOMAINS_FILE). Domain failures are returned as usage errors.
+func billingDomainOf(ctx context.Context, adminToken, projectID string) (string, []UsageError) {
+	projectToDomain, errs := billingDomainProjects(ctx, adminToken)
+	return projectToDomain[projectID], errs
+}
+
+// billingDomainProjects maps the project IDs of every DOMAINS_FILE domain to
+// the domain name; nil without DOMAINS_FILE. Domains are resolved in parallel
+// through the domain cache; failures are returned as usage errors.
+func billingDomainProjects(ctx context.Context, adminToken string) (map[string]string, []UsageError) {
+	domainFile, domainNames, err := fileConfigs.get().domainNames(clusterOf(ctx))
+	if domainFile == "" {
+		return nil, nil
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to load domain list", "file", domainFile, "error", err)
+		return nil, []UsageError{{Error: fmt.Sprintf("failed to load domain list: %v", err)}}
+	}
+
+	var (
+		mu              sync.Mutex
+		wg              sync.WaitGroup
+		projectToDomain = make(map[string]string)
+		errs            []UsageError
+	)
+	for _, domainName := range domainNames {
+		wg.Add(1)
+		go func(domainName string) {
+			defer wg.Done()
+			projects, err := resolveDomainProjects(ctx, adminToken, domainName, policyDefault)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, UsageError{
+					DomainName: domainName,
+					Error:      fmt.Sprintf("failed to list projects for domain: %v", err),
+				})
+				return
+			}
+			for _, p := range projects {
+				projectToDomain[p.ID] = domainName
+			}
+		}(domainName)
+	}
+	wg.Wait()
+	return projectToDomain, errs
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusPool is the set of directly reachable Prometheus servers from
+// PROMETHEUS_URL (comma-separated, e.g. an HA pair). Queries go to the first
+// endpoint that is believed healthy and fail over to the next one on a network
+// error or 5xx. An endpoint that failed is skipped for PROMETHEUS_PROBE_SECONDS,
+// after which it is tried first again.
+type prometheusPool struct {
+	raw           string
+	endpoints     []*promEndpoint
+	probeInterval time.Duration
+}
+
+// promEndpoint is one Prometheus server and its last known state.
+type promEndpoint struct {
+	url string
+
+	mu      sync.Mutex
+	up      bool
+	checked time.Time // zero = never contacted
+	lastErr string
+	served  int64
+}
+
+// PrometheusEndpointStatus is one endpoint as shown in deep health.
+type PrometheusEndpointStatus struct {
+	URL         string `json:"url"`
+	Reachable   bool   `json:"reachable"`
+	LastChecked string `json:"last_checked,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Served      int64  `json:"queries_served"`
+}
+
+var (
+	promPoolMu sync.Mutex
+	promPools  = make(map[string]*prometheusPool) // by PROMETHEUS_URL value
+)
+
+// prometheusPoolFromEnv returns the pool for the current PROMETHEUS_URL, or nil
+// when it is not set.
+func prometheusPoolFromEnv() *prometheusPool {
+	return prometheusPoolFor(os.Getenv("PROMETHEUS_URL"))
+}
+
+// prometheusPoolFor returns the pool for a PROMETHEUS_URL value (one per
+// cluster), or nil when it is empty. Endpoint state survives as long as the
+// value is unchanged.
+func prometheusPoolFor(raw string) *prometheusPool {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+
+	promPoolMu.Lock()
+	defer promPoolMu.Unlock()
+	if pool := promPools[raw]; pool != nil {
+		return pool
+	}
+
+	pool := &prometheusPool{raw: raw, probeInterval: 30 * time.Second}
+	if v, err := strconv.Atoi(getEnv("PROMETHEUS_PROBE_SECONDS", "")); err == nil && v > 0 {
+		pool.probeInterval = time.Duration(v) * time.Second
+	}
+	for _, u := range strings.Split(raw, ",") {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u != "" {
+			pool.endpoints = append(pool.endpoints, &promEndpoint{url: u})
+		}
+	}
+	promPools[raw] = pool
+	return pool
+}
+
+// usable reports whether the endpoint should be tried before the others:
+// it is up, was never contacted, or its failure is older than the probe interval.
+func (e *promEndpoint) usable(probeInterval time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.up || e.checked.IsZero() || time.Since(e.checked) >= probeInterval
+}
+
+func (e *promEndpoint) record(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.checked = time.Now()
+	e.up = err == nil
+	e.lastErr = ""
+	if err != nil {
+		e.lastErr = err.Error()
+	}
+}
+
+func (e *promEndpoint) status() PrometheusEndpointStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := PrometheusEndpointStatus{
+		URL:       e.url,
+		Reachable: e.up,
+		LastError: e.lastErr,
+		Served:    e.served,
+	}
+	if !e.checked.IsZero() {
+		s.LastChecked = e.checked.Format(time.RFC3339)
+	}
+	return s
+}
+
+// order returns the endpoints to try: usable ones in configured order, then the rest
+// (so a query still goes out when every endpoint is marked down).
+func (p *prometheusPool) order() []*promEndpoint {
+	var first, rest []*promEndpoint
+	for _, e := range p.endpoints {
+		if e.usable(p.probeInterval) {
+			first = append(first, e)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	return append(first, rest...)
+}
+
+// Fetch GETs an /api/v1/ path (see promInstantPath / promRangePath) from the
+// first endpoint that answers. A 4xx is the query's fault, not the server's,
+// so it is returned without failing over.
+func (p *prometheusPool) Fetch(apiPath string) ([]byte, error) {
+	var errs []string
+	for i, e := range p.order() {
+		body, status, err := prometheusDirectGet(e.url, apiPath)
+		if err == nil && status >= http.StatusInternalServerError {
+			err = fmt.Errorf("status %d: %.200s", status, string(body))
+		}
+		e.record(err)
+		if err != nil {
+			slog.Warn("Prometheus endpoint failed", "service", "prometheus", "endpoint", redactURL(e.url), "error", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", e.url, err))
+			continue
+		}
+
+		e.mu.Lock()
+		e.served++
+		e.mu.Unlock()
+		metrics.IncCounter("vhi_prometheus_queries_total",
+			"Prometheus queries served, by endpoint.", map[string]string{"endpoint": e.url})
+		if i > 0 {
+			slog.Info("Prometheus query served by failover endpoint", "service", "prometheus", "endpoint", redactURL(e.url))
+		}
+
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("prometheus %s returned status %d: %.200s", e.url, status, string(body))
+		}
+		return body, nil
+	}
+	return nil, fmt.Errorf("all Prometheus endpoints failed: %s", strings.Join(errs, "; "))
+}
+
+// Status returns every endpoint's state. With probe, endpoints whose state is
+// older than the probe interval are checked first via /-/healthy.
+func (p *prometheusPool) Status(probe bool) []PrometheusEndpointStatus {
+	if probe {
+		var wg sync.WaitGroup
+		for _, e := range p.endpoints {
+			e.mu.Lock()
+			stale := e.checked.IsZero() || time.Since(e.checked) >= p.probeInterval
+			e.mu.Unlock()
+			if !stale {
+				continue
+			}
+			wg.Add(1)
+			go func(e *promEndpoint) {
+				defer wg.Done()
+				e.record(probePrometheus(e.url))
+			}(e)
+		}
+		wg.Wait()
+	}
+
+	statuses := make([]PrometheusEndpointStatus, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		statuses = append(statuses, e.status())
+	}
+	return statuses
+}
+
+// prometheusDirectGet GETs baseURL/api/v1/apiPath. Plain HTTP client — Prometheus
+// internal endpoint, no auth or TLS settings needed.
+func prometheusDirectGet(baseURL, apiPath string) ([]byte, int, error) {
+	fullURL := fmt.Sprintf("%s/api/v1/%s", baseURL, apiPath)
+	slog.Debug("Prometheus direct query", "service", "prometheus", "url", redactURL(fullURL))
+
+	client := &http.Client{Transport: prometheusDirectTransport, Timeout: 15 * time.Second}
+	resp, err := client.Get(fullURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("prometheus direct GET failed: %w", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	slog.Debug("Prometheus direct response", "service", "prometheus", "status", resp.StatusCode)
+	return body, resp.StatusCode, nil
+}
+
+// probePrometheus checks a Prometheus server's /-/healthy endpoint.
+func probePrometheus(baseURL string) error {
+	client := &http.Client{Transport: prometheusDirectTransport, Timeout: 5 * time.Second}
+	resp, err := client.Get(baseURL + "/-/healthy")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health probe returned status %d", resp.StatusCode)
+	}
+	return nil
+}
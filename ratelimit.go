@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -82,7 +82,7 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 	}
 
 	limiter := newIPRateLimiter(rate.Limit(rps), burst)
-	log.Printf("Rate limiter enabled: %.1f req/s, burst %d per IP", rps, burst)
+	slog.Info("Rate limiter enabled", "rps", rps, "burst", burst)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := r.RemoteAddr
@@ -92,7 +92,7 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 		}
 
 		if !limiter.getLimiter(ip).Allow() {
-			log.Printf("Rate limit exceeded for IP: %s", ip)
+			slog.WarnContext(r.Context(), "Rate limit exceeded", "ip", ip)
 			w.Header().Set("Retry-After", "1")
 			http.Error(w, `{"error":"rate limit exceeded"}`, http.StatusTooManyRequests)
 			return
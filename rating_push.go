@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// Rating push: per-instance usage of a period is transformed into records of
+// an external rating/billing system (CloudKitty-style) and POSTed to it in
+// batches. RATING_PUSH_CONFIG names the YAML mapping file, validated at
+// startup; unknown keys are errors (see rating-push.example.yaml):
+//
+//	url: https://rating.example.com/v1/usage
+//	auth: {type: bearer, token_env: RATING_PUSH_TOKEN}
+//	schedule: "0 4 1 * *"
+//	batch_size: 200
+//	metrics:
+//	  - {source: vcpu_hours, name: instance.vcpu, unit: vcpu*hour}
+//	  - {source: memory_gb_hours, name: instance.memory, unit: MiB*hour, factor: 1024}
+//	field_names: {quantity: qty, resource_id: resource}
+//	static_fields: {region: jakarta-1}
+//
+// Files ending in .json are read as JSON, as before.
+//
+// Each instance yields one record per metric. Record IDs are deterministic
+// (cluster, instance, metric, period), and the delivery state of every record
+// is kept in Redis, so a retry or a second push of the same period never sends
+// an accepted record again. Since an accepted record is never updated, only
+// periods that ended settle_minutes ago (default 120, Gnocchi's late measures)
+// are pushed, and one push per cluster and period runs at a time
+// (rating_push_lock:<period>). The receiver answers 2xx, optionally with
+// {"rejected":[{"id":"...","reason":"..."}]}; 4xx rejects the whole batch;
+// 5xx, 408, 429 and network errors are retried. Every run records a
+// reconciliation summary (sent, accepted, rejected with reasons), readable at
+// GET /api/v1/admin/billing/push/runs.
+
+// ratingMetricSources are the usage values a metric mapping can take.
+var ratingMetricSources = map[string]func(item InvoiceLineItem, hours float64) float64{
+	"cpu_hours":       func(i InvoiceLineItem, _ float64) float64 { return i.CPUHours },
+	"vcpu_hours":      func(i InvoiceLineItem, h float64) float64 { return float64(i.VCPUs) * h },
+	"memory_gb_hours": func(i InvoiceLineItem, _ float64) float64 { return i.MemoryGBHours },
+	"usage_cost":      func(i InvoiceLineItem, _ float64) float64 { return i.UsageCost },
+	"total_cost":      func(i InvoiceLineItem, _ float64) float64 { return i.TotalCost },
+}
+
+// ratingRecordFields are the standard record fields; field_names may rename them.
+var ratingRecordFields = []string{
+	"id", "resource_id", "resource_name", "flavor_name", "project_id",
+	"metric", "unit", "quantity", "period_start", "period_end",
+}
+
+// RatingMetric maps one usage value onto a metric of the external system.
+type RatingMetric struct {
+	Source string  `json:"source" yaml:"source"` // see ratingMetricSources
+	Name   string  `json:"name" yaml:"name"`
+	Unit   string  `json:"unit" yaml:"unit"`
+	Factor float64 `json:"factor" yaml:"factor"` // multiplies the value (default 1)
+}
+
+// RatingAuth is how the push authenticates. Secrets are read from the named
+// environment variables, never from the mapping file.
+type RatingAuth struct {
+	Type        string `json:"type" yaml:"type"` // none, bearer, basic, header
+	TokenEnv    string `json:"token_env" yaml:"token_env"`
+	Username    string `json:"username" yaml:"username"`
+	PasswordEnv string `json:"password_env" yaml:"password_env"`
+	Header      string `json:"header" yaml:"header"` // for type header, e.g. X-Api-Key
+}
+
+// RatingPushConfig is the mapping file.
+type RatingPushConfig struct {
+	URL            string            `json:"url" yaml:"url"`
+	Auth           RatingAuth        `json:"auth" yaml:"auth"`
+	Schedule       string            `json:"schedule" yaml:"schedule"` // optional cron, pushes the previous month
+	BatchSize      int               `json:"batch_size" yaml:"batch_size"`
+	BatchKey       string            `json:"batch_key" yaml:"batch_key"` // body is {"<batch_key>": [records]}, default "records"
+	TimeoutSeconds int               `json:"timeout_seconds" yaml:"timeout_seconds"`
+	Retries        int               `json:"retries" yaml:"retries"`
+	SettleMinutes  int               `json:"settle_minutes" yaml:"settle_minutes"` // periods must have ended this long ago
+	Metrics        []RatingMetric    `json:"metrics" yaml:"metrics"`
+	FieldNames     map[string]string `json:"field_names" yaml:"field_names"`
+	StaticFields   map[string]string `json:"static_fields" yaml:"static_fields"`
+}
+
+// loadRatingPushConfig reads and validates the mapping file.
+func loadRatingPushConfig(path string) (*RatingPushConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg RatingPushConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an http(s) URL")
+	}
+	switch cfg.Auth.Type {
+	case "", "none":
+	case "bearer", "header":
+		if cfg.Auth.TokenEnv == "" || os.Getenv(cfg.Auth.TokenEnv) == "" {
+			return nil, fmt.Errorf("auth.token_env must name a set environment variable")
+		}
+		if cfg.Auth.Type == "header" && cfg.Auth.Header == "" {
+			return nil, fmt.Errorf("auth.header is required for auth type header")
+		}
+	case "basic":
+		if cfg.Auth.Username == "" || cfg.Auth.PasswordEnv == "" || os.Getenv(cfg.Auth.PasswordEnv) == "" {
+			return nil, fmt.Errorf("basic auth needs auth.username and auth.password_env naming a set environment variable")
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth.type %q (none, bearer, basic, header)", cfg.Auth.Type)
+	}
+	if cfg.Schedule != "" {
+		if _, err := parseCron(cfg.Schedule); err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+	}
+	if len(cfg.Metrics) == 0 {
+		return nil, fmt.Errorf("metrics must map at least one source")
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.Metrics {
+		m := &cfg.Metrics[i]
+		if _, ok := ratingMetricSources[m.Source]; !ok {
+			return nil, fmt.Errorf("metrics[%d]: unknown source %q (cpu_hours, vcpu_hours, memory_gb_hours, usage_cost, total_cost)", i, m.Source)
+		}
+		if m.Name == "" {
+			return nil, fmt.Errorf("metrics[%d]: name is required", i)
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("metrics[%d]: name %q is mapped twice", i, m.Name)
+		}
+		seen[m.Name] = true
+		if m.Factor == 0 {
+			m.Factor = 1
+		}
+	}
+	standard := make(map[string]bool)
+	for _, f := range ratingRecordFields {
+		standard[f] = true
+	}
+	for field, name := range cfg.FieldNames {
+		if !standard[field] {
+			return nil, fmt.Errorf("field_names: unknown field %q", field)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("field_names: %q is renamed to an empty name", field)
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 200
+	}
+	if cfg.BatchKey == "" {
+		cfg.BatchKey = "records"
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 30
+	}
+	if cfg.Retries < 0 {
+		return nil, fmt.Errorf("retries must not be negative")
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = 3
+	}
+	if cfg.SettleMinutes < 0 {
+		return nil, fmt.Errorf("settle_minutes must not be negative")
+	}
+	if cfg.SettleMinutes == 0 {
+		cfg.SettleMinutes = 120
+	}
+	return &cfg, nil
+}
+
+// settle is how long after its end a period may be pushed.
+func (cfg *RatingPushConfig) settle() time.Duration {
+	return time.Duration(cfg.SettleMinutes) * time.Minute
+}
+
+const (
+	ratingPushStateKeyPrefix = "rating_push_state:" // + period, per cluster: record ID -> state
+	ratingPushRunKeyPrefix   = "rating_push_run:"   // + run ID
+	ratingPushRunsKey        = "rating_push_runs"   // latest run IDs
+	ratingPushClaimKeyPrefix = "rating_push_claim:" // + period, per cluster (schedule)
+	ratingPushLockKeyPrefix  = "rating_push_lock:"  // + period, per cluster; the running push
+)
+
+const (
+	ratingPushStateTTL  = 400 * 24 * time.Hour // a year of periods can be re-pushed safely
+	ratingPushRunTTL    = 30 * 24 * time.Hour
+	ratingPushLockTTL   = time.Hour // past push's 30 minute timeout
+	ratingPushRunsKept  = 50
+	ratingRejectionsMax = 100 // rejections listed per run
+)
+
+// Rating push run states.
+const (
+	ratingPushRunning = "running"
+	ratingPushDone    = "done"
+	ratingPushFailed  = "failed"
+)
+
+// RatingRejection is one record the receiver refused.
+type RatingRejection struct {
+	RecordID   string `json:"record_id"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Metric     string `json:"metric,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// RatingPushRun is the reconciliation summary of one push.
+type RatingPushRun struct {
+	ID         string            `json:"id"`
+	Cluster    string            `json:"cluster"`
+	Trigger    string            `json:"trigger"` // api, schedule
+	Status     string            `json:"status"`  // running, done, failed
+	StartDate  string            `json:"start_date"`
+	EndDate    string            `json:"end_date"`
+	Period     string            `json:"period"`
+	StartedAt  string            `json:"started_at"`
+	FinishedAt string            `json:"finished_at,omitempty"`
+	Records    int               `json:"records"`    // records for the period
+	Skipped    int               `json:"skipped"`    // accepted by an earlier run, not sent
+	Sent       int               `json:"sent"`       // sent in this run
+	Accepted   int               `json:"accepted"`   // accepted in this run
+	Rejected   int               `json:"rejected"`   // rejected in this run
+	Failed     int               `json:"failed"`     // not delivered (retried by the next push)
+	Rejections []RatingRejection `json:"rejections"` // first ratingRejectionsMax
+	Error      string            `json:"error,omitempty"`
+}
+
+// ratingPusher pushes rating records with one config.
+type ratingPusher struct {
+	cfg      *RatingPushConfig
+	schedule *cronSchedule // nil without a schedule
+	client   *http.Client
+	mu       sync.Mutex // one run at a time per replica
+}
+
+// ratingPush is the process-wide pusher, nil when RATING_PUSH_CONFIG is unset.
+var ratingPush *ratingPusher
+
+// newRatingPusherFromEnv loads RATING_PUSH_CONFIG; an invalid file is fatal.
+func newRatingPusherFromEnv() *ratingPusher {
+	path := getEnv("RATING_PUSH_CONFIG", "")
+	if path == "" {
+		return nil
+	}
+	cfg, err := loadRatingPushConfig(path)
+	if err != nil {
+		fatal("RATING_PUSH_CONFIG is invalid", "file", path, "error", err)
+	}
+	p := &ratingPusher{cfg: cfg, client: &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second}}
+	if cfg.Schedule != "" {
+		p.schedule, _ = parseCron(cfg.Schedule) // validated by loadRatingPushConfig
+	}
+	slog.Info("Rating push enabled", "url", redactURL(cfg.URL), "metrics", len(cfg.Metrics), "schedule", cfg.Schedule)
+	if redisClient == nil {
+		slog.Warn("Rating push needs Redis for delivery state; pushes will fail until REDIS_HOST is configured")
+	}
+	return p
+}
+
+// Start runs the scheduled pushes, if the config has a schedule.
+func (p *ratingPusher) Start() {
+	if p.schedule != nil {
+		go p.loop()
+	}
+}
+
+// loop pushes the previous calendar month (UTC) of every cluster on schedule.
+func (p *ratingPusher) loop() {
+	for {
+		next := p.schedule.Next(time.Now().UTC())
+		if next.IsZero() {
+			slog.Error("Rating push schedule never fires")
+			return
+		}
+		time.Sleep(time.Until(next))
+		start := time.Date(next.Year(), next.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+		startDate := start.Format("2006-01-02T15:04:05")
+		end := start.AddDate(0, 1, 0).Add(-time.Second)
+		endDate := end.Format("2006-01-02T15:04:05")
+		// A schedule early on the 1st waits for the month to settle
+		time.Sleep(time.Until(end.Add(p.cfg.settle())))
+		period := exportPeriod(startDate, endDate)
+		for _, cluster := range clusters {
+			if !claimRatingPush(cluster, period) {
+				continue
+			}
+			if locked, err := lockRatingPush(cluster, period); err != nil || !locked {
+				slog.Warn("Rating push of the period already running, skipping the scheduled one", "cluster", cluster.Name,
+					"period", period, "error", err)
+				continue
+			}
+			run, err := p.newRun(cluster, "schedule", startDate, endDate)
+			if err != nil {
+				slog.Error("Rating push: failed to start run", "cluster", cluster.Name, "error", err)
+				unlockRatingPush(cluster, period)
+				continue
+			}
+			p.execute(cluster, run)
+		}
+	}
+}
+
+// claimRatingPush lets one replica run the scheduled push of a period.
+func claimRatingPush(cluster *Cluster, period string) bool {
+	if redisClient == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ok, err := redisClient.SetNX(ctx, redisKey(cluster.key(ratingPushClaimKeyPrefix+period)), time.Now().UTC().Format(time.RFC3339), ratingPushRunTTL).Result()
+	if err != nil {
+		slog.Error("Rating push claim failed", "service", "redis", "period", period, "error", err)
+		return false
+	}
+	return ok
+}
+
+// lockRatingPush takes the lock of the running push of a period, shared by
+// the replicas; execute releases it.
+func lockRatingPush(cluster *Cluster, period string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return redisClient.SetNX(ctx, redisKey(cluster.key(ratingPushLockKeyPrefix+period)), time.Now().UTC().Format(time.RFC3339), ratingPushLockTTL).Result()
+}
+
+func unlockRatingPush(cluster *Cluster, period string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := redisClient.Del(ctx, redisKey(cluster.key(ratingPushLockKeyPrefix+period))).Err(); err != nil {
+		slog.Warn("Rating push lock release failed, it expires on its own", "service", "redis", "period", period, "error", err)
+	}
+}
+
+// newRun creates and stores a running run.
+func (p *ratingPusher) newRun(cluster *Cluster, trigger, startDate, endDate string) (*RatingPushRun, error) {
+	id, err := newBillingJobID()
+	if err != nil {
+		return nil, err
+	}
+	run := &RatingPushRun{
+		ID:         id,
+		Cluster:    cluster.Name,
+		Trigger:    trigger,
+		Status:     ratingPushRunning,
+		StartDate:  startDate,
+		EndDate:    endDate,
+		Period:     exportPeriod(startDate, endDate),
+		StartedAt:  time.Now().Format(time.RFC3339),
+		Rejections: []RatingRejection{},
+	}
+	if err := saveRatingPushRun(run); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	redisClient.LPush(ctx, redisKey(ratingPushRunsKey), id)
+	redisClient.LTrim(ctx, redisKey(ratingPushRunsKey), 0, ratingPushRunsKept-1)
+	return run, nil
+}
+
+func saveRatingPushRun(run *RatingPushRun) error {
+	if redisClient == nil {
+		return errors.New("rating push requires Redis (REDIS_HOST)")
+	}
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return redisClient.Set(ctx, redisKey(ratingPushRunKeyPrefix+run.ID), data, ratingPushRunTTL).Err()
+}
+
+// ratingRecord is one record to send, with what the summary needs.
+type ratingRecord struct {
+	id         string
+	instanceID string
+	metric     string
+	body       map[string]interface{}
+}
+
+// execute runs a push to the end, stores its summary and releases the lock
+// of the period (lockRatingPush).
+func (p *ratingPusher) execute(cluster *Cluster, run *RatingPushRun) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer unlockRatingPush(cluster, run.Period)
+
+	err := p.push(cluster, run)
+	run.FinishedAt = time.Now().Format(time.RFC3339)
+	run.Status = ratingPushDone
+	if err != nil {
+		run.Status = ratingPushFailed
+		run.Error = err.Error()
+		slog.Error("Rating push failed", "run_id", run.ID, "cluster", cluster.Name, "period", run.Period, "error", err)
+	} else {
+		slog.Info("Rating push done", "run_id", run.ID, "cluster", cluster.Name, "period", run.Period,
+			"records", run.Records, "sent", run.Sent, "accepted", run.Accepted, "rejected", run.Rejected,
+			"skipped", run.Skipped, "failed", run.Failed)
+	}
+	if err := saveRatingPushRun(run); err != nil {
+		slog.Warn("Failed to save rating push run", "run_id", run.ID, "error", err)
+	}
+	for result, n := range map[string]int{"accepted": run.Accepted, "rejected": run.Rejected, "failed": run.Failed, "skipped": run.Skipped} {
+		if n > 0 {
+			metrics.AddCounter("vhi_rating_push_records_total",
+				"Rating push records by result (accepted, rejected, failed, skipped).",
+				map[string]string{"result": result}, float64(n))
+		}
+	}
+}
+
+// push bills the cluster's instances for the run's period and delivers the
+// records that were not accepted before.
+func (p *ratingPusher) push(cluster *Cluster, run *RatingPushRun) error {
+	ctx, cancel := context.WithTimeout(withCluster(context.Background(), cluster), 30*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate admin: %w", err)
+	}
+	client := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  cluster.env("GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+	})
+	instances, err := client.GetAllInstances()
+	if err != nil {
+		return fmt.Errorf("Gnocchi instances failed: %w", err)
+	}
+	instances = instancesActiveSince(instances, run.StartDate)
+	projectOf := make(map[string]string, len(instances))
+	for _, inst := range instances {
+		projectOf[inst.ID] = inst.ProjectID
+	}
+	// Prices don't matter for the usage sources; the cost sources are priced like
+	// /billing/report without price parameters: defaults, tiers and the default
+	// pricing expression
+	cfg := fileConfigs.get()
+	expr, err := cfg.pricingExpr()
+	if err != nil {
+		return fmt.Errorf("invalid default pricing expression: %w", err)
+	}
+	pricing := ReportPricing{Tiers: cfg.tiers, Expr: expr}
+	reports, err := billInstances(client, instances, run.StartDate, run.EndDate, 0.05, 0.01, pricing, nil)
+	if err != nil {
+		return err
+	}
+
+	records := p.buildRecords(cluster, run, reports, projectOf)
+	run.Records = len(records)
+
+	stateKey := redisKey(cluster.key(ratingPushStateKeyPrefix + run.Period))
+	states, err := redisClient.HGetAll(ctx, stateKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to read delivery state: %w", err)
+	}
+	var pending []ratingRecord
+	for _, rec := range records {
+		if states[rec.id] == "accepted" {
+			run.Skipped++
+			continue
+		}
+		pending = append(pending, rec)
+	}
+
+	for i := 0; i < len(pending); i += p.cfg.BatchSize {
+		end := i + p.cfg.BatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[i:end]
+		rejected, err := p.sendBatch(ctx, batch)
+		if err != nil {
+			// Not delivered; the records stay pending for the next push
+			run.Failed += len(pending) - i
+			return err
+		}
+		run.Sent += len(batch)
+
+		update := make(map[string]interface{}, len(batch))
+		for _, rec := range batch {
+			reason, isRejected := rejected[rec.id]
+			if !isRejected {
+				run.Accepted++
+				update[rec.id] = "accepted"
+				continue
+			}
+			run.Rejected++
+			update[rec.id] = "rejected: " + reason
+			if len(run.Rejections) < ratingRejectionsMax {
+				run.Rejections = append(run.Rejections, RatingRejection{
+					RecordID: rec.id, InstanceID: rec.instanceID, Metric: rec.metric, Reason: reason,
+				})
+			}
+		}
+		// Recorded before the next batch, so a crash never re-sends accepted records
+		if err := redisClient.HSet(ctx, stateKey, update).Err(); err != nil {
+			return fmt.Errorf("failed to record delivery state: %w", err)
+		}
+		redisClient.Expire(ctx, stateKey, ratingPushStateTTL)
+		if err := saveRatingPushRun(run); err != nil {
+			slog.Warn("Failed to save rating push run", "run_id", run.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// buildRecords maps every report onto one record per configured metric.
+func (p *ratingPusher) buildRecords(cluster *Cluster, run *RatingPushRun, reports []BillingReport, projectOf map[string]string) []ratingRecord {
+	name := func(field string) string {
+		if n, ok := p.cfg.FieldNames[field]; ok {
+			return n
+		}
+		return field
+	}
+
+	var records []ratingRecord
+	for _, report := range reports {
+		item := newInvoiceLineItem(report)
+		// Same period hours as the invoice's memory GB-hours
+		hours := CalculateCPUBilling(report.CPUUsage, report.StartDate, report.EndDate).BillingPeriodHours
+		for _, m := range p.cfg.Metrics {
+			id := sha256Hex([]byte(cluster.Name + "|" + report.InstanceID + "|" + m.Name + "|" + run.Period))[:32]
+			body := make(map[string]interface{}, len(ratingRecordFields)+len(p.cfg.StaticFields))
+			for k, v := range p.cfg.StaticFields {
+				body[k] = v
+			}
+			body[name("id")] = id
+			body[name("resource_id")] = report.InstanceID
+			body[name("resource_name")] = report.InstanceName
+			body[name("flavor_name")] = report.FlavorName
+			body[name("project_id")] = projectOf[report.InstanceID]
+			body[name("metric")] = m.Name
+			body[name("unit")] = m.Unit
+			body[name("quantity")] = ratingMetricSources[m.Source](item, hours) * m.Factor
+			body[name("period_start")] = item.PeriodStart
+			body[name("period_end")] = item.PeriodEnd
+			records = append(records, ratingRecord{id: id, instanceID: report.InstanceID, metric: m.Name, body: body})
+		}
+	}
+	return records
+}
+
+// sendBatch POSTs a batch, retrying transient failures. It returns the
+// rejected record IDs with their reason; err means nothing was delivered.
+func (p *ratingPusher) sendBatch(ctx context.Context, batch []ratingRecord) (map[string]string, error) {
+	bodies := make([]map[string]interface{}, len(batch))
+	ids := make([]string, len(batch))
+	for i, rec := range batch {
+		bodies[i] = rec.body
+		ids[i] = rec.id
+	}
+	payload, err := json.Marshal(map[string]interface{}{p.cfg.BatchKey: bodies})
+	if err != nil {
+		return nil, err
+	}
+	// Same batch, same key: a receiver that de-duplicates can drop a resend
+	sort.Strings(ids)
+	idempotencyKey := sha256Hex([]byte(strings.Join(ids, ",")))
+
+	var lastErr error
+	for attempt := 0; attempt <= p.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(1<<attempt) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		rejected, retry, err := p.post(ctx, payload, idempotencyKey, ids)
+		if err == nil {
+			return rejected, nil
+		}
+		lastErr = err
+		slog.Warn("Rating push batch failed", "service", "rating", "attempt", attempt+1, "records", len(batch), "error", err)
+		if !retry {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// post sends one request. A 4xx other than 408/429 rejects every record of
+// the batch (no error); retry tells whether err is worth retrying.
+func (p *ratingPusher) post(ctx context.Context, payload []byte, idempotencyKey string, ids []string) (rejected map[string]string, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	switch p.cfg.Auth.Type {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+os.Getenv(p.cfg.Auth.TokenEnv))
+	case "header":
+		req.Header.Set(p.cfg.Auth.Header, os.Getenv(p.cfg.Auth.TokenEnv))
+	case "basic":
+		req.SetBasicAuth(p.cfg.Auth.Username, os.Getenv(p.cfg.Auth.PasswordEnv))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		var result struct {
+			Rejected []struct {
+				ID     string `json:"id"`
+				Reason string `json:"reason"`
+			} `json:"rejected"`
+		}
+		rejected = make(map[string]string)
+		if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &result) == nil {
+			for _, r := range result.Rejected {
+				rejected[r.ID] = r.Reason
+			}
+		}
+		return rejected, false, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, false, fmt.Errorf("receiver refused the credentials (status %d)", resp.StatusCode)
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	reason := fmt.Sprintf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	if len(reason) > 300 {
+		reason = reason[:300]
+	}
+	rejected = make(map[string]string, len(ids))
+	for _, id := range ids {
+		rejected[id] = reason
+	}
+	return rejected, false, nil
+}
+
+// POST /api/v1/admin/billing/push?start_date=...&end_date=...
+// Pushes the period (default: the previous calendar month) of ?cluster= in
+// the background; answers 202 with the run, see GET .../push/runs/{id}. A
+// period that ended less than settle_minutes ago is refused (422), as is one
+// being pushed already (409).
+func postRatingPush(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if ratingPush == nil {
+		http.Error(w, `{"error":"rating push is not configured (RATING_PUSH_CONFIG)"}`, http.StatusServiceUnavailable)
+		return
+	}
+	if !cacheEnabled() {
+		http.Error(w, `{"error":"rating push requires Redis (REDIS_HOST), which is not configured or unreachable"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	q := r.URL.Query()
+	startDate, endDate := q.Get("start_date"), q.Get("end_date")
+	if startDate == "" || endDate == "" {
+		now := time.Now()
+		startDate = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02T15:04:05")
+		endDate = time.Date(now.Year(), now.Month(), 0, 23, 59, 59, 0, time.UTC).Format("2006-01-02T15:04:05")
+	}
+	start, err1 := time.Parse("2006-01-02T15:04:05", startDate)
+	end, err2 := time.Parse("2006-01-02T15:04:05", endDate)
+	if err1 != nil || err2 != nil || !end.After(start) {
+		http.Error(w, `{"error":"start_date and end_date must be 2006-01-02T15:04:05 with end after start"}`, http.StatusBadRequest)
+		return
+	}
+	if settled := end.Add(ratingPush.cfg.settle()); settled.After(time.Now()) {
+		http.Error(w, fmt.Sprintf(`{"error":"the period can be pushed from %s, once its usage has settled (settle_minutes)"}`,
+			settled.UTC().Format(time.RFC3339)), http.StatusUnprocessableEntity)
+		return
+	}
+
+	cluster := clusterOf(r.Context())
+	period := exportPeriod(startDate, endDate)
+	locked, err := lockRatingPush(cluster, period)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Rating push lock failed", "service", "redis", "period", period, "error", err)
+		http.Error(w, `{"error":"failed to lock the rating push period"}`, http.StatusBadGateway)
+		return
+	}
+	if !locked {
+		http.Error(w, `{"error":"a rating push of this period is already running"}`, http.StatusConflict)
+		return
+	}
+	run, err := ratingPush.newRun(cluster, "api", startDate, endDate)
+	if err != nil {
+		unlockRatingPush(cluster, period)
+		slog.ErrorContext(r.Context(), "Failed to create rating push run", "error", err)
+		http.Error(w, `{"error":"failed to create rating push run"}`, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Rating push started", "run_id", run.ID, "cluster", cluster.Name, "period", run.Period,
+		"token_label", tokenLabel(r))
+	go ratingPush.execute(cluster, run)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/admin/billing/push/runs/"+run.ID)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, run)
+}
+
+// GET /api/v1/admin/billing/push/runs (latest first, without the rejection list)
+func getRatingPushRuns(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if !cacheEnabled() {
+		http.Error(w, `{"error":"rating push requires Redis (REDIS_HOST), which is not configured or unreachable"}`, http.StatusServiceUnavailable)
+		return
+	}
+	ids, err := redisClient.LRange(r.Context(), redisKey(ratingPushRunsKey), 0, -1).Result()
+	if err != nil {
+		http.Error(w, `{"error":"failed to read rating push runs"}`, http.StatusBadGateway)
+		return
+	}
+	runs := make([]RatingPushRun, 0, len(ids))
+	for _, id := range ids {
+		var run RatingPushRun
+		if ok, err := loadRatingPushRun(id, &run); err != nil || !ok {
+			continue
+		}
+		run.Rejections = nil
+		runs = append(runs, run)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, map[string]interface{}{"runs": runs})
+}
+
+// GET /api/v1/admin/billing/push/runs/{id}
+func getRatingPushRun(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if !cacheEnabled() {
+		http.Error(w, `{"error":"rating push requires Redis (REDIS_HOST), which is not configured or unreachable"}`, http.StatusServiceUnavailable)
+		return
+	}
+	var run RatingPushRun
+	ok, err := loadRatingPushRun(mux.Vars(r)["id"], &run)
+	if err != nil {
+		http.Error(w, `{"error":"failed to read rating push run"}`, http.StatusBadGateway)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"error":"rating push run not found or expired"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, run)
+}
+
+func loadRatingPushRun(id string, dest *RatingPushRun) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	data, err := redisGet(ctx, ratingPushRunKeyPrefix+id)
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, dest)
+}
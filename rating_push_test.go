@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRatingConfig writes content to a temporary file called name.
+func writeRatingConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRatingPushConfigExample(t *testing.T) {
+	t.Setenv("RATING_PUSH_TOKEN", "secret")
+	cfg, err := loadRatingPushConfig("rating-push.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URL != "https://rating.example.com/v1/usage" || cfg.Auth.Type != "bearer" || cfg.Auth.TokenEnv != "RATING_PUSH_TOKEN" {
+		t.Errorf("url/auth = %s %+v", cfg.URL, cfg.Auth)
+	}
+	if cfg.Schedule != "0 4 1 * *" || cfg.BatchSize != 200 || cfg.BatchKey != "records" || cfg.Retries != 3 {
+		t.Errorf("schedule %q, batch %d/%s, retries %d", cfg.Schedule, cfg.BatchSize, cfg.BatchKey, cfg.Retries)
+	}
+	if len(cfg.Metrics) != 2 || cfg.Metrics[0].Factor != 1 || cfg.Metrics[1].Factor != 1024 {
+		t.Errorf("metrics = %+v", cfg.Metrics)
+	}
+	if cfg.FieldNames["quantity"] != "qty" || cfg.StaticFields["region"] != "jakarta-1" {
+		t.Errorf("field_names %v, static_fields %v", cfg.FieldNames, cfg.StaticFields)
+	}
+}
+
+func TestLoadRatingPushConfigDefaults(t *testing.T) {
+	path := writeRatingConfig(t, "push.yml", `
+url: http://rating:8080/usage
+metrics:
+  - {source: cpu_hours, name: cpu}
+`)
+	cfg, err := loadRatingPushConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BatchSize != 200 || cfg.BatchKey != "records" || cfg.TimeoutSeconds != 30 || cfg.Retries != 3 || cfg.Metrics[0].Factor != 1 ||
+		cfg.SettleMinutes != 120 {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+}
+
+func TestLoadRatingPushConfigJSON(t *testing.T) {
+	path := writeRatingConfig(t, "push.json", `{"url": "https://rating/usage", "metrics": [{"source": "total_cost", "name": "cost"}]}`)
+	if _, err := loadRatingPushConfig(path); err != nil {
+		t.Errorf("JSON config: %v", err)
+	}
+	path = writeRatingConfig(t, "typo.json", `{"url": "https://rating/usage", "metric": []}`)
+	if _, err := loadRatingPushConfig(path); err == nil {
+		t.Error("unknown JSON key accepted")
+	}
+}
+
+func TestLoadRatingPushConfigInvalid(t *testing.T) {
+	t.Setenv("RATING_PUSH_TOKEN", "")
+	valid := "url: https://rating/usage\nmetrics:\n  - {source: cpu_hours, name: cpu}\n"
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", valid + "batchsize: 10\n", "field batchsize not found"},
+		{"unknown nested key", valid + "auth: {type: bearer, token: abc}\n", "field token not found"},
+		{"not YAML", "url: [", "parse"},
+		{"bad url", "url: ftp://rating\nmetrics:\n  - {source: cpu_hours, name: cpu}\n", "url must be an http(s) URL"},
+		{"no metrics", "url: https://rating/usage\n", "metrics must map at least one source"},
+		{"unknown source", "url: https://rating/usage\nmetrics:\n  - {source: gpu_hours, name: gpu}\n", `unknown source "gpu_hours"`},
+		{"duplicate metric", valid + "  - {source: vcpu_hours, name: cpu}\n", `name "cpu" is mapped twice`},
+		{"unset token", valid + "auth: {type: bearer, token_env: RATING_PUSH_TOKEN}\n", "auth.token_env"},
+		{"bad schedule", valid + "schedule: every day\n", "schedule"},
+		{"unknown field rename", valid + "field_names: {price: cost}\n", `unknown field "price"`},
+		{"negative retries", valid + "retries: -1\n", "retries must not be negative"},
+		{"negative settle", valid + "settle_minutes: -5\n", "settle_minutes must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadRatingPushConfig(writeRatingConfig(t, "push.yaml", tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostRatingPushRefusesUnsettledAndRunningPeriods(t *testing.T) {
+	useMiniredis(t)
+	prev := ratingPush
+	ratingPush = &ratingPusher{cfg: &RatingPushConfig{SettleMinutes: 120}}
+	t.Cleanup(func() { ratingPush = prev })
+	push := func(start, end time.Time) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/billing/push?start_date="+start.Format("2006-01-02T15:04:05")+
+			"&end_date="+end.Format("2006-01-02T15:04:05"), nil)
+		rec := httptest.NewRecorder()
+		postRatingPush(rec, req)
+		return rec
+	}
+
+	// Ended an hour ago: Gnocchi may still add measures
+	now := time.Now().UTC().Truncate(time.Second)
+	if rec := push(now.Add(-25*time.Hour), now.Add(-time.Hour)); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unsettled period: status %d: %s, want 422", rec.Code, rec.Body.String())
+	}
+
+	// Settled, but another replica is pushing it
+	start, end := now.Add(-72*time.Hour), now.Add(-48*time.Hour)
+	locked, err := lockRatingPush(defaultCluster(), exportPeriod(start.Format("2006-01-02T15:04:05"), end.Format("2006-01-02T15:04:05")))
+	if err != nil || !locked {
+		t.Fatalf("lock = %v, %v", locked, err)
+	}
+	if rec := push(start, end); rec.Code != http.StatusConflict {
+		t.Errorf("running period: status %d: %s, want 409", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InstanceReconciliation is the response of GET /api/v1/reconcile/instances.
+// It shows billing-coverage gaps between Nova and Gnocchi:
+//   - tracked:          server exists and has Gnocchi metrics
+//   - orphaned_gnocchi: live Gnocchi resource (no ended_at) without a Nova server
+//   - untracked_nova:   Nova server without a Gnocchi resource (not billed)
+//
+// Gnocchi resources with ended_at set belong to deleted servers and are only counted.
+type InstanceReconciliation struct {
+	Timestamp       string              `json:"timestamp"`
+	Tracked         []ReconcileInstance `json:"tracked"`
+	OrphanedGnocchi []ReconcileInstance `json:"orphaned_gnocchi"`
+	UntrackedNova   []ReconcileInstance `json:"untracked_nova"`
+	EndedGnocchi    int                 `json:"ended_gnocchi_resources"`
+	Summary         ReconcileSummary    `json:"summary"`
+}
+
+// ReconcileInstance is one instance in a reconciliation list.
+type ReconcileInstance struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ProjectID string `json:"project_id"`
+	Status    string `json:"status,omitempty"` // Nova status, empty for Gnocchi-only entries
+}
+
+// ReconcileSummary holds the list sizes.
+type ReconcileSummary struct {
+	NovaServers      int `json:"nova_servers"`
+	GnocchiResources int `json:"gnocchi_resources"`
+	Tracked          int `json:"tracked"`
+	OrphanedGnocchi  int `json:"orphaned_gnocchi"`
+	UntrackedNova    int `json:"untracked_nova"`
+}
+
+// GET /api/v1/reconcile/instances
+func getInstanceReconciliation(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	if clusterEnv(r.Context(), "NOVA_URL", "") == "" || clusterEnv(r.Context(), "GNOCCHI_URL", "") == "" {
+		http.Error(w, `{"error":"NOVA_URL and GNOCCHI_URL must both be configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+
+	novaClient := NewNovaClient(NovaConfig{
+		BaseURL:  clusterEnv(r.Context(), "NOVA_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+	gnocchiClient := NewGnocchiClient(GnocchiConfig{
+		BaseURL:  clusterEnv(r.Context(), "GNOCCHI_URL", ""),
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(r.Context()),
+	})
+
+	var (
+		servers    []NovaServer
+		serversErr error
+		instances  []GnocchiInstance
+		gnocchiErr error
+		wg         sync.WaitGroup
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		servers, serversErr = novaClient.ListAllServers()
+	}()
+	go func() {
+		defer wg.Done()
+		instances, gnocchiErr = gnocchiClient.GetAllInstances()
+	}()
+	wg.Wait()
+
+	// A partial join would report every instance as a gap, so both sides are required
+	if serversErr != nil {
+		slog.ErrorContext(ctx, "Nova servers failed", "service", "nova", "error", serversErr)
+		http.Error(w, fmt.Sprintf(`{"error":"Nova servers failed: %v"}`, serversErr), http.StatusBadGateway)
+		return
+	}
+	if gnocchiErr != nil {
+		slog.ErrorContext(ctx, "Gnocchi instances failed", "service", "gnocchi", "error", gnocchiErr)
+		http.Error(w, fmt.Sprintf(`{"error":"Gnocchi instances failed: %v"}`, gnocchiErr), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, reconcileInstances(servers, instances))
+}
+
+// reconcileInstances joins Nova servers and Gnocchi instance resources by UUID.
+func reconcileInstances(servers []NovaServer, instances []GnocchiInstance) InstanceReconciliation {
+	result := InstanceReconciliation{
+		Timestamp:       time.Now().Format(time.RFC3339),
+		Tracked:         []ReconcileInstance{},
+		OrphanedGnocchi: []ReconcileInstance{},
+		UntrackedNova:   []ReconcileInstance{},
+	}
+
+	gnocchiByID := make(map[string]GnocchiInstance, len(instances))
+	for _, inst := range instances {
+		gnocchiByID[inst.ID] = inst
+	}
+
+	novaIDs := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		novaIDs[srv.ID] = true
+		entry := ReconcileInstance{
+			ID:        srv.ID,
+			Name:      srv.Name,
+			ProjectID: srv.TenantID,
+			Status:    srv.Status,
+		}
+		if _, ok := gnocchiByID[srv.ID]; ok {
+			result.Tracked = append(result.Tracked, entry)
+		} else {
+			result.UntrackedNova = append(result.UntrackedNova, entry)
+		}
+	}
+
+	for _, inst := range instances {
+		if novaIDs[inst.ID] {
+			continue
+		}
+		if inst.EndedAt != nil && *inst.EndedAt != "" {
+			result.EndedGnocchi++
+			continue
+		}
+		result.OrphanedGnocchi = append(result.OrphanedGnocchi, ReconcileInstance{
+			ID:        inst.ID,
+			Name:      inst.DisplayName,
+			ProjectID: inst.ProjectID,
+		})
+	}
+
+	for _, list := range [][]ReconcileInstance{result.Tracked, result.OrphanedGnocchi, result.UntrackedNova} {
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	}
+
+	result.Summary = ReconcileSummary{
+		NovaServers:      len(servers),
+		GnocchiResources: len(instances),
+		Tracked:          len(result.Tracked),
+		OrphanedGnocchi:  len(result.OrphanedGnocchi),
+		UntrackedNova:    len(result.UntrackedNova),
+	}
+
+	slog.Info("Instance reconciliation", "tracked", result.Summary.Tracked, "orphaned_gnocchi", result.Summary.OrphanedGnocchi,
+		"untracked_nova", result.Summary.UntrackedNova, "ended", result.EndedGnocchi)
+
+	return result
+}
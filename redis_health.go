@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Redis client is kept for the life of the process even when Redis is
+// unreachable (also at startup). A probe pings it every
+// REDIS_HEALTH_INTERVAL_SECONDS (default 10); while it is down the cache
+// helpers skip Redis instead of waiting for timeouts, and caching resumes as
+// soon as a ping succeeds again.
+
+// redisStatus is the last known Redis reachability.
+type redisStatus struct {
+	up atomic.Bool // read on every cache access
+
+	mu        sync.Mutex
+	downSince time.Time
+	lastError string
+	lastCheck time.Time
+}
+
+// redisState is the process-wide Redis status, updated by the probe.
+var redisState = &redisStatus{}
+
+// cacheEnabled reports whether the cache helpers should use Redis now.
+func cacheEnabled() bool {
+	return redisClient != nil && redisState.up.Load()
+}
+
+// record stores a ping result and logs and counts up/down transitions.
+func (s *redisStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCheck = time.Now()
+
+	if err == nil {
+		if !s.up.Swap(true) {
+			if !s.downSince.IsZero() {
+				slog.Info("Redis reachable again, caching resumed", "service", "redis", "down_for", time.Since(s.downSince).Round(time.Second))
+			}
+			countRedisTransition("up")
+		}
+		s.downSince = time.Time{}
+		return
+	}
+
+	s.lastError = err.Error()
+	if s.up.Swap(false) || s.downSince.IsZero() {
+		slog.Warn("Redis unreachable, caching paused", "service", "redis", "error", err)
+		s.downSince = s.lastCheck
+		countRedisTransition("down")
+	}
+}
+
+func countRedisTransition(state string) {
+	metrics.IncCounter("vhi_redis_state_changes_total",
+		"Redis reachability changes seen by the health probe, by new state.",
+		map[string]string{"state": state})
+}
+
+// redisStatusSnapshot is a copy of the status for deep health.
+type redisStatusSnapshot struct {
+	Up        bool
+	DownSince time.Time
+	LastError string
+	LastCheck time.Time
+}
+
+func (s *redisStatus) snapshot() redisStatusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return redisStatusSnapshot{
+		Up:        s.up.Load(),
+		DownSince: s.downSince,
+		LastError: s.lastError,
+		LastCheck: s.lastCheck,
+	}
+}
+
+// pingRedis pings Redis and records the result.
+func pingRedis(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	err := redisClient.Ping(ctx).Err()
+	redisState.record(err)
+	return err
+}
+
+// startRedisProbe starts the periodic ping and exports the state at /metrics.
+// No-op when Redis is not configured.
+func startRedisProbe() {
+	if redisClient == nil {
+		return
+	}
+	metrics.RegisterGauge("vhi_redis_up",
+		"1 while Redis is reachable and used for caching.",
+		func() []metricSample {
+			if redisState.up.Load() {
+				return []metricSample{{Value: 1}}
+			}
+			return []metricSample{{Value: 0}}
+		})
+	metrics.RegisterGauge("vhi_redis_down_seconds",
+		"Seconds since Redis became unreachable (0 while reachable).",
+		func() []metricSample {
+			snap := redisState.snapshot()
+			if snap.Up || snap.DownSince.IsZero() {
+				return []metricSample{{Value: 0}}
+			}
+			return []metricSample{{Value: time.Since(snap.DownSince).Seconds()}}
+		})
+
+	interval := envSeconds("REDIS_HEALTH_INTERVAL_SECONDS", 10*time.Second)
+	go func() {
+		for range time.Tick(interval) {
+			pingRedis(context.Background())
+		}
+	}()
+}
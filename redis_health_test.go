@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useMiniredis points the cache at an in-memory Redis for the test and marks
+// it up, as the probe would. Failed calls are not retried, so tests that stop
+// Redis stay fast.
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prevClient, prevState := redisClient, redisState
+	redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1, DialerRetries: 1})
+	redisState = &redisStatus{}
+	redisState.record(nil)
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient, redisState = prevClient, prevState
+	})
+	return mr
+}
+
+func TestRedisProbeRecovery(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+
+	cacheSetExpiry("probe_test", "before", time.Minute)
+	var v string
+	if _, ok := cacheGet("probe_test", &v); !ok || v != "before" {
+		t.Fatalf("cache while up = %q, %v", v, ok)
+	}
+
+	// Down: the probe marks it, the cache helpers skip Redis
+	mr.Close()
+	if err := pingRedis(ctx); err == nil {
+		t.Fatal("ping succeeded with Redis stopped")
+	}
+	snap := redisState.snapshot()
+	if cacheEnabled() || snap.Up || snap.DownSince.IsZero() || snap.LastError == "" {
+		t.Errorf("state while down = %+v, cache enabled %v", snap, cacheEnabled())
+	}
+	if _, ok := cacheGet("probe_test", &v); ok {
+		t.Error("cache read while Redis is marked down")
+	}
+	downSince := snap.DownSince
+
+	// Still down: the outage start is kept
+	pingRedis(ctx)
+	if got := redisState.snapshot().DownSince; !got.Equal(downSince) {
+		t.Errorf("down_since moved from %s to %s", downSince, got)
+	}
+
+	// Back up: the next probe restores caching (miniredis keeps its data)
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pingRedis(ctx); err != nil {
+		t.Fatalf("ping after restart: %v", err)
+	}
+	snap = redisState.snapshot()
+	if !cacheEnabled() || !snap.Up || !snap.DownSince.IsZero() {
+		t.Errorf("state after recovery = %+v, cache enabled %v", snap, cacheEnabled())
+	}
+	if _, ok := cacheGet("probe_test", &v); !ok || v != "before" {
+		t.Errorf("cache after recovery = %q, %v", v, ok)
+	}
+}
+
+func TestRedisLegacyKeyFallback(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	prevPrefix, prevFallback := redisKeyPrefix, redisLegacyFallback
+	t.Cleanup(func() { redisKeyPrefix, redisLegacyFallback = prevPrefix, prevFallback })
+	redisKeyPrefix = "tenant:"
+	mr.Set(defaultRedisKeyPrefix+"a", "old")
+	mr.Set(defaultRedisKeyPrefix+"b", "old")
+
+	// Off by default: a miss stays a miss
+	redisLegacyFallback = false
+	if _, err := redisGet(ctx, "a"); err != redis.Nil {
+		t.Fatalf("fallback off: err = %v, want redis.Nil", err)
+	}
+
+	redisLegacyFallback = true
+	if data, err := redisGet(ctx, "b"); err != nil || string(data) != "old" {
+		t.Fatalf("fallback on: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Attachments of the monthly report emails: a CSV with one row per instance
+// and a plain PDF (Courier table) with the same lines and the totals. The PDF
+// is written directly, one text object per page, so no PDF library is needed.
+
+// reportCSVHeader is the first row of the monthly report CSV.
+var reportCSVHeader = []string{
+	"domain", "project_id", "instance_id", "instance_name", "flavor_name",
+	"period_start", "period_end", "currency", "vcpus", "cpu_hours", "cpu_cost",
+	"memory_gb_hours", "memory_cost", "usage_cost", "adjustments_total", "total_cost",
+}
+
+// renderReportCSV writes one row per report. projectOf maps instance IDs to
+// project IDs. Text cells go through csvSafe, like the CSV exports.
+func renderReportCSV(domain string, reports []BillingReport, projectOf map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(reportCSVHeader)
+	money := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	for _, r := range reports {
+		item := newInvoiceLineItem(r)
+		w.Write([]string{
+			csvSafe(domain), csvSafe(projectOf[r.InstanceID]), item.InstanceID, csvSafe(item.InstanceName), csvSafe(item.FlavorName),
+			item.PeriodStart, item.PeriodEnd, item.Currency, strconv.Itoa(item.VCPUs),
+			strconv.FormatFloat(item.CPUHours, 'f', 2, 64), money(item.CPUCost),
+			strconv.FormatFloat(item.MemoryGBHours, 'f', 2, 64), money(item.MemoryCost),
+			money(item.UsageCost), money(item.AdjustmentsTotal), money(item.TotalCost),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// renderReportPDF renders the report as an A4 landscape PDF.
+func renderReportPDF(domain, period string, reports []BillingReport) []byte {
+	lines := []string{
+		"Monthly usage report",
+		"",
+		"Domain:    " + domain,
+		"Period:    " + period,
+		fmt.Sprintf("Instances: %d", len(reports)),
+		"",
+		fmt.Sprintf("%-36s  %-24s  %-16s  %5s  %10s  %10s  %10s", "Instance ID", "Name", "Flavor", "vCPU", "CPU cost", "Mem cost", "Total"),
+		strings.Repeat("-", 124),
+	}
+	var usage, adjustments, total float64
+	currency := ""
+	for _, r := range reports {
+		lines = append(lines, fmt.Sprintf("%-36s  %-24s  %-16s  %5d  %10.2f  %10.2f  %10.2f",
+			r.InstanceID, clip(r.InstanceName, 24), clip(r.FlavorName, 16), r.VCPUs, r.CPUCost, r.MemoryCost, r.TotalCost))
+		usage += r.UsageCost
+		adjustments += r.AdjustmentsTotal
+		total += r.TotalCost
+		currency = r.Currency
+	}
+	lines = append(lines,
+		strings.Repeat("-", 124),
+		fmt.Sprintf("%-100s  %10s  %10.2f", "Usage cost", "", usage),
+		fmt.Sprintf("%-100s  %10s  %10.2f", "Adjustments", "", adjustments),
+		fmt.Sprintf("%-100s  %10s  %10.2f", "Total ("+currency+")", "", total),
+	)
+	return writeTextPDF(lines)
+}
+
+// clip shortens s to n characters for a fixed-width column.
+func clip(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "~"
+}
+
+const (
+	pdfPageWidth    = 842 // A4 landscape, points
+	pdfPageHeight   = 595
+	pdfMargin       = 36
+	pdfFontSize     = 8
+	pdfLineHeight   = 10
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// writeTextPDF lays lines out in Courier over as many pages as needed.
+func writeTextPDF(lines []string) []byte {
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects: 1 catalog, 2 page tree, 3 font, then a page and its content per page
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	)
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfEscape escapes a PDF string literal; characters outside ASCII become '?'
+// (the standard Courier font has no Unicode mapping).
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
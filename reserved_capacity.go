@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProjectReservation is the capacity a project holds on the hypervisors:
+// flavor vCPUs and RAM of its ACTIVE servers (same rule as ReservedVCPUs in
+// the Nova cluster usage). Used for commitment-based billing.
+type ProjectReservation struct {
+	ActiveVMs int     `json:"active_vms"`
+	VCPUs     int     `json:"vcpus"`
+	RAMGiB    float64 `json:"ram_gib"`
+}
+
+// ReservedCapacityResponse is the response of GET /api/v1/usage/reserved.
+type ReservedCapacityResponse struct {
+	Timestamp string                        `json:"timestamp"` // when the server list was taken
+	Source    string                        `json:"source"`    // cluster_usage (cached Nova collection) or nova
+	Projects  map[string]ProjectReservation `json:"projects"`
+	Total     ProjectReservation            `json:"total"`
+}
+
+// reservedByProject sums the flavor vCPUs/RAM of ACTIVE servers per tenant.
+func reservedByProject(servers []NovaServer) map[string]ProjectReservation {
+	byProject := make(map[string]ProjectReservation)
+	for _, srv := range servers {
+		if srv.Status != "ACTIVE" {
+			continue
+		}
+		r := byProject[srv.TenantID]
+		r.ActiveVMs++
+		r.VCPUs += srv.Flavor.VCPUs
+		r.RAMGiB += float64(srv.Flavor.RAM) / 1024.0
+		byProject[srv.TenantID] = r
+	}
+	return byProject
+}
+
+// loadReservedByProject returns the per-project reservation. The Nova cluster
+// usage collection already has it from its server list, so that (cached) copy
+// is used when available; otherwise Nova is asked directly.
+func loadReservedByProject(ctx context.Context) (*ReservedCapacityResponse, error) {
+	if usage, _, err := loadClusterUsage(ctx, policyDefault); err == nil && usage.ReservedByProject != nil {
+		return &ReservedCapacityResponse{
+			Timestamp: usage.Timestamp,
+			Source:    "cluster_usage",
+			Projects:  usage.ReservedByProject,
+		}, nil
+	}
+
+	novaURL := clusterEnv(ctx, "NOVA_URL", "")
+	if novaURL == "" {
+		return nil, fmt.Errorf("NOVA_URL is not configured")
+	}
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate admin: %w", err)
+	}
+	servers, err := NewNovaClient(NovaConfig{
+		BaseURL:  novaURL,
+		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
+		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
+	}).ListAllServers()
+	if err != nil {
+		return nil, fmt.Errorf("Nova servers failed: %w", err)
+	}
+	return &ReservedCapacityResponse{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Source:    "nova",
+		Projects:  reservedByProject(servers),
+	}, nil
+}
+
+// GET /api/v1/usage/reserved?project=<project_id>
+func getReservedCapacity(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	response, err := loadReservedByProject(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Reserved capacity failed", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	// Filter to one project (an unknown project simply holds nothing)
+	if project := strings.TrimSpace(r.URL.Query().Get("project")); project != "" {
+		response.Projects = map[string]ProjectReservation{project: response.Projects[project]}
+	}
+	for _, p := range response.Projects {
+		response.Total.ActiveVMs += p.ActiveVMs
+		response.Total.VCPUs += p.VCPUs
+		response.Total.RAMGiB += p.RAMGiB
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
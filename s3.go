@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible object store (AWS S3, MinIO, Ceph RGW).
+// Requests are path-style (<endpoint>/<bucket>/<key>) and signed with AWS
+// Signature Version 4, so no SDK is needed.
+type S3Config struct {
+	Endpoint  string // e.g. https://minio.example.com:9000
+	Bucket    string
+	Region    string // us-east-1 for MinIO unless configured otherwise
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+}
+
+// S3Client uploads objects to one bucket.
+type S3Client struct {
+	config     S3Config
+	httpClient *http.Client
+}
+
+// NewS3Client membuat S3 client baru.
+func NewS3Client(config S3Config) *S3Client {
+	tr := &http.Transport{}
+
+	if config.Insecure {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &S3Client{
+		config: config,
+		httpClient: &http.Client{
+			Transport: tr,
+			Timeout:   60 * time.Second,
+		},
+	}
+}
+
+// PutObject uploads body under key.
+func (c *S3Client) PutObject(ctx context.Context, key, contentType string, body []byte) error {
+	u, err := url.Parse(strings.TrimRight(c.config.Endpoint, "/"))
+	if err != nil {
+		return fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	// The signature covers the encoded path, so it is built (and sent) exactly
+	u.RawPath = s3URIEncode(u.Path) + "/" + s3URIEncode(c.config.Bucket) + "/" + s3URIEncode(key)
+	u.Path = u.Path + "/" + c.config.Bucket + "/" + key
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", contentType)
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("S3 PUT %s returned status %d: %s", key, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sign adds the SigV4 Authorization header (single chunk, signed payload).
+func (c *S3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.config.SecretKey), day)
+	key = hmacSHA256(key, c.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.config.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3URIEncode percent-encodes everything but unreserved characters and "/",
+// as SigV4 canonical URIs require.
+func s3URIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 export for the data warehouse. With S3_EXPORT_ENDPOINT and
+// S3_EXPORT_BUCKET set, every snapshot the background collector takes
+// (cluster usage, total usage) and every finished cluster billing job is
+// uploaded as JSON under S3_EXPORT_PREFIX:
+//
+//	<cluster>/snapshots/<kind>/<YYYY-MM-DD>/<YYYYMMDDTHHMMSSZ>.json
+//	<cluster>/<domain>/<project>/<period>/report.json     (ClusterBillingResult of the project)
+//	<cluster>/<domain>/<project>/<period>/invoice.jsonl   (invoice_jsonl of the project)
+//	manifests/<YYYY-MM-DD>.json                           (every object of that day)
+//
+// period is YYYY-MM for a calendar month, else YYYYMMDD-YYYYMMDD. Projects
+// outside DOMAINS_FILE go under the domain "_none". Uploads run in one
+// background worker and are retried S3_EXPORT_RETRIES times with backoff;
+// when the queue is full, newer objects are dropped (and counted). With Redis,
+// the object keys of the snapshots are kept for
+// S3_EXPORT_SNAPSHOT_RETENTION_DAYS, and the body of every snapshot whose upload
+// failed or was dropped, so POST /api/v1/admin/export/backfill can upload
+// those again.
+
+// Export kinds (the kind label of vhi_s3_exports_total).
+const (
+	exportKindClusterUsage = "cluster_usage"
+	exportKindTotalUsage   = "total_usage"
+	exportKindReport       = "report"
+	exportKindInvoice      = "invoice"
+	exportKindManifest     = "manifest"
+)
+
+const (
+	exportSnapshotKeyPrefix = "export_snapshots:" // + <kind>:<day>, per cluster; object keys
+	exportPendingKeyPrefix  = "export_pending:"   // + object key; body of a failed snapshot upload
+	exportManifestKeyPrefix = "export_manifest:"  // + <day>; also :lock and :dirty
+)
+
+// exportManifestLockTTL bounds how long a crashed replica can hold a
+// manifest lock; a rewrite with upload retries takes well under it.
+const exportManifestLockTTL = 5 * time.Minute
+
+// exportQueueSize bounds the objects waiting for the upload worker.
+const exportQueueSize = 64
+
+// exportBackfillMaxDays bounds the date range of one backfill request.
+const exportBackfillMaxDays = 31
+
+// exportObject is one object to upload.
+type exportObject struct {
+	Key         string
+	Kind        string
+	Cluster     string
+	Day         string // manifest the object is listed in (YYYY-MM-DD, UTC)
+	ContentType string
+	Body        []byte
+	Backfill    bool // kept in Redis when the upload fails, for backfill
+}
+
+// exportSnapshot is the body of a snapshot object, and what Redis keeps for backfill.
+type exportSnapshot struct {
+	Cluster string          `json:"cluster"`
+	Kind    string          `json:"kind"`
+	TakenAt string          `json:"taken_at"` // RFC3339, UTC
+	Data    json.RawMessage `json:"data"`
+}
+
+// ExportManifestEntry is one object listed in a daily manifest.
+type ExportManifestEntry struct {
+	Key        string `json:"key"`
+	Kind       string `json:"kind"`
+	Cluster    string `json:"cluster"`
+	Size       int    `json:"size"`
+	SHA256     string `json:"sha256"`
+	UploadedAt string `json:"uploaded_at"`
+}
+
+// ExportManifest is the body of manifests/<day>.json.
+type ExportManifest struct {
+	Date        string                `json:"date"`
+	GeneratedAt string                `json:"generated_at"`
+	Objects     []ExportManifestEntry `json:"objects"`
+}
+
+// s3Exporter queues objects for one upload worker.
+type s3Exporter struct {
+	client    *S3Client
+	prefix    string
+	retries   int
+	retention time.Duration // snapshot history in Redis
+	queue     chan exportObject
+
+	// Manifest entries without Redis (this process only), by day then key
+	manifestMu sync.Mutex
+	manifests  map[string]map[string]ExportManifestEntry
+}
+
+// exporter is the process-wide S3 exporter, nil when disabled.
+var exporter *s3Exporter
+
+// newS3ExporterFromEnv reads S3_EXPORT_*; nil when the endpoint or bucket is unset.
+func newS3ExporterFromEnv() *s3Exporter {
+	endpoint := getEnv("S3_EXPORT_ENDPOINT", "")
+	bucket := getEnv("S3_EXPORT_BUCKET", "")
+	if endpoint == "" || bucket == "" {
+		return nil
+	}
+
+	retries := 3
+	if v, err := strconv.Atoi(getEnv("S3_EXPORT_RETRIES", "")); err == nil && v >= 0 {
+		retries = v
+	}
+	retention := 7 * 24 * time.Hour
+	if v, err := strconv.Atoi(getEnv("S3_EXPORT_SNAPSHOT_RETENTION_DAYS", "")); err == nil && v > 0 {
+		retention = time.Duration(v) * 24 * time.Hour
+	}
+	prefix := strings.Trim(getEnv("S3_EXPORT_PREFIX", ""), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	e := &s3Exporter{
+		client: NewS3Client(S3Config{
+			Endpoint:  endpoint,
+			Bucket:    bucket,
+			Region:    getEnv("S3_EXPORT_REGION", "us-east-1"),
+			AccessKey: getEnv("S3_EXPORT_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_EXPORT_SECRET_KEY", ""),
+			Insecure:  getEnv("S3_EXPORT_INSECURE", "false") == "true",
+		}),
+		prefix:    prefix,
+		retries:   retries,
+		retention: retention,
+		queue:     make(chan exportObject, exportQueueSize),
+		manifests: make(map[string]map[string]ExportManifestEntry),
+	}
+	metrics.RegisterGauge("vhi_s3_export_queue_length",
+		"Objects waiting for the S3 export worker.",
+		func() []metricSample {
+			return []metricSample{{Value: float64(len(e.queue))}}
+		})
+	slog.Info("S3 export enabled", "endpoint", redactURL(endpoint), "bucket", bucket, "prefix", prefix)
+	go e.run()
+	return e
+}
+
+func (e *s3Exporter) run() {
+	for obj := range e.queue {
+		e.put(obj)
+	}
+}
+
+// enqueue queues obj without blocking.
+func (e *s3Exporter) enqueue(obj exportObject) {
+	select {
+	case e.queue <- obj:
+	default:
+		slog.Warn("S3 export queue full, dropping object", "key", obj.Key)
+		countExport(obj.Kind, "dropped")
+		e.keepPending(obj)
+	}
+}
+
+// put uploads obj with retries and lists it in its day's manifest.
+func (e *s3Exporter) put(obj exportObject) error {
+	if err := e.upload(obj); err != nil {
+		e.keepPending(obj)
+		return err
+	}
+	if obj.Backfill && redisClient != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		redisClient.Del(ctx, redisKey(exportPendingKeyPrefix+obj.Key))
+		cancel()
+	}
+	if err := e.updateManifest(obj); err != nil {
+		slog.Warn("S3 export manifest update failed", "service", "s3", "day", obj.Day, "error", err)
+	}
+	return nil
+}
+
+// upload tries once plus e.retries times, backing off 2s, 4s, 8s, ... (max 30s).
+func (e *s3Exporter) upload(obj exportObject) error {
+	var err error
+	for attempt := 0; attempt <= e.retries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<attempt) * time.Second
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			time.Sleep(backoff)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		err = e.client.PutObject(ctx, e.prefix+obj.Key, obj.ContentType, obj.Body)
+		cancel()
+		if err == nil {
+			countExport(obj.Kind, "uploaded")
+			return nil
+		}
+		slog.Warn("S3 upload failed", "service", "s3", "key", obj.Key, "attempt", attempt+1, "error", err)
+	}
+	countExport(obj.Kind, "error")
+	return err
+}
+
+// keepPending keeps the body of a snapshot that was not uploaded in Redis for
+// the retention period, for backfill.
+func (e *s3Exporter) keepPending(obj exportObject) {
+	if !obj.Backfill || redisClient == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := redisClient.Set(ctx, redisKey(exportPendingKeyPrefix+obj.Key), obj.Body, e.retention).Err(); err != nil {
+		slog.Warn("S3 export: failed to keep snapshot for backfill", "service", "redis", "key", obj.Key, "error", err)
+	}
+}
+
+// updateManifest records obj in its day's entries and rewrites
+// manifests/<day>.json from them. With Redis the entries are a hash shared by
+// the replicas (see updateSharedManifest).
+func (e *s3Exporter) updateManifest(obj exportObject) error {
+	entry := ExportManifestEntry{
+		Key:        e.prefix + obj.Key,
+		Kind:       obj.Kind,
+		Cluster:    obj.Cluster,
+		Size:       len(obj.Body),
+		SHA256:     sha256Hex(obj.Body),
+		UploadedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	e.manifestMu.Lock()
+	defer e.manifestMu.Unlock()
+
+	if redisClient != nil {
+		return e.updateSharedManifest(obj.Day, entry)
+	}
+	day := e.manifests[obj.Day]
+	if day == nil {
+		day = make(map[string]ExportManifestEntry)
+		e.manifests[obj.Day] = day
+		// Hanya simpan hari-hari dalam masa retensi
+		cutoff := time.Now().UTC().Add(-e.retention).Format("2006-01-02")
+		for d := range e.manifests {
+			if d < cutoff {
+				delete(e.manifests, d)
+			}
+		}
+	}
+	day[entry.Key] = entry
+	entries := make([]ExportManifestEntry, 0, len(day))
+	for _, en := range day {
+		entries = append(entries, en)
+	}
+	return e.uploadManifest(obj.Day, entries)
+}
+
+// updateSharedManifest adds entry to the day's Redis hash and rewrites the
+// manifest from it under a Redis lock, so one replica can't overwrite another's
+// rewrite with an older list. A replica that finds the lock taken only flags
+// the day dirty; the holder checks the flag after releasing the lock and
+// rewrites again, so no entry is left out.
+func (e *s3Exporter) updateSharedManifest(day string, entry ExportManifestEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportManifestLockTTL)
+	defer cancel()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := redisKey(exportManifestKeyPrefix + day)
+	lockKey, dirtyKey := key+":lock", key+":dirty"
+	if err := redisClient.HSet(ctx, key, entry.Key, data).Err(); err != nil {
+		return err
+	}
+	redisClient.Expire(ctx, key, e.retention+24*time.Hour)
+	if err := redisClient.Set(ctx, dirtyKey, 1, exportManifestLockTTL).Err(); err != nil {
+		return err
+	}
+
+	holder, err := newBillingJobID()
+	if err != nil {
+		return err
+	}
+	for {
+		locked, err := redisClient.SetNX(ctx, lockKey, holder, exportManifestLockTTL).Result()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return nil // the holder rewrites it with this entry
+		}
+		redisClient.Del(ctx, dirtyKey)
+		err = e.rewriteSharedManifest(ctx, day, key)
+		if current, getErr := redisClient.Get(ctx, lockKey).Result(); getErr == nil && current == holder {
+			redisClient.Del(ctx, lockKey)
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := redisClient.Exists(ctx, dirtyKey).Result(); err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// rewriteSharedManifest uploads the manifest of day from its Redis hash.
+func (e *s3Exporter) rewriteSharedManifest(ctx context.Context, day, key string) error {
+	all, err := redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	entries := make([]ExportManifestEntry, 0, len(all))
+	for _, raw := range all {
+		var en ExportManifestEntry
+		if json.Unmarshal([]byte(raw), &en) == nil {
+			entries = append(entries, en)
+		}
+	}
+	return e.uploadManifest(day, entries)
+}
+
+// uploadManifest uploads manifests/<day>.json listing entries.
+func (e *s3Exporter) uploadManifest(day string, entries []ExportManifestEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	body, err := json.Marshal(ExportManifest{
+		Date:        day,
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Objects:     entries,
+	})
+	if err != nil {
+		return err
+	}
+	return e.upload(exportObject{
+		Key:         "manifests/" + day + ".json",
+		Kind:        exportKindManifest,
+		ContentType: "application/json",
+		Body:        body,
+	})
+}
+
+// exportSnapshot uploads a snapshot taken by the collector and lists its key
+// in Redis for backfill. No-op when the exporter is disabled.
+func (e *s3Exporter) exportSnapshot(cluster *Cluster, kind string, v interface{}) {
+	if e == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Warn("S3 export: failed to encode snapshot", "kind", kind, "error", err)
+		return
+	}
+	snap := exportSnapshot{
+		Cluster: cluster.Name,
+		Kind:    kind,
+		TakenAt: time.Now().UTC().Format(time.RFC3339),
+		Data:    data,
+	}
+	body, err := json.Marshal(snap)
+	if err != nil {
+		return
+	}
+
+	obj := snapshotObject(snap, body)
+	if redisClient != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		key := redisKey(cluster.key(exportSnapshotKeyPrefix + kind + ":" + snap.TakenAt[:10]))
+		if err := redisClient.RPush(ctx, key, obj.Key).Err(); err != nil {
+			slog.Warn("S3 export: failed to list snapshot for backfill", "service", "redis", "kind", kind, "error", err)
+		} else {
+			redisClient.Expire(ctx, key, e.retention)
+		}
+		cancel()
+	}
+	e.enqueue(obj)
+}
+
+// snapshotObject builds the upload of a snapshot.
+func snapshotObject(snap exportSnapshot, body []byte) exportObject {
+	takenAt, err := time.Parse(time.RFC3339, snap.TakenAt)
+	if err != nil {
+		takenAt = time.Now().UTC()
+	}
+	day := takenAt.Format("2006-01-02")
+	return exportObject{
+		Key:         snap.Cluster + "/snapshots/" + snap.Kind + "/" + day + "/" + takenAt.Format("20060102T150405Z") + ".json",
+		Kind:        snap.Kind,
+		Cluster:     snap.Cluster,
+		Day:         day,
+		ContentType: "application/json",
+		Body:        body,
+		Backfill:    true,
+	}
+}
+
+// exportBillingResult uploads the report and invoice of a finished cluster
+// billing job, one pair per project. projectOf maps instance IDs to project
+// IDs; the domains come from DOMAINS_FILE. No-op when the exporter is disabled.
+func (e *s3Exporter) exportBillingResult(cluster *Cluster, result ClusterBillingResult, projectOf map[string]string, adminToken string) {
+	if e == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withCluster(context.Background(), cluster), 2*time.Minute)
+	projectToDomain, errs := billingDomainProjects(ctx, adminToken)
+	cancel()
+	if len(errs) > 0 {
+		// Projects of the failed domains land under _none; the export still runs
+		slog.Warn("S3 export: some billing domains failed to resolve", "job_id", result.JobID, "errors", len(errs))
+	}
+
+	byProject := make(map[string][]BillingReport)
+	for _, report := range result.Reports {
+		project := projectOf[report.InstanceID]
+		byProject[project] = append(byProject[project], report)
+	}
+
+	period := exportPeriod(result.StartDate, result.EndDate)
+	day := time.Now().UTC().Format("2006-01-02")
+	for project, reports := range byProject {
+		domain := projectToDomain[project]
+		if domain == "" {
+			domain = "_none"
+		}
+		if project == "" {
+			project = "_none"
+		}
+		dir := cluster.Name + "/" + domain + "/" + project + "/" + period + "/"
+
+		projectResult := result
+		projectResult.Reports = reports
+		projectResult.InstanceCount = len(reports)
+		projectResult.TotalCost = 0
+		for _, r := range reports {
+			projectResult.TotalCost += r.TotalCost
+		}
+		report, err := json.Marshal(projectResult)
+		if err != nil {
+			slog.Warn("S3 export: failed to encode billing report", "job_id", result.JobID, "error", err)
+			continue
+		}
+		var invoice bytes.Buffer
+		encodeInvoiceJSONL(&invoice, reports, result.StartDate, result.EndDate, result.Currency)
+
+		e.enqueue(exportObject{Key: dir + "report.json", Kind: exportKindReport, Cluster: cluster.Name,
+			Day: day, ContentType: "application/json", Body: report})
+		e.enqueue(exportObject{Key: dir + "invoice.jsonl", Kind: exportKindInvoice, Cluster: cluster.Name,
+			Day: day, ContentType: invoiceJSONLContentType, Body: invoice.Bytes()})
+	}
+	slog.Info("S3 export: billing result queued", "job_id", result.JobID, "cluster", cluster.Name,
+		"period", period, "projects", len(byProject))
+}
+
+// exportPeriod names a billing period: YYYY-MM when it is exactly one
+// calendar month, else YYYYMMDD-YYYYMMDD.
+func exportPeriod(startDate, endDate string) string {
+	start, err1 := time.Parse("2006-01-02T15:04:05", startDate)
+	end, err2 := time.Parse("2006-01-02T15:04:05", endDate)
+	if err1 != nil || err2 != nil {
+		return strings.NewReplacer(":", "", "T", "").Replace(startDate + "-" + endDate)
+	}
+	monthEnd := start.AddDate(0, 1, 0)
+	if start.Day() == 1 && start.Equal(start.Truncate(24*time.Hour)) &&
+		(end.Equal(monthEnd) || end.Equal(monthEnd.Add(-time.Second))) {
+		return start.Format("2006-01")
+	}
+	return start.Format("20060102") + "-" + end.Format("20060102")
+}
+
+func countExport(kind, result string) {
+	metrics.IncCounter("vhi_s3_exports_total",
+		"S3 export uploads by kind and result (uploaded, error, dropped).",
+		map[string]string{"kind": kind, "result": result})
+}
+
+// ExportBackfillResponse is the body of POST /api/v1/admin/export/backfill.
+type ExportBackfillResponse struct {
+	Status    string   `json:"status"` // started
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	Clusters  []string `json:"clusters"`
+	Snapshots int      `json:"snapshots"` // not uploaded before, uploaded again
+}
+
+// POST /api/v1/admin/export/backfill?start=2026-10-01&end=2026-10-07
+// Uploads the snapshots of the days start..end (UTC, inclusive) whose upload
+// failed or was dropped, with their manifests, in the background. Every
+// cluster unless ?cluster= is given.
+func postExportBackfill(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if exporter == nil {
+		http.Error(w, `{"error":"S3 export is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+	if redisClient == nil {
+		http.Error(w, `{"error":"backfill needs Redis, where the snapshots are kept"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	start, err := time.Parse("2006-01-02", query.Get("start"))
+	if err != nil {
+		http.Error(w, `{"error":"start must be a date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	end := start
+	if v := query.Get("end"); v != "" {
+		if end, err = time.Parse("2006-01-02", v); err != nil {
+			http.Error(w, `{"error":"end must be a date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if end.Before(start) {
+		http.Error(w, `{"error":"end must not be before start"}`, http.StatusBadRequest)
+		return
+	}
+	if end.Sub(start) >= exportBackfillMaxDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf(`{"error":"range is limited to %d days"}`, exportBackfillMaxDays), http.StatusBadRequest)
+		return
+	}
+
+	targets := clusters
+	if query.Get("cluster") != "" {
+		targets = []*Cluster{clusterOf(r.Context())}
+	}
+
+	var snapshots []exportSnapshot
+	var bodies [][]byte
+	for _, c := range targets {
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			for _, kind := range []string{exportKindClusterUsage, exportKindTotalUsage} {
+				key := redisKey(c.key(exportSnapshotKeyPrefix + kind + ":" + day.Format("2006-01-02")))
+				objectKeys, err := redisClient.LRange(r.Context(), key, 0, -1).Result()
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Backfill: failed to read snapshots", "service", "redis", "key", key, "error", err)
+					http.Error(w, `{"error":"failed to read stored snapshots"}`, http.StatusBadGateway)
+					return
+				}
+				for _, objectKey := range objectKeys {
+					raw, err := redisClient.Get(r.Context(), redisKey(exportPendingKeyPrefix+objectKey)).Bytes()
+					if err != nil {
+						continue // uploaded, or no longer kept
+					}
+					var snap exportSnapshot
+					if err := json.Unmarshal(raw, &snap); err != nil {
+						continue
+					}
+					snapshots = append(snapshots, snap)
+					bodies = append(bodies, raw)
+				}
+			}
+		}
+	}
+
+	names := make([]string, len(targets))
+	for i, c := range targets {
+		names[i] = c.Name
+	}
+	slog.InfoContext(r.Context(), "S3 export backfill started", "start", start.Format("2006-01-02"),
+		"end", end.Format("2006-01-02"), "clusters", strings.Join(names, ","), "snapshots", len(snapshots))
+
+	// Upload langsung (bukan lewat antrean) supaya backfill tidak di-drop
+	go func() {
+		failed := 0
+		for i, snap := range snapshots {
+			if exporter.put(snapshotObject(snap, bodies[i])) != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			slog.Warn("S3 export backfill finished with errors", "snapshots", len(snapshots), "failed", failed)
+			return
+		}
+		slog.Info("S3 export backfill finished", "snapshots", len(snapshots))
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, ExportBackfillResponse{
+		Status:    "started",
+		Start:     start.Format("2006-01-02"),
+		End:       end.Format("2006-01-02"),
+		Clusters:  names,
+		Snapshots: len(snapshots),
+	})
+}
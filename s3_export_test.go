@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeS3 keeps the last body PUT under each key of bucket "b". While failing
+// is set every PUT answers 500.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	failing atomic.Bool
+}
+
+// newTestExporter returns an exporter uploading to a fake S3, without the
+// background worker, and the fake.
+func newTestExporter(t *testing.T) (*s3Exporter, *fakeS3) {
+	t.Helper()
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s3.failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		key := strings.TrimPrefix(r.URL.Path, "/b/")
+		if strings.HasPrefix(key, "manifests/") {
+			time.Sleep(10 * time.Millisecond) // widen the window for racing rewrites
+		}
+		s3.mu.Lock()
+		s3.objects[key] = body
+		s3.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return newExporterFor(srv.URL), s3
+}
+
+func newExporterFor(endpoint string) *s3Exporter {
+	return &s3Exporter{
+		client:    NewS3Client(S3Config{Endpoint: endpoint, Bucket: "b", Region: "us-east-1"}),
+		retention: time.Hour,
+		queue:     make(chan exportObject, exportQueueSize),
+		manifests: make(map[string]map[string]ExportManifestEntry),
+	}
+}
+
+func (s *fakeS3) get(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[key]
+}
+
+func TestSharedManifestKeepsEveryEntry(t *testing.T) {
+	useMiniredis(t)
+	first, s3 := newTestExporter(t)
+	// A second replica with the same bucket and Redis
+	second := newExporterFor(strings.TrimSuffix(first.client.config.Endpoint, "/"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		replica := first
+		if i%2 == 1 {
+			replica = second
+		}
+		wg.Add(1)
+		go func(i int, e *s3Exporter) {
+			defer wg.Done()
+			obj := exportObject{Key: fmt.Sprintf("default/report-%d.json", i), Kind: exportKindReport, Day: "2026-10-01", Body: []byte("{}")}
+			if err := e.put(obj); err != nil {
+				t.Error(err)
+			}
+		}(i, replica)
+	}
+	wg.Wait()
+
+	var manifest ExportManifest
+	if err := json.Unmarshal(s3.get("manifests/2026-10-01.json"), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Objects) != 10 {
+		t.Errorf("manifest lists %d objects, want all 10 uploads of both replicas", len(manifest.Objects))
+	}
+}
+
+func TestSnapshotBackfillKeepsOnlyFailedUploads(t *testing.T) {
+	mr := useMiniredis(t)
+	e, s3 := newTestExporter(t)
+	prev := exporter
+	exporter = e
+	t.Cleanup(func() { exporter = prev })
+	cluster := defaultCluster()
+
+	// Uploaded: only its object key is kept
+	e.exportSnapshot(cluster, exportKindClusterUsage, map[string]int{"vcpus": 1})
+	uploaded := <-e.queue
+	if err := e.put(uploaded); err != nil {
+		t.Fatal(err)
+	}
+	// Failed: its body is kept for backfill
+	s3.failing.Store(true)
+	time.Sleep(time.Second) // a distinct object key
+	e.exportSnapshot(cluster, exportKindClusterUsage, map[string]int{"vcpus": 2})
+	failed := <-e.queue
+	if e.put(failed) == nil {
+		t.Fatal("upload to a failing S3 succeeded")
+	}
+	s3.failing.Store(false)
+
+	day := failed.Day
+	listed, _ := mr.List(redisKey(exportSnapshotKeyPrefix + exportKindClusterUsage + ":" + day))
+	if strings.Join(listed, ",") != uploaded.Key+","+failed.Key {
+		t.Errorf("listed %v, want the two object keys", listed)
+	}
+	if mr.Exists(redisKey(exportPendingKeyPrefix + uploaded.Key)) {
+		t.Error("body of an uploaded snapshot kept")
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/admin/export/backfill?start="+day, nil)
+	rec := httptest.NewRecorder()
+	postExportBackfill(rec, req)
+	var resp ExportBackfillResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusAccepted || resp.Snapshots != 1 {
+		t.Fatalf("backfill: status %d: %s, want the one failed snapshot", rec.Code, rec.Body.String())
+	}
+	manifestLists := func(key string) bool {
+		var manifest ExportManifest
+		json.Unmarshal(s3.get("manifests/"+day+".json"), &manifest)
+		for _, en := range manifest.Objects {
+			if en.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(5 * time.Second); !manifestLists(failed.Key); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("failed snapshot not uploaded by the backfill")
+		}
+	}
+	for mr.Exists(redisKey(exportManifestKeyPrefix + day + ":lock")) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if string(s3.get(failed.Key)) != string(failed.Body) {
+		t.Errorf("backfilled body = %s", s3.get(failed.Key))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// selftestFlag: --selftest (or SELFTEST=true) runs the pre-flight checks and
+// exits instead of starting the HTTP server.
+var selftestFlag = flag.Bool("selftest", false, "check the backend dependencies, print the result and exit")
+
+// selftestTimeout bounds the Keystone and Redis checks; the Gnocchi, Nova and
+// Cinder clients have their own request timeout.
+const selftestTimeout = 30 * time.Second
+
+// errSelftestSkipped marks a check whose dependency is not configured.
+var errSelftestSkipped = errors.New("not configured")
+
+// selftestCheck is one dependency check. Required checks fail the self-test.
+type selftestCheck struct {
+	Name     string
+	Required bool
+	Run      func(ctx context.Context) (detail string, err error)
+}
+
+// selftestRequested reports whether --selftest or SELFTEST=true was given.
+func selftestRequested() bool {
+	return *selftestFlag || getEnv("SELFTEST", "false") == "true"
+}
+
+// selftestChecks returns the checks in order: per cluster admin login first,
+// since Gnocchi, Nova and Cinder use its token, then Redis. Keystone and
+// Gnocchi are always required; Nova, Cinder and Redis only when configured.
+func selftestChecks() []selftestCheck {
+	var checks []selftestCheck
+	for _, c := range clusters {
+		checks = append(checks, clusterSelftestChecks(c)...)
+	}
+	return append(checks, selftestCheck{
+		Name:     "redis ping",
+		Required: redisConfigured(),
+		Run: func(ctx context.Context) (string, error) {
+			if !redisConfigured() {
+				return "", errSelftestSkipped
+			}
+			if redisClient == nil {
+				return "", errors.New("client not initialized (see the Redis log lines above)")
+			}
+			if err := pingRedis(ctx); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s mode", redisMode), nil
+		},
+	})
+}
+
+// clusterSelftestChecks returns the Keystone, Gnocchi, Nova and Cinder checks
+// of one cluster, named after it when several are configured.
+func clusterSelftestChecks(c *Cluster) []selftestCheck {
+	var adminToken string
+	name := func(check string) string {
+		if len(clusters) > 1 {
+			return c.Name + ": " + check
+		}
+		return check
+	}
+
+	// Tanpa token admin, cek OpenStack lainnya tidak bisa jalan
+	needToken := func() error {
+		if adminToken == "" {
+			return errors.New("skipped: admin login failed")
+		}
+		return nil
+	}
+
+	return []selftestCheck{
+		{
+			Name:     name("keystone admin login"),
+			Required: true,
+			Run: func(ctx context.Context) (string, error) {
+				token, err := GetAdminToken(withCluster(ctx, c))
+				if err != nil {
+					return "", err
+				}
+				adminToken = token
+				return fmt.Sprintf("admin project %s", c.tokens.ProjectID()), nil
+			},
+		},
+		{
+			Name:     name("gnocchi instance list"),
+			Required: true,
+			Run: func(ctx context.Context) (string, error) {
+				url := c.env("GNOCCHI_URL", "")
+				if url == "" {
+					return "", errors.New("GNOCCHI_URL is not set")
+				}
+				if err := needToken(); err != nil {
+					return "", err
+				}
+				instances, err := NewGnocchiClient(GnocchiConfig{BaseURL: url, Token: adminToken, Insecure: true}).GetAllInstances()
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d instances", len(instances)), nil
+			},
+		},
+		{
+			Name:     name("nova hypervisor stats"),
+			Required: c.env("NOVA_URL", "") != "",
+			Run: func(ctx context.Context) (string, error) {
+				url := c.env("NOVA_URL", "")
+				if url == "" {
+					return "", errSelftestSkipped
+				}
+				if err := needToken(); err != nil {
+					return "", err
+				}
+				stats, err := NewNovaClient(NovaConfig{BaseURL: url, Token: adminToken, Insecure: true}).GetHypervisorStats()
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d hypervisors, %d running VMs", stats.Count, stats.RunningVMs), nil
+			},
+		},
+		{
+			Name:     name("cinder volume list"),
+			Required: c.env("CINDER_URL", "") != "",
+			Run: func(ctx context.Context) (string, error) {
+				url := c.env("CINDER_URL", "")
+				if url == "" {
+					return "", errSelftestSkipped
+				}
+				if err := needToken(); err != nil {
+					return "", err
+				}
+				volumes, err := NewCinderClient(CinderConfig{
+					BaseURL:   url,
+					Token:     adminToken,
+					ProjectID: cinderProjectID(withCluster(ctx, c)),
+					Insecure:  true,
+				}).ListAllVolumes()
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d volumes", len(volumes)), nil
+			},
+		},
+	}
+}
+
+// redisConfigured reports whether any of the Redis address settings is set.
+func redisConfigured() bool {
+	return os.Getenv("REDIS_HOST") != "" || os.Getenv("REDIS_SENTINEL_ADDRS") != "" ||
+		os.Getenv("REDIS_CLUSTER_ADDRS") != ""
+}
+
+// runSelftest runs the checks, prints a PASS/FAIL/SKIP table to stdout and
+// returns the process exit code: 1 when a required check failed.
+func runSelftest() int {
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "CHECK\tRESULT\tTIME\tDETAIL")
+
+	failed := 0
+	for _, check := range selftestChecks() {
+		ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+		started := time.Now()
+		detail, err := check.Run(ctx)
+		elapsed := time.Since(started).Round(time.Millisecond)
+		cancel()
+
+		result := "PASS"
+		switch {
+		case errors.Is(err, errSelftestSkipped):
+			result, detail = "SKIP", err.Error()
+		case err != nil:
+			result, detail = "FAIL", err.Error()
+			if check.Required {
+				failed++
+			}
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", check.Name, result, elapsed, detail)
+	}
+	out.Flush()
+
+	if failed > 0 {
+		fmt.Printf("selftest: %d required check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("selftest: all required checks passed")
+	return 0
+}
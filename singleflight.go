@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// flightGroup de-duplicates concurrent identical collections: when the cache
+// has just expired and several dashboards ask at once, the first request runs
+// the collection and the others wait for its result instead of starting their
+// own. The collection runs detached from every caller's context, so a caller
+// that goes away doesn't cancel it for the others.
+type flightGroup struct {
+	endpoint string // metric label
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+func newFlightGroup(endpoint string) *flightGroup {
+	return &flightGroup{endpoint: endpoint, flights: make(map[string]*flight)}
+}
+
+// Do runs fn once per key at a time and returns its result to every caller
+// waiting on that key. shared is true for callers that joined a running flight.
+// A caller whose ctx ends stops waiting (ctx.Err()); fn keeps running.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	f, running := g.flights[key]
+	if running {
+		g.mu.Unlock()
+		metrics.IncCounter("vhi_singleflight_coalesced_total",
+			"Requests that shared an in-flight collection instead of starting their own.",
+			map[string]string{"endpoint": g.endpoint})
+	} else {
+		f = g.startLocked(key, fn)
+		g.mu.Unlock()
+	}
+
+	select {
+	case <-f.done:
+		return f.val, f.err, running
+	case <-ctx.Done():
+		return nil, ctx.Err(), running
+	}
+}
+
+// Start runs fn in the background unless a flight for key is already running
+// (stale-while-revalidate refresh). Reports whether a new flight was started.
+func (g *flightGroup) Start(key string, fn func() (interface{}, error)) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, running := g.flights[key]; running {
+		return false
+	}
+	g.startLocked(key, func() (interface{}, error) {
+		v, err := fn()
+		if err != nil {
+			slog.Warn("Background refresh failed", "endpoint", g.endpoint, "error", err)
+		}
+		return v, err
+	})
+	return true
+}
+
+// startLocked registers and starts a flight; g.mu must be held. A panic in fn
+// becomes the flight's error, so its waiters don't block forever.
+func (g *flightGroup) startLocked(key string, fn func() (interface{}, error)) *flight {
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				slog.Error("Collection panicked", "endpoint", g.endpoint, "key", key, "panic", p, "stack", string(debug.Stack()))
+				f.val, f.err = nil, fmt.Errorf("internal error: %v", p)
+			}
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+		f.val, f.err = fn()
+	}()
+	return f
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := newFlightGroup("test")
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		panic("boom")
+	}
+
+	// Two callers wait on the flight that will panic
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err, _ := g.Do(context.Background(), "k", fn)
+			results <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err == nil || !strings.Contains(err.Error(), "internal error: boom") {
+				t.Errorf("err = %v, want the panic as an error", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("caller still blocked after the flight panicked")
+		}
+	}
+
+	// The key is free again
+	v, err, shared := g.Do(context.Background(), "k", func() (interface{}, error) { return 1, nil })
+	if v != 1 || err != nil || shared {
+		t.Errorf("next flight = %v, %v, shared %v", v, err, shared)
+	}
+}
+
+func TestFlightGroupStartPanic(t *testing.T) {
+	g := newFlightGroup("test")
+	if !g.Start("k", func() (interface{}, error) { panic("boom") }) {
+		t.Fatal("flight not started")
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		_, running := g.flights["k"]
+		g.mu.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("panicked background flight was never removed")
+		}
+	}
+}
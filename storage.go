@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The vstorage Prometheus metrics count raw (physical) bytes across all chunk
+// servers. With 3 replicas or erasure coding, the space a user can actually
+// provision is physical / redundancy factor. The factor is configured per tier:
+//
+//	VSTORAGE_REDUNDANCY_DEFAULT=replica3            (default for tiers not listed)
+//	VSTORAGE_REDUNDANCY_TIERS=0=replica3,1=ec5+2
+//
+// Accepted specs: replicaN / rN (factor N), ecK+M (factor (K+M)/K), or a plain factor.
+
+// redundancy is one parsed redundancy setting.
+type redundancy struct {
+	Spec   string
+	Factor float64
+}
+
+// redundancyConfig holds the default and per-tier redundancy settings.
+type redundancyConfig struct {
+	Default redundancy
+	Tiers   map[string]redundancy
+}
+
+// parseRedundancy parses a redundancy spec into its raw-to-usable factor.
+func parseRedundancy(spec string) (redundancy, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+
+	switch {
+	case strings.HasPrefix(spec, "replica") || strings.HasPrefix(spec, "r"):
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(spec, "replica"), "r"))
+		if err != nil || n < 1 {
+			return redundancy{}, fmt.Errorf("invalid replica spec %q", spec)
+		}
+		return redundancy{Spec: fmt.Sprintf("replica%d", n), Factor: float64(n)}, nil
+
+	case strings.HasPrefix(spec, "ec"):
+		parts := strings.SplitN(strings.TrimPrefix(spec, "ec"), "+", 2)
+		if len(parts) != 2 {
+			return redundancy{}, fmt.Errorf("invalid erasure coding spec %q (expected ecK+M)", spec)
+		}
+		k, errK := strconv.Atoi(parts[0])
+		m, errM := strconv.Atoi(parts[1])
+		if errK != nil || errM != nil || k < 1 || m < 0 {
+			return redundancy{}, fmt.Errorf("invalid erasure coding spec %q", spec)
+		}
+		return redundancy{Spec: spec, Factor: float64(k+m) / float64(k)}, nil
+
+	default:
+		f, err := strconv.ParseFloat(spec, 64)
+		if err != nil || f < 1 {
+			return redundancy{}, fmt.Errorf("invalid redundancy %q", spec)
+		}
+		return redundancy{Spec: spec, Factor: f}, nil
+	}
+}
+
+// loadRedundancyConfig reads the redundancy settings from env.
+// Invalid entries are logged and ignored so a typo doesn't take the endpoint down.
+func loadRedundancyConfig() redundancyConfig {
+	cfg := redundancyConfig{
+		Default: redundancy{Spec: "replica3", Factor: 3},
+		Tiers:   make(map[string]redundancy),
+	}
+
+	if v := os.Getenv("VSTORAGE_REDUNDANCY_DEFAULT"); v != "" {
+		if r, err := parseRedundancy(v); err == nil {
+			cfg.Default = r
+		} else {
+			slog.Warn("VSTORAGE_REDUNDANCY_DEFAULT ignored", "using", cfg.Default.Spec, "error", err)
+		}
+	}
+
+	for _, item := range strings.Split(os.Getenv("VSTORAGE_REDUNDANCY_TIERS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			slog.Warn("VSTORAGE_REDUNDANCY_TIERS: invalid entry (expected tier=spec)", "entry", item)
+			continue
+		}
+		r, err := parseRedundancy(kv[1])
+		if err != nil {
+			slog.Warn("VSTORAGE_REDUNDANCY_TIERS: invalid tier", "tier", kv[0], "error", err)
+			continue
+		}
+		cfg.Tiers[strings.TrimSpace(kv[0])] = r
+	}
+
+	return cfg
+}
+
+// forTier returns the redundancy for a tier, falling back to the default.
+func (cfg redundancyConfig) forTier(tier string) redundancy {
+	if r, ok := cfg.Tiers[tier]; ok {
+		return r
+	}
+	return cfg.Default
+}
+
+// VStorageCapacity is the response of GET /api/v1/storage/vstorage.
+type VStorageCapacity struct {
+	Timestamp string `json:"timestamp"`
+
+	// Physical = raw bytes as reported by Prometheus
+	PhysicalTotalTiB float64 `json:"physical_total_tib"`
+	PhysicalUsedTiB  float64 `json:"physical_used_tib"`
+	PhysicalFreeTiB  float64 `json:"physical_free_tib"`
+
+	// Usable = physical / redundancy factor (estimate)
+	UsableTotalTiB float64 `json:"usable_total_tib"`
+	UsableUsedTiB  float64 `json:"usable_used_tib"`
+	UsableFreeTiB  float64 `json:"usable_free_tib"`
+
+	RedundancyAssumption string              `json:"redundancy_assumption"`
+	Tiers                []VStorageTierUsage `json:"tiers"`
+
+	// Exact byte counts, only returned with ?precision=raw
+	Bytes *VStorageBytes `json:"bytes,omitempty"`
+}
+
+// VStorageBytes holds the physical byte values behind the TiB fields.
+type VStorageBytes struct {
+	PhysicalTotal float64 `json:"physical_total"`
+	PhysicalUsed  float64 `json:"physical_used"`
+	PhysicalFree  float64 `json:"physical_free"`
+}
+
+// withPrecision returns the capacity as it should be rendered: the TiB values
+// are never rounded, so only the byte counts depend on p.
+func (c VStorageCapacity) withPrecision(p Precision) VStorageCapacity {
+	if p != PrecisionRaw {
+		c.Bytes = nil
+	}
+	return c
+}
+
+// VStorageTierUsage is the physical and usable capacity of one tier.
+type VStorageTierUsage struct {
+	Tier             string  `json:"tier"`
+	Redundancy       string  `json:"redundancy"`
+	RedundancyFactor float64 `json:"redundancy_factor"`
+	PhysicalTotalTiB float64 `json:"physical_total_tib"`
+	PhysicalUsedTiB  float64 `json:"physical_used_tib"`
+	PhysicalFreeTiB  float64 `json:"physical_free_tib"`
+	UsableTotalTiB   float64 `json:"usable_total_tib"`
+	UsableUsedTiB    float64 `json:"usable_used_tib"`
+	UsableFreeTiB    float64 `json:"usable_free_tib"`
+}
+
+// buildVStorageCapacity fetches the cluster storage stat and converts it
+// into physical and usable capacity.
+func buildVStorageCapacity(c PanelAPI) (*VStorageCapacity, error) {
+	stat, err := c.GetStorageStat()
+	if err != nil {
+		return nil, err
+	}
+	return vstorageCapacityFromStat(c, stat), nil
+}
+
+// vstorageCapacityFromStat computes usable capacity for an already fetched stat.
+// Per-tier figures are used when per-tier redundancy is configured; otherwise
+// (or if the per-tier query fails) the cluster totals are divided by the default factor.
+// When VSTORAGE_USABLE_TOTAL_QUERY and VSTORAGE_USABLE_FREE_QUERY are set (recording
+// rules for licensed/logical space exist), their results replace the estimate.
+func vstorageCapacityFromStat(c PanelAPI, stat *VStorageStat) *VStorageCapacity {
+	cfg := loadRedundancyConfig()
+
+	var tiers []VStorageTierStat
+	if len(cfg.Tiers) > 0 {
+		var err error
+		tiers, err = c.GetStorageTiers()
+		if err != nil {
+			slog.Warn("Per-tier vstorage query failed, using cluster totals", "service", "prometheus", "error", err)
+			tiers = nil
+		}
+	}
+	if tiers == nil {
+		tiers = []VStorageTierStat{{Tier: "all", TotalBytes: stat.TotalBytes, FreeBytes: stat.FreeBytes}}
+	}
+
+	bytesToTiB := 1024.0 * 1024.0 * 1024.0 * 1024.0
+	capacity := &VStorageCapacity{
+		Timestamp:        time.Now().Format(time.RFC3339),
+		PhysicalTotalTiB: stat.TotalBytes / bytesToTiB,
+		PhysicalUsedTiB:  stat.UsedBytes / bytesToTiB,
+		PhysicalFreeTiB:  stat.FreeBytes / bytesToTiB,
+		Tiers:            make([]VStorageTierUsage, 0, len(tiers)),
+		Bytes:            &VStorageBytes{PhysicalTotal: stat.TotalBytes, PhysicalUsed: stat.UsedBytes, PhysicalFree: stat.FreeBytes},
+	}
+
+	var assumptions []string
+	for _, t := range tiers {
+		r := cfg.forTier(t.Tier)
+		used := t.TotalBytes - t.FreeBytes
+		if used < 0 {
+			used = 0
+		}
+
+		tier := VStorageTierUsage{
+			Tier:             t.Tier,
+			Redundancy:       r.Spec,
+			RedundancyFactor: r.Factor,
+			PhysicalTotalTiB: t.TotalBytes / bytesToTiB,
+			PhysicalUsedTiB:  used / bytesToTiB,
+			PhysicalFreeTiB:  t.FreeBytes / bytesToTiB,
+			UsableTotalTiB:   t.TotalBytes / r.Factor / bytesToTiB,
+			UsableUsedTiB:    used / r.Factor / bytesToTiB,
+			UsableFreeTiB:    t.FreeBytes / r.Factor / bytesToTiB,
+		}
+		capacity.Tiers = append(capacity.Tiers, tier)
+
+		capacity.UsableTotalTiB += tier.UsableTotalTiB
+		capacity.UsableUsedTiB += tier.UsableUsedTiB
+		capacity.UsableFreeTiB += tier.UsableFreeTiB
+
+		assumptions = append(assumptions, fmt.Sprintf("tier %s: %s (physical / %.2f)", t.Tier, r.Spec, r.Factor))
+	}
+	capacity.RedundancyAssumption = strings.Join(assumptions, "; ")
+
+	// Prefer real logical figures when the recording rules exist
+	totalQuery := os.Getenv("VSTORAGE_USABLE_TOTAL_QUERY")
+	freeQuery := os.Getenv("VSTORAGE_USABLE_FREE_QUERY")
+	if totalQuery != "" && freeQuery != "" {
+		total, free, err := queryUsableStorage(c, totalQuery, freeQuery)
+		if err != nil {
+			slog.Warn("Usable storage queries failed, keeping redundancy estimate", "service", "prometheus", "error", err)
+		} else {
+			capacity.UsableTotalTiB = total / bytesToTiB
+			capacity.UsableFreeTiB = free / bytesToTiB
+			capacity.UsableUsedTiB = math.Max(total-free, 0) / bytesToTiB
+			capacity.RedundancyAssumption = "reported by VSTORAGE_USABLE_TOTAL_QUERY / VSTORAGE_USABLE_FREE_QUERY"
+		}
+	}
+
+	return capacity
+}
+
+// queryUsableStorage runs the configured logical total/free queries.
+func queryUsableStorage(c PanelAPI, totalQuery, freeQuery string) (float64, float64, error) {
+	fetch, err := c.prometheusFetcher()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	body, err := fetch(totalQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := parsePromResult(body, totalQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	body, err = fetch(freeQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	free, err := parsePromResult(body, freeQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	return total, free, nil
+}
+
+// GET /api/v1/storage/vstorage
+func getVStorageCapacity(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	precision, err := parsePrecision(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+	panel := panelFor(r.Context())
+	if panel == nil {
+		http.Error(w, `{"error":"VHI Panel client not initialized"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	capacity, err := buildVStorageCapacity(panel)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "vStorage capacity failed", "service", "panel", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"vstorage capacity failed: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, capacity.withPrecision(precision))
+}
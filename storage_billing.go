@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageBillingReport is the response of GET /api/v1/billing/storage.
+// Cost is the monthly cost of the currently provisioned Cinder volumes.
+type StorageBillingReport struct {
+	Timestamp              string           `json:"timestamp"`
+	Currency               string           `json:"currency"`
+	TotalVolumes           int              `json:"total_volumes"`
+	TotalSizeGiB           int              `json:"total_size_gib"`
+	DefaultPricePerGBMonth float64          `json:"default_price_per_gb_month"`
+	ByVolumeType           []VolumeTypeCost `json:"by_volume_type"`
+	UnpricedVolumeTypes    []string         `json:"unpriced_volume_types,omitempty"`
+	TotalMonthlyCost       float64          `json:"total_monthly_cost"`
+}
+
+// VolumeTypeCost is the cost of all volumes of one volume type.
+type VolumeTypeCost struct {
+	VolumeType      string  `json:"volume_type"`
+	Count           int     `json:"count"`
+	SizeGiB         int     `json:"size_gib"`
+	PricePerGBMonth float64 `json:"price_per_gb_month"`
+	MonthlyCost     float64 `json:"monthly_cost"`
+	DefaultPrice    bool    `json:"default_price"` // true when the type had no price in storage_prices
+}
+
+// parseStoragePrices parses "ssd:0.10,hdd:0.03" into volume_type → price per GB-month.
+func parseStoragePrices(s string) (map[string]float64, error) {
+	prices := make(map[string]float64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		// Split on the last ":" so volume types containing ":" still work
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q (expected volume_type:price)", item)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(item[i+1:]), 64)
+		if err != nil || price < 0 {
+			return nil, fmt.Errorf("invalid price in %q", item)
+		}
+		prices[strings.TrimSpace(item[:i])] = price
+	}
+	return prices, nil
+}
+
+// CalculateStorageCost prices the ByVolumeType breakdown. Types without a price
+// use defaultPrice and are listed in UnpricedVolumeTypes.
+func CalculateStorageCost(stats *StorageStats, prices map[string]float64, defaultPrice float64) StorageBillingReport {
+	report := StorageBillingReport{
+		Timestamp:              time.Now().Format(time.RFC3339),
+		Currency:               "USD",
+		TotalVolumes:           stats.TotalVolumes,
+		TotalSizeGiB:           stats.AllSizeGiB,
+		DefaultPricePerGBMonth: defaultPrice,
+		ByVolumeType:           make([]VolumeTypeCost, 0, len(stats.ByVolumeType)),
+	}
+
+	for vt, b := range stats.ByVolumeType {
+		price, ok := prices[vt]
+		if !ok {
+			price = defaultPrice
+			report.UnpricedVolumeTypes = append(report.UnpricedVolumeTypes, vt)
+		}
+		cost := VolumeTypeCost{
+			VolumeType:      vt,
+			Count:           b.Count,
+			SizeGiB:         b.SizeGiB,
+			PricePerGBMonth: price,
+			MonthlyCost:     float64(b.SizeGiB) * price,
+			DefaultPrice:    !ok,
+		}
+		report.ByVolumeType = append(report.ByVolumeType, cost)
+		report.TotalMonthlyCost += cost.MonthlyCost
+	}
+
+	sort.Slice(report.ByVolumeType, func(i, j int) bool {
+		return report.ByVolumeType[i].VolumeType < report.ByVolumeType[j].VolumeType
+	})
+	sort.Strings(report.UnpricedVolumeTypes)
+	return report
+}
+
+// GET /api/v1/billing/storage?storage_prices=ssd:0.10,hdd:0.03&default_storage_price=0.05
+func getStorageBilling(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	prices, err := parseStoragePrices(r.URL.Query().Get("storage_prices"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid storage_prices: %v"}`, err), http.StatusBadRequest)
+		return
+	}
+	defaultPrice := parseFloat(r.URL.Query().Get("default_storage_price"),
+		parseFloat(getEnv("DEFAULT_STORAGE_PRICE_PER_GB_MONTH", ""), 0.05))
+	if defaultPrice < 0 {
+		http.Error(w, `{"error":"default_storage_price must not be negative"}`, http.StatusBadRequest)
+		return
+	}
+
+	cinderURL := clusterEnv(r.Context(), "CINDER_URL", "")
+	if cinderURL == "" {
+		http.Error(w, `{"error":"CINDER_URL is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	adminToken, err := GetAdminToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get admin token", "service", "keystone", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"failed to authenticate admin: %v"}`, err), http.StatusUnauthorized)
+		return
+	}
+
+	cinderClient := NewCinderClient(CinderConfig{
+		BaseURL:   cinderURL,
+		Token:     adminToken,
+		ProjectID: cinderProjectID(ctx),
+		Insecure:  true,
+		Calls:     upstreamCallsOf(ctx),
+	})
+
+	stats, err := cinderClient.GetProvisionedStorage()
+	if err != nil {
+		slog.ErrorContext(ctx, "Cinder volumes failed", "service", "cinder", "error", err)
+		http.Error(w, fmt.Sprintf(`{"error":"Cinder volumes failed: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	report := CalculateStorageCost(stats, prices, defaultPrice)
+	if len(report.UnpricedVolumeTypes) > 0 {
+		slog.WarnContext(ctx, "Storage billing used the default price for some volume types", "volume_types", report.UnpricedVolumeTypes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, report)
+}
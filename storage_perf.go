@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storagePerfMetric is one vstorage performance figure and its PromQL.
+// Queries should aggregate "by (tier)" so the per-tier breakdown is available;
+// queries without a tier label simply yield a cluster total.
+type storagePerfMetric struct {
+	Name    string // JSON key
+	EnvVar  string
+	Default string
+	Scale   float64 // multiplier applied to the query result (e.g. bytes → MB)
+	Latency bool    // latencies are combined with max, not summed
+}
+
+// Defaults follow the vstorage csd exporter metric names charted by the VHI
+// Grafana dashboards; override per deployment with the STORAGE_*_QUERY env vars.
+var storagePerfMetrics = []storagePerfMetric{
+	{Name: "read_iops", EnvVar: "STORAGE_READ_IOPS_QUERY",
+		Default: `sum by (tier) (rate(csd_read_ops_total[5m]))`, Scale: 1},
+	{Name: "write_iops", EnvVar: "STORAGE_WRITE_IOPS_QUERY",
+		Default: `sum by (tier) (rate(csd_write_ops_total[5m]))`, Scale: 1},
+	{Name: "read_mb_per_sec", EnvVar: "STORAGE_READ_BYTES_QUERY",
+		Default: `sum by (tier) (rate(csd_read_bytes_total[5m]))`, Scale: 1.0 / (1024 * 1024)},
+	{Name: "write_mb_per_sec", EnvVar: "STORAGE_WRITE_BYTES_QUERY",
+		Default: `sum by (tier) (rate(csd_write_bytes_total[5m]))`, Scale: 1.0 / (1024 * 1024)},
+	{Name: "read_latency_p99_ms", EnvVar: "STORAGE_READ_LATENCY_P99_QUERY",
+		Default: `histogram_quantile(0.99, sum by (tier, le) (rate(csd_read_latency_seconds_bucket[5m])))`, Scale: 1000, Latency: true},
+	{Name: "write_latency_p99_ms", EnvVar: "STORAGE_WRITE_LATENCY_P99_QUERY",
+		Default: `histogram_quantile(0.99, sum by (tier, le) (rate(csd_write_latency_seconds_bucket[5m])))`, Scale: 1000, Latency: true},
+}
+
+func (m storagePerfMetric) query() string {
+	return getEnv(m.EnvVar, m.Default)
+}
+
+// StoragePerformance is the response of GET /api/v1/storage/performance.
+// Cluster latency is the worst tier's p99 (percentiles can't be summed).
+type StoragePerformance struct {
+	Timestamp string                        `json:"timestamp"`
+	Cluster   map[string]float64            `json:"cluster"`
+	Tiers     map[string]map[string]float64 `json:"tiers,omitempty"`
+	History   map[string][]SeriesPoint      `json:"history,omitempty"`
+	Errors    map[string]string             `json:"errors,omitempty"` // metric → why it's missing
+}
+
+// GET /api/v1/storage/performance?history=1h&step=60s
+func getStoragePerformance(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	window, step, err := parseHistoryParams(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	panel := panelFor(r.Context())
+	if panel == nil {
+		http.Error(w, `{"error":"VHI Panel client not initialized"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Same access path selection as GetStorageStat (direct / API key / SSO)
+	fetch, err := panel.prometheusAPIFetcher()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"prometheus unavailable: %v"}`, err), http.StatusBadGateway)
+		return
+	}
+
+	perf := StoragePerformance{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Cluster:   make(map[string]float64),
+		Tiers:     make(map[string]map[string]float64),
+		Errors:    make(map[string]string),
+	}
+	if window > 0 {
+		perf.History = make(map[string][]SeriesPoint)
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	end := time.Now()
+	for _, m := range storagePerfMetrics {
+		m := m
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := m.query()
+			combine := sumValues
+			if m.Latency {
+				combine = maxValues
+			}
+
+			body, err := fetch(promInstantPath(q))
+			var samples []promSample
+			if err == nil {
+				samples, err = parsePromVector(body, q)
+			}
+			if err == nil && len(samples) == 0 {
+				err = fmt.Errorf("no series (exporter not deployed or query %q needs adjusting)", q)
+			}
+
+			var history []SeriesPoint
+			var historyErr error
+			if err == nil && window > 0 {
+				body, historyErr = fetch(promRangePath(q, end.Add(-window), end, step))
+				if historyErr == nil {
+					history, historyErr = parsePromMatrix(body, q, combine)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				perf.Errors[m.Name] = err.Error()
+				return
+			}
+
+			first := true
+			for _, s := range samples {
+				v := s.Value * m.Scale
+				if first {
+					perf.Cluster[m.Name] = v
+					first = false
+				} else {
+					perf.Cluster[m.Name] = combine(perf.Cluster[m.Name], v)
+				}
+				if tier, ok := s.Labels["tier"]; ok {
+					if perf.Tiers[tier] == nil {
+						perf.Tiers[tier] = make(map[string]float64)
+					}
+					perf.Tiers[tier][m.Name] = v
+				}
+			}
+
+			if historyErr != nil {
+				perf.Errors[m.Name+"_history"] = historyErr.Error()
+			} else if history != nil {
+				for i := range history {
+					history[i].Value *= m.Scale
+				}
+				perf.History[m.Name] = history
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(perf.Errors) > 0 {
+		names := make([]string, 0, len(perf.Errors))
+		for k := range perf.Errors {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		slog.WarnContext(r.Context(), "Storage performance metrics unavailable", "service", "prometheus", "metrics", strings.Join(names, ","))
+	}
+	if len(perf.Tiers) == 0 {
+		perf.Tiers = nil
+	}
+	if len(perf.Errors) == 0 {
+		perf.Errors = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, perf)
+}
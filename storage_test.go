@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetVStorageCapacityFromPanel(t *testing.T) {
+	panel := newFakePanel(t)
+	usePanel(t, newFakePanelClient(t, panel))
+
+	rec := httptest.NewRecorder()
+	getVStorageCapacity(rec, httptest.NewRequest("GET", "/api/v1/storage/vstorage", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var capacity VStorageCapacity
+	if err := json.Unmarshal(rec.Body.Bytes(), &capacity); err != nil {
+		t.Fatal(err)
+	}
+	if capacity.PhysicalTotalTiB != 4 || capacity.PhysicalFreeTiB != 1 || capacity.PhysicalUsedTiB != 3 {
+		t.Errorf("physical TiB = %v total, %v free, %v used", capacity.PhysicalTotalTiB, capacity.PhysicalFreeTiB, capacity.PhysicalUsedTiB)
+	}
+	if capacity.Bytes != nil {
+		t.Error("byte counts without ?precision=raw")
+	}
+}
+
+func TestGetVStorageCapacityPanelErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"non-200", http.StatusBadGateway, `upstream down`, "status 502"},
+		{"malformed JSON", 0, `{"status": "success", "data": `, "prometheus decode failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panel := newFakePanel(t)
+			panel.promStatus, panel.promBody = tt.status, tt.body
+			usePanel(t, newFakePanelClient(t, panel))
+
+			rec := httptest.NewRecorder()
+			getVStorageCapacity(rec, httptest.NewRequest("GET", "/api/v1/storage/vstorage", nil))
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("status %d, want 502", rec.Code)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("body %s, want it to mention %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestGetVStorageCapacityWithoutPanel(t *testing.T) {
+	usePanel(t, nil)
+	rec := httptest.NewRecorder()
+	getVStorageCapacity(rec, httptest.NewRequest("GET", "/api/v1/storage/vstorage", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+}
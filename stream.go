@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clusterStream fans out ClusterUsage snapshots to all connected WebSocket clients.
+// A single goroutine collects usage (through the Redis cache) once per interval,
+// so the backend load is the same for 1 or 100 wall displays.
+type clusterStream struct {
+	mu       sync.Mutex
+	clients  map[*streamClient]struct{}
+	running  bool
+	last     []byte // most recent frame, sent to clients as soon as they connect
+	interval time.Duration
+	maxConns int
+}
+
+// streamClient is one connected WebSocket. Frames are queued on send and written
+// by the connection's own writer goroutine.
+type streamClient struct {
+	send chan []byte
+}
+
+const (
+	streamWriteTimeout = 10 * time.Second
+	streamPongTimeout  = 60 * time.Second
+	streamPingInterval = 30 * time.Second
+)
+
+// usageStream is the process-wide stream hub, created in main after .env is loaded.
+var usageStream *clusterStream
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// Dashboards are served from other origins; access is already gated by bearerAuth.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// newClusterStream reads STREAM_INTERVAL_SECONDS (default 10) and
+// STREAM_MAX_CONNECTIONS (default 50) from env.
+func newClusterStream() *clusterStream {
+	interval := 10 * time.Second
+	if v := os.Getenv("STREAM_INTERVAL_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			interval = time.Duration(parsed) * time.Second
+		}
+	}
+
+	maxConns := 50
+	if v := os.Getenv("STREAM_MAX_CONNECTIONS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			maxConns = parsed
+		}
+	}
+
+	return &clusterStream{
+		clients:  make(map[*streamClient]struct{}),
+		interval: interval,
+		maxConns: maxConns,
+	}
+}
+
+// register adds a client and starts the broadcast loop if it isn't running.
+// Returns false when the connection cap has been reached.
+func (s *clusterStream) register(c *streamClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) >= s.maxConns {
+		return false
+	}
+	s.clients[c] = struct{}{}
+	if s.last != nil {
+		c.send <- s.last
+	}
+
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	return true
+}
+
+// unregister removes a client and closes its send channel.
+func (s *clusterStream) unregister(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.send)
+	}
+}
+
+// run collects and broadcasts usage every interval until the last client leaves.
+func (s *clusterStream) run() {
+	slog.Info("Cluster usage stream started", "interval", s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.broadcast(s.snapshot())
+
+		<-ticker.C
+
+		s.mu.Lock()
+		if len(s.clients) == 0 {
+			s.running = false
+			s.last = nil
+			s.mu.Unlock()
+			slog.Info("Cluster usage stream stopped (no clients)")
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// snapshot returns the JSON frame for the current cluster usage, or an error frame.
+func (s *clusterStream) snapshot() []byte {
+	var (
+		frame []byte
+		err   error
+	)
+	usage, _, loadErr := loadClusterUsage(context.Background(), policyDefault)
+	if loadErr != nil {
+		slog.Warn("Cluster usage stream collection failed", "error", loadErr)
+		frame, err = json.Marshal(map[string]string{"error": loadErr.Error()})
+	} else {
+		frame, err = marshalJSON(usage.withPrecision(PrecisionRounded))
+	}
+	if err != nil {
+		slog.Warn("Failed to marshal stream frame", "error", err)
+		return nil
+	}
+	return frame
+}
+
+// broadcast queues a frame for every client. Slow clients that still have a
+// frame pending simply miss this one instead of blocking everyone else.
+func (s *clusterStream) broadcast(frame []byte) {
+	if frame == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last = frame
+	for c := range s.clients {
+		select {
+		case c.send <- frame:
+		default:
+		}
+	}
+}
+
+// GET /api/v1/usage/cluster/stream
+func streamClusterUsage(w http.ResponseWriter, r *http.Request) {
+	if !allowClusterWide(w, r) {
+		return
+	}
+	if !clusterOf(r.Context()).isDefault() {
+		http.Error(w, `{"error":"the usage stream covers the default cluster only; poll /usage/cluster?cluster= instead"}`, http.StatusBadRequest)
+		return
+	}
+	client := &streamClient{send: make(chan []byte, 1)}
+	if !usageStream.register(client) {
+		slog.WarnContext(r.Context(), "Cluster usage stream connection cap reached, rejecting client",
+			"max_conns", usageStream.maxConns, "remote_addr", r.RemoteAddr)
+		http.Error(w, `{"error":"too many stream connections"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already wrote the HTTP error response
+		slog.WarnContext(r.Context(), "WebSocket upgrade failed", "error", err)
+		usageStream.unregister(client)
+		return
+	}
+	slog.InfoContext(r.Context(), "Cluster usage stream client connected", "remote_addr", r.RemoteAddr)
+
+	go streamWriter(conn, client)
+
+	// Reader loop — we don't expect messages, but reading is how we notice
+	// the client going away (close frame, network error, missed pongs).
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+	})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	usageStream.unregister(client)
+	slog.InfoContext(r.Context(), "Cluster usage stream client disconnected", "remote_addr", r.RemoteAddr)
+}
+
+// streamWriter writes queued frames and keep-alive pings until the send channel
+// is closed by unregister or a write fails.
+func streamWriter(conn *websocket.Conn, client *streamClient) {
+	ping := time.NewTicker(streamPingInterval)
+	defer func() {
+		ping.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-client.send:
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Response timezone for the billing endpoints: ?tz=Asia/Jakarta formats the
+// output timestamps and keys the usage_by_day buckets in that zone. Gnocchi
+// is still queried with the request's start/end dates as UTC. Without ?tz
+// the output is unchanged (Gnocchi timestamps as returned, days in UTC).
+
+// parseTimezone returns the ?tz location, nil when not given. An unknown zone
+// name is answered with 400 (ok is false).
+func parseTimezone(w http.ResponseWriter, r *http.Request) (*time.Location, bool) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return nil, true
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid tz %q (use an IANA name such as Asia/Jakarta)"}`, name), http.StatusBadRequest)
+		return nil, false
+	}
+	return loc, true
+}
+
+// inZone converts t to loc; nil leaves t as it is.
+func inZone(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		return t
+	}
+	return t.In(loc)
+}
+
+// formatTimestamp reformats an RFC3339 timestamp in loc. It is returned as is
+// when loc is nil or it does not parse.
+func formatTimestamp(ts string, loc *time.Location) string {
+	if loc == nil {
+		return ts
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return ts
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+// zoneName is the name of loc for cache keys, empty for nil.
+func zoneName(loc *time.Location) string {
+	if loc == nil {
+		return ""
+	}
+	return loc.String()
+}
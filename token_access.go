@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Bearer tokens and per-token project allowlists.
+//
+//	API_BEARER_TOKEN="..."                             label "default"
+//	API_TOKENS="tenant-a:tokenA,tenant-b:tokenB"       additional labelled tokens
+//	API_TOKEN_PROJECTS="tenant-a:proj1|proj2,tenant-b:proj3"
+//	API_TOKEN_SCOPES="dashboard:read,ops:read|refresh"
+//
+// A token whose label has no API_TOKEN_PROJECTS entry may bill any instance.
+// A restricted token may only bill instances whose Gnocchi project_id is in
+// its list, and cannot use the cluster-wide endpoints (usage totals, cluster,
+// node and reserved usage, network and storage, alerts, the cluster list,
+// reconciliation, diagnostics, deep health, admin); instance search and the
+// inventory only list its projects' instances.
+//
+// A token whose label has no API_TOKEN_SCOPES entry has every scope. Every
+// token may read; refresh is needed for ?refresh / ?no_store (cache_policy.go).
+//
+// ALLOW_QUERY_TOKEN=true additionally accepts the token as ?access_token= for
+// webhook and monitoring clients that cannot set headers. It is off by
+// default: a token in the URL ends up in proxy and load balancer access logs,
+// browser history and Referer headers, so use a dedicated, scoped token for
+// such clients and rotate it. The parameter is removed from the request
+// before the handlers run, so this API never logs it.
+
+// defaultTokenLabel is the label of API_BEARER_TOKEN.
+const defaultTokenLabel = "default"
+
+// scopeRefresh allows forcing recomputation (above plain read access).
+const scopeRefresh = "refresh"
+
+type tokenLabelKey struct{}
+
+// apiTokens returns the configured tokens by label.
+func apiTokens() map[string]string {
+	tokens := make(map[string]string)
+	if t := os.Getenv("API_BEARER_TOKEN"); t != "" {
+		tokens[defaultTokenLabel] = t
+	}
+	for _, entry := range strings.Split(os.Getenv("API_TOKENS"), ",") {
+		label, token, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		label, token = strings.TrimSpace(label), strings.TrimSpace(token)
+		if !ok || label == "" || token == "" {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				slog.Warn("Ignoring invalid API_TOKENS entry (want label:token)")
+			}
+			continue
+		}
+		tokens[label] = token
+	}
+	return tokens
+}
+
+// tokenProjects returns the allowed project IDs for a token label, and
+// whether the label is restricted at all.
+func tokenProjects(label string) (map[string]bool, bool) {
+	for _, entry := range strings.Split(os.Getenv("API_TOKEN_PROJECTS"), ",") {
+		l, list, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || strings.TrimSpace(l) != label {
+			continue
+		}
+		allowed := make(map[string]bool)
+		for _, p := range strings.Split(list, "|") {
+			if p = strings.TrimSpace(p); p != "" {
+				allowed[p] = true
+			}
+		}
+		return allowed, true
+	}
+	return nil, false
+}
+
+// tokenScopes returns the scopes of a token label, and whether the label is
+// limited to them at all.
+func tokenScopes(label string) (map[string]bool, bool) {
+	for _, entry := range strings.Split(os.Getenv("API_TOKEN_SCOPES"), ",") {
+		l, list, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || strings.TrimSpace(l) != label {
+			continue
+		}
+		scopes := make(map[string]bool)
+		for _, s := range strings.Split(list, "|") {
+			if s = strings.TrimSpace(s); s != "" {
+				scopes[s] = true
+			}
+		}
+		return scopes, true
+	}
+	return nil, false
+}
+
+// hasScope reports whether the token that authenticated r has scope.
+func hasScope(r *http.Request, scope string) bool {
+	scopes, limited := tokenScopes(tokenLabel(r))
+	return !limited || scopes[scope]
+}
+
+// queryTokenAllowed reports whether ?access_token= is accepted (ALLOW_QUERY_TOKEN).
+func queryTokenAllowed() bool {
+	return os.Getenv("ALLOW_QUERY_TOKEN") == "true"
+}
+
+// takeQueryToken returns ?access_token= and removes it from r's URL.
+func takeQueryToken(r *http.Request) string {
+	query := r.URL.Query()
+	token := query.Get("access_token")
+	query.Del("access_token")
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	return token
+}
+
+// withTokenLabel stores the authenticated token label in the request context.
+func withTokenLabel(r *http.Request, label string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenLabelKey{}, label))
+}
+
+// tokenLabel returns the label of the token that authenticated r.
+func tokenLabel(r *http.Request) string {
+	label, _ := r.Context().Value(tokenLabelKey{}).(string)
+	return label
+}
+
+// allowProject reports whether the request's token may see projectID's
+// instances; otherwise it writes 403.
+func allowProject(w http.ResponseWriter, r *http.Request, projectID string) bool {
+	label := tokenLabel(r)
+	allowed, restricted := tokenProjects(label)
+	if !restricted || allowed[projectID] {
+		return true
+	}
+	slog.WarnContext(r.Context(), "Token denied access to project", "token_label", label, "project_id", projectID)
+	http.Error(w, `{"error":"instance is not in a project allowed for this token"}`, http.StatusForbidden)
+	return false
+}
+
+// allowInstance looks up the instance's project in Gnocchi and applies
+// allowProject. Unrestricted tokens skip the lookup.
+func allowInstance(w http.ResponseWriter, r *http.Request, client *GnocchiClient, instanceID string) bool {
+	if _, restricted := tokenProjects(tokenLabel(r)); !restricted {
+		return true
+	}
+	instance, err := getInstanceResource(r.Context(), client, instanceID, requestCachePolicy(r))
+	if err != nil {
+		writeInstanceError(w, err)
+		return false
+	}
+	return allowProject(w, r, instance.ProjectID)
+}
+
+// allowClusterWide writes 403 for restricted tokens, which may not use
+// endpoints that return other projects' data.
+func allowClusterWide(w http.ResponseWriter, r *http.Request) bool {
+	if _, restricted := tokenProjects(tokenLabel(r)); !restricted {
+		return true
+	}
+	http.Error(w, `{"error":"this token is restricted to specific projects"}`, http.StatusForbidden)
+	return false
+}
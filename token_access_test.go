@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClusterWideEndpointsRejectRestrictedTokens(t *testing.T) {
+	t.Setenv("API_TOKEN_PROJECTS", "tenant-a:proj-a")
+
+	handlers := map[string]http.HandlerFunc{
+		"/admin/cache/stats":    getCacheStats,
+		"/usage/total":          getTotalUsage,
+		"/usage/cluster":        getClusterUsage,
+		"/usage/cluster/stream": streamClusterUsage,
+		"/usage/reserved":       getReservedCapacity,
+		"/usage/nodes":          getNodeUsage,
+		"/reconcile/instances":  getInstanceReconciliation,
+		"/usage/network":        getNetworkUsage,
+		"/storage/capacity":     getVStorageCapacity,
+		"/storage/performance":  getStoragePerformance,
+		"/admin/diagnostics":    getDiagnostics,
+		"/cluster/alerts":       getClusterAlerts,
+		"/health/deep":          deepHealthCheck,
+		"/clusters":             getClusters,
+	}
+	for path, handler := range handlers {
+		rec := httptest.NewRecorder()
+		handler(rec, withTokenLabel(httptest.NewRequest("GET", "/api/v1"+path, nil), "tenant-a"))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", path, rec.Code)
+		}
+	}
+}
+
+func TestAllowClusterWide(t *testing.T) {
+	t.Setenv("API_TOKEN_PROJECTS", "tenant-a:proj-a")
+
+	for label, want := range map[string]bool{"tenant-a": false, "ops": true, defaultTokenLabel: true} {
+		rec := httptest.NewRecorder()
+		if got := allowClusterWide(rec, withTokenLabel(httptest.NewRequest("GET", "/", nil), label)); got != want {
+			t.Errorf("%s: allowed = %v, want %v", label, got, want)
+		}
+	}
+}
+
+func TestInstanceSearchFiltersRestrictedTokens(t *testing.T) {
+	useMiniredis(t)
+	t.Setenv("GNOCCHI_URL", "http://gnocchi.invalid")
+	t.Setenv("API_TOKEN_PROJECTS", "tenant-a:proj-a")
+	cacheSetExpiry(defaultCluster().key(instanceListKey), []InstanceSearchEntry{
+		{ID: "i-1", Name: "web-1", ProjectID: "proj-a"},
+		{ID: "i-2", Name: "web-2", ProjectID: "proj-b"},
+		{ID: "i-3", Name: "db-1", ProjectID: "proj-a"},
+	}, getInstanceListTTL())
+
+	search := func(label string) []string {
+		rec := httptest.NewRecorder()
+		getInstanceSearch(rec, withTokenLabel(httptest.NewRequest("GET", "/api/v1/instances/search?q=web", nil), label))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", label, rec.Code, rec.Body.String())
+		}
+		var result InstanceSearchResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range result.Instances {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	if got := search("tenant-a"); len(got) != 1 || got[0] != "i-1" {
+		t.Errorf("restricted token found %v, want [i-1]", got)
+	}
+	if got := search("ops"); len(got) != 2 {
+		t.Errorf("unrestricted token found %v, want both web instances", got)
+	}
+}
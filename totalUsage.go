@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,6 +22,14 @@ type TotalUsage struct {
 	CPUCoresUsed float64      `json:"cpu_cores_used"` // Total vCPU cores terpakai
 	RAMUsedGB    float64      `json:"ram_used_gb"`    // Total RAM terpakai (GiB)
 	Errors       []UsageError `json:"errors,omitempty"`
+
+	// Set when served from the cache; Timestamp is when the snapshot was taken
+	Cached     bool  `json:"cached,omitempty"`
+	AgeSeconds int64 `json:"age_seconds,omitempty"`
+
+	// Set when served from the last good snapshot because collection failed
+	Stale            bool  `json:"stale,omitempty"`
+	StalenessSeconds int64 `json:"staleness_seconds,omitempty"`
 }
 
 // UsageError merepresentasikan kegagalan parsial saat mengambil usage dari VM/domain tertentu.
@@ -31,16 +44,21 @@ type UsageError struct {
 // GET /api/v1/usage/total
 // Mendapatkan total usage untuk SEMUA VM di semua domain/project
 // FIXED VERSION - Removes early return that was causing 0 GB RAM
+// ?mode=detailed sums per instance instead of through Gnocchi aggregates
+// (see total_usage_aggregates.go); it is never cached.
 
 func getTotalUsage(w http.ResponseWriter, r *http.Request) {
-	// Batas waktu global untuk operasi ini (sesuai PRD: maksimal 5 menit)
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
-	defer cancel()
+	if !allowClusterWide(w, r) {
+		return
+	}
+	cluster := clusterOf(r.Context())
 
 	// Baca daftar nama domain dari file (satu nama per baris)
-	domainFile := getEnv("DOMAINS_FILE", "")
-	domainNames, err := LoadDomainNames(domainFile)
+	domainFile, domainNames, err := fileConfigs.get().domainNames(cluster)
 	if err != nil {
+		if serveStaleTotalUsage(w, cluster, err) {
+			return
+		}
 		http.Error(w, fmt.Sprintf("failed to load domain list from %s: %v", domainFile, err), http.StatusInternalServerError)
 		return
 	}
@@ -49,12 +67,134 @@ func getTotalUsage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Cache per domain list, kecuali ?refresh=true / ?no_store=true.
+	// ?refresh_domains=true juga me-resolve ulang project tiap domain di Keystone.
+	policy, ok := parseCachePolicy(w, r)
+	if !ok {
+		return
+	}
+	domainPolicy := policyDefault
+	if r.URL.Query().Get("refresh_domains") == "true" {
+		if !allowRefresh(w, r) {
+			return
+		}
+		domainPolicy = policyRefresh
+		if policy == policyDefault {
+			policy = policyRefresh
+		}
+	}
+	if policy == policyNoStore {
+		domainPolicy = policyNoStore
+	}
+	detailed, err := parseUsageMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusBadRequest)
+		return
+	}
+	if detailed {
+		policy = policyNoStore
+	}
+
+	usageKey := totalUsageCacheKey(cluster, domainNames)
+	if !policy.readsCache() {
+		setXCache(w, policy.result())
+	} else if cached, fresh := getCachedTotalUsage(usageKey); cached != nil {
+		if fresh {
+			setXCache(w, cacheHit)
+		} else {
+			// Stale-while-revalidate: sajikan data lama, satu refresh di background
+			setXCache(w, cacheStale)
+			totalUsageFlight.Start(usageKey, refreshTotalUsage(cluster, domainNames, usageKey, policyDefault, policyDefault, false, nil))
+		}
+		writeTotalUsage(w, cached)
+		return
+	} else {
+		setXCache(w, cacheMiss)
+	}
+
+	// Request identik yang bersamaan berbagi satu koleksi (refresh ikut atau memimpin koleksi yang sedang jalan)
+	flightKey := policy.flightKey(usageKey)
+	if detailed {
+		flightKey += ":detailed"
+	}
+	v, err, shared := totalUsageFlight.Do(r.Context(), flightKey,
+		refreshTotalUsage(cluster, domainNames, usageKey, policy, domainPolicy, detailed, upstreamCallsOf(r.Context())))
+	if shared {
+		setXCache(w, cacheCoalesced)
+	}
+	if err != nil {
+		if policy != policyNoStore {
+			if serveStaleTotalUsage(w, cluster, err) {
+				return
+			}
+		}
+		status := http.StatusInternalServerError
+		var failure *totalUsageFailure
+		if errors.As(err, &failure) {
+			status = failure.status
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeTotalUsage(w, v.(*TotalUsage))
+}
+
+// totalUsageFlight coalesces concurrent /usage/total collections per domain list.
+var totalUsageFlight = newFlightGroup("usage_total")
+
+// refreshTotalUsage returns the flight body that collects total usage for the
+// cluster's domains and, unless policy is no_store, stores it at usageKey.
+// domainPolicy applies to the domain → projects cache; detailed selects the
+// per-instance path. calls counts the backend calls for the request leading
+// the flight (nil in the background).
+func refreshTotalUsage(cluster *Cluster, domainNames []string, usageKey string, policy, domainPolicy cachePolicy, detailed bool, calls *upstreamCalls) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		usage, err := collectTotalUsage(cluster, domainNames, domainPolicy, detailed, calls)
+		if err != nil {
+			return nil, err
+		}
+		if !policy.writesCache() {
+			return usage, nil
+		}
+		// Hasil parsial di-cache lebih singkat
+		ttl := totalUsageCacheTTL()
+		if len(usage.Errors) > 0 {
+			ttl = totalUsagePartialCacheTTL()
+		}
+		cacheSetExpiry(usageKey, usage, swrExpiry(ttl, maxStaleFromEnv("TOTAL_USAGE_MAX_STALE_SECONDS")))
+
+		// Simpan snapshot terakhir sebagai cadangan untuk SERVE_STALE_ON_ERROR
+		if serveStaleOnError() {
+			cacheSet(cluster.key(totalUsageKey), usage)
+		}
+		return usage, nil
+	}
+}
+
+// totalUsageFailure is a collection failure with the HTTP status to report.
+type totalUsageFailure struct {
+	status int
+	err    error
+}
+
+func (e *totalUsageFailure) Error() string { return e.err.Error() }
+
+// collectTotalUsage sums vCPUs and RAM of every instance in the given domains.
+// Per-instance failures end up in Errors; only failures that leave nothing to
+// sum are returned as an error. Domain → project mappings come from the domain
+// cache as domainPolicy allows. Usage comes from Gnocchi aggregates per project
+// batch, or from two measure requests per instance when detailed.
+func collectTotalUsage(cluster *Cluster, domainNames []string, domainPolicy cachePolicy, detailed bool, calls *upstreamCalls) (*TotalUsage, error) {
+	// Batas waktu global untuk operasi ini (sesuai PRD: maksimal 5 menit).
+	// Tidak terikat ke request, karena hasilnya bisa dipakai request lain.
+	ctx, cancel := context.WithTimeout(withUpstreamCalls(withCluster(context.Background(), cluster), calls), 5*time.Minute)
+	defer cancel()
+
 	// Login admin ke Keystone untuk mendapatkan admin token (X-Subject-Token)
 	adminToken, err := GetAdminToken(ctx)
 	if err != nil {
-		log.Printf("Error: failed to get admin token: %v", err)
-		http.Error(w, fmt.Sprintf("failed to authenticate admin: %v", err), http.StatusUnauthorized)
-		return
+		slog.ErrorContext(ctx, "Failed to get admin token", "service", "keystone", "error", err)
+		return nil, &totalUsageFailure{http.StatusUnauthorized, fmt.Errorf("failed to authenticate admin: %w", err)}
 	}
 
 	// Bangun peta projectID -> domainName berdasarkan domainNames
@@ -74,9 +214,9 @@ func getTotalUsage(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		projects, err := ListProjectsForDomainName(ctx, adminToken, domainName)
+		projects, err := resolveDomainProjects(ctx, adminToken, domainName, domainPolicy)
 		if err != nil {
-			log.Printf("Warning: failed to list projects for domain %s: %v", domainName, err)
+			slog.WarnContext(ctx, "Failed to list projects for domain", "service", "keystone", "domain", domainName, "error", err)
 			errMu.Lock()
 			usageErrors = append(usageErrors, UsageError{
 				DomainName: domainName,
@@ -101,161 +241,297 @@ func getTotalUsage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	log.Printf("Project to Domain mapping: %d projects across %d domains", len(projectToDomain), len(domainNames))
-
-	var totalCPUCoresUsed float64
-	var totalRAMUsedGB float64
-	var totalVMs int
-	var mu sync.Mutex
+	slog.DebugContext(ctx, "Project to domain mapping", "projects", len(projectToDomain), "domains", len(domainNames))
 
 	// Client Gnocchi dengan admin token (tidak lagi membaca GNOCCHI_TOKEN dari .env)
-	baseURL := getEnv("GNOCCHI_URL", "")
 	gnocchiClient := NewGnocchiClient(GnocchiConfig{
-		BaseURL:  baseURL,
+		BaseURL:  cluster.env("GNOCCHI_URL", ""),
 		Token:    adminToken,
+		Reauth:   adminReauth(ctx),
 		Insecure: true,
+		Calls:    upstreamCallsOf(ctx),
 	})
 
-	log.Println("Fetching all instances from Gnocchi with admin token...")
-	instances, err := gnocchiClient.GetAllInstances()
+	targets, err := domainUsageTargets(gnocchiClient, projectToDomain)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get instances from Gnocchi: %v", err), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	var sums usageSums
+	if detailed {
+		sums = sumInstanceUsage(ctx, gnocchiClient, targets, "", "")
+	} else {
+		sums = sumInstanceUsageAggregated(ctx, gnocchiClient, targets)
 	}
+	usageErrors = append(usageErrors, sums.Errors...)
 
-	log.Printf("Found %d total instances in Gnocchi", len(instances))
+	slog.InfoContext(ctx, "Total usage collected", "cluster", clusterOf(ctx).Name, "vms", sums.TotalVMs,
+		"cpu_cores_used", sums.CPUCoresUsed, "ram_used_gb", sums.RAMUsedGB, "errors", len(usageErrors), "detailed", detailed)
 
-	// Filter instance berdasarkan mapping project -> domain
-	type instanceWithDomain struct {
-		Instance   GnocchiInstance
-		DomainName string
+	return &TotalUsage{
+		Timestamp:    time.Now().Format(time.RFC3339),
+		TotalVMs:     sums.TotalVMs,
+		CPUCoresUsed: sums.CPUCoresUsed,
+		RAMUsedGB:    sums.RAMUsedGB,
+		Errors:       usageErrors,
+	}, nil
+}
+
+// domainUsageTargets lists all instances in Gnocchi and keeps those of the
+// projects in projectToDomain, tagged with their domain.
+func domainUsageTargets(gnocchiClient *GnocchiClient, projectToDomain map[string]string) ([]usageTarget, error) {
+	instances, err := gnocchiClient.GetAllInstances()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get instances from Gnocchi: %w", err)
 	}
 
-	var targets []instanceWithDomain
+	// Filter instance berdasarkan mapping project -> domain
+	var targets []usageTarget
 	for _, inst := range instances {
 		if domainName, ok := projectToDomain[inst.ProjectID]; ok {
-			targets = append(targets, instanceWithDomain{
+			targets = append(targets, usageTarget{
 				Instance:   inst,
 				DomainName: domainName,
 			})
 		}
 	}
+	slog.Debug("Instances in target domains", "service", "gnocchi", "instances", len(instances), "targets", len(targets))
+	return targets, nil
+}
+
+// usageTarget is an instance to sum, with the domain it was selected for
+// (empty when selected by project).
+type usageTarget struct {
+	Instance   GnocchiInstance
+	DomainName string
+}
+
+// ProjectUsage is one project's share of the summed usage.
+type ProjectUsage struct {
+	TotalVMs     int     `json:"total_vms"`
+	CPUCoresUsed float64 `json:"cpu_cores_used"`
+	RAMUsedGB    float64 `json:"ram_used_gb"`
+}
 
-	totalVMs = len(targets)
-	log.Printf("Filtered to %d instances in target domains", totalVMs)
+// InstanceUsage is the latest vCPUs and RAM of one summed instance.
+type InstanceUsage struct {
+	InstanceID string  `json:"instance_id"`
+	Name       string  `json:"name"`
+	Flavor     string  `json:"flavor,omitempty"`
+	VCPUs      float64 `json:"vcpus"`
+	RAMGB      float64 `json:"ram_gb"`
+}
 
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 10) // Max 10 concurrent requests
+// usageSums is the result of sumInstanceUsage.
+type usageSums struct {
+	ProjectUsage
+	ByProject  map[string]*ProjectUsage
+	ByInstance map[string]*InstanceUsage
+	Errors     []UsageError
+}
 
+// sumInstanceUsage adds up the vCPUs and RAM (latest measure, within
+// start/end when given) of the targets. Up to 10 Gnocchi requests run at
+// once, shared fairly between projects (runFair). Per-instance failures are
+// collected in Errors.
+func sumInstanceUsage(ctx context.Context, gnocchiClient *GnocchiClient, targets []usageTarget, start, end string) usageSums {
+	sums := usageSums{
+		ByProject:  make(map[string]*ProjectUsage),
+		ByInstance: make(map[string]*InstanceUsage, len(targets)),
+	}
+	var mu sync.Mutex
+
+	addError := func(t usageTarget, msg string) {
+		mu.Lock()
+		sums.Errors = append(sums.Errors, UsageError{
+			DomainName: t.DomainName,
+			InstanceID: t.Instance.ID,
+			ProjectID:  t.Instance.ProjectID,
+			Error:      msg,
+		})
+		mu.Unlock()
+	}
+
+	sums.TotalVMs = len(targets)
 	for _, t := range targets {
-		t := t
+		if sums.ByProject[t.Instance.ProjectID] == nil {
+			sums.ByProject[t.Instance.ProjectID] = &ProjectUsage{}
+		}
+		sums.ByProject[t.Instance.ProjectID].TotalVMs++
+		sums.ByInstance[t.Instance.ID] = &InstanceUsage{
+			InstanceID: t.Instance.ID,
+			Name:       t.Instance.DisplayName,
+			Flavor:     t.Instance.FlavorName,
+		}
+	}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	// Max 10 concurrent requests, dibagi adil antar project (lihat runFair)
+	workers := 10
+	tasks := make(map[string][]func())
 
-			// Hargai batas paralel global
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+	for _, t := range targets {
+		t := t
 
+		tasks[t.Instance.ProjectID] = append(tasks[t.Instance.ProjectID], func() {
 			// Cek context sebelum kerja berat
 			if ctx.Err() != nil {
-				errMu.Lock()
-				usageErrors = append(usageErrors, UsageError{
-					DomainName: t.DomainName,
-					InstanceID: t.Instance.ID,
-					ProjectID:  t.Instance.ProjectID,
-					Error:      fmt.Sprintf("context cancelled while processing instance: %v", ctx.Err()),
-				})
-				errMu.Unlock()
+				addError(t, fmt.Sprintf("context cancelled while processing instance: %v", ctx.Err()))
 				return
 			}
 
 			inst := t.Instance
+			project := sums.ByProject[inst.ProjectID]
+			instance := sums.ByInstance[inst.ID]
 
 			// ===================================================================
 			// Get vCPU count from "vcpus" metric
 			// ===================================================================
 			if vcpuMetricID, ok := inst.Metrics["vcpus"]; ok {
-				measures, err := gnocchiClient.GetMetricMeasures(vcpuMetricID, "", "", 300)
+				measures, err := gnocchiClient.GetMetricMeasures(vcpuMetricID, start, end, 300)
 				if err != nil {
-					log.Printf("Warning: Failed to get vCPUs for instance %s (%s): %v", inst.DisplayName, inst.ID, err)
-					errMu.Lock()
-					usageErrors = append(usageErrors, UsageError{
-						DomainName: t.DomainName,
-						InstanceID: inst.ID,
-						ProjectID:  inst.ProjectID,
-						Error:      fmt.Sprintf("failed to get vcpus measures: %v", err),
-					})
-					errMu.Unlock()
+					slog.DebugContext(ctx, "Failed to get vCPUs", "service", "gnocchi", "instance_id", inst.ID, "instance_name", inst.DisplayName, "error", err)
+					addError(t, fmt.Sprintf("failed to get vcpus measures: %v", err))
 				} else if len(measures) > 0 {
 					vcpus := measures[len(measures)-1].Value
-					log.Printf("Instance %s (%s): vCPUs = %.0f", inst.DisplayName, inst.ID, vcpus)
+					slog.DebugContext(ctx, "Instance vCPUs", "instance_id", inst.ID, "vcpus", vcpus)
 					mu.Lock()
-					totalCPUCoresUsed += vcpus
+					sums.CPUCoresUsed += vcpus
+					project.CPUCoresUsed += vcpus
+					instance.VCPUs = vcpus
 					mu.Unlock()
 				} else {
-					log.Printf("Warning: Instance %s (%s) has vcpus metric but no data points", inst.DisplayName, inst.ID)
+					slog.DebugContext(ctx, "Instance vcpus metric has no data points", "instance_id", inst.ID, "instance_name", inst.DisplayName)
 				}
 			} else {
-				log.Printf("Warning: Instance %s (%s) has no vcpus metric", inst.DisplayName, inst.ID)
+				slog.DebugContext(ctx, "Instance has no vcpus metric", "instance_id", inst.ID, "instance_name", inst.DisplayName)
 			}
 
 			// ===================================================================
 			// Get RAM from "memory" metric (value in MB)
 			// ===================================================================
 			if memMetricID, ok := inst.Metrics["memory"]; ok {
-				memMeasures, err := gnocchiClient.GetMetricMeasures(memMetricID, "", "", 300)
+				memMeasures, err := gnocchiClient.GetMetricMeasures(memMetricID, start, end, 300)
 				if err != nil {
-					log.Printf("Warning: Failed to get Memory for instance %s (%s): %v", inst.DisplayName, inst.ID, err)
-					errMu.Lock()
-					usageErrors = append(usageErrors, UsageError{
-						DomainName: t.DomainName,
-						InstanceID: inst.ID,
-						ProjectID:  inst.ProjectID,
-						Error:      fmt.Sprintf("failed to get memory measures: %v", err),
-					})
-					errMu.Unlock()
+					slog.DebugContext(ctx, "Failed to get memory", "service", "gnocchi", "instance_id", inst.ID, "instance_name", inst.DisplayName, "error", err)
+					addError(t, fmt.Sprintf("failed to get memory measures: %v", err))
 				} else if len(memMeasures) > 0 {
 					memMB := memMeasures[len(memMeasures)-1].Value
 					memGB := memMB / 1024.0
-					log.Printf("Instance %s (%s): Memory = %.0f MB (%.2f GB)", inst.DisplayName, inst.ID, memMB, memGB)
+					slog.DebugContext(ctx, "Instance memory", "instance_id", inst.ID, "memory_mb", memMB)
 					mu.Lock()
-					totalRAMUsedGB += memGB
+					sums.RAMUsedGB += memGB
+					project.RAMUsedGB += memGB
+					instance.RAMGB = memGB
 					mu.Unlock()
 				} else {
-					log.Printf("Warning: Instance %s (%s) has memory metric but no data points", inst.DisplayName, inst.ID)
+					slog.DebugContext(ctx, "Instance memory metric has no data points", "instance_id", inst.ID, "instance_name", inst.DisplayName)
 				}
 			} else {
-				log.Printf("Warning: Instance %s (%s) has no memory metric. Available: %v",
-					inst.DisplayName, inst.ID, getMetricKeys(inst.Metrics))
+				slog.DebugContext(ctx, "Instance has no memory metric", "instance_id", inst.ID,
+					"instance_name", inst.DisplayName, "metrics", getMetricKeys(inst.Metrics))
 			}
-		}()
+		})
 	}
 
-	wg.Wait()
+	runFair(workers, projectConcurrency(), tasks)
+	return sums
+}
 
-	log.Printf("========================================")
-	log.Printf("Total VMs in target domains: %d", totalVMs)
-	log.Printf("Total CPU cores used: %.2f", totalCPUCoresUsed)
-	log.Printf("Total RAM used: %.2f GB", totalRAMUsedGB)
-	log.Printf("Errors encountered: %d", len(usageErrors))
-	log.Printf("========================================")
+// writeTotalUsage writes usage, with 206 Partial Content when it has partial errors.
+func writeTotalUsage(w http.ResponseWriter, usage *TotalUsage) {
+	w.Header().Set("Content-Type", "application/json")
+	if len(usage.Errors) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	writeJSON(w, usage)
+}
 
-	response := TotalUsage{
-		Timestamp:    time.Now().Format(time.RFC3339),
-		TotalVMs:     totalVMs,
-		CPUCoresUsed: totalCPUCoresUsed,
-		RAMUsedGB:    totalRAMUsedGB,
-		Errors:       usageErrors,
+// totalUsageCacheKey returns the cluster's cache key for a domain list. The key
+// contains a hash of the sorted names, so editing DOMAINS_FILE starts a new cache entry.
+func totalUsageCacheKey(cluster *Cluster, domainNames []string) string {
+	sorted := append([]string(nil), domainNames...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return cluster.key(totalUsageKey) + ":" + hex.EncodeToString(sum[:8])
+}
+
+// getCachedTotalUsage returns the cached usage for key and whether it is fresh
+// (younger than its TTL, the partial TTL when it has errors). Past the TTL but
+// within TOTAL_USAGE_MAX_STALE_SECONDS it is returned marked stale; nil when
+// missing or older.
+func getCachedTotalUsage(key string) (*TotalUsage, bool) {
+	var usage TotalUsage
+	age, ok := cacheGet(key, &usage)
+	if !ok {
+		return nil, false
+	}
+	ttl := totalUsageCacheTTL()
+	if len(usage.Errors) > 0 {
+		ttl = totalUsagePartialCacheTTL()
+	}
+	if age > ttl+maxStaleFromEnv("TOTAL_USAGE_MAX_STALE_SECONDS") {
+		countCache(key, cacheMiss)
+		return nil, false
+	}
+	usage.Cached = true
+	usage.AgeSeconds = int64(age.Seconds())
+	if age > ttl {
+		countCache(key, cacheStale)
+		usage.Stale = true
+		usage.StalenessSeconds = usage.AgeSeconds
+		return &usage, false
 	}
+	countCache(key, cacheHit)
+	return &usage, true
+}
+
+// totalUsageCacheTTL returns CACHE_TTL_TOTAL (older name TOTAL_USAGE_CACHE_SECONDS),
+// default CACHE_TTL_SECONDS.
+func totalUsageCacheTTL() time.Duration {
+	return getCacheTTLFor("TOTAL", envSeconds("TOTAL_USAGE_CACHE_SECONDS", getCacheTTL()))
+}
+
+// totalUsagePartialCacheTTL returns how long a response with partial errors is
+// cached (TOTAL_USAGE_PARTIAL_CACHE_SECONDS, default 15, at most the full TTL).
+func totalUsagePartialCacheTTL() time.Duration {
+	ttl := 15 * time.Second
+	if v, err := strconv.Atoi(getEnv("TOTAL_USAGE_PARTIAL_CACHE_SECONDS", "")); err == nil && v > 0 {
+		ttl = time.Duration(v) * time.Second
+	}
+	if full := totalUsageCacheTTL(); ttl > full {
+		ttl = full
+	}
+	return ttl
+}
+
+// serveStaleTotalUsage writes the last good TotalUsage snapshot (marked stale)
+// when SERVE_STALE_ON_ERROR is enabled and one is cached. Returns false if the
+// caller should report the original error instead.
+func serveStaleTotalUsage(w http.ResponseWriter, cluster *Cluster, cause error) bool {
+	if !serveStaleOnError() {
+		return false
+	}
+
+	key := cluster.key(totalUsageKey)
+	var usage TotalUsage
+	age, ok := cacheGet(key, &usage)
+	if !ok {
+		return false
+	}
+	countCache(key, cacheStale)
+	usage.Stale = true
+	usage.StalenessSeconds = int64(age.Seconds())
+
+	slog.Warn("Total usage collection failed, serving stale snapshot", "cluster", cluster.Name,
+		"staleness_seconds", usage.StalenessSeconds, "error", cause)
+	setXCache(w, cacheStale)
 
 	w.Header().Set("Content-Type", "application/json")
-	// Jika ada error parsial, gunakan 206 Partial Content
-	if len(usageErrors) > 0 {
+	if len(usage.Errors) > 0 {
 		w.WriteHeader(http.StatusPartialContent)
 	}
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, usage)
+	return true
 }
 
 // Helper function to get metric keys for logging
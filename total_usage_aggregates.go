@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// /usage/total sums the latest vcpus and memory of every instance. Instead of
+// two measure requests per instance, sumInstanceUsageAggregated asks Gnocchi
+// for the latest values of all instances of a batch of projects at once: two
+// aggregates requests per batch. Projects whose batch fails, and instances
+// that exist but have no measure in the lookback window (e.g. stopped), go
+// through the per-instance path (sumInstanceUsage), so the sums match it.
+// Deleted instances without a recent measure use nothing and add 0.
+
+// aggregateProjectBatch is how many projects one aggregates request searches.
+const aggregateProjectBatch = 50
+
+// aggregateBatchWorkers bounds the batches in flight (two requests each).
+const aggregateBatchWorkers = 4
+
+// aggregateLookback returns TOTAL_USAGE_AGGREGATE_LOOKBACK_SECONDS (default
+// 1 hour): how far back the aggregates requests look for the latest measure.
+func aggregateLookback() time.Duration {
+	return envSeconds("TOTAL_USAGE_AGGREGATE_LOOKBACK_SECONDS", time.Hour)
+}
+
+// sumInstanceUsageAggregated is sumInstanceUsage (latest measures, no period)
+// through Gnocchi aggregates per project batch.
+func sumInstanceUsageAggregated(ctx context.Context, gnocchiClient *GnocchiClient, targets []usageTarget) usageSums {
+	byProject := make(map[string][]usageTarget)
+	for _, t := range targets {
+		byProject[t.Instance.ProjectID] = append(byProject[t.Instance.ProjectID], t)
+	}
+	projectIDs := make([]string, 0, len(byProject))
+	for id := range byProject {
+		projectIDs = append(projectIDs, id)
+	}
+	sort.Strings(projectIDs)
+
+	sums := usageSums{
+		ByProject:  make(map[string]*ProjectUsage),
+		ByInstance: make(map[string]*InstanceUsage, len(targets)),
+	}
+	lookback := aggregateLookback()
+
+	var (
+		mu       sync.Mutex
+		fallback []usageTarget
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, aggregateBatchWorkers)
+	)
+	for i := 0; i < len(projectIDs); i += aggregateProjectBatch {
+		end := i + aggregateProjectBatch
+		if end > len(projectIDs) {
+			end = len(projectIDs)
+		}
+		batch := projectIDs[i:end]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var batchTargets []usageTarget
+			for _, id := range batch {
+				batchTargets = append(batchTargets, byProject[id]...)
+			}
+			if ctx.Err() != nil {
+				mu.Lock()
+				fallback = append(fallback, batchTargets...)
+				mu.Unlock()
+				return
+			}
+
+			var (
+				vcpus, memory       map[string]float64
+				vcpusErr, memoryErr error
+				metricWG            sync.WaitGroup
+			)
+			metricWG.Add(2)
+			go func() {
+				defer metricWG.Done()
+				vcpus, vcpusErr = gnocchiClient.GetLatestMeasuresByProjects("vcpus", batch, 300, lookback)
+			}()
+			go func() {
+				defer metricWG.Done()
+				memory, memoryErr = gnocchiClient.GetLatestMeasuresByProjects("memory", batch, 300, lookback)
+			}()
+			metricWG.Wait()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if vcpusErr != nil || memoryErr != nil {
+				slog.WarnContext(ctx, "Gnocchi aggregates failed, falling back to per-instance measures", "service", "gnocchi",
+					"projects", len(batch), "instances", len(batchTargets), "vcpus_error", vcpusErr, "memory_error", memoryErr)
+				fallback = append(fallback, batchTargets...)
+				return
+			}
+			for _, t := range batchTargets {
+				inst := t.Instance
+				_, wantVCPUs := inst.Metrics["vcpus"]
+				_, wantMemory := inst.Metrics["memory"]
+				v, hasVCPUs := vcpus[inst.ID]
+				m, hasMemory := memory[inst.ID]
+				if inst.EndedAt == nil && ((wantVCPUs && !hasVCPUs) || (wantMemory && !hasMemory)) {
+					fallback = append(fallback, t)
+					continue
+				}
+				sums.addInstance(t, v, m/1024.0)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(fallback) > 0 {
+		slog.DebugContext(ctx, "Instances summed per instance", "service", "gnocchi", "instances", len(fallback))
+		sums.merge(sumInstanceUsage(ctx, gnocchiClient, fallback, "", ""))
+	}
+	return sums
+}
+
+// addInstance adds one instance's vCPUs and RAM (GiB) to the sums.
+func (s *usageSums) addInstance(t usageTarget, vcpus, ramGB float64) {
+	project := s.ByProject[t.Instance.ProjectID]
+	if project == nil {
+		project = &ProjectUsage{}
+		s.ByProject[t.Instance.ProjectID] = project
+	}
+	s.TotalVMs++
+	s.CPUCoresUsed += vcpus
+	s.RAMUsedGB += ramGB
+	project.TotalVMs++
+	project.CPUCoresUsed += vcpus
+	project.RAMUsedGB += ramGB
+	s.ByInstance[t.Instance.ID] = &InstanceUsage{
+		InstanceID: t.Instance.ID,
+		Name:       t.Instance.DisplayName,
+		Flavor:     t.Instance.FlavorName,
+		VCPUs:      vcpus,
+		RAMGB:      ramGB,
+	}
+}
+
+// merge adds the sums of other (disjoint instances) to s.
+func (s *usageSums) merge(other usageSums) {
+	s.TotalVMs += other.TotalVMs
+	s.CPUCoresUsed += other.CPUCoresUsed
+	s.RAMUsedGB += other.RAMUsedGB
+	for id, p := range other.ByProject {
+		project := s.ByProject[id]
+		if project == nil {
+			s.ByProject[id] = p
+			continue
+		}
+		project.TotalVMs += p.TotalVMs
+		project.CPUCoresUsed += p.CPUCoresUsed
+		project.RAMUsedGB += p.RAMUsedGB
+	}
+	for id, inst := range other.ByInstance {
+		s.ByInstance[id] = inst
+	}
+	s.Errors = append(s.Errors, other.Errors...)
+}
+
+// parseUsageMode reads ?mode= of /usage/total: aggregate (default) or
+// detailed (two measure requests per instance, for debugging).
+func parseUsageMode(mode string) (detailed bool, err error) {
+	switch mode {
+	case "", "aggregate":
+		return false, nil
+	case "detailed":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid mode %s (expected aggregate or detailed)", mode)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingGnocchi serves /aggregates (latest vcpus 2 and memory 4096 MB of
+// every instance of the searched projects) and per-metric measures with the
+// same values, counting both kinds of request.
+type countingGnocchi struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	aggregates    int
+	measures      int
+	missing       map[string]bool // instances left out of aggregates answers
+	failAggregate bool
+}
+
+func newCountingGnocchi(t *testing.T) *countingGnocchi {
+	t.Helper()
+	g := &countingGnocchi{missing: map[string]bool{}}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		switch {
+		case r.URL.Path == "/aggregates":
+			g.aggregates++
+			if g.failAggregate {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			var body struct {
+				Operations string `json:"operations"`
+				Search     struct {
+					In struct {
+						ProjectID []string `json:"project_id"`
+					} `json:"in"`
+				} `json:"search"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			metric, value := "vcpus", 2.0
+			if strings.Contains(body.Operations, "memory") {
+				metric, value = "memory", 4096
+			}
+			measures := map[string]interface{}{}
+			for _, project := range body.Search.In.ProjectID {
+				id := "i-" + strings.TrimPrefix(project, "p-")
+				if !g.missing[id] {
+					measures[id] = map[string]interface{}{metric: map[string]interface{}{
+						"mean": [][]interface{}{{"2026-01-01T00:00:00+00:00", 300.0, value}},
+					}}
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"measures": measures})
+		case strings.HasPrefix(r.URL.Path, "/metric/"):
+			g.measures++
+			value := 2.0
+			if strings.HasPrefix(r.URL.Path, "/metric/mem-") {
+				value = 4096
+			}
+			fmt.Fprintf(w, `[["2026-01-01T00:00:00+00:00", 300.0, %v]]`, value)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+// usageTargets returns n running instances i-<k>, each in its own project p-<k>.
+func usageTargets(n int) []usageTarget {
+	targets := make([]usageTarget, n)
+	for k := range targets {
+		targets[k] = usageTarget{Instance: GnocchiInstance{
+			ID:        fmt.Sprintf("i-%d", k),
+			ProjectID: fmt.Sprintf("p-%d", k),
+			Metrics:   map[string]string{"vcpus": fmt.Sprintf("vcpus-%d", k), "memory": fmt.Sprintf("mem-%d", k)},
+		}}
+	}
+	return targets
+}
+
+func TestSumInstanceUsageAggregatedOneCallPerBatch(t *testing.T) {
+	gnocchi := newCountingGnocchi(t)
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchi.URL, MaxRetries: -1})
+
+	// 120 projects: batches of 50, 50 and 20, two aggregates requests each
+	sums := sumInstanceUsageAggregated(context.Background(), client, usageTargets(120))
+	if gnocchi.aggregates != 6 || gnocchi.measures != 0 {
+		t.Errorf("aggregates requests %d, measure requests %d; want 6 and 0", gnocchi.aggregates, gnocchi.measures)
+	}
+	if sums.TotalVMs != 120 || sums.CPUCoresUsed != 240 || sums.RAMUsedGB != 480 {
+		t.Errorf("sums = %+v", sums.ProjectUsage)
+	}
+	if p := sums.ByProject["p-7"]; p == nil || p.TotalVMs != 1 || p.CPUCoresUsed != 2 || p.RAMUsedGB != 4 {
+		t.Errorf("project p-7 = %+v", p)
+	}
+}
+
+func TestSumInstanceUsageAggregatedFallback(t *testing.T) {
+	gnocchi := newCountingGnocchi(t)
+	client := NewGnocchiClient(GnocchiConfig{BaseURL: gnocchi.URL, MaxRetries: -1})
+
+	// A running instance without a recent measure is summed per instance
+	gnocchi.missing["i-3"] = true
+	sums := sumInstanceUsageAggregated(context.Background(), client, usageTargets(10))
+	if gnocchi.aggregates != 2 || gnocchi.measures != 2 {
+		t.Errorf("aggregates requests %d, measure requests %d; want 2 and 2 (one instance)", gnocchi.aggregates, gnocchi.measures)
+	}
+	if sums.TotalVMs != 10 || sums.CPUCoresUsed != 20 || sums.ByInstance["i-3"].VCPUs != 2 {
+		t.Errorf("sums = %+v, i-3 = %+v", sums.ProjectUsage, sums.ByInstance["i-3"])
+	}
+
+	// A failed batch is summed per instance, with the same result
+	gnocchi.aggregates, gnocchi.measures, gnocchi.failAggregate = 0, 0, true
+	fallback := sumInstanceUsageAggregated(context.Background(), client, usageTargets(10))
+	if gnocchi.aggregates != 2 || gnocchi.measures != 20 {
+		t.Errorf("aggregates requests %d, measure requests %d; want 2 and 20", gnocchi.aggregates, gnocchi.measures)
+	}
+	if fallback.ProjectUsage != sums.ProjectUsage || len(fallback.Errors) != 0 {
+		t.Errorf("fallback sums = %+v (errors %v), want %+v", fallback.ProjectUsage, fallback.Errors, sums.ProjectUsage)
+	}
+}
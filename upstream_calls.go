@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Every request counts the backend calls (Gnocchi, Nova, Cinder, Keystone) it
+// triggers, to see how many calls an endpoint costs and whether batching
+// helps. countUpstreamCalls stores an upstreamCalls in the request context and
+// sends the total as X-Upstream-Calls; with ?meta=true a JSON object response
+// also gets _meta.upstream_calls.
+//
+// The clients count in their transport. Gnocchi, Nova and Cinder requests are
+// built without a context, so their config carries the counter
+// (Calls: upstreamCallsOf(ctx)); Keystone requests carry the request context
+// and are counted from it. Work shared through a flight is counted for the
+// request that started it; coalesced requests and cache hits report 0.
+
+// upstreamCalls counts the backend calls of one request per service.
+type upstreamCalls struct {
+	mu        sync.Mutex
+	byService map[string]int
+}
+
+func (c *upstreamCalls) add(service string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.byService == nil {
+		c.byService = make(map[string]int)
+	}
+	c.byService[service]++
+	c.mu.Unlock()
+}
+
+// total returns the number of calls so far.
+func (c *upstreamCalls) total() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, v := range c.byService {
+		n += v
+	}
+	return n
+}
+
+// snapshot returns a copy of the counts per service.
+func (c *upstreamCalls) snapshot() map[string]int {
+	out := make(map[string]int)
+	if c == nil {
+		return out
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.byService {
+		out[k] = v
+	}
+	return out
+}
+
+type upstreamCallsKey struct{}
+
+// withUpstreamCalls returns ctx carrying calls (ctx itself when calls is nil).
+// Use it to keep counting in a context detached from the request.
+func withUpstreamCalls(ctx context.Context, calls *upstreamCalls) context.Context {
+	if calls == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamCallsKey{}, calls)
+}
+
+// upstreamCallsOf returns the request's counter, nil outside requests
+// (collector, jobs), where nothing is counted.
+func upstreamCallsOf(ctx context.Context) *upstreamCalls {
+	if ctx == nil {
+		return nil
+	}
+	calls, _ := ctx.Value(upstreamCallsKey{}).(*upstreamCalls)
+	return calls
+}
+
+// countingTransport counts every HTTP request of a client, retries and pages
+// included, in calls or else in the counter of the request context.
+type countingTransport struct {
+	base    http.RoundTripper
+	service string
+	calls   *upstreamCalls
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	calls := t.calls
+	if calls == nil {
+		calls = upstreamCallsOf(req.Context())
+	}
+	calls.add(t.service)
+	return t.base.RoundTrip(req)
+}
+
+// upstreamCallsWriter sets X-Upstream-Calls when the response header is
+// written; calls made after that (while streaming) are not in the header.
+type upstreamCallsWriter struct {
+	http.ResponseWriter
+	calls       *upstreamCalls
+	wroteHeader bool
+}
+
+func (w *upstreamCallsWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("X-Upstream-Calls", strconv.Itoa(w.calls.total()))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *upstreamCallsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *upstreamCallsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+func (w *upstreamCallsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countUpstreamCalls is a middleware that counts the backend calls of each
+// request (see above). WebSocket upgrades get the counter but no header (they
+// need the raw writer).
+func countUpstreamCalls(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls := &upstreamCalls{}
+		r = r.WithContext(withUpstreamCalls(r.Context(), calls))
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&upstreamCallsWriter{ResponseWriter: w, calls: calls}, r)
+	})
+}
+
+// upstreamCallsMeta is the _meta object added with ?meta=true.
+type upstreamCallsMeta struct {
+	UpstreamCalls          int            `json:"upstream_calls"`
+	UpstreamCallsByService map[string]int `json:"upstream_calls_by_service"`
+}
+
+// addMetaJSON adds _meta to an encoded JSON object; other documents (arrays)
+// are returned unchanged. Numbers are kept as written (json.Number).
+func addMetaJSON(data []byte, calls *upstreamCalls) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+	obj["_meta"] = upstreamCallsMeta{UpstreamCalls: calls.total(), UpstreamCallsByService: calls.snapshot()}
+	return json.Marshal(obj)
+}
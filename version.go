@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// buildVersion is set at build time: go build -ldflags "-X main.buildVersion=v1.2.3"
+var buildVersion = "dev"
+
+// VersionInfo is the response of GET /version.
+type VersionInfo struct {
+	Version   string               `json:"version"`
+	GoVersion string               `json:"go_version"`
+	Time      string               `json:"time"`
+	Panel     *PanelPlatformStatus `json:"panel,omitempty"` // license and HA, when the panel is configured
+}
+
+// GET /version
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	info := VersionInfo{
+		Version:   buildVersion,
+		GoVersion: runtime.Version(),
+		Time:      time.Now().Format(time.RFC3339),
+	}
+	if panelClient != nil {
+		platform := getPanelPlatformStatus(panelClient)
+		info.Panel = &platform
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, info)
+}
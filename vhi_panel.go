@@ -3,35 +3,67 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 // VHIPanelConfig holds config for the VHI admin panel API.
 type VHIPanelConfig struct {
-	BaseURL  string // e.g. https://10.21.0.240:8888
-	Username string
-	Password string
-	Domain   string
-	Insecure bool
+	BaseURL    string // e.g. https://10.21.0.240:8888
+	Username   string
+	Password   string
+	Domain     string
+	CACertFile string // PEM bundle used to verify the panel certificate (cluster CA)
+	Insecure   bool   // skip certificate verification — explicit opt-in only
+
+	PrometheusURL string // direct Prometheus, comma-separated for failover (PROMETHEUS_URL)
+	GrafanaAPIKey string // GRAFANA_API_KEY
 }
 
+// PanelAPI is what the handlers need from the VHI panel. *VHIPanelClient is the
+// only production implementation; the interface lets the handlers run against a fake.
+type PanelAPI interface {
+	Login() error
+	GetStat() (*PanelStat, error)
+	GetNodes() ([]PanelNode, error)
+	GetAlerts() ([]PanelAlert, error)
+	GetStorageStat() (*VStorageStat, error)
+	GetStorageTiers() ([]VStorageTierStat, error)
+	GetLicense() (*PanelLicense, error)
+	GetHAStatus() (*PanelHA, error)
+	BreakerStatus() BreakerStatus
+	LoginStatus() PanelLoginStatus
+	ResetLoginBackoff()
+	prometheusFetcher() (func(string) ([]byte, error), error)
+	prometheusAPIFetcher() (func(string) ([]byte, error), error)
+}
+
+var _ PanelAPI = (*VHIPanelClient)(nil)
+
 // VHIPanelClient interacts with the VHI admin panel API (port 8888).
 type VHIPanelClient struct {
 	mu             sync.Mutex // protects token, cookies, grafanaCookies
+	loginMu        sync.Mutex // serializes logins; taken before mu (see ensureLoggedIn)
 	config         VHIPanelConfig
+	transport      http.RoundTripper // shared by every panel/Grafana request: uniform TLS settings and metrics
 	httpClient     *http.Client
 	token          string
-	cookies        []*http.Cookie // session cookies from VHI panel login
-	grafanaCookies []*http.Cookie // session cookies from Grafana login
+	cookies        []*http.Cookie     // session cookies from VHI panel login
+	grafanaCookies []*http.Cookie     // session cookies from Grafana login
+	sessions       *panelSessionStore // optional Redis-shared session (nil = disabled)
+	breaker        *circuitBreaker    // shared by every panel/Grafana request
+	loginBackoff   *loginBackoff      // suspends logins after repeated auth failures
 }
 
 // PanelStat represents the VHI panel /api/v2/compute/cluster/stat response.
@@ -88,6 +120,7 @@ type PanelStat struct {
 		BackingUp   int `json:"backing-up"`
 		ErrorDelete int `json:"error_deleting"`
 		InUse       int `json:"in-use"`
+		Error       int `json:"error"`
 		ReservedVol int `json:"reserved"`
 		Count       int `json:"count"`
 	} `json:"volumes"`
@@ -111,17 +144,37 @@ type promQueryResult struct {
 }
 
 // NewVHIPanelClient creates a new VHI panel API client.
-func NewVHIPanelClient(config VHIPanelConfig) *VHIPanelClient {
-	tr := &http.Transport{}
+// Returns an error if CACertFile is set but cannot be read or parsed.
+func NewVHIPanelClient(config VHIPanelConfig) (*VHIPanelClient, error) {
+	tlsConfig := &tls.Config{}
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VHI panel CA file %s: %w", config.CACertFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid PEM certificates in VHI panel CA file %s", config.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
 	if config.Insecure {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		slog.Warn("VHI panel TLS certificate verification is DISABLED (VHI_PANEL_INSECURE=true)", "service", "panel")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	tr := &instrumentedTransport{
+		base:     &http.Transport{TLSClientConfig: tlsConfig},
+		classify: classifyPanelRequest,
 	}
 
 	// Cookie jar to automatically handle session cookies from login
 	jar, _ := cookiejar.New(nil)
 
 	return &VHIPanelClient{
-		config: config,
+		config:       config,
+		transport:    tr,
+		breaker:      newCircuitBreaker(),
+		loginBackoff: newLoginBackoff(),
 		httpClient: &http.Client{
 			Transport: tr,
 			Timeout:   30 * time.Second,
@@ -131,20 +184,124 @@ func NewVHIPanelClient(config VHIPanelConfig) *VHIPanelClient {
 				return http.ErrUseLastResponse
 			},
 		},
-	}
+	}, nil
 }
 
 // Login authenticates with the VHI panel and obtains a session token.
 // Thread-safe — acquires mutex internally.
 func (c *VHIPanelClient) Login() error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loginLocked()
+}
+
+// ensureLoggedIn logs in unless the client already has a session. The login
+// releases c.mu during the HTTP call, so loginMu makes concurrent callers
+// without a session wait for the one login instead of each starting their own
+// (a second login replaces the session the first caller is using).
+func (c *VHIPanelClient) ensureLoggedIn() error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.token != "" {
+		return nil
+	}
 	return c.loginLocked()
 }
 
-// loginLocked is the internal login implementation.
+// EnableSessionSharing makes the client persist its session in Redis and
+// reuse sessions created by other replicas. Call before the first Login.
+func (c *VHIPanelClient) EnableSessionSharing(store *panelSessionStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions = store
+}
+
+// RestoreSession loads the shared session, if any. The caller should validate
+// it with a cheap request — a 401 there triggers the normal login.
+func (c *VHIPanelClient) RestoreSession() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		return false
+	}
+	return c.adoptSharedSessionLocked(true)
+}
+
+// adoptSharedSessionLocked switches to the shared session when it differs from
+// ours (another replica logged in). With force, any stored session is taken.
+// Caller MUST hold c.mu.
+func (c *VHIPanelClient) adoptSharedSessionLocked(force bool) bool {
+	shared := c.sessions.Load()
+	if shared == nil || (!force && shared.Token == c.token) {
+		return false
+	}
+	c.token = shared.Token
+	c.cookies = fromStoredCookies(shared.Cookies)
+	c.grafanaCookies = fromStoredCookies(shared.GrafanaCookies)
+	slog.Info("VHI Panel session restored from Redis", "service", "panel", "saved_at", shared.SavedAt.Format(time.RFC3339))
+	return true
+}
+
+// saveSessionLocked publishes the current session. Caller MUST hold c.mu.
+func (c *VHIPanelClient) saveSessionLocked() {
+	if c.sessions == nil || c.token == "" {
+		return
+	}
+	c.sessions.Save(panelSession{
+		Token:          c.token,
+		Cookies:        toStoredCookies(c.cookies),
+		GrafanaCookies: toStoredCookies(c.grafanaCookies),
+		SavedAt:        time.Now(),
+	})
+}
+
+// loginLocked obtains a panel session: a newer session shared by another
+// replica is adopted; otherwise only the holder of the login lock logs in while
+// the others wait briefly for its session.
 // Caller MUST hold c.mu before calling.
 func (c *VHIPanelClient) loginLocked() error {
+	if c.sessions == nil {
+		return c.panelLoginLocked()
+	}
+
+	if c.adoptSharedSessionLocked(false) {
+		return nil
+	}
+
+	if !c.sessions.TryLoginLock() {
+		slog.Info("VHI Panel login in progress on another replica, waiting for its session", "service", "panel")
+		for deadline := time.Now().Add(panelLoginWait); time.Now().Before(deadline); {
+			c.mu.Unlock()
+			time.Sleep(500 * time.Millisecond)
+			c.mu.Lock()
+			if c.adoptSharedSessionLocked(false) {
+				return nil
+			}
+		}
+		slog.Warn("No shared panel session after waiting, logging in ourselves", "service", "panel", "waited", panelLoginWait)
+	} else {
+		defer c.sessions.ReleaseLoginLock()
+	}
+
+	if err := c.panelLoginLocked(); err != nil {
+		return err
+	}
+	c.saveSessionLocked()
+	return nil
+}
+
+// panelLoginLocked performs the actual POST /api/v2/login.
+// Caller MUST hold c.mu before calling.
+func (c *VHIPanelClient) panelLoginLocked() error {
+	// Fail fast instead of hammering the panel with credentials it keeps rejecting
+	if err := c.loginBackoff.Check(); err != nil {
+		return err
+	}
+
 	loginURL := fmt.Sprintf("%s/api/v2/login", c.config.BaseURL)
 
 	loginBody := map[string]string{
@@ -157,8 +314,6 @@ func (c *VHIPanelClient) loginLocked() error {
 		return fmt.Errorf("failed to marshal login body: %w", err)
 	}
 
-	log.Printf("VHI Panel login to: %s", loginURL)
-
 	req, err := http.NewRequest("POST", loginURL, bytes.NewReader(bodyJSON))
 	if err != nil {
 		return fmt.Errorf("failed to create login request: %w", err)
@@ -169,7 +324,7 @@ func (c *VHIPanelClient) loginLocked() error {
 
 	// Unlock during HTTP call to avoid blocking other goroutines
 	c.mu.Unlock()
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.sendPanel(c.httpClient, req)
 	c.mu.Lock()
 
 	if err != nil {
@@ -179,10 +334,15 @@ func (c *VHIPanelClient) loginLocked() error {
 
 	body, _ := io.ReadAll(resp.Body)
 
-	log.Printf("VHI Panel login response status: %d", resp.StatusCode)
+	slog.Debug("VHI Panel login response", "service", "panel", "url", loginURL, "status", resp.StatusCode)
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("login failed with status %d: %s", resp.StatusCode, string(body))
+		err := fmt.Errorf("login failed with status %d: %.200s", resp.StatusCode, string(body))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden ||
+			resp.StatusCode == http.StatusBadRequest {
+			c.loginBackoff.Failure(err.Error())
+		}
+		return err
 	}
 
 	var loginResp struct {
@@ -198,19 +358,24 @@ func (c *VHIPanelClient) loginLocked() error {
 		return fmt.Errorf("failed to parse login response: %w (body: %s)", err, string(body))
 	}
 
+	// The panel accepted the credentials
+	c.loginBackoff.Reset()
+
+	// A new panel session invalidates any Grafana session derived from the old one
+	c.grafanaCookies = nil
+
 	if loginResp.ScopedToken != "" {
 		c.token = loginResp.ScopedToken
 		c.cookies = resp.Cookies()
-		log.Printf("VHI Panel login successful, scoped_token obtained, %d cookies saved", len(c.cookies))
-		for _, ck := range c.cookies {
-			log.Printf("  → Cookie: name=%q value=%.8s***", ck.Name, ck.Value)
-		}
+		slog.Info("VHI Panel login successful (scoped token)", "service", "panel", "cookies", len(c.cookies))
 		return nil
 	}
 
 	if loginResp.Token != "" && loginResp.Token != "unscoped" {
 		c.token = loginResp.Token
-		log.Printf("VHI Panel login successful, token obtained")
+		// Keep the session cookie here too, otherwise Grafana SSO has nothing to send as session0
+		c.cookies = resp.Cookies()
+		slog.Info("VHI Panel login successful", "service", "panel", "cookies", len(c.cookies))
 		return nil
 	}
 
@@ -226,24 +391,14 @@ func (c *VHIPanelClient) loginLocked() error {
 // We do NOT need a separate Grafana form login — all the 405 endpoints we tried before
 // were dead ends.
 func (c *VHIPanelClient) loginGrafana() error {
-	c.mu.Lock()
 	// Ensure we have a VHI panel session first.
-	if c.token == "" {
-		if err := c.loginLocked(); err != nil {
-			c.mu.Unlock()
-			return fmt.Errorf("VHI panel login required before Grafana SSO: %w", err)
-		}
+	if err := c.ensureLoggedIn(); err != nil {
+		return fmt.Errorf("VHI panel login required before Grafana SSO: %w", err)
 	}
 
 	// Copy cookies while holding the lock
-	var session0Cookies []*http.Cookie
-	for _, ck := range c.cookies {
-		cp := *ck
-		if cp.Name == "session" {
-			cp.Name = "session0"
-		}
-		session0Cookies = append(session0Cookies, &cp)
-	}
+	c.mu.Lock()
+	session0Cookies := asSession0Cookies(c.cookies)
 	c.mu.Unlock()
 
 	if len(session0Cookies) == 0 {
@@ -261,8 +416,10 @@ func (c *VHIPanelClient) loginGrafana() error {
 		req.AddCookie(ck)
 	}
 
+	// Same transport (and therefore the same CA / insecure settings) as the panel client,
+	// but without the cookie jar so only the session0 cookies above are sent.
 	noRedirectClient := &http.Client{
-		Transport: c.httpClient.Transport,
+		Transport: c.transport,
 		Timeout:   15 * time.Second,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
@@ -270,33 +427,48 @@ func (c *VHIPanelClient) loginGrafana() error {
 	}
 
 	// HTTP call without lock
-	resp, err := noRedirectClient.Do(req)
+	resp, err := c.sendPanel(noRedirectClient, req)
 	if err != nil {
 		return fmt.Errorf("Grafana SSO request failed: %w", err)
 	}
 	body, _ := io.ReadAll(resp.Body)
 	resp.Body.Close()
 
-	log.Printf("Grafana SSO /api/user → status %d", resp.StatusCode)
+	slog.Debug("Grafana SSO /api/user response", "service", "grafana", "status", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusFound && resp.StatusCode != http.StatusSeeOther {
+		// Don't keep the cookies — doGrafanaGet would treat them as a live session and never retry SSO
+		return fmt.Errorf("Grafana SSO failed: status %d body: %.200s", resp.StatusCode, string(body))
+	}
 
 	// Lock to write grafanaCookies
 	c.mu.Lock()
 	c.grafanaCookies = session0Cookies
 	for _, ck := range resp.Cookies() {
-		log.Printf("  → Grafana SSO cookie: name=%q value=%.8s***", ck.Name, ck.Value)
 		if ck.Name == "grafana_session" {
 			c.grafanaCookies = append(c.grafanaCookies, ck)
-			log.Printf("Grafana session obtained via SSO!")
+			slog.Debug("Grafana session obtained via SSO", "service", "grafana")
 		}
 	}
+	c.saveSessionLocked()
 	c.mu.Unlock()
 
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusFound || resp.StatusCode == http.StatusSeeOther {
-		log.Printf("Grafana SSO succeeded (status %d)", resp.StatusCode)
-		return nil
-	}
+	slog.Info("Grafana SSO succeeded", "service", "grafana", "status", resp.StatusCode)
+	return nil
+}
 
-	return fmt.Errorf("Grafana SSO failed: status %d body: %.200s", resp.StatusCode, string(body))
+// asSession0Cookies copies the panel login cookies, renaming "session" to
+// "session0" — the name the panel's Grafana proxy expects for SSO.
+func asSession0Cookies(cookies []*http.Cookie) []*http.Cookie {
+	out := make([]*http.Cookie, 0, len(cookies))
+	for _, ck := range cookies {
+		cp := *ck
+		if cp.Name == "session" {
+			cp.Name = "session0"
+		}
+		out = append(out, &cp)
+	}
+	return out
 }
 
 // doGrafanaGet performs a GET to a Grafana endpoint with grafana session cookies, auto re-login on 401.
@@ -318,34 +490,30 @@ func (c *VHIPanelClient) doGrafanaGet(fullURL string) ([]byte, error) {
 		}
 		req.Header.Set("Accept", "application/json")
 
-		// Copy cookies under lock
+		// Copy cookies under lock. grafanaCookies already contains the session0
+		// copies from SSO, so the panel cookies are not added a second time.
 		c.mu.Lock()
 		for _, cookie := range c.grafanaCookies {
-			req.AddCookie(cookie)
-		}
-		for _, cookie := range c.cookies {
 			cp := *cookie
-			if cp.Name == "session" {
-				cp.Name = "session0"
-			}
 			req.AddCookie(&cp)
 		}
 		c.mu.Unlock()
 
 		// HTTP call without lock
-		resp, err := c.httpClient.Do(req)
+		resp, err := c.sendPanel(c.httpClient, req)
 		if err != nil {
 			return nil, fmt.Errorf("grafana request failed: %w", err)
 		}
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 
-		log.Printf("Grafana %s status: %d", fullURL, resp.StatusCode)
+		slog.Debug("Grafana response", "service", "grafana", "url", fullURL, "status", resp.StatusCode)
 
 		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
-			log.Printf("Grafana session expired, re-logging in...")
+			slog.Info("Grafana session expired, logging in again", "service", "grafana")
 			c.mu.Lock()
 			c.grafanaCookies = nil
+			c.saveSessionLocked()
 			c.mu.Unlock()
 			continue
 		}
@@ -360,21 +528,14 @@ func (c *VHIPanelClient) doGrafanaGet(fullURL string) ([]byte, error) {
 // doAuthGet performs a GET request with auth headers, auto re-login on 401.
 func (c *VHIPanelClient) doAuthGet(endpoint string) ([]byte, error) {
 	for attempt := 0; attempt < 2; attempt++ {
-		c.mu.Lock()
-		if c.token == "" {
-			if err := c.loginLocked(); err != nil {
-				c.mu.Unlock()
-				return nil, fmt.Errorf("panel login failed: %w", err)
-			}
+		if err := c.ensureLoggedIn(); err != nil {
+			return nil, fmt.Errorf("panel login failed: %w", err)
 		}
 
 		// Copy token and cookies while holding lock
+		c.mu.Lock()
 		token := c.token
-		cookiesCopy := make([]*http.Cookie, len(c.cookies))
-		for i, ck := range c.cookies {
-			cp := *ck
-			cookiesCopy[i] = &cp
-		}
+		cookiesCopy := asSession0Cookies(c.cookies)
 		c.mu.Unlock()
 
 		url := fmt.Sprintf("%s%s", c.config.BaseURL, endpoint)
@@ -389,33 +550,38 @@ func (c *VHIPanelClient) doAuthGet(endpoint string) ([]byte, error) {
 		req.Header.Set("X-Requested-With", "XMLHttpRequest")
 		req.Header.Set("X-Session-Id", "0")
 		for _, cookie := range cookiesCopy {
-			cp := *cookie
-			if cp.Name == "session" {
-				cp.Name = "session0"
-			}
-			req.AddCookie(&cp)
+			req.AddCookie(cookie)
 		}
 
 		// HTTP call without lock
-		resp, err := c.httpClient.Do(req)
+		resp, err := c.sendPanel(c.httpClient, req)
 		if err != nil {
 			return nil, fmt.Errorf("request failed: %w", err)
 		}
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 
-		log.Printf("VHI Panel %s response status: %d", endpoint, resp.StatusCode)
+		slog.Debug("VHI Panel response", "service", "panel", "endpoint", endpoint, "status", resp.StatusCode)
 
 		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
-			log.Printf("VHI Panel token expired, re-logging in...")
+			slog.Info("VHI Panel token expired, logging in again", "service", "panel")
 			c.mu.Lock()
-			c.token = ""
-			c.cookies = nil
+			// Only drop the session if nobody re-logged in meanwhile — with several
+			// concurrent 401s this keeps it to a single re-login.
+			if c.token == token {
+				c.token = ""
+				c.cookies = nil
+				c.grafanaCookies = nil
+				// Drop the shared copy too, otherwise we'd adopt the dead session again
+				if c.sessions != nil {
+					c.sessions.Invalidate(token)
+				}
+			}
 			c.mu.Unlock()
 			continue
 		}
 		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("request returned status %d: %s", resp.StatusCode, string(body))
+			return nil, &panelStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 		}
 		return body, nil
 	}
@@ -435,76 +601,275 @@ func (c *VHIPanelClient) GetStat() (*PanelStat, error) {
 		return nil, fmt.Errorf("failed to decode stat response: %w (body: %s)", err, string(body))
 	}
 
-	log.Printf("VHI Panel stat: vCPUs=%d, System=%d, Free=%d, Fenced=%d, Block=%.2f TiB",
-		stat.Compute.VCPUs, stat.Reserved.VCPUs, stat.Compute.VCPUsFree,
-		stat.Fenced.VCPUs, float64(stat.Compute.BlockCapacity)/1099511627776.0)
+	slog.Debug("VHI Panel stat", "service", "panel", "vcpus", stat.Compute.VCPUs, "system_vcpus", stat.Reserved.VCPUs,
+		"free_vcpus", stat.Compute.VCPUsFree, "fenced_vcpus", stat.Fenced.VCPUs, "block_capacity_bytes", stat.Compute.BlockCapacity)
 
 	return &stat, nil
 }
 
-// queryPrometheusDirect queries a PromQL expression directly against a Prometheus server.
-// This is the preferred method when PROMETHEUS_URL is set — no auth required.
-func queryPrometheusDirect(prometheusURL, promql string) (float64, error) {
-	fullURL := fmt.Sprintf("%s/api/v1/query?query=%s", prometheusURL, url.QueryEscape(promql))
-	log.Printf("Prometheus direct query: %s", fullURL)
+// PanelNode is one entry of the panel's node list (the dashboard's Nodes page).
+// Only the fields we use are decoded; anything else the panel sends is ignored
+// so newer panel versions don't break decoding.
+type PanelNode struct {
+	ID       string     `json:"id"`
+	Hostname string     `json:"hostname"`
+	Host     string     `json:"host"` // some panel versions use host instead of hostname
+	State    string     `json:"state"`
+	Status   string     `json:"status"`
+	Roles    panelRoles `json:"roles"`
+	CPUCores int        `json:"cpu_cores"`
+	CPUUsage float64    `json:"cpu_usage"` // percent
+	MemTotal int64      `json:"mem_total"` // bytes
+	MemUsage int64      `json:"mem_usage"` // bytes
+}
+
+// Name returns the node hostname regardless of which field the panel filled in.
+func (n PanelNode) Name() string {
+	if n.Hostname != "" {
+		return n.Hostname
+	}
+	return n.Host
+}
+
+// panelRoles decodes node roles sent either as ["compute", "storage"] or as
+// [{"name": "compute"}, ...] depending on the panel version.
+type panelRoles []string
+
+func (r *panelRoles) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err == nil {
+		*r = names
+		return nil
+	}
 
-	// Plain HTTP client — Prometheus internal endpoint, no TLS needed.
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Get(fullURL)
+	var objs []struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(data, &objs); err != nil {
+		// Unknown shape — ignore rather than failing the whole node list
+		*r = nil
+		return nil
+	}
+	for _, o := range objs {
+		if o.Name != "" {
+			*r = append(*r, o.Name)
+		} else if o.Role != "" {
+			*r = append(*r, o.Role)
+		}
+	}
+	return nil
+}
+
+// GetNodes retrieves the per-node statistics from the VHI panel.
+// The panel wraps the list differently across versions ("data", "nodes" or a bare array).
+func (c *VHIPanelClient) GetNodes() ([]PanelNode, error) {
+	body, err := c.doAuthGet("/api/v2/nodes")
 	if err != nil {
-		return 0, fmt.Errorf("prometheus direct GET failed: %w", err)
+		return nil, err
 	}
-	body, _ := io.ReadAll(resp.Body)
-	resp.Body.Close()
 
-	log.Printf("Prometheus direct status: %d", resp.StatusCode)
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("prometheus direct returned status %d: %.200s", resp.StatusCode, string(body))
+	var nodes []PanelNode
+	if err := json.Unmarshal(body, &nodes); err == nil {
+		return nodes, nil
+	}
+
+	var wrapped struct {
+		Data  []PanelNode `json:"data"`
+		Nodes []PanelNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to decode nodes response: %w (body: %.200s)", err, string(body))
+	}
+	if len(wrapped.Data) > 0 {
+		return wrapped.Data, nil
+	}
+	return wrapped.Nodes, nil
+}
+
+// PanelAlert is one alert from the VHI panel alerts list.
+// Field names vary between panel versions, so several aliases are decoded.
+type PanelAlert struct {
+	ID        string `json:"id"`
+	Severity  string `json:"severity"`
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+	Text      string `json:"text"`
+	Status    string `json:"status"` // e.g. active, resolved
+	CreatedAt string `json:"created_at"`
+	Timestamp string `json:"timestamp"`
+	Enabled   *bool  `json:"enabled"`
+}
+
+// Active reports whether the alert is still open.
+func (a PanelAlert) Active() bool {
+	if a.Enabled != nil && !*a.Enabled {
+		return false
+	}
+	switch strings.ToLower(a.Status) {
+	case "resolved", "closed", "inactive", "dismissed":
+		return false
+	}
+	return true
+}
+
+// panelAlertsPage is one page of the panel alerts response.
+// The next page is given either as an opaque cursor or as a relative URL.
+type panelAlertsPage struct {
+	Data       []PanelAlert `json:"data"`
+	Alerts     []PanelAlert `json:"alerts"`
+	NextCursor string       `json:"next_cursor"`
+	Next       string       `json:"next"`
+	Links      struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+// maxAlertPages caps cursor pagination in case the panel keeps returning a cursor.
+const maxAlertPages = 50
+
+// GetAlerts retrieves all alerts from the VHI panel, following cursor pagination.
+func (c *VHIPanelClient) GetAlerts() ([]PanelAlert, error) {
+	const alertsPath = "/api/v2/alerts?limit=100"
+
+	var alerts []PanelAlert
+	endpoint := alertsPath
+
+	for page := 0; page < maxAlertPages && endpoint != ""; page++ {
+		body, err := c.doAuthGet(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		// Some panel versions return a bare array without pagination
+		var bare []PanelAlert
+		if err := json.Unmarshal(body, &bare); err == nil {
+			return append(alerts, bare...), nil
+		}
+
+		var p panelAlertsPage
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, fmt.Errorf("failed to decode alerts response: %w (body: %.200s)", err, string(body))
+		}
+		alerts = append(alerts, p.Data...)
+		alerts = append(alerts, p.Alerts...)
+
+		next := p.Next
+		if next == "" {
+			next = p.Links.Next
+		}
+		next = strings.TrimPrefix(next, c.config.BaseURL)
+
+		switch {
+		case p.NextCursor != "":
+			endpoint = alertsPath + "&cursor=" + url.QueryEscape(p.NextCursor)
+		case strings.HasPrefix(next, "/"):
+			endpoint = next
+		case next != "":
+			endpoint = alertsPath + "&cursor=" + url.QueryEscape(next)
+		default:
+			endpoint = ""
+		}
 	}
-	return parsePromResult(body, promql)
+
+	return alerts, nil
 }
 
-// queryPrometheusWithAPIKey queries a PromQL expression via the Grafana datasource proxy
+// fetchPrometheusWithAPIKey runs a PromQL expression via the Grafana datasource proxy
 // using a Grafana API key (Authorization: Bearer <key>). No SSO cookies needed.
 // Create a key in: Grafana → Configuration → API Keys → Add API key (role: Viewer)
-func (c *VHIPanelClient) queryPrometheusWithAPIKey(apiKey, promql string) (float64, error) {
-	fullURL := fmt.Sprintf("%s/grafana/api/datasources/1/resources/api/v1/query?query=%s",
-		c.config.BaseURL, url.QueryEscape(promql))
+func (c *VHIPanelClient) fetchPrometheusWithAPIKey(apiKey, apiPath string) ([]byte, error) {
+	fullURL := fmt.Sprintf("%s/grafana/api/datasources/1/resources/api/v1/%s", c.config.BaseURL, apiPath)
 
 	req, err := http.NewRequest("GET", fullURL, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.sendPanel(c.httpClient, req)
 	if err != nil {
-		return 0, fmt.Errorf("grafana API key request failed: %w", err)
+		return nil, fmt.Errorf("grafana API key request failed: %w", err)
 	}
 	body, _ := io.ReadAll(resp.Body)
 	resp.Body.Close()
 
-	log.Printf("Grafana API key query status: %d", resp.StatusCode)
+	slog.Debug("Grafana API key query response", "service", "grafana", "status", resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("grafana API key returned status %d: %.200s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("grafana API key returned status %d: %.200s", resp.StatusCode, string(body))
 	}
-	return parsePromResult(body, promql)
+	return body, nil
 }
 
-// queryPrometheus queries a PromQL expression via the Grafana datasource resources endpoint.
+// fetchPrometheusSSO runs a PromQL expression via the Grafana datasource resources endpoint.
 // Uses grafana_session + session0 cookies for auth (same as browser Grafana access).
-// Fallback when PROMETHEUS_URL and GRAFANA_API_KEY are not set.
-func (c *VHIPanelClient) queryPrometheus(promql string) (float64, error) {
+func (c *VHIPanelClient) fetchPrometheusSSO(apiPath string) ([]byte, error) {
 	// Note: use /resources/ not /proxy/ — matches actual Grafana network requests
-	fullURL := fmt.Sprintf("%s/grafana/api/datasources/1/resources/api/v1/query?query=%s",
-		c.config.BaseURL, url.QueryEscape(promql))
+	fullURL := fmt.Sprintf("%s/grafana/api/datasources/1/resources/api/v1/%s", c.config.BaseURL, apiPath)
 
 	body, err := c.doGrafanaGet(fullURL)
 	if err != nil {
-		return 0, fmt.Errorf("prometheus query %q failed: %w", promql, err)
+		return nil, fmt.Errorf("prometheus request %s failed: %w", apiPath, err)
+	}
+	return body, nil
+}
+
+// promInstantPath builds the Prometheus API path of an instant query.
+func promInstantPath(promql string) string {
+	return "query?query=" + url.QueryEscape(promql)
+}
+
+// promRangePath builds the Prometheus API path of a range query.
+func promRangePath(promql string, start, end time.Time, step time.Duration) string {
+	params := url.Values{}
+	params.Set("query", promql)
+	params.Set("start", fmt.Sprintf("%d", start.Unix()))
+	params.Set("end", fmt.Sprintf("%d", end.Unix()))
+	params.Set("step", fmt.Sprintf("%ds", int(step.Seconds())))
+	return "query_range?" + params.Encode()
+}
+
+// prometheusFetcher returns a function that runs an instant query and returns
+// the raw response body. See prometheusAPIFetcher for the access path.
+func (c *VHIPanelClient) prometheusFetcher() (func(string) ([]byte, error), error) {
+	fetch, err := c.prometheusAPIFetcher()
+	if err != nil {
+		return nil, err
+	}
+	return func(q string) ([]byte, error) {
+		return fetch(promInstantPath(q))
+	}, nil
+}
+
+// prometheusAPIFetcher selects the Prometheus access path and returns a function
+// that GETs an /api/v1/ path (e.g. promRangePath) and returns the raw response body.
+// Priority:
+//  1. Direct Prometheus (config PrometheusURL, comma-separated for failover) — no auth, simplest.
+//  2. Grafana API key (config GrafanaAPIKey) — no SSO needed.
+//  3. Grafana datasource proxy (requires SSO cookies) — fallback.
+func (c *VHIPanelClient) prometheusAPIFetcher() (func(string) ([]byte, error), error) {
+	switch {
+	case strings.TrimSpace(c.config.PrometheusURL) != "":
+		pool := prometheusPoolFor(c.config.PrometheusURL)
+		slog.Debug("Prometheus source: direct Prometheus", "service", "prometheus", "endpoints", len(pool.endpoints))
+		return pool.Fetch, nil
+
+	case c.config.GrafanaAPIKey != "":
+		apiKey := c.config.GrafanaAPIKey
+		slog.Debug("Prometheus source: Grafana API key", "service", "prometheus")
+		return func(apiPath string) ([]byte, error) {
+			return c.fetchPrometheusWithAPIKey(apiKey, apiPath)
+		}, nil
+
+	default:
+		slog.Debug("Prometheus source: Grafana SSO proxy (set PROMETHEUS_URL or GRAFANA_API_KEY for better results)", "service", "prometheus")
+		recordSSOFallback()
+		if err := c.ensureLoggedIn(); err != nil {
+			return nil, fmt.Errorf("login failed: %w", err)
+		}
+		return c.fetchPrometheusSSO, nil
 	}
-	return parsePromResult(body, promql)
 }
 
 // parsePromResult parses a Prometheus /api/v1/query response and returns the scalar value.
@@ -532,68 +897,207 @@ func parsePromResult(body []byte, promql string) (float64, error) {
 	return val, nil
 }
 
-// GetStorageStat retrieves vstorage logical storage metrics.
-// Priority:
-//  1. Direct Prometheus (PROMETHEUS_URL env) — no auth, simplest.
-//  2. Grafana datasource proxy (requires SSO cookies) — fallback.
-func (c *VHIPanelClient) GetStorageStat() (*VStorageStat, error) {
-	const (
-		queryTotal = `sum(tier:mdsd_fs_space_bytes:sum{cloud=""})`
-		queryFree  = `sum(tier:mdsd_fs_free_space_bytes:sum{cloud=""})`
-	)
-
-	var queryFn func(string) (float64, error)
+// promSample is one series of an instant-vector Prometheus result.
+type promSample struct {
+	Labels map[string]string
+	Value  float64
+}
 
-	switch {
-	case os.Getenv("PROMETHEUS_URL") != "":
-		// --- Option 1: Direct Prometheus (preferred, no auth needed) ---
-		promURL := os.Getenv("PROMETHEUS_URL")
-		log.Printf("vStorage source: direct Prometheus at %s", promURL)
-		queryFn = func(q string) (float64, error) {
-			return queryPrometheusDirect(promURL, q)
-		}
+// parsePromVector parses a Prometheus /api/v1/query response into all returned series.
+// Unlike parsePromResult it keeps the labels, for queries that return one series per node/tier.
+func parsePromVector(body []byte, promql string) ([]promSample, error) {
+	var result struct {
+		Status string `json:"status"`
+		Data   struct {
+			Result []struct {
+				Metric map[string]string  `json:"metric"`
+				Value  [2]json.RawMessage `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("prometheus decode failed: %w (body: %.200s)", err, string(body))
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("prometheus returned status %q for %q", result.Status, promql)
+	}
 
-	case os.Getenv("GRAFANA_API_KEY") != "":
-		// --- Option 2: Grafana API key (no SSO needed) ---
-		apiKey := os.Getenv("GRAFANA_API_KEY")
-		log.Printf("vStorage source: Grafana API key")
-		queryFn = func(q string) (float64, error) {
-			return c.queryPrometheusWithAPIKey(apiKey, q)
+	samples := make([]promSample, 0, len(result.Data.Result))
+	for _, r := range result.Data.Result {
+		var valStr string
+		if err := json.Unmarshal(r.Value[1], &valStr); err != nil {
+			continue
 		}
-
-	default:
-		// --- Option 3: Grafana SSO cookies (fallback, likely to fail) ---
-		log.Printf("vStorage source: Grafana SSO proxy (set PROMETHEUS_URL or GRAFANA_API_KEY for better results)")
-		c.mu.Lock()
-		needsLogin := c.token == ""
-		c.mu.Unlock()
-		if needsLogin {
-			if err := c.Login(); err != nil {
-				return nil, fmt.Errorf("login failed: %w", err)
-			}
+		var val float64
+		if _, err := fmt.Sscanf(valStr, "%f", &val); err != nil {
+			continue
 		}
-		queryFn = c.queryPrometheus
+		samples = append(samples, promSample{Labels: r.Metric, Value: val})
 	}
+	return samples, nil
+}
 
-	totalBytes, err := queryFn(queryTotal)
+// vstorage capacity queries. queryStorageCombined returns both series in one
+// round-trip, distinguished by the "kind" label added with label_replace.
+const (
+	queryStorageTotal    = `sum(tier:mdsd_fs_space_bytes:sum{cloud=""})`
+	queryStorageFree     = `sum(tier:mdsd_fs_free_space_bytes:sum{cloud=""})`
+	queryStorageCombined = `label_replace(` + queryStorageTotal + `, "kind", "total", "", "")` +
+		` or label_replace(` + queryStorageFree + `, "kind", "free", "", "")`
+)
+
+// GetStorageStat retrieves vstorage logical storage metrics.
+// The Prometheus access path is chosen by prometheusFetcher. A single combined
+// query is tried first; if it fails, total and free are queried concurrently.
+func (c *VHIPanelClient) GetStorageStat() (*VStorageStat, error) {
+	fetch, err := c.prometheusFetcher()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get vstorage total: %w", err)
+		return nil, err
 	}
 
-	freeBytes, err := queryFn(queryFree)
+	totalBytes, freeBytes, err := queryStorageCombinedStat(fetch)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get vstorage free: %w", err)
+		slog.Warn("Combined vstorage query failed, using separate queries", "service", "prometheus", "error", err)
+		totalBytes, freeBytes, err = queryStorageSeparateStat(fetch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	usedBytes := totalBytes - freeBytes
+	if usedBytes < 0 {
+		// Total and free come from different scrapes; with clock skew free can exceed total.
+		slog.Warn("vStorage free exceeds total, clamping used to 0", "free_bytes", freeBytes, "total_bytes", totalBytes)
+		usedBytes = 0
 	}
 
 	stat := &VStorageStat{
 		TotalBytes: totalBytes,
 		FreeBytes:  freeBytes,
-		UsedBytes:  totalBytes - freeBytes,
+		UsedBytes:  usedBytes,
 	}
 
 	bytesToTiB := 1024.0 * 1024.0 * 1024.0 * 1024.0
-	log.Printf("vStorage: Total=%.1f TiB, Used=%.1f TiB, Free=%.1f TiB",
-		totalBytes/bytesToTiB, stat.UsedBytes/bytesToTiB, freeBytes/bytesToTiB)
+	slog.Debug("vStorage capacity", "service", "prometheus", "total_tib", totalBytes/bytesToTiB,
+		"used_tib", stat.UsedBytes/bytesToTiB, "free_tib", freeBytes/bytesToTiB)
 
 	return stat, nil
 }
+
+// queryStorageCombinedStat fetches total and free with one PromQL expression.
+func queryStorageCombinedStat(fetch func(string) ([]byte, error)) (total, free float64, err error) {
+	body, err := fetch(queryStorageCombined)
+	if err != nil {
+		return 0, 0, err
+	}
+	samples, err := parsePromVector(body, queryStorageCombined)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var haveTotal, haveFree bool
+	for _, s := range samples {
+		switch s.Labels["kind"] {
+		case "total":
+			total, haveTotal = s.Value, true
+		case "free":
+			free, haveFree = s.Value, true
+		}
+	}
+	if !haveTotal || !haveFree {
+		return 0, 0, fmt.Errorf("combined query returned %d series, missing total or free", len(samples))
+	}
+	return total, free, nil
+}
+
+// queryStorageSeparateStat fetches total and free with two concurrent queries.
+func queryStorageSeparateStat(fetch func(string) ([]byte, error)) (total, free float64, err error) {
+	var (
+		totalErr, freeErr error
+		wg                sync.WaitGroup
+	)
+	query := func(q string) (float64, error) {
+		body, err := fetch(q)
+		if err != nil {
+			return 0, err
+		}
+		return parsePromResult(body, q)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		total, totalErr = query(queryStorageTotal)
+	}()
+	go func() {
+		defer wg.Done()
+		free, freeErr = query(queryStorageFree)
+	}()
+	wg.Wait()
+
+	if totalErr != nil {
+		return 0, 0, fmt.Errorf("failed to get vstorage total: %w", totalErr)
+	}
+	if freeErr != nil {
+		return 0, 0, fmt.Errorf("failed to get vstorage free: %w", freeErr)
+	}
+	return total, free, nil
+}
+
+// VStorageTierStat holds raw (physical) vstorage capacity for one storage tier.
+type VStorageTierStat struct {
+	Tier       string
+	TotalBytes float64
+	FreeBytes  float64
+}
+
+// GetStorageTiers retrieves vstorage total/free capacity broken down by tier.
+func (c *VHIPanelClient) GetStorageTiers() ([]VStorageTierStat, error) {
+	const (
+		queryTierTotal = `sum by (tier) (tier:mdsd_fs_space_bytes:sum{cloud=""})`
+		queryTierFree  = `sum by (tier) (tier:mdsd_fs_free_space_bytes:sum{cloud=""})`
+	)
+
+	fetch, err := c.prometheusFetcher()
+	if err != nil {
+		return nil, err
+	}
+
+	tiers := make(map[string]*VStorageTierStat)
+	var order []string
+	for _, q := range []string{queryTierTotal, queryTierFree} {
+		body, err := fetch(q)
+		if err != nil {
+			return nil, fmt.Errorf("vstorage tier query failed: %w", err)
+		}
+		samples, err := parsePromVector(body, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples {
+			name := s.Labels["tier"]
+			t, ok := tiers[name]
+			if !ok {
+				t = &VStorageTierStat{Tier: name}
+				tiers[name] = t
+				order = append(order, name)
+			}
+			if q == queryTierTotal {
+				t.TotalBytes = s.Value
+			} else {
+				t.FreeBytes = s.Value
+			}
+		}
+	}
+
+	if len(order) == 0 {
+		return nil, fmt.Errorf("prometheus returned no vstorage tiers")
+	}
+
+	sort.Strings(order)
+	result := make([]VStorageTierStat, 0, len(order))
+	for _, name := range order {
+		result = append(result, *tiers[name])
+	}
+	return result, nil
+}
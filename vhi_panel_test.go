@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePanel is an httptest VHI panel: /api/v2/login, the compute stat and node
+// list, Grafana SSO (/grafana/api/user) and the Grafana Prometheus datasource.
+// Like the real panel, the login sets a "session" cookie that Grafana only
+// accepts back as "session0", and Grafana queries need the grafana_session
+// cookie from SSO.
+type fakePanel struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	unscopedOnly bool            // login answers with token only, no scoped_token
+	tokens       map[string]bool // valid X-Auth-Tokens
+	session      string          // current panel session cookie
+	grafana      string          // current grafana_session cookie
+	logins       int
+	ssoCalls     int
+	statCalls    int
+	statHold     chan struct{} // when set, stat answers once it is closed
+
+	// Scripted answers; status 0 means 200 with the default body
+	statStatus  int
+	statBody    string
+	nodesStatus int
+	nodesBody   string
+	promStatus  int
+	promBody    string
+}
+
+const fakePanelStat = `{
+	"compute": {"cpu_allocation_ratio": 8, "ram_allocation_ratio": 1, "vcpus": 40, "vcpus_free": 344,
+		"vm_mem_reserved": 85899345920, "vm_mem_free": 429496729600, "hypervisors": 3},
+	"servers": {"count": 12, "active": 10, "shutoff": 2},
+	"fenced": {"vcpus": 0, "physical_mem_total": 0},
+	"physical": {"cpu_cores": 48, "vcpus_total": 384, "mem_total": 824633720832},
+	"reserved": {"vcpus": 0, "memory": 68719476736},
+	"volumes": {"count": 5, "available": 1, "in-use": 4}
+}`
+
+const fakePanelNodes = `{"data": [
+	{"id": "1", "hostname": "node1.example.com", "state": "online", "roles": ["compute", "storage"],
+	 "cpu_cores": 16, "cpu_usage": 12.5, "mem_total": 274877906944, "mem_usage": 68719476736}
+]}`
+
+func newFakePanel(t *testing.T) *fakePanel {
+	t.Helper()
+	p := &fakePanel{tokens: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/login", p.login)
+	mux.HandleFunc("/api/v2/compute/cluster/stat", p.authed(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.statCalls++
+		status, body, hold := p.statStatus, p.statBody, p.statHold
+		p.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		scripted(w, status, body, fakePanelStat)
+	}))
+	mux.HandleFunc("/api/v2/nodes", p.authed(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		status, body := p.nodesStatus, p.nodesBody
+		p.mu.Unlock()
+		scripted(w, status, body, fakePanelNodes)
+	}))
+	mux.HandleFunc("/grafana/api/user", p.grafanaSSO)
+	mux.HandleFunc("/grafana/api/datasources/1/resources/api/v1/query", p.promQuery)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// scripted writes status and body, or 200 with def when status is 0.
+func scripted(w http.ResponseWriter, status int, body, def string) {
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	if body == "" {
+		body = def
+	}
+	fmt.Fprint(w, body)
+}
+
+func (p *fakePanel) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	p.logins++
+	token := fmt.Sprintf("token-%d", p.logins)
+	p.tokens[token] = true
+	p.session = fmt.Sprintf("session-%d", p.logins)
+	unscoped := p.unscopedOnly
+	p.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: p.session, Path: "/"})
+	if unscoped {
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": "unscoped", "scoped_token": token})
+}
+
+// authed answers 401 unless the request has a valid token and the session as session0.
+func (p *fakePanel) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		ok := p.tokens[r.Header.Get("X-Auth-Token")]
+		session := p.session
+		p.mu.Unlock()
+		if ck, err := r.Cookie("session0"); !ok || err != nil || ck.Value != session {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (p *fakePanel) grafanaSSO(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ssoCalls++
+	if ck, err := r.Cookie("session0"); err != nil || ck.Value != p.session {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p.grafana = fmt.Sprintf("grafana-%d", p.ssoCalls)
+	http.SetCookie(w, &http.Cookie{Name: "grafana_session", Value: p.grafana, Path: "/"})
+	fmt.Fprint(w, `{"login":"admin"}`)
+}
+
+func (p *fakePanel) promQuery(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grafana, status, body := p.grafana, p.promStatus, p.promBody
+	p.mu.Unlock()
+	if ck, err := r.Cookie("grafana_session"); err != nil || grafana == "" || ck.Value != grafana {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if status != 0 || body != "" {
+		scripted(w, status, body, "")
+		return
+	}
+
+	q := r.URL.Query().Get("query")
+	var series []string
+	switch {
+	case q == queryStorageCombined:
+		series = []string{
+			`{"metric": {"kind": "total"}, "value": [0, "4398046511104"]}`,
+			`{"metric": {"kind": "free"}, "value": [0, "1099511627776"]}`,
+		}
+	case strings.Contains(q, "node_cpu"):
+		series = []string{`{"metric": {"instance": "node1.example.com:9100"}, "value": [0, "25"]}`}
+	case strings.Contains(q, "node_memory"):
+		series = []string{`{"metric": {"instance": "node1.example.com:9100"}, "value": [0, "1024"]}`}
+	}
+	fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": [%s]}}`, strings.Join(series, ","))
+}
+
+// expire invalidates every issued token, like a panel session timeout.
+func (p *fakePanel) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens = map[string]bool{}
+}
+
+// newFakePanelClient returns a client for p.
+func newFakePanelClient(t *testing.T, p *fakePanel) *VHIPanelClient {
+	t.Helper()
+	client, err := NewVHIPanelClient(VHIPanelConfig{BaseURL: p.URL, Username: "admin", Password: "secret", Domain: "Default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// usePanel makes client the default cluster's panel for the test.
+func usePanel(t *testing.T, client PanelAPI) {
+	t.Helper()
+	prev := defaultCluster().panel
+	defaultCluster().panel = client
+	t.Cleanup(func() { defaultCluster().panel = prev })
+}
+
+func TestPanelLoginScopedToken(t *testing.T) {
+	panel := newFakePanel(t)
+	client := newFakePanelClient(t, panel)
+
+	if err := client.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if client.token != "token-1" {
+		t.Errorf("token = %q, want the scoped token", client.token)
+	}
+	if len(client.cookies) != 1 || client.cookies[0].Name != "session" {
+		t.Errorf("cookies = %v, want the session cookie", client.cookies)
+	}
+}
+
+func TestPanelLoginUnscopedToken(t *testing.T) {
+	panel := newFakePanel(t)
+	panel.unscopedOnly = true
+	client := newFakePanelClient(t, panel)
+
+	if err := client.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if client.token != "token-1" {
+		t.Errorf("token = %q, want the plain token", client.token)
+	}
+	if _, err := client.GetStat(); err != nil {
+		t.Errorf("stat with the plain token: %v", err)
+	}
+}
+
+func TestPanelStatExpiredTokenRelogsInOnce(t *testing.T) {
+	panel := newFakePanel(t)
+	client := newFakePanelClient(t, panel)
+
+	if _, err := client.GetStat(); err != nil {
+		t.Fatal(err)
+	}
+	panel.expire()
+	stat, err := client.GetStat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Physical.VCPUsTotal != 384 {
+		t.Errorf("vcpus_total = %d", stat.Physical.VCPUsTotal)
+	}
+	if panel.logins != 2 {
+		t.Errorf("logins = %d, want 2 (one re-login)", panel.logins)
+	}
+	if panel.statCalls != 2 {
+		t.Errorf("stat calls reaching the handler = %d, want 2", panel.statCalls)
+	}
+}
+
+func TestPanelGrafanaSSOSession(t *testing.T) {
+	panel := newFakePanel(t)
+	client := newFakePanelClient(t, panel)
+
+	stat, err := client.GetStorageStat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalBytes != 4398046511104 || stat.FreeBytes != 1099511627776 {
+		t.Errorf("storage stat = %+v", stat)
+	}
+	if panel.ssoCalls != 1 {
+		t.Errorf("SSO calls = %d, want 1", panel.ssoCalls)
+	}
+
+	var names []string
+	for _, ck := range client.grafanaCookies {
+		names = append(names, ck.Name)
+	}
+	if got := strings.Join(names, ","); got != "session0,grafana_session" {
+		t.Errorf("grafana cookies = %s, want session0,grafana_session", got)
+	}
+
+	// The Grafana session is reused for the next query
+	if _, err := client.GetStorageStat(); err != nil {
+		t.Fatal(err)
+	}
+	if panel.ssoCalls != 1 {
+		t.Errorf("SSO calls after a second query = %d, want 1", panel.ssoCalls)
+	}
+}
+
+func TestPanelStatErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"error":"boom"}`, "500"},
+		{"forbidden", http.StatusForbidden, `{"error":"denied"}`, "403"},
+		{"malformed JSON", 0, `{"compute": `, "failed to decode stat response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panel := newFakePanel(t)
+			panel.statStatus, panel.statBody = tt.status, tt.body
+			client := newFakePanelClient(t, panel)
+
+			_, err := client.GetStat()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}